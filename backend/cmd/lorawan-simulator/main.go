@@ -1,12 +1,73 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/api"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/scenario"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/storage"
 )
 
 func main() {
+	storageType := flag.String("storage", "", "persist the simulator state across restarts: json or bolt (disabled when empty)")
+	storagePath := flag.String("storage-path", "", "file of the persisted state (default lorawan-simulator.json or lorawan-simulator.db)")
+	scenarioPath := flag.String("scenario", "", "YAML or JSON scenario file applied at startup")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	pool := networkserver.NewPool()
 
-	api.Init(pool)
+	// Closed once the state is saved a last time
+	persisted := make(chan struct{})
+
+	if *storageType != "" {
+		store, err := storage.New(storage.Type(*storageType), *storagePath)
+		if err != nil {
+			log.Fatalf("[storage] unable to open the store: %v", err)
+		}
+		defer store.Close()
+
+		snapshots, err := store.Load()
+		if err != nil {
+			log.Fatalf("[storage] unable to load the state: %v", err)
+		}
+		log.Printf("[storage] restoring %d network servers", len(snapshots))
+		pool.Restore(snapshots)
+
+		go func() {
+			storage.Persist(ctx, pool, store)
+			close(persisted)
+		}()
+	} else {
+		close(persisted)
+	}
+
+	// Applied after the restore, so that restored entities are kept
+	if *scenarioPath != "" {
+		s, err := scenario.Load(*scenarioPath)
+		if err != nil {
+			log.Fatalf("[scenario] unable to load %s: %v", *scenarioPath, err)
+		}
+		result, err := scenario.Apply(pool, s)
+		if err != nil {
+			log.Fatalf("[scenario] unable to apply %s: %v", *scenarioPath, err)
+		}
+		log.Printf("[scenario] added %d network servers, %d gateways and %d devices", result.NetworkServers, result.Gateways, result.Devices)
+	}
+
+	go func() {
+		api.Init(pool)
+		stop()
+	}()
+
+	<-ctx.Done()
+	<-persisted
 }
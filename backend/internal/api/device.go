@@ -1,11 +1,18 @@
 package api
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/brocaar/lorawan"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
 	"github.com/gin-gonic/gin"
 )
 
@@ -57,6 +64,30 @@ func postDevice(c *gin.Context) {
 		NwkSKey  string `json:"nwkskey"`
 		FCntUp   uint32 `json:"fcntup"`
 		FCntDown uint32 `json:"fcntdn"`
+		// Optional regional parameters
+		Region   string   `json:"region"`
+		SubBand  int      `json:"subBand"`
+		DataRate *int     `json:"dataRate"`
+		TxPower  *float64 `json:"txPower"`
+		// Optional DevStatusAns battery level (default 255, unknown)
+		Battery *uint8 `json:"battery"`
+		// Optional ADR (default disabled)
+		ADR bool `json:"adr"`
+		// Optional transmissions of a confirmed uplink without ACK (default
+		// NbTrans)
+		ConfirmedTransmissions int `json:"confirmedTransmissions"`
+		// Optional delay (s) of the empty uplink acknowledging a confirmed
+		// downlink (default disabled, the ACK waits for the next uplink)
+		AutoAck *float64 `json:"autoAck"`
+		// Optional device class (default A)
+		Class               string `json:"class"`
+		PingSlotPeriodicity *int   `json:"pingSlotPeriodicity"`
+		// Optional LoRaWAN version (default 1.0) and 1.1 keys, the NwkSKey
+		// being the FNwkSIntKey of a 1.1 session
+		MACVersion  string `json:"macVersion"`
+		NwkKey      string `json:"nwkkey"`
+		SNwkSIntKey string `json:"snwksintkey"`
+		NwkSEncKey  string `json:"nwksenckey"`
 	}
 
 	if err := c.Bind(&json); err != nil {
@@ -112,6 +143,32 @@ func postDevice(c *gin.Context) {
 		}
 	}
 
+	macVersion, err := device.ParseMACVersion(json.MACVersion)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	// Parse optional LoRaWAN 1.1 keys
+	var keys11 device.LoRaWAN11Keys
+	for _, k := range []struct {
+		name  string
+		value string
+		key   *lorawan.AES128Key
+	}{
+		{"NwkKey", json.NwkKey, &keys11.NwkKey},
+		{"SNwkSIntKey", json.SNwkSIntKey, &keys11.SNwkSIntKey},
+		{"NwkSEncKey", json.NwkSEncKey, &keys11.NwkSEncKey},
+	} {
+		if k.value == "" {
+			continue
+		}
+		if err := k.key.UnmarshalText([]byte(k.value)); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid " + k.name + " format"})
+			return
+		}
+	}
+
 	// Prepare location if provided
 	var location *device.Location
 	if json.Latitude != nil && json.Longitude != nil {
@@ -121,11 +178,61 @@ func postDevice(c *gin.Context) {
 		}
 	}
 
+	// Parse optional region (default EU868)
+	reg, err := region.Get(region.Name(json.Region))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if _, err := reg.DeviceChannels(json.SubBand); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	class, err := device.ParseClass(json.Class)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
 	dev, err := ns.AddDevice(deveui, joineui, appkey, lorawan.DevNonce(json.DevNonce), devaddr, appskey, nwkskey, json.FCntUp, json.FCntDown, location)
 	if err != nil {
 		c.IndentedJSON(http.StatusConflict, gin.H{"message": err.Error()})
 		return
 	}
+
+	err = dev.SetRegion(reg, json.SubBand)
+	if err == nil {
+		err = dev.SetMACVersion(macVersion, keys11)
+	}
+	if err == nil && json.DataRate != nil {
+		err = dev.SetDataRate(*json.DataRate)
+	}
+	if err == nil && json.TxPower != nil {
+		err = dev.SetTxPower(*json.TxPower)
+	}
+	if json.Battery != nil {
+		dev.SetBattery(*json.Battery)
+	}
+	dev.SetADR(json.ADR)
+	if err == nil {
+		err = dev.SetConfirmedTransmissions(json.ConfirmedTransmissions)
+	}
+	if err == nil && json.AutoAck != nil {
+		err = dev.SetAutoAck(true, time.Duration(*json.AutoAck*float64(time.Second)))
+	}
+	if err == nil && json.PingSlotPeriodicity != nil {
+		err = dev.SetPingSlotPeriodicity(*json.PingSlotPeriodicity)
+	}
+	if err == nil {
+		err = dev.SetClass(class)
+	}
+	if err != nil {
+		ns.RemoveDevice(deveui)
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
 	c.IndentedJSON(http.StatusCreated, dev.GetInfo())
 }
 
@@ -135,6 +242,28 @@ func getDeviceByEUI(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, dev.GetInfo())
 }
 
+func getDeviceEvents(c *gin.Context) {
+	dev := c.MustGet("device").(*device.Device)
+
+	// Filters are optional, e.g. ?type=downlink&since=2026-01-01T12:00:00Z
+	var query struct {
+		Types []string  `form:"type"`
+		Since time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+		Until time.Time `form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+	}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	filter := device.EventFilter{Since: query.Since, Until: query.Until}
+	for _, t := range query.Types {
+		filter.Types = append(filter.Types, device.EventType(t))
+	}
+
+	c.IndentedJSON(http.StatusOK, dev.Events(filter))
+}
+
 func delDevice(c *gin.Context) {
 	ns := c.MustGet("networkServer").(*networkserver.NetworkServer)
 	dev := c.MustGet("device").(*device.Device)
@@ -163,11 +292,103 @@ func sendDeviceJoinRequest(c *gin.Context) {
 	c.IndentedJSON(http.StatusNoContent, nil)
 }
 
+func sendDeviceRejoinRequest(c *gin.Context) {
+	ns := c.MustGet("networkServer").(*networkserver.NetworkServer)
+	dev := c.MustGet("device").(*device.Device)
+
+	// Body is optional, the default is a type 0 Rejoin-request
+	var json struct {
+		Type int `json:"type"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&json); err != nil && !errors.Is(err, io.EOF) {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+	}
+
+	rejoinType, err := device.ParseRejoinType(json.Type)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err := ns.SendRejoinRequest(dev.GetInfo().DevEUI, rejoinType); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusNoContent, nil)
+}
+
+func requestDeviceMACCommands(c *gin.Context) {
+	dev := c.MustGet("device").(*device.Device)
+
+	// MAC commands requested in the next uplink
+	var json struct {
+		LinkCheck  bool `json:"linkCheck"`
+		DeviceTime bool `json:"deviceTime"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if !json.LinkCheck && !json.DeviceTime {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "no MAC command requested"})
+		return
+	}
+
+	if json.LinkCheck {
+		dev.RequestLinkCheck()
+	}
+	if json.DeviceTime {
+		dev.RequestDeviceTime()
+	}
+
+	c.IndentedJSON(http.StatusNoContent, nil)
+}
+
 func sendDeviceUplink(c *gin.Context) {
 	ns := c.MustGet("networkServer").(*networkserver.NetworkServer)
 	dev := c.MustGet("device").(*device.Device)
 
-	err := ns.SendUplink(dev.GetInfo().DevEUI)
+	// All fields are optional, defaults are a confirmed uplink on FPort 1 with payload 01020304
+	var json struct {
+		Payload   *string `json:"payload"`
+		Encoding  string  `json:"encoding"` // hex (default) or base64
+		FPort     *uint8  `json:"fport"`
+		Confirmed *bool   `json:"confirmed"`
+	}
+
+	// Body is optional
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&json); err != nil && !errors.Is(err, io.EOF) {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+	}
+
+	fPort := uint8(1)
+	if json.FPort != nil {
+		fPort = *json.FPort
+	}
+
+	confirmed := true
+	if json.Confirmed != nil {
+		confirmed = *json.Confirmed
+	}
+
+	payload := []byte{0x01, 0x02, 0x03, 0x04}
+	if json.Payload != nil {
+		var err error
+		payload, err = decodePayload(*json.Payload, json.Encoding)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+	}
+
+	err := ns.SendUplink(dev.GetInfo().DevEUI, fPort, payload, confirmed)
 
 	if err != nil {
 		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
@@ -176,3 +397,117 @@ func sendDeviceUplink(c *gin.Context) {
 
 	c.IndentedJSON(http.StatusNoContent, nil)
 }
+
+func getDeviceSchedule(c *gin.Context) {
+	ns := c.MustGet("networkServer").(*networkserver.NetworkServer)
+	dev := c.MustGet("device").(*device.Device)
+
+	status, err := ns.GetSchedule(dev.GetInfo().DevEUI)
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, status)
+}
+
+func startDeviceSchedule(c *gin.Context) {
+	ns := c.MustGet("networkServer").(*networkserver.NetworkServer)
+	dev := c.MustGet("device").(*device.Device)
+
+	// Uplink fields are optional and default like a manual uplink
+	var json struct {
+		Type      string  `json:"type" binding:"required"` // interval, jitter or cron
+		Interval  string  `json:"interval"`                // e.g. 30s, 5m
+		Jitter    string  `json:"jitter"`
+		Cron      string  `json:"cron"` // e.g. */5 * * * *
+		Payload   *string `json:"payload"`
+		Encoding  string  `json:"encoding"`
+		FPort     *uint8  `json:"fport"`
+		Confirmed *bool   `json:"confirmed"`
+	}
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	config := networkserver.ScheduleConfig{
+		Type:      networkserver.ScheduleType(json.Type),
+		Cron:      json.Cron,
+		FPort:     1,
+		Payload:   []byte{0x01, 0x02, 0x03, 0x04},
+		Confirmed: true,
+	}
+
+	var err error
+	if json.Interval != "" {
+		config.Interval, err = time.ParseDuration(json.Interval)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid interval"})
+			return
+		}
+	}
+	if json.Jitter != "" {
+		config.Jitter, err = time.ParseDuration(json.Jitter)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid jitter"})
+			return
+		}
+	}
+	if json.FPort != nil {
+		config.FPort = *json.FPort
+	}
+	if json.Confirmed != nil {
+		config.Confirmed = *json.Confirmed
+	}
+	if json.Payload != nil {
+		config.Payload, err = decodePayload(*json.Payload, json.Encoding)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+	}
+
+	devEUI := dev.GetInfo().DevEUI
+	if err := ns.StartSchedule(devEUI, config); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	status, _ := ns.GetSchedule(devEUI)
+	c.IndentedJSON(http.StatusOK, status)
+}
+
+func stopDeviceSchedule(c *gin.Context) {
+	ns := c.MustGet("networkServer").(*networkserver.NetworkServer)
+	dev := c.MustGet("device").(*device.Device)
+
+	err := ns.StopSchedule(dev.GetInfo().DevEUI)
+	if err != nil {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusNoContent, nil)
+}
+
+// decodePayload decodes a hex or base64 encoded payload
+func decodePayload(payload string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "hex":
+		b, err := hex.DecodeString(payload)
+		if err != nil {
+			return nil, errors.New("invalid hex payload")
+		}
+		return b, nil
+	case "base64":
+		b, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, errors.New("invalid base64 payload")
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported payload encoding %q", encoding)
+	}
+}
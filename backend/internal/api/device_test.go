@@ -6,11 +6,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/brocaar/lorawan"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -46,6 +48,13 @@ func setupDeviceTestRouter() (*gin.Engine, *networkserver.Pool) {
 		{
 			dev.GET("", getDeviceByEUI)
 			dev.DELETE("", delDevice)
+			dev.GET("/events", getDeviceEvents)
+			dev.POST("/uplink", sendDeviceUplink)
+			dev.POST("/rejoin", sendDeviceRejoinRequest)
+			dev.POST("/mac-commands", requestDeviceMACCommands)
+			dev.GET("/schedule", getDeviceSchedule)
+			dev.POST("/schedule/start", startDeviceSchedule)
+			dev.POST("/schedule/stop", stopDeviceSchedule)
 		}
 	}
 
@@ -131,6 +140,176 @@ func TestPostDevice(t *testing.T) {
 		err := json.Unmarshal(w.Body.Bytes(), &response)
 		assert.NoError(t, err)
 		assert.Equal(t, lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, response.DevEUI)
+		assert.Equal(t, device.ClassA, response.Class)
+	})
+
+	t.Run("creates class C device", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]interface{}{
+			"deveui":  "0102030405060708",
+			"joineui": "aabbccddeeff0011",
+			"appkey":  "0102030405060708090a0b0c0d0e0f10",
+			"class":   "C",
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response device.DeviceInfo
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, device.ClassC, response.Class)
+	})
+
+	t.Run("creates class B device with ping slot periodicity", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]interface{}{
+			"deveui":              "0102030405060708",
+			"joineui":             "aabbccddeeff0011",
+			"appkey":              "0102030405060708090a0b0c0d0e0f10",
+			"class":               "B",
+			"pingSlotPeriodicity": 4,
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response device.DeviceInfo
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, device.ClassB, response.Class)
+		assert.NotNil(t, response.ClassB)
+		assert.Equal(t, 4, response.ClassB.PingSlotPeriodicity)
+	})
+
+	t.Run("creates LoRaWAN 1.1 device", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]interface{}{
+			"deveui":     "0102030405060708",
+			"joineui":    "aabbccddeeff0011",
+			"appkey":     "0102030405060708090a0b0c0d0e0f10",
+			"macVersion": "1.1",
+			"nwkkey":     "100f0e0d0c0b0a090807060504030201",
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response device.DeviceInfo
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, device.MACVersion1_1, response.MACVersion)
+		if assert.NotNil(t, response.LoRaWAN11) {
+			assert.Equal(t, "100f0e0d0c0b0a090807060504030201", response.LoRaWAN11.NwkKey.String())
+			assert.NotEqual(t, lorawan.AES128Key{}, response.LoRaWAN11.JSIntKey)
+		}
+	})
+
+	t.Run("creates device with region, sub-band and data rate", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]interface{}{
+			"deveui":   "0102030405060708",
+			"joineui":  "aabbccddeeff0011",
+			"appkey":   "0102030405060708090a0b0c0d0e0f10",
+			"region":   "US915",
+			"subBand":  1,
+			"dataRate": 0,
+			"txPower":  20,
+			"battery":  200,
+			"adr":      true,
+			"autoAck":  2.5,
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response device.DeviceInfo
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, region.US915, response.Region)
+		assert.Equal(t, 1, response.SubBand)
+		assert.Equal(t, 0, response.DataRate)
+		assert.Equal(t, 20.0, response.TxPower)
+		assert.Equal(t, uint8(200), response.Battery)
+		assert.Len(t, response.Channels, 9)
+		assert.Equal(t, 1, response.NbTrans)
+		assert.True(t, response.ADR)
+		if assert.NotNil(t, response.AutoAck) {
+			assert.Equal(t, 2.5, *response.AutoAck)
+		}
+
+		// RX windows of the region
+		assert.Equal(t, 1, response.RX1Delay)
+		assert.Equal(t, uint32(923300000), response.RX2Frequency)
+		assert.Equal(t, 8, response.RX2DataRate)
+	})
+
+	t.Run("returns 400 when regional parameters are invalid", func(t *testing.T) {
+		bodies := []map[string]interface{}{
+			{"region": "XX123"},
+			{"region": "EU868", "subBand": 2},
+			{"region": "US915", "subBand": 9},
+			{"region": "EU868", "dataRate": 9},
+			{"region": "EU868", "txPower": 20},
+			{"class": "D"},
+			{"confirmedTransmissions": 16},
+			{"autoAck": -1},
+			{"class": "B", "pingSlotPeriodicity": 8},
+			{"macVersion": "1.2"},
+			{"macVersion": "1.1", "nwkkey": "invalid"},
+		}
+
+		for _, extra := range bodies {
+			router, testPool := setupDeviceTestRouter()
+			ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+			body := map[string]interface{}{
+				"deveui":  "0102030405060708",
+				"joineui": "aabbccddeeff0011",
+				"appkey":  "0102030405060708090a0b0c0d0e0f10",
+			}
+			for k, v := range extra {
+				body[k] = v
+			}
+			jsonBody, _ := json.Marshal(body)
+
+			req, _ := http.NewRequest("POST", "/network-servers/test-server/devices", bytes.NewBuffer(jsonBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code, "body: %v", extra)
+			// Device must not be left behind
+			assert.Len(t, ns.ListDevices(), 0)
+		}
 	})
 
 	t.Run("returns 409 when adding duplicate device", func(t *testing.T) {
@@ -363,6 +542,409 @@ func TestDelDevice(t *testing.T) {
 	})
 }
 
+func TestSendDeviceUplink(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	joinEUI := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	appKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+
+	t.Run("sends default uplink without body", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		dev, _ := ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices/0102030405060708/uplink", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, uint32(1), dev.GetInfo().FCntUp)
+	})
+
+	t.Run("sends uplink with hex payload", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		dev, _ := ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		body := map[string]interface{}{
+			"payload":   "0a0b0c",
+			"fport":     10,
+			"confirmed": false,
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices/0102030405060708/uplink", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, uint32(1), dev.GetInfo().FCntUp)
+	})
+
+	t.Run("sends uplink with base64 payload on FPort 0", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		body := map[string]interface{}{
+			"payload":  "Ag==",
+			"encoding": "base64",
+			"fport":    0,
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices/0102030405060708/uplink", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	})
+
+	t.Run("returns 400 when payload is not valid hex", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		dev, _ := ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		body := map[string]interface{}{
+			"payload": "zz",
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices/0102030405060708/uplink", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, uint32(0), dev.GetInfo().FCntUp)
+	})
+
+	t.Run("returns 400 when encoding is unsupported", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		body := map[string]interface{}{
+			"payload":  "0102",
+			"encoding": "ascii",
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices/0102030405060708/uplink", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("returns 400 when FPort is RFU", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		body := map[string]interface{}{
+			"payload": "0102",
+			"fport":   230,
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices/0102030405060708/uplink", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestSendDeviceRejoinRequest(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	joinEUI := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	appKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+
+	newDevice := func(macVersion device.MACVersion) (*gin.Engine, *device.Device) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		dev, _ := ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+		dev.SetMACVersion(macVersion, device.LoRaWAN11Keys{NwkKey: appKey})
+		return router, dev
+	}
+
+	t.Run("sends type 0 rejoin request without body", func(t *testing.T) {
+		router, dev := newDevice(device.MACVersion1_1)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices/0102030405060708/rejoin", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, uint16(1), dev.GetInfo().RJCount0)
+	})
+
+	t.Run("sends type 1 rejoin request", func(t *testing.T) {
+		router, dev := newDevice(device.MACVersion1_1)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices/0102030405060708/rejoin", bytes.NewBufferString(`{"type":1}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, uint16(1), dev.GetInfo().RJCount1)
+	})
+
+	t.Run("rejects invalid rejoin type", func(t *testing.T) {
+		router, _ := newDevice(device.MACVersion1_1)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices/0102030405060708/rejoin", bytes.NewBufferString(`{"type":3}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("rejects rejoin of a 1.0 device", func(t *testing.T) {
+		router, _ := newDevice(device.MACVersion1_0)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/devices/0102030405060708/rejoin", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestRequestDeviceMACCommands(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	joinEUI := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	appKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	url := "/network-servers/test-server/devices/0102030405060708/mac-commands"
+
+	t.Run("requests LinkCheckReq and DeviceTimeReq", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		dev, _ := ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(`{"linkCheck":true,"deviceTime":true}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		info := dev.GetInfo()
+		if assert.NotNil(t, info.LinkCheck) {
+			assert.True(t, info.LinkCheck.Pending)
+		}
+		if assert.NotNil(t, info.DeviceTime) {
+			assert.True(t, info.DeviceTime.Pending)
+		}
+	})
+
+	t.Run("returns 400 when no MAC command is requested", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		for _, body := range []string{`{}`, `{"linkCheck":"yes"}`} {
+			req, _ := http.NewRequest("POST", url, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+	})
+}
+
+func TestGetDeviceEvents(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	joinEUI := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	appKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	url := "/network-servers/test-server/devices/0102030405060708/events"
+
+	getEvents := func(t *testing.T, router *gin.Engine, query string) []device.Event {
+		req, _ := http.NewRequest("GET", url+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var events []device.Event
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &events))
+		return events
+	}
+
+	t.Run("returns the uplinks and downlinks filtered by type", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		dev, _ := ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		_, err := dev.Uplink(1, []byte{0x01, 0x02}, false)
+		assert.NoError(t, err)
+
+		fPort := uint8(10)
+		downlink := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{
+				FHDR:       lorawan.FHDR{DevAddr: devAddr},
+				FPort:      &fPort,
+				FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte{0xaa, 0xbb}}},
+			},
+		}
+		assert.NoError(t, downlink.EncryptFRMPayload(lorawan.AES128Key{}))
+		assert.NoError(t, downlink.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, lorawan.AES128Key{}))
+		assert.NoError(t, dev.Downlink(downlink))
+
+		events := getEvents(t, router, "")
+		if assert.Len(t, events, 2) {
+			assert.Equal(t, device.EventUplink, events[0].Type)
+			assert.Equal(t, "0102", events[0].Payload)
+		}
+
+		events = getEvents(t, router, "?type=downlink")
+		if assert.Len(t, events, 1) {
+			assert.Equal(t, device.EventDownlink, events[0].Type)
+			assert.Equal(t, uint32(0), *events[0].FCnt)
+			assert.Equal(t, uint8(10), *events[0].FPort)
+			assert.Equal(t, "aabb", events[0].Payload)
+		}
+
+		assert.Len(t, getEvents(t, router, "?type=downlink&type=uplink"), 2)
+		assert.Empty(t, getEvents(t, router, "?type=join_accept"))
+	})
+
+	t.Run("filters by time", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		dev, _ := ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		_, err := dev.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+
+		assert.Len(t, getEvents(t, router, "?since=2026-01-01T00:00:00Z"), 1)
+		assert.Empty(t, getEvents(t, router, "?until=2026-01-01T00:00:00Z"))
+	})
+
+	t.Run("returns 400 on an invalid time", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		req, _ := http.NewRequest("GET", url+"?since=yesterday", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestDeviceSchedule(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	joinEUI := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	appKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	scheduleURL := "/network-servers/test-server/devices/0102030405060708/schedule"
+
+	t.Run("returns stopped schedule by default", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		req, _ := http.NewRequest("GET", scheduleURL, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response networkserver.ScheduleStatus
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.False(t, response.Running)
+	})
+
+	t.Run("starts and stops a schedule", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		body := map[string]interface{}{
+			"type":      "jitter",
+			"interval":  "1h",
+			"jitter":    "5m",
+			"payload":   "AQI=",
+			"encoding":  "base64",
+			"fport":     5,
+			"confirmed": false,
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", scheduleURL+"/start", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response networkserver.ScheduleStatus
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.True(t, response.Running)
+		assert.Equal(t, networkserver.ScheduleTypeJitter, response.Type)
+		assert.Equal(t, "1h0m0s", response.Interval)
+		assert.Equal(t, "5m0s", response.Jitter)
+		assert.Equal(t, "0102", response.Payload)
+		assert.Equal(t, uint8(5), response.FPort)
+		assert.False(t, response.Confirmed)
+		assert.NotNil(t, response.NextRun)
+
+		req, _ = http.NewRequest("POST", scheduleURL+"/stop", nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		// Stopping twice fails
+		req, _ = http.NewRequest("POST", scheduleURL+"/stop", nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("rejects invalid schedules", func(t *testing.T) {
+		router, testPool := setupDeviceTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		bodies := []map[string]interface{}{
+			{},
+			{"type": "interval", "interval": "soon"},
+			{"type": "interval"},
+			{"type": "cron", "cron": "every day"},
+			{"type": "interval", "interval": "1m", "payload": "zz"},
+			{"type": "interval", "interval": "1m", "fport": 0},
+			{"type": "interval", "interval": "1m", "fport": 230},
+			{"type": "interval", "interval": "1m", "payload": strings.Repeat("00", 256)},
+		}
+
+		for _, body := range bodies {
+			jsonBody, _ := json.Marshal(body)
+			req, _ := http.NewRequest("POST", scheduleURL+"/start", bytes.NewBuffer(jsonBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code, "body: %v", body)
+		}
+	})
+}
+
 func TestIntegration_DeviceWorkflow(t *testing.T) {
 	t.Run("complete CRUD workflow for devices", func(t *testing.T) {
 		router, testPool := setupDeviceTestRouter()
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/eventbus"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// keepAliveInterval is the period of the SSE comments and WebSocket pings
+// keeping idle event streams open through proxies
+const keepAliveInterval = 30 * time.Second
+
+var upgrader = websocket.Upgrader{}
+
+// streamEvents sends the events of the simulator as they happen, over a
+// WebSocket when the client asks for an upgrade and as Server-Sent Events
+// otherwise
+func streamEvents(c *gin.Context) {
+	// Filters are optional, e.g. ?networkServer=localhost&device=0011223344556677
+	var query struct {
+		NetworkServer string `form:"networkServer"`
+		Gateway       string `form:"gateway"`
+		Device        string `form:"device"`
+	}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	filter := eventbus.Filter{NetworkServer: query.NetworkServer}
+	if query.Gateway != "" {
+		var eui lorawan.EUI64
+		if err := eui.UnmarshalText([]byte(query.Gateway)); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid gateway EUI format"})
+			return
+		}
+		filter.GatewayEUI = &eui
+	}
+	if query.Device != "" {
+		var eui lorawan.EUI64
+		if err := eui.UnmarshalText([]byte(query.Device)); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "invalid device EUI format"})
+			return
+		}
+		filter.DevEUI = &eui
+	}
+
+	sub := pool.Subscribe(filter)
+	defer sub.Close()
+
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		streamWebSocket(c, sub)
+		return
+	}
+
+	// Headers are sent right away, nginx must not buffer the stream
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return false
+			}
+			c.SSEvent("message", event)
+			return true
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// streamWebSocket sends the events as JSON messages until the client closes
+// the WebSocket
+func streamWebSocket(c *gin.Context, sub *eventbus.Subscription) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader answered the client
+		log.Printf("[api] websocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Messages of the client are ignored, reading detects the close
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/eventbus"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupEventsTestServer(t *testing.T) (*httptest.Server, *networkserver.NetworkServer) {
+	gin.SetMode(gin.TestMode)
+
+	pool = networkserver.NewPool()
+	ns, err := pool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+	assert.NoError(t, err)
+
+	router := gin.New()
+	router.GET("/events", streamEvents)
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server, ns
+}
+
+func TestStreamEvents(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+
+	t.Run("streams the events of a device as Server-Sent Events", func(t *testing.T) {
+		server, ns := setupEventsTestServer(t)
+
+		resp, err := http.Get(server.URL + "/events?networkServer=test-server&device=0102030405060708")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		// The gateway is filtered out
+		ns.AddGateway(lorawan.EUI64{0xaa}, "ws://localhost:3001", nil, nil)
+		ns.AddDevice(devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+
+		events := make(chan eventbus.Event)
+		go func() {
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if data, ok := strings.CutPrefix(scanner.Text(), "data:"); ok {
+					var event eventbus.Event
+					if json.Unmarshal([]byte(data), &event) == nil {
+						events <- event
+					}
+				}
+			}
+		}()
+
+		select {
+		case event := <-events:
+			assert.Equal(t, networkserver.EventDeviceAdded, event.Type)
+			assert.Equal(t, "test-server", event.NetworkServer)
+			assert.Equal(t, devEUI, *event.DevEUI)
+		case <-time.After(time.Second):
+			t.Fatal("event not received")
+		}
+	})
+
+	t.Run("streams the events over a WebSocket", func(t *testing.T) {
+		server, ns := setupEventsTestServer(t)
+
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/events?gateway=aa00000000000000"
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		ns.AddGateway(lorawan.EUI64{0xaa}, "ws://localhost:3001", nil, nil)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var event eventbus.Event
+		assert.NoError(t, conn.ReadJSON(&event))
+		assert.Equal(t, networkserver.EventGatewayAdded, event.Type)
+		assert.Equal(t, lorawan.EUI64{0xaa}, *event.GatewayEUI)
+	})
+
+	t.Run("returns 400 on an invalid EUI", func(t *testing.T) {
+		server, _ := setupEventsTestServer(t)
+
+		for _, query := range []string{"?gateway=zz", "?device=0102"} {
+			resp, err := http.Get(server.URL + "/events" + query)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+		}
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/brocaar/lorawan"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/gateway"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
 	"github.com/gin-gonic/gin"
 )
 
@@ -50,6 +51,13 @@ func postGateway(c *gin.Context) {
 		Headers      map[string]string `json:"headers"`
 		Latitude     *float64          `json:"latitude"`
 		Longitude    *float64          `json:"longitude"`
+		Region       string            `json:"region"`
+		Protocol     string            `json:"protocol"`
+		MQTT         *struct {
+			Encoding    string `json:"encoding"`
+			TopicPrefix string `json:"topicPrefix"`
+		} `json:"mqtt"`
+		TxFailureRate float64 `json:"txFailureRate"`
 	}
 
 	if err := c.Bind(&json); err != nil {
@@ -82,6 +90,29 @@ func postGateway(c *gin.Context) {
 		}
 	}
 
+	// Parse optional region (default EU868)
+	reg, err := region.Get(region.Name(json.Region))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	// Parse optional protocol (default LoRa Basics Station)
+	protocol, err := gateway.ParseProtocol(json.Protocol)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	// Parse optional MQTT configuration of ChirpStack MQTT gateways
+	var mqttConfig gateway.MQTTConfig
+	if json.MQTT != nil {
+		mqttConfig = gateway.MQTTConfig{
+			Encoding:    gateway.MQTTEncoding(json.MQTT.Encoding),
+			TopicPrefix: json.MQTT.TopicPrefix,
+		}
+	}
+
 	// Create gateway with optional location and headers
 	gw, err := ns.AddGateway(eui, json.DiscoveryURI, location, headers)
 
@@ -89,6 +120,18 @@ func postGateway(c *gin.Context) {
 		c.IndentedJSON(http.StatusConflict, gin.H{"message": err.Error()})
 		return
 	}
+	gw.SetRegion(reg)
+	gw.SetProtocol(protocol)
+	if err := gw.SetMQTTConfig(mqttConfig); err != nil {
+		ns.RemoveGateway(eui)
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := gw.SetTxFailureRate(json.TxFailureRate); err != nil {
+		ns.RemoveGateway(eui)
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
 	c.IndentedJSON(http.StatusCreated, gw.GetInfo())
 }
 
@@ -11,6 +11,7 @@ import (
 	"github.com/brocaar/lorawan"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/gateway"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -132,6 +133,187 @@ func TestPostGateway(t *testing.T) {
 		assert.Equal(t, "http://discovery.example.com", response.DiscoveryURI)
 	})
 
+	t.Run("creates gateway with region", func(t *testing.T) {
+		router, testPool := setupGatewayTestRouter()
+		testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]string{
+			"eui":          "0102030405060708",
+			"discoveryUri": "http://discovery.example.com",
+			"region":       "AU915",
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/gateways", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response gateway.GatewayInfo
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, region.AU915, response.Region)
+	})
+
+	t.Run("returns 400 when region is unsupported", func(t *testing.T) {
+		router, testPool := setupGatewayTestRouter()
+		testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]string{
+			"eui":          "0102030405060708",
+			"discoveryUri": "http://discovery.example.com",
+			"region":       "XX123",
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/gateways", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("creates Semtech UDP gateway", func(t *testing.T) {
+		router, testPool := setupGatewayTestRouter()
+		testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]string{
+			"eui":          "0102030405060708",
+			"discoveryUri": "udp://localhost:1700",
+			"protocol":     "semtech-udp",
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/gateways", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response gateway.GatewayInfo
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, gateway.ProtocolSemtechUDP, response.Protocol)
+	})
+
+	t.Run("creates ChirpStack MQTT gateway", func(t *testing.T) {
+		router, testPool := setupGatewayTestRouter()
+		testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]interface{}{
+			"eui":          "0102030405060708",
+			"discoveryUri": "tcp://localhost:1883",
+			"protocol":     "chirpstack-mqtt",
+			"mqtt": map[string]string{
+				"encoding":    "json",
+				"topicPrefix": "eu868",
+			},
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/gateways", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response gateway.GatewayInfo
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, gateway.ProtocolChirpStackMQTT, response.Protocol)
+		assert.Equal(t, &gateway.MQTTConfig{Encoding: gateway.MQTTEncodingJSON, TopicPrefix: "eu868"}, response.MQTT)
+	})
+
+	t.Run("returns 400 when MQTT encoding is unsupported", func(t *testing.T) {
+		router, testPool := setupGatewayTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]interface{}{
+			"eui":          "0102030405060708",
+			"discoveryUri": "tcp://localhost:1883",
+			"protocol":     "chirpstack-mqtt",
+			"mqtt":         map[string]string{"encoding": "xml"},
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/gateways", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Empty(t, ns.ListGateways())
+	})
+
+	t.Run("creates gateway with TX failure rate", func(t *testing.T) {
+		router, testPool := setupGatewayTestRouter()
+		testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]interface{}{
+			"eui":           "0102030405060708",
+			"discoveryUri":  "wss://example.com:6887",
+			"txFailureRate": 0.25,
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/gateways", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response gateway.GatewayInfo
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, 0.25, response.TxFailureRate)
+	})
+
+	t.Run("returns 400 when TX failure rate is out of range", func(t *testing.T) {
+		router, testPool := setupGatewayTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]interface{}{
+			"eui":           "0102030405060708",
+			"discoveryUri":  "wss://example.com:6887",
+			"txFailureRate": 2,
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/gateways", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Empty(t, ns.ListGateways())
+	})
+
+	t.Run("returns 400 when protocol is unsupported", func(t *testing.T) {
+		router, testPool := setupGatewayTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]string{
+			"eui":          "0102030405060708",
+			"discoveryUri": "udp://localhost:1700",
+			"protocol":     "mqtt",
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("POST", "/network-servers/test-server/gateways", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Empty(t, ns.ListGateways())
+	})
+
 	t.Run("returns 409 when adding duplicate gateway", func(t *testing.T) {
 		router, testPool := setupGatewayTestRouter()
 		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
@@ -18,6 +18,14 @@ func Init(p *networkserver.Pool) {
 	pool = p
 	router := gin.Default()
 
+	// GET /events - Event stream (SSE or WebSocket), registered before the
+	// timeout middleware as it stays open
+	router.GET("/events", streamEvents)
+
+	// POST /scenarios - Apply a scenario, registered before the timeout
+	// middleware as connecting its gateways may take longer
+	router.POST("/scenarios", postScenario)
+
 	// Add timeout middleware to all routes
 	router.Use(timeoutMiddleware(apiTimeout))
 
@@ -42,6 +50,12 @@ func Init(p *networkserver.Pool) {
 		// POST /network-servers/:name/sync
 		ns.POST("/sync", syncNetworkServersByName)
 
+		// GET /network-servers/:name/propagation
+		ns.GET("/propagation", getPropagation)
+
+		// PUT /network-servers/:name/propagation
+		ns.PUT("/propagation", putPropagation)
+
 		/*
 		 *	GATEWAYS
 		 */
@@ -85,11 +99,29 @@ func Init(p *networkserver.Pool) {
 			// DELETE /network-servers/:name/devices/:eui
 			dev.DELETE("", delDevice)
 
+			// GET /network-servers/:name/devices/:eui/events
+			dev.GET("/events", getDeviceEvents)
+
 			// POST /network-servers/:name/devices/:eui/join
 			dev.POST("/join", sendDeviceJoinRequest)
 
+			// POST /network-servers/:name/devices/:eui/rejoin
+			dev.POST("/rejoin", sendDeviceRejoinRequest)
+
+			// POST /network-servers/:name/devices/:eui/mac-commands
+			dev.POST("/mac-commands", requestDeviceMACCommands)
+
 			// POST /network-servers/:name/devices/:eui/uplink
 			dev.POST("/uplink", sendDeviceUplink)
+
+			// GET /network-servers/:name/devices/:eui/schedule
+			dev.GET("/schedule", getDeviceSchedule)
+
+			// POST /network-servers/:name/devices/:eui/schedule/start
+			dev.POST("/schedule/start", startDeviceSchedule)
+
+			// POST /network-servers/:name/devices/:eui/schedule/stop
+			dev.POST("/schedule/stop", stopDeviceSchedule)
 		}
 	}
 
@@ -5,6 +5,7 @@ import (
 
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/propagation"
 	"github.com/gin-gonic/gin"
 )
 
@@ -83,3 +84,26 @@ func syncNetworkServersByName(c *gin.Context) {
 
 	c.IndentedJSON(http.StatusNoContent, nil)
 }
+
+func getPropagation(c *gin.Context) {
+	ns := c.MustGet("networkServer").(*networkserver.NetworkServer)
+
+	c.IndentedJSON(http.StatusOK, ns.GetPropagation())
+}
+
+func putPropagation(c *gin.Context) {
+	ns := c.MustGet("networkServer").(*networkserver.NetworkServer)
+
+	var json propagation.Config
+	if err := c.Bind(&json); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err := ns.SetPropagation(json); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, ns.GetPropagation())
+}
@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/propagation"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -33,6 +34,8 @@ func setupTestRouter() (*gin.Engine, *networkserver.Pool) {
 		// Network Server operations
 		ns.GET("", getNetworkServersByName)
 		ns.DELETE("", delNetworkServer)
+		ns.GET("/propagation", getPropagation)
+		ns.PUT("/propagation", putPropagation)
 	}
 
 	return router, testPool
@@ -233,6 +236,68 @@ func TestDelNetworkServer(t *testing.T) {
 	})
 }
 
+func TestPropagation(t *testing.T) {
+	t.Run("returns free space by default", func(t *testing.T) {
+		router, testPool := setupTestRouter()
+		testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		req, _ := http.NewRequest("GET", "/network-servers/test-server/propagation", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response propagation.Config
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, propagation.FreeSpace, response.Model)
+	})
+
+	t.Run("sets model with defaults", func(t *testing.T) {
+		router, testPool := setupTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		body := map[string]interface{}{
+			"model":       "okumura-hata",
+			"environment": "suburban",
+		}
+		jsonBody, _ := json.Marshal(body)
+
+		req, _ := http.NewRequest("PUT", "/network-servers/test-server/propagation", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response propagation.Config
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, propagation.Config{
+			Model:         propagation.OkumuraHata,
+			Environment:   propagation.Suburban,
+			GatewayHeight: propagation.DefaultGatewayHeight,
+			DeviceHeight:  propagation.DefaultDeviceHeight,
+		}, response)
+		assert.Equal(t, response, ns.GetPropagation())
+	})
+
+	t.Run("returns 400 when model is unsupported", func(t *testing.T) {
+		router, testPool := setupTestRouter()
+		ns, _ := testPool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+
+		jsonBody, _ := json.Marshal(map[string]string{"model": "two-ray"})
+
+		req, _ := http.NewRequest("PUT", "/network-servers/test-server/propagation", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, propagation.FreeSpace, ns.GetPropagation().Model)
+	})
+}
+
 func TestIntegration_NetworkServerWorkflow(t *testing.T) {
 	t.Run("complete CRUD workflow", func(t *testing.T) {
 		router, _ := setupTestRouter()
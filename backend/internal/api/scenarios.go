@@ -0,0 +1,33 @@
+package api
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/scenario"
+	"github.com/gin-gonic/gin"
+)
+
+// postScenario applies a YAML or JSON scenario to the pool
+func postScenario(c *gin.Context) {
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	s, err := scenario.Parse(data)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	result, err := scenario.Apply(pool, s)
+	if err != nil {
+		// The entities added before the error are kept
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, result)
+}
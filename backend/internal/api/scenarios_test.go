@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/scenario"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupScenarioTestRouter() (*gin.Engine, *networkserver.Pool) {
+	gin.SetMode(gin.TestMode)
+
+	testPool := networkserver.NewPool()
+	pool = testPool
+
+	router := gin.New()
+	router.POST("/scenarios", postScenario)
+
+	return router, testPool
+}
+
+func TestPostScenario(t *testing.T) {
+	t.Run("applies a YAML scenario", func(t *testing.T) {
+		router, testPool := setupScenarioTestRouter()
+
+		body := `
+networkServers:
+  - name: test-server
+    config: {type: generic}
+    gateways:
+      - eui: 0102030405060708
+        discoveryUri: ws://localhost:3001
+    devices:
+      - count: 5
+        deveui: 1000000000000000
+        keys: deveui
+`
+		req, _ := http.NewRequest("POST", "/scenarios", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/yaml")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var result scenario.Result
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		assert.Equal(t, scenario.Result{NetworkServers: 1, Gateways: 1, Devices: 5}, result)
+
+		ns, err := testPool.Get("test-server")
+		assert.NoError(t, err)
+		assert.Len(t, ns.ListDevices(), 5)
+	})
+
+	t.Run("applies a JSON scenario", func(t *testing.T) {
+		router, testPool := setupScenarioTestRouter()
+
+		body := `{"networkServers": [{"name": "test-server", "config": {"type": "generic"}}]}`
+		req, _ := http.NewRequest("POST", "/scenarios", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Len(t, testPool.List(), 1)
+	})
+
+	t.Run("returns 400 on an invalid scenario", func(t *testing.T) {
+		router, testPool := setupScenarioTestRouter()
+
+		req, _ := http.NewRequest("POST", "/scenarios", strings.NewReader(`networkServers: [{name: a}, {name: a}]`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "network server a defined twice")
+		assert.Empty(t, testPool.List())
+	})
+}
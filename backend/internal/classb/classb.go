@@ -0,0 +1,154 @@
+package classb
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+)
+
+// Timing of a beacon period
+const (
+	BeaconPeriod   = 128 * time.Second
+	BeaconReserved = 2120 * time.Millisecond // beacon transmission
+	BeaconWindow   = 122880 * time.Millisecond
+	SlotLength     = 30 * time.Millisecond
+
+	// slots of the beacon window
+	slots = 4096
+)
+
+// Layout of a beacon frame: offsets of the Time and GwSpecific fields, and
+// length of the frame. It is the layout field of the router_config bcning
+// section of LoRa Basics Station.
+type Layout [3]int
+
+// infoDescGPS is the InfoDesc of a GwSpecific field holding the coordinates
+// of the gateway antenna
+const infoDescGPS = 0
+
+// Validate checks that the fields fit the frame
+func (l Layout) Validate() error {
+	timeOffset, infoOffset, length := l[0], l[1], l[2]
+	if timeOffset < 0 || infoOffset < timeOffset+6 || length < infoOffset+9 {
+		return fmt.Errorf("invalid beacon layout %v", [3]int(l))
+	}
+	return nil
+}
+
+// EncodeBeacon returns the beacon frame of the given beacon time (GPS seconds
+// of the start of the beacon period), with the coordinates of the gateway
+// when known
+func EncodeBeacon(layout Layout, beaconTime uint32, location *radio.Location) ([]byte, error) {
+	if err := layout.Validate(); err != nil {
+		return nil, err
+	}
+	timeOffset, infoOffset, length := layout[0], layout[1], layout[2]
+
+	frame := make([]byte, length)
+	binary.LittleEndian.PutUint32(frame[timeOffset:], beaconTime)
+	binary.LittleEndian.PutUint16(frame[timeOffset+4:], crc16(frame[:timeOffset+4]))
+
+	frame[infoOffset] = infoDescGPS
+	if location != nil {
+		putCoordinate(frame[infoOffset+1:], location.Latitude/90)
+		putCoordinate(frame[infoOffset+4:], location.Longitude/180)
+	}
+	binary.LittleEndian.PutUint16(frame[length-2:], crc16(frame[infoOffset:length-2]))
+
+	return frame, nil
+}
+
+// DecodeBeacon returns the beacon time of a beacon frame, failing when a CRC
+// does not match
+func DecodeBeacon(layout Layout, frame []byte) (uint32, error) {
+	if err := layout.Validate(); err != nil {
+		return 0, err
+	}
+	timeOffset, infoOffset, length := layout[0], layout[1], layout[2]
+
+	if len(frame) != length {
+		return 0, fmt.Errorf("invalid beacon length %d, expected %d", len(frame), length)
+	}
+	if binary.LittleEndian.Uint16(frame[timeOffset+4:]) != crc16(frame[:timeOffset+4]) {
+		return 0, errors.New("invalid beacon time CRC")
+	}
+	if binary.LittleEndian.Uint16(frame[length-2:]) != crc16(frame[infoOffset:length-2]) {
+		return 0, errors.New("invalid beacon GwSpecific CRC")
+	}
+
+	return binary.LittleEndian.Uint32(frame[timeOffset:]), nil
+}
+
+// putCoordinate encodes a coordinate scaled to [-1, 1] as a 24-bit two's
+// complement little endian integer
+func putCoordinate(b []byte, value float64) {
+	v := int32(math.Round(value * (1 << 23)))
+	v = min(v, 1<<23-1)
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// crc16 is the CRC-16/CCITT of the beacon fields
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// PingPeriod returns the slots between two ping slots of the given
+// periodicity (0-7), i.e. a ping slot every 2^periodicity seconds
+func PingPeriod(periodicity int) int {
+	return 1 << (5 + periodicity)
+}
+
+// PingOffset returns the randomized offset of the first ping slot of a
+// device in the beacon period
+func PingOffset(beaconTime uint32, devAddr lorawan.DevAddr, periodicity int) int {
+	var b [16]byte
+	binary.LittleEndian.PutUint32(b[0:], beaconTime)
+	// DevAddr is transmitted little endian
+	for i := 0; i < 4; i++ {
+		b[4+i] = devAddr[3-i]
+	}
+
+	// AES-128 with an all-zero key
+	block, _ := aes.NewCipher(make([]byte, 16))
+	var rand [16]byte
+	block.Encrypt(rand[:], b[:])
+
+	return (int(rand[0]) + int(rand[1])*256) % PingPeriod(periodicity)
+}
+
+// PingSlots returns the ping slots of a device in the beacon period starting
+// at the given instant
+func PingSlots(periodStart time.Time, beaconTime uint32, devAddr lorawan.DevAddr, periodicity int) []time.Time {
+	period := PingPeriod(periodicity)
+	offset := PingOffset(beaconTime, devAddr, periodicity)
+
+	var pingSlots []time.Time
+	for slot := offset; slot < slots; slot += period {
+		pingSlots = append(pingSlots, periodStart.Add(BeaconReserved+time.Duration(slot)*SlotLength))
+	}
+	return pingSlots
+}
+
+// BeaconTime returns the beacon time of the period containing the given GPS
+// time, and the GPS time elapsed since its start
+func BeaconTime(timeSinceGPSEpoch time.Duration) (uint32, time.Duration) {
+	elapsed := timeSinceGPSEpoch % BeaconPeriod
+	return uint32((timeSinceGPSEpoch - elapsed) / time.Second), elapsed
+}
@@ -0,0 +1,117 @@
+package classb
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/stretchr/testify/assert"
+)
+
+var eu868Layout = Layout{2, 8, 17}
+
+func TestCRC16(t *testing.T) {
+	// CRC-16/CCITT check value
+	assert.Equal(t, uint16(0x31c3), crc16([]byte("123456789")))
+}
+
+func TestEncodeBeacon(t *testing.T) {
+	t.Run("encodes time and gateway coordinates", func(t *testing.T) {
+		frame, err := EncodeBeacon(eu868Layout, 1476229120, &radio.Location{Latitude: 45, Longitude: -90})
+		assert.NoError(t, err)
+		assert.Len(t, frame, 17)
+
+		assert.Equal(t, []byte{0x00, 0x00}, frame[:2])
+		assert.Equal(t, uint32(1476229120), binary.LittleEndian.Uint32(frame[2:]))
+		assert.Equal(t, byte(0), frame[8])
+		// Half of the latitude and longitude ranges
+		assert.Equal(t, []byte{0x00, 0x00, 0x40}, frame[9:12])
+		assert.Equal(t, []byte{0x00, 0x00, 0xc0}, frame[12:15])
+
+		beaconTime, err := DecodeBeacon(eu868Layout, frame)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(1476229120), beaconTime)
+	})
+
+	t.Run("encodes the US915 layout", func(t *testing.T) {
+		layout := Layout{5, 11, 23}
+		frame, err := EncodeBeacon(layout, 128, nil)
+		assert.NoError(t, err)
+		assert.Len(t, frame, 23)
+
+		beaconTime, err := DecodeBeacon(layout, frame)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(128), beaconTime)
+	})
+
+	t.Run("rejects invalid layout", func(t *testing.T) {
+		_, err := EncodeBeacon(Layout{2, 4, 17}, 128, nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestDecodeBeacon(t *testing.T) {
+	frame, err := EncodeBeacon(eu868Layout, 256, nil)
+	assert.NoError(t, err)
+
+	t.Run("rejects corrupted time", func(t *testing.T) {
+		corrupted := append([]byte(nil), frame...)
+		corrupted[3] ^= 0x01
+		_, err := DecodeBeacon(eu868Layout, corrupted)
+		assert.EqualError(t, err, "invalid beacon time CRC")
+	})
+
+	t.Run("rejects corrupted GwSpecific", func(t *testing.T) {
+		corrupted := append([]byte(nil), frame...)
+		corrupted[10] ^= 0x01
+		_, err := DecodeBeacon(eu868Layout, corrupted)
+		assert.EqualError(t, err, "invalid beacon GwSpecific CRC")
+	})
+
+	t.Run("rejects frame of another layout", func(t *testing.T) {
+		_, err := DecodeBeacon(Layout{5, 11, 23}, frame)
+		assert.Error(t, err)
+	})
+}
+
+func TestPingSlots(t *testing.T) {
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+
+	t.Run("offset is random within the ping period", func(t *testing.T) {
+		offsets := make(map[int]bool)
+		for beaconTime := uint32(0); beaconTime < 128*100; beaconTime += 128 {
+			offset := PingOffset(beaconTime, devAddr, 7)
+			assert.GreaterOrEqual(t, offset, 0)
+			assert.Less(t, offset, 4096)
+			offsets[offset] = true
+		}
+		assert.Greater(t, len(offsets), 90)
+
+		assert.Equal(t, PingOffset(1280, devAddr, 7), PingOffset(1280, devAddr, 7))
+		assert.NotEqual(t, PingOffset(1280, devAddr, 7), PingOffset(1280, lorawan.DevAddr{0x01, 0x02, 0x03, 0x05}, 7))
+		assert.Less(t, PingOffset(1280, devAddr, 0), 32)
+	})
+
+	t.Run("opens a slot every ping period", func(t *testing.T) {
+		start := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+		for periodicity := 0; periodicity <= 7; periodicity++ {
+			pingSlots := PingSlots(start, 1280, devAddr, periodicity)
+			assert.Len(t, pingSlots, 128>>periodicity)
+
+			offset := time.Duration(PingOffset(1280, devAddr, periodicity)) * SlotLength
+			assert.Equal(t, start.Add(BeaconReserved+offset), pingSlots[0])
+			for i := 1; i < len(pingSlots); i++ {
+				assert.Equal(t, time.Duration(PingPeriod(periodicity))*SlotLength, pingSlots[i].Sub(pingSlots[i-1]))
+			}
+			assert.True(t, pingSlots[len(pingSlots)-1].Before(start.Add(BeaconReserved+BeaconWindow)))
+		}
+	})
+}
+
+func TestBeaconTime(t *testing.T) {
+	beaconTime, elapsed := BeaconTime(1476229125*time.Second + 500*time.Millisecond)
+	assert.Equal(t, uint32(1476229120), beaconTime)
+	assert.Equal(t, 5500*time.Millisecond, elapsed)
+}
@@ -0,0 +1,60 @@
+package device
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// SetAutoAck makes the device acknowledge a confirmed downlink with an empty
+// uplink when no other uplink carried the ACK within the delay. Disabled,
+// the ACK waits for the next uplink.
+func (d *Device) SetAutoAck(enabled bool, delay time.Duration) error {
+	if delay < 0 {
+		return errors.New("auto-ack delay must not be negative")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.autoAck = enabled
+	d.autoAckDelay = delay
+	return nil
+}
+
+// receiveConfirmedDownlink sets the ACK of the next uplink, signing the FCnt
+// of the downlink in 1.1, and schedules the auto-ack.
+// Must be called with the lock held.
+func (d *Device) receiveConfirmedDownlink(fCnt uint32) {
+	d.ackPending = true
+	d.ackFCntDn = fCnt
+
+	if d.autoAck {
+		time.AfterFunc(d.autoAckDelay, d.sendAutoAck)
+	}
+}
+
+// sendAutoAck sends an empty uplink carrying a pending ACK
+func (d *Device) sendAutoAck() {
+	d.mu.RLock()
+	ackPending := d.ackPending
+	d.mu.RUnlock()
+	if !ackPending {
+		return
+	}
+
+	log.Printf("[%s] sending empty uplink to acknowledge the confirmed downlink", d.DevEUI)
+	if _, err := d.Uplink(1, nil, false); err != nil {
+		log.Printf("[%s] auto-ack failed: %v", d.DevEUI, err)
+	}
+}
+
+// autoAckInfo returns the auto-ack delay in seconds, nil when disabled.
+// Must be called with the lock held.
+func (d *Device) autoAckInfo() *float64 {
+	if !d.autoAck {
+		return nil
+	}
+	delay := d.autoAckDelay.Seconds()
+	return &delay
+}
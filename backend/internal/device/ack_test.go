@@ -0,0 +1,119 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDevice_ConfirmedDownlink(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	nwkSKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+
+	newDevice := func() (*Device, chan radio.Uplink) {
+		uplinkCh := make(chan radio.Uplink, 10)
+		return New(uplinkCh, devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, devAddr, lorawan.AES128Key{}, nwkSKey, 0, 0), uplinkCh
+	}
+
+	confirmedDownlink := func(t *testing.T, device *Device, fCnt uint32) {
+		phy := lorawan.PHYPayload{
+			MHDR:       lorawan.MHDR{MType: lorawan.ConfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{FHDR: lorawan.FHDR{DevAddr: devAddr, FCnt: fCnt}},
+		}
+		assert.NoError(t, phy.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, nwkSKey))
+		assert.NoError(t, device.Downlink(phy))
+	}
+
+	receive := func(t *testing.T, uplinkCh chan radio.Uplink) radio.Uplink {
+		select {
+		case uplink := <-uplinkCh:
+			return uplink
+		case <-time.After(time.Second):
+			t.Fatal("uplink not broadcast")
+			return radio.Uplink{}
+		}
+	}
+
+	ack := func(uplink radio.Uplink) bool {
+		return uplink.PHYPayload.MACPayload.(*lorawan.MACPayload).FHDR.FCtrl.ACK
+	}
+
+	t.Run("acknowledges in the next uplink", func(t *testing.T) {
+		device, uplinkCh := newDevice()
+
+		confirmedDownlink(t, device, 5)
+		assert.True(t, device.GetInfo().AckPending)
+
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		assert.True(t, ack(receive(t, uplinkCh)))
+		assert.False(t, device.GetInfo().AckPending)
+
+		_, err = device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		assert.False(t, ack(receive(t, uplinkCh)))
+	})
+
+	t.Run("signs the FCnt of the confirmed downlink in 1.1", func(t *testing.T) {
+		nwkKey := lorawan.AES128Key{0xff, 0xee, 0xdd, 0xcc, 0xbb, 0xaa, 0x99, 0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11, 0x00}
+		device, uplinkCh := newTestDevice11(t, nwkKey, true)
+		info := device.GetInfo()
+
+		phy := lorawan.PHYPayload{
+			MHDR:       lorawan.MHDR{MType: lorawan.ConfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{FHDR: lorawan.FHDR{DevAddr: info.DevAddr, FCnt: 7}},
+		}
+		assert.NoError(t, phy.SetDownlinkDataMIC(lorawan.LoRaWAN1_1, 0, info.LoRaWAN11.SNwkSIntKey))
+		assert.NoError(t, device.Downlink(phy))
+
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		uplink := receive(t, uplinkCh)
+		assert.True(t, ack(uplink))
+
+		txCh, err := device.region.UplinkChannelIndex(uplink.Frequency, uplink.DataRate)
+		assert.NoError(t, err)
+		ok, err := uplink.PHYPayload.ValidateUplinkDataMIC(lorawan.LoRaWAN1_1, 7, uint8(uplink.DataRate), uint8(txCh), info.NwkSKey, info.LoRaWAN11.SNwkSIntKey)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("sends an empty uplink with auto-ack", func(t *testing.T) {
+		device, uplinkCh := newDevice()
+		assert.NoError(t, device.SetAutoAck(true, 10*time.Millisecond))
+		assert.Equal(t, 0.01, *device.GetInfo().AutoAck)
+
+		confirmedDownlink(t, device, 0)
+
+		uplink := receive(t, uplinkCh)
+		assert.True(t, ack(uplink))
+		assert.Nil(t, uplink.PHYPayload.MACPayload.(*lorawan.MACPayload).FPort)
+		assert.False(t, device.GetInfo().AckPending)
+	})
+
+	t.Run("skips auto-ack when an uplink carried the ACK", func(t *testing.T) {
+		device, uplinkCh := newDevice()
+		assert.NoError(t, device.SetAutoAck(true, 100*time.Millisecond))
+
+		confirmedDownlink(t, device, 0)
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		assert.True(t, ack(receive(t, uplinkCh)))
+
+		select {
+		case <-uplinkCh:
+			t.Fatal("unexpected auto-ack uplink")
+		case <-time.After(300 * time.Millisecond):
+		}
+	})
+
+	t.Run("rejects negative auto-ack delay", func(t *testing.T) {
+		device, _ := newDevice()
+		assert.Error(t, device.SetAutoAck(true, -time.Second))
+		assert.Nil(t, device.GetInfo().AutoAck)
+	})
+}
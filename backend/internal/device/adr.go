@@ -0,0 +1,78 @@
+package device
+
+import (
+	"fmt"
+	"log"
+)
+
+// ADR backoff of the LoRaWAN specification: without downlink for
+// adrAckLimit uplinks the device sets ADRACKReq, then every adrAckDelay
+// uplinks it steps towards the most robust link. Variables so that tests can
+// shorten them.
+var (
+	adrAckLimit = 64
+	adrAckDelay = 32
+)
+
+// SetADR enables the ADR bit of the uplinks, letting the network server set
+// the data rate, TX power and NbTrans. The device then requests a downlink
+// with ADRACKReq and backs off when the network server stays silent.
+func (d *Device) SetADR(enabled bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.adr = enabled
+	d.adrAckCnt = 0
+}
+
+// adrAckReq reports whether the next uplink sets ADRACKReq.
+// Must be called with the lock held.
+func (d *Device) adrAckReq() bool {
+	return d.adr && d.adrAckCnt >= adrAckLimit
+}
+
+// adrBackoff regains connectivity after adrAckLimit+adrAckDelay uplinks
+// without downlink: first the maximum TX power, then one data rate lower at
+// each adrAckDelay, and finally the default channels with a single
+// transmission.
+// Must be called with the lock held.
+func (d *Device) adrBackoff() {
+	if !d.adr || d.adrAckCnt < adrAckLimit+adrAckDelay {
+		return
+	}
+	d.adrAckCnt = adrAckLimit
+
+	if d.txPower < d.maxEIRP {
+		d.txPower = d.maxEIRP
+		log.Printf("[%s] ADR backoff: %g dBm", d.DevEUI, d.txPower)
+		return
+	}
+
+	for dr := d.dataRate - 1; dr >= 0; dr-- {
+		if _, err := d.region.DataRate(dr); err == nil && d.supportsDataRate(d.chMask, dr) {
+			d.setDataRate(dr, "ADR backoff")
+			return
+		}
+	}
+
+	defaults, err := d.region.ChannelMask(d.subBand)
+	if err != nil {
+		return
+	}
+	for i, on := range defaults {
+		d.chMask[i] = d.chMask[i] || on
+	}
+	d.nbTrans = 1
+	log.Printf("[%s] ADR backoff: default channels enabled", d.DevEUI)
+}
+
+// setDataRate changes the uplink data rate, raising an
+// EventDataRateChanged.
+// Must be called with the lock held.
+func (d *Device) setDataRate(dr int, reason string) {
+	if dr == d.dataRate {
+		return
+	}
+	d.emit(EventDataRateChanged, fmt.Sprintf("DR%d to DR%d (%s)", d.dataRate, dr, reason))
+	d.dataRate = dr
+}
@@ -0,0 +1,126 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDevice_ADR(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	nwkSKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+
+	limit, delay := adrAckLimit, adrAckDelay
+	adrAckLimit, adrAckDelay = 4, 2
+	t.Cleanup(func() { adrAckLimit, adrAckDelay = limit, delay })
+
+	newDevice := func() (*Device, chan radio.Uplink) {
+		uplinkCh := make(chan radio.Uplink, 10)
+		return New(uplinkCh, devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, devAddr, lorawan.AES128Key{}, nwkSKey, 0, 0), uplinkCh
+	}
+
+	// uplink sends an uplink and returns its FHDR
+	uplink := func(t *testing.T, device *Device, uplinkCh chan radio.Uplink) (radio.Uplink, lorawan.FHDR) {
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		select {
+		case uplink := <-uplinkCh:
+			return uplink, uplink.PHYPayload.MACPayload.(*lorawan.MACPayload).FHDR
+		case <-time.After(time.Second):
+			t.Fatal("uplink not broadcast")
+			return radio.Uplink{}, lorawan.FHDR{}
+		}
+	}
+
+	emptyDownlink := func(t *testing.T, device *Device, fCnt uint32) {
+		phy := lorawan.PHYPayload{
+			MHDR:       lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{FHDR: lorawan.FHDR{DevAddr: devAddr, FCnt: fCnt}},
+		}
+		assert.NoError(t, phy.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, nwkSKey))
+		assert.NoError(t, device.Downlink(phy))
+	}
+
+	t.Run("leaves the ADR bit unset by default", func(t *testing.T) {
+		device, uplinkCh := newDevice()
+		for i := 0; i < 8; i++ {
+			_, fhdr := uplink(t, device, uplinkCh)
+			assert.False(t, fhdr.FCtrl.ADR)
+			assert.False(t, fhdr.FCtrl.ADRACKReq)
+		}
+	})
+
+	t.Run("requests a downlink and backs off without answer", func(t *testing.T) {
+		device, uplinkCh := newDevice()
+		device.SetADR(true)
+		assert.NoError(t, device.SetTxPower(10))
+
+		// ADRACKReq from the 5th uplink without downlink
+		for i := 0; i < 6; i++ {
+			received, fhdr := uplink(t, device, uplinkCh)
+			assert.True(t, fhdr.FCtrl.ADR)
+			assert.Equal(t, i >= 4, fhdr.FCtrl.ADRACKReq, "uplink %d", i)
+			assert.Equal(t, 10.0, received.TxPower)
+		}
+
+		// The maximum TX power first, then a lower data rate
+		received, fhdr := uplink(t, device, uplinkCh)
+		assert.True(t, fhdr.FCtrl.ADRACKReq)
+		assert.Equal(t, 16.0, received.TxPower)
+		assert.Equal(t, 5, received.DataRate)
+
+		uplink(t, device, uplinkCh)
+		received, _ = uplink(t, device, uplinkCh)
+		assert.Equal(t, 4, received.DataRate)
+		info := device.GetInfo()
+		assert.Equal(t, 4, info.DataRate)
+		if assert.NotNil(t, info.LastEvent) {
+			assert.Equal(t, EventDataRateChanged, info.LastEvent.Type)
+			assert.Equal(t, "DR5 to DR4 (ADR backoff)", info.LastEvent.Message)
+		}
+
+		// A downlink restarts the backoff
+		emptyDownlink(t, device, 0)
+		assert.Equal(t, 0, device.GetInfo().ADRAckCnt)
+		_, fhdr = uplink(t, device, uplinkCh)
+		assert.False(t, fhdr.FCtrl.ADRACKReq)
+	})
+
+	t.Run("repeats unconfirmed uplinks NbTrans times", func(t *testing.T) {
+		retransmission := retransmissionDelay
+		retransmissionDelay = 10 * time.Millisecond
+		t.Cleanup(func() { retransmissionDelay = retransmission })
+
+		device, uplinkCh := newDevice()
+		device.mu.Lock()
+		device.nbTrans = 2
+		device.rx1Delay = 0 // RX2 after one second
+		device.mu.Unlock()
+
+		_, fhdr := uplink(t, device, uplinkCh)
+		select {
+		case repetition := <-uplinkCh:
+			assert.Equal(t, fhdr.FCnt, repetition.PHYPayload.MACPayload.(*lorawan.MACPayload).FHDR.FCnt)
+		case <-time.After(2 * time.Second):
+			t.Fatal("uplink not repeated")
+		}
+		select {
+		case <-uplinkCh:
+			t.Fatal("uplink repeated more than NbTrans times")
+		case <-time.After(1200 * time.Millisecond):
+		}
+
+		// A downlink stops the repetitions
+		uplink(t, device, uplinkCh)
+		emptyDownlink(t, device, 1)
+		select {
+		case <-uplinkCh:
+			t.Fatal("uplink repeated after a downlink")
+		case <-time.After(1200 * time.Millisecond):
+		}
+	})
+}
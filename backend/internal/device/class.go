@@ -0,0 +1,30 @@
+package device
+
+import "fmt"
+
+// Class is the LoRaWAN class of the device, selecting when it listens to
+// downlinks
+type Class string
+
+const (
+	// ClassA only listens in the RX1 and RX2 windows following an uplink
+	ClassA Class = "A"
+	// ClassB also listens in ping slots, scheduled on the beacons
+	// transmitted by the gateways
+	ClassB Class = "B"
+	// ClassC also listens on the RX2 frequency and data rate whenever it is
+	// not transmitting
+	ClassC Class = "C"
+)
+
+// ParseClass validates a device class, an empty class selects class A
+func ParseClass(name string) (Class, error) {
+	switch Class(name) {
+	case "", ClassA:
+		return ClassA, nil
+	case ClassB, ClassC:
+		return Class(name), nil
+	default:
+		return "", fmt.Errorf("unsupported device class %q", name)
+	}
+}
@@ -0,0 +1,213 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/gps"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/classb"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+)
+
+// beaconlessOperation is how long a class B device keeps opening its ping
+// slots after the last beacon received
+var beaconlessOperation = 2 * time.Hour
+
+// ClassBInfo is the state of a class B device
+type ClassBInfo struct {
+	PingSlotPeriodicity  int        `json:"pingSlotPeriodicity"`         // a ping slot every 2^periodicity s
+	PingSlotFrequency    uint32     `json:"pingSlotFrequency,omitempty"` // hops on the region channels when unset
+	PingSlotDataRate     int        `json:"pingSlotDataRate"`
+	BeaconFrequency      uint32     `json:"beaconFrequency,omitempty"` // hops on the region channels when unset
+	BeaconLocked         bool       `json:"beaconLocked"`
+	LastBeacon           *time.Time `json:"lastBeacon,omitempty"`
+	TimeSynced           bool       `json:"timeSynced"` // GPS time learned with DeviceTimeReq
+	PingSlotInfoAnswered bool       `json:"pingSlotInfoAnswered"`
+	Downlinks            int        `json:"downlinks"` // received in the ping slots
+}
+
+// SetPingSlotPeriodicity sets the periodicity (0-7) of the ping slots, a
+// ping slot every 2^periodicity seconds. A class B device informs the
+// network server with a PingSlotInfoReq on the next uplink.
+func (d *Device) SetPingSlotPeriodicity(periodicity int) error {
+	if periodicity < 0 || periodicity > 7 {
+		return errors.New("ping slot periodicity must be between 0 and 7")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pingSlotPeriodicity = periodicity
+	if d.class == ClassB {
+		d.pingSlotInfoAnswered = false
+		d.queueMACCommand(lorawan.PingSlotInfoReq, &lorawan.PingSlotInfoReqPayload{Periodicity: uint8(periodicity)})
+	}
+
+	return nil
+}
+
+// switchToClassB queues the MAC commands announcing the ping slots to the
+// network server and acquiring the GPS time to search the beacon.
+// Must be called with the lock held.
+func (d *Device) switchToClassB() {
+	d.pingSlotInfoAnswered = false
+	d.timeSynced = false
+	d.lastBeacon = time.Time{}
+	d.queueMACCommand(lorawan.PingSlotInfoReq, &lorawan.PingSlotInfoReqPayload{Periodicity: uint8(d.pingSlotPeriodicity)})
+	d.requestMACCommand(lorawan.DeviceTimeReq)
+}
+
+// gpsTime returns the time since the GPS epoch of an instant, as known by
+// the device
+// Must be called with the lock held.
+func (d *Device) gpsTime(t time.Time) time.Duration {
+	return gps.Time(t).TimeSinceGPSEpoch() + d.gpsOffset
+}
+
+// receiveBeacon locks a class B device on a beacon transmitted at the
+// frequency and data rate of the region. Other devices ignore beacons.
+func (d *Device) receiveBeacon(downlink radio.Downlink) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.class != ClassB || downlink.Region != d.region.Name() {
+		return nil
+	}
+
+	beaconTime, err := classb.DecodeBeacon(d.region.BeaconLayout(), downlink.Beacon)
+	if err != nil {
+		return err
+	}
+	periodStart := time.Duration(beaconTime) * time.Second
+
+	frequency := d.beaconFrequency
+	if frequency == 0 {
+		frequency = d.region.BeaconFrequency(periodStart)
+	}
+	if downlink.Frequency != frequency || downlink.DataRate != d.region.BeaconDataRate() {
+		return fmt.Errorf("beacon on %d Hz DR%d, expected %d Hz DR%d", downlink.Frequency, downlink.DataRate, frequency, d.region.BeaconDataRate())
+	}
+
+	// Once the GPS time is known the beacon is only searched at the start of
+	// the beacon period
+	if offset := d.gpsTime(downlink.Time) - periodStart; d.timeSynced && (offset > rxWindowTolerance || offset < -rxWindowTolerance) {
+		return fmt.Errorf("beacon of GPS time %d received %s off the beacon period", beaconTime, offset)
+	}
+
+	if !d.beaconLocked(downlink.Time) {
+		log.Printf("[%s] class B beacon locked", d.DevEUI)
+	}
+	d.lastBeacon = downlink.Time
+	d.lastBeaconTime = beaconTime
+
+	return nil
+}
+
+// beaconLocked is true when a beacon was received within the beaconless
+// operation before the given instant.
+// Must be called with the lock held.
+func (d *Device) beaconLocked(t time.Time) bool {
+	return !d.lastBeacon.IsZero() && t.Sub(d.lastBeacon) < beaconlessOperation
+}
+
+// receivePingSlot is true when a class B device receives the downlink in one
+// of its ping slots, derived from the last beacon received.
+// Must be called with the lock held.
+func (d *Device) receivePingSlot(downlink radio.Downlink) bool {
+	if d.class != ClassB || !d.beaconLocked(downlink.Time) || downlink.Region != d.region.Name() {
+		return false
+	}
+
+	// Beacon period of the downlink, extrapolated without beacons
+	periods := downlink.Time.Sub(d.lastBeacon) / classb.BeaconPeriod
+	if downlink.Time.Before(d.lastBeacon) {
+		periods--
+	}
+	periodStart := d.lastBeacon.Add(periods * classb.BeaconPeriod)
+	beaconTime := d.lastBeaconTime + uint32(periods*classb.BeaconPeriod/time.Second)
+
+	// Closest slot of the beacon window
+	elapsed := downlink.Time.Sub(periodStart) - classb.BeaconReserved
+	slot := int((elapsed + classb.SlotLength/2) / classb.SlotLength)
+	offset := elapsed - time.Duration(slot)*classb.SlotLength
+	if elapsed < -rxWindowTolerance || offset > rxWindowTolerance || offset < -rxWindowTolerance {
+		return false
+	}
+
+	pingOffset := classb.PingOffset(beaconTime, d.DevAddr, d.pingSlotPeriodicity)
+	if slot < pingOffset || (slot-pingOffset)%classb.PingPeriod(d.pingSlotPeriodicity) != 0 {
+		return false
+	}
+
+	frequency := d.pingSlotFrequency
+	if frequency == 0 {
+		frequency = d.region.PingSlotFrequency(d.DevAddr, time.Duration(beaconTime)*time.Second)
+	}
+	return downlink.Frequency == frequency && downlink.DataRate == d.pingSlotDataRate
+}
+
+// handleDeviceTimeAns learns the GPS time of the network server at the end
+// of the uplink carrying the DeviceTimeReq.
+// Must be called with the lock held.
+func (d *Device) handleDeviceTimeAns(ans *lorawan.DeviceTimeAnsPayload) {
+	if d.deviceTimeReq.IsZero() {
+		log.Printf("[%s] DeviceTimeAns without DeviceTimeReq", d.DevEUI)
+		return
+	}
+
+	d.gpsOffset = ans.TimeSinceGPSEpoch - gps.Time(d.deviceTimeReq).TimeSinceGPSEpoch()
+	d.timeSynced = true
+	d.recordDeviceTime(d.deviceTimeReq, ans)
+	d.deviceTimeReq = time.Time{}
+	log.Printf("[%s] DeviceTimeAns: GPS time offset %s", d.DevEUI, d.gpsOffset)
+}
+
+// handlePingSlotChannelReq changes the frequency and data rate of the ping
+// slots, a zero frequency restores the channels of the region.
+// Must be called with the lock held.
+func (d *Device) handlePingSlotChannelReq(req *lorawan.PingSlotChannelReqPayload) *lorawan.PingSlotChannelAnsPayload {
+	_, err := d.region.DataRate(int(req.DR))
+	ans := &lorawan.PingSlotChannelAnsPayload{DataRateOK: err == nil, ChannelFrequencyOK: true}
+	if ans.DataRateOK {
+		d.pingSlotFrequency = req.Frequency
+		d.pingSlotDataRate = int(req.DR)
+		log.Printf("[%s] PingSlotChannelReq: %d Hz DR%d", d.DevEUI, req.Frequency, req.DR)
+	}
+	return ans
+}
+
+// handleBeaconFreqReq changes the frequency of the beacons, a zero frequency
+// restores the channels of the region.
+// Must be called with the lock held.
+func (d *Device) handleBeaconFreqReq(req *lorawan.BeaconFreqReqPayload) *lorawan.BeaconFreqAnsPayload {
+	d.beaconFrequency = req.Frequency
+	log.Printf("[%s] BeaconFreqReq: %d Hz", d.DevEUI, req.Frequency)
+	return &lorawan.BeaconFreqAnsPayload{BeaconFrequencyOK: true}
+}
+
+// classBInfo returns the state of a class B device, nil for other classes.
+// Must be called with the lock held.
+func (d *Device) classBInfo() *ClassBInfo {
+	if d.class != ClassB {
+		return nil
+	}
+
+	info := &ClassBInfo{
+		PingSlotPeriodicity:  d.pingSlotPeriodicity,
+		PingSlotFrequency:    d.pingSlotFrequency,
+		PingSlotDataRate:     d.pingSlotDataRate,
+		BeaconFrequency:      d.beaconFrequency,
+		BeaconLocked:         d.beaconLocked(time.Now()),
+		TimeSynced:           d.timeSynced,
+		PingSlotInfoAnswered: d.pingSlotInfoAnswered,
+		Downlinks:            d.classBDownlinks,
+	}
+	if !d.lastBeacon.IsZero() {
+		lastBeacon := d.lastBeacon
+		info.LastBeacon = &lastBeacon
+	}
+	return info
+}
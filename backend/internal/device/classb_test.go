@@ -0,0 +1,239 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/gps"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/classb"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDevice_ClassB(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	appSKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	nwkSKey := lorawan.AES128Key{0x10, 0x0f, 0x0e, 0x0d, 0x0c, 0x0b, 0x0a, 0x09, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}
+	eu868Layout := classb.Layout{2, 8, 17}
+
+	// newClassB returns an activated class B device, its pending MAC
+	// commands already sent
+	newClassB := func(t *testing.T, periodicity int) (*Device, chan radio.Uplink) {
+		uplinkCh := make(chan radio.Uplink, 10)
+		device := New(uplinkCh, devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, devAddr, appSKey, nwkSKey, 0, 0)
+		assert.NoError(t, device.SetPingSlotPeriodicity(periodicity))
+		assert.NoError(t, device.SetClass(ClassB))
+		return device, uplinkCh
+	}
+
+	uplinkMAC := func(t *testing.T, device *Device, uplinkCh chan radio.Uplink) (radio.Uplink, *lorawan.MACPayload) {
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		select {
+		case uplink := <-uplinkCh:
+			macPL, ok := uplink.PHYPayload.MACPayload.(*lorawan.MACPayload)
+			assert.True(t, ok)
+			return uplink, macPL
+		case <-time.After(time.Second):
+			t.Fatal("uplink not broadcast")
+			return radio.Uplink{}, nil
+		}
+	}
+
+	beacon := func(t *testing.T, beaconTime uint32, at time.Time) radio.Downlink {
+		frame, err := classb.EncodeBeacon(eu868Layout, beaconTime, nil)
+		assert.NoError(t, err)
+		return radio.Downlink{Beacon: frame, Region: region.EU868, Frequency: 869525000, DataRate: 3, Time: at}
+	}
+
+	// overTheAir returns the frame as received by the device, with its MAC
+	// commands still encoded
+	overTheAir := func(t *testing.T, phy lorawan.PHYPayload) lorawan.PHYPayload {
+		b, err := phy.MarshalBinary()
+		assert.NoError(t, err)
+		var received lorawan.PHYPayload
+		assert.NoError(t, received.UnmarshalBinary(b))
+		return received
+	}
+
+	// Downlinks count up across the devices, ahead of each of them
+	var fCntDn uint32
+	dataDown := func(t *testing.T, fOpts ...lorawan.Payload) lorawan.PHYPayload {
+		fCntDn++
+		fPort := uint8(10)
+		phy := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{
+				FHDR:       lorawan.FHDR{DevAddr: devAddr, FCnt: fCntDn, FOpts: fOpts},
+				FPort:      &fPort,
+				FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte{0xaa}}},
+			},
+		}
+		assert.NoError(t, phy.EncryptFRMPayload(appSKey))
+		assert.NoError(t, phy.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, nwkSKey))
+		return overTheAir(t, phy)
+	}
+
+	// macDown carries MAC commands in the FRMPayload of FPort 0
+	macDown := func(t *testing.T, cmds ...lorawan.MACCommand) lorawan.PHYPayload {
+		var b []byte
+		for _, cmd := range cmds {
+			cmdBytes, err := cmd.MarshalBinary()
+			assert.NoError(t, err)
+			b = append(b, cmdBytes...)
+		}
+		fCntDn++
+		fPort := uint8(0)
+		phy := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{
+				FHDR:       lorawan.FHDR{DevAddr: devAddr, FCnt: fCntDn},
+				FPort:      &fPort,
+				FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: b}},
+			},
+		}
+		assert.NoError(t, phy.EncryptFRMPayload(nwkSKey))
+		assert.NoError(t, phy.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, nwkSKey))
+		return overTheAir(t, phy)
+	}
+
+	t.Run("announces the ping slots and requests the GPS time", func(t *testing.T) {
+		device, uplinkCh := newClassB(t, 5)
+
+		_, macPL := uplinkMAC(t, device, uplinkCh)
+		assert.False(t, macPL.FHDR.FCtrl.ClassB)
+		assert.Len(t, macPL.FHDR.FOpts, 2)
+		assert.Equal(t, &lorawan.MACCommand{CID: lorawan.PingSlotInfoReq, Payload: &lorawan.PingSlotInfoReqPayload{Periodicity: 5}}, macPL.FHDR.FOpts[0])
+		assert.Equal(t, &lorawan.MACCommand{CID: lorawan.DeviceTimeReq}, macPL.FHDR.FOpts[1])
+
+		// Sent once
+		_, macPL = uplinkMAC(t, device, uplinkCh)
+		assert.Empty(t, macPL.FHDR.FOpts)
+
+		info := device.GetInfo()
+		assert.Equal(t, ClassB, info.Class)
+		assert.NotNil(t, info.ClassB)
+		assert.Equal(t, 5, info.ClassB.PingSlotPeriodicity)
+		assert.Equal(t, 3, info.ClassB.PingSlotDataRate)
+		assert.False(t, info.ClassB.BeaconLocked)
+	})
+
+	t.Run("locks on beacons and receives downlinks in the ping slots", func(t *testing.T) {
+		device, uplinkCh := newClassB(t, 3)
+		uplinkMAC(t, device, uplinkCh)
+
+		const beaconTime = 1476229120
+		beaconStart := time.Now()
+		assert.NoError(t, device.Receive(beacon(t, beaconTime, beaconStart)))
+
+		info := device.GetInfo()
+		assert.True(t, info.ClassB.BeaconLocked)
+		assert.True(t, beaconStart.Equal(*info.ClassB.LastBeacon))
+
+		// Uplinks announce the class B mode
+		_, macPL := uplinkMAC(t, device, uplinkCh)
+		assert.True(t, macPL.FHDR.FCtrl.ClassB)
+
+		pingSlots := classb.PingSlots(beaconStart, beaconTime, devAddr, 3)
+		assert.NoError(t, device.Receive(radio.Downlink{PHYPayload: dataDown(t), Region: region.EU868, Frequency: 869525000, DataRate: 3, Time: pingSlots[1]}))
+
+		// Ping slots of the next beacon periods are extrapolated
+		next := beaconStart.Add(classb.BeaconPeriod)
+		pingSlots = classb.PingSlots(next, beaconTime+128, devAddr, 3)
+		assert.NoError(t, device.Receive(radio.Downlink{PHYPayload: dataDown(t), Region: region.EU868, Frequency: 869525000, DataRate: 3, Time: pingSlots[0].Add(5 * time.Millisecond)}))
+		assert.Equal(t, 2, device.GetInfo().ClassB.Downlinks)
+
+		// Missed between the ping slots and on other parameters
+		downlinks := []radio.Downlink{
+			{Region: region.EU868, Frequency: 869525000, DataRate: 3, Time: pingSlots[0].Add(classb.SlotLength)},
+			{Region: region.EU868, Frequency: 869525000, DataRate: 3, Time: pingSlots[0].Add(-classb.SlotLength)},
+			{Region: region.EU868, Frequency: 869525000, DataRate: 0, Time: pingSlots[0]},
+			{Region: region.EU868, Frequency: 868100000, DataRate: 3, Time: pingSlots[0]},
+		}
+		for _, downlink := range downlinks {
+			downlink.PHYPayload = dataDown(t)
+			err := device.Receive(downlink)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "missed RX window")
+		}
+		assert.Equal(t, 2, device.GetInfo().ClassB.Downlinks)
+
+		// Ping slots stop after the beaconless operation
+		late := beaconStart.Add(beaconlessOperation + classb.BeaconPeriod)
+		periods := uint32((beaconlessOperation/classb.BeaconPeriod + 1) * 128)
+		pingSlots = classb.PingSlots(late.Add(-late.Sub(beaconStart)%classb.BeaconPeriod), beaconTime+periods, devAddr, 3)
+		assert.Error(t, device.Receive(radio.Downlink{PHYPayload: dataDown(t), Region: region.EU868, Frequency: 869525000, DataRate: 3, Time: pingSlots[0]}))
+	})
+
+	t.Run("rejects beacons on other parameters", func(t *testing.T) {
+		device, _ := newClassB(t, 7)
+
+		downlink := beacon(t, 1476229120, time.Now())
+		downlink.Frequency = 868100000
+		assert.Error(t, device.Receive(downlink))
+
+		downlink = beacon(t, 1476229120, time.Now())
+		downlink.Beacon[3] ^= 0x01
+		assert.EqualError(t, device.Receive(downlink), "invalid beacon time CRC")
+
+		assert.False(t, device.GetInfo().ClassB.BeaconLocked)
+	})
+
+	t.Run("ignores beacons when not class B", func(t *testing.T) {
+		device := New(nil, devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, devAddr, appSKey, nwkSKey, 0, 0)
+		assert.NoError(t, device.Receive(beacon(t, 1476229120, time.Now())))
+		assert.Nil(t, device.GetInfo().ClassB)
+	})
+
+	t.Run("handles the class B MAC commands", func(t *testing.T) {
+		device, uplinkCh := newClassB(t, 7)
+		uplink, _ := uplinkMAC(t, device, uplinkCh)
+
+		// The network server is 1 second ahead
+		networkTime := gps.Time(uplink.Time).TimeSinceGPSEpoch() + time.Second
+		assert.NoError(t, device.Downlink(dataDown(t,
+			&lorawan.MACCommand{CID: lorawan.DeviceTimeAns, Payload: &lorawan.DeviceTimeAnsPayload{TimeSinceGPSEpoch: networkTime}},
+			&lorawan.MACCommand{CID: lorawan.PingSlotInfoAns},
+			&lorawan.MACCommand{CID: lorawan.PingSlotChannelReq, Payload: &lorawan.PingSlotChannelReqPayload{Frequency: 869100000, DR: 5}},
+		)))
+		assert.NoError(t, device.Downlink(macDown(t,
+			lorawan.MACCommand{CID: lorawan.BeaconFreqReq, Payload: &lorawan.BeaconFreqReqPayload{Frequency: 869300000}},
+		)))
+
+		info := device.GetInfo()
+		assert.True(t, info.ClassB.TimeSynced)
+		assert.True(t, info.ClassB.PingSlotInfoAnswered)
+		assert.Equal(t, uint32(869100000), info.ClassB.PingSlotFrequency)
+		assert.Equal(t, 5, info.ClassB.PingSlotDataRate)
+		assert.Equal(t, uint32(869300000), info.ClassB.BeaconFrequency)
+
+		// Answered on the next uplink
+		_, macPL := uplinkMAC(t, device, uplinkCh)
+		assert.Equal(t, []lorawan.Payload{
+			&lorawan.MACCommand{CID: lorawan.PingSlotChannelAns, Payload: &lorawan.PingSlotChannelAnsPayload{DataRateOK: true, ChannelFrequencyOK: true}},
+			&lorawan.MACCommand{CID: lorawan.BeaconFreqAns, Payload: &lorawan.BeaconFreqAnsPayload{BeaconFrequencyOK: true}},
+		}, macPL.FHDR.FOpts)
+
+		// The beacon is searched at the start of the beacon periods of the
+		// network GPS time
+		beaconTime, elapsed := classb.BeaconTime(gps.Time(time.Now()).TimeSinceGPSEpoch() + time.Second)
+		aligned := beacon(t, beaconTime, time.Now().Add(-elapsed))
+		aligned.Frequency = 869300000
+		misaligned := aligned
+		misaligned.Time = aligned.Time.Add(-time.Second)
+
+		assert.Error(t, device.Receive(misaligned))
+		assert.NoError(t, device.Receive(aligned))
+		assert.True(t, device.GetInfo().ClassB.BeaconLocked)
+	})
+
+	t.Run("validates the ping slot periodicity", func(t *testing.T) {
+		device, _ := newClassB(t, 0)
+		assert.Error(t, device.SetPingSlotPeriodicity(8))
+		assert.Error(t, device.SetPingSlotPeriodicity(-1))
+		assert.Equal(t, 0, device.GetInfo().ClassB.PingSlotPeriodicity)
+	})
+}
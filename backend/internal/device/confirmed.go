@@ -0,0 +1,110 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxConfirmedUplinks is the number of confirmed uplinks reported by a device
+const maxConfirmedUplinks = 16
+
+// AckStatus is the acknowledgement status of a confirmed uplink
+type AckStatus string
+
+const (
+	// AckPending waits for the ACK in the RX windows of the transmissions
+	AckPending AckStatus = "pending"
+	// AckReceived is set by a downlink with the ACK bit
+	AckReceived AckStatus = "acked"
+	// AckMissing is set when the transmissions are exhausted, or another
+	// uplink is sent, without ACK
+	AckMissing AckStatus = "unacknowledged"
+)
+
+// ConfirmedUplink is a confirmed uplink and its acknowledgement
+type ConfirmedUplink struct {
+	FCnt          uint32     `json:"fcnt"`
+	Time          time.Time  `json:"time"`          // of the first transmission
+	Transmissions int        `json:"transmissions"` // with the same FCnt
+	Status        AckStatus  `json:"status"`
+	AckTime       *time.Time `json:"ackTime,omitempty"`
+}
+
+// SetConfirmedTransmissions sets the maximum transmissions (1-15) of a
+// confirmed uplink without ACK, 0 uses the NbTrans of the network server
+func (d *Device) SetConfirmedTransmissions(transmissions int) error {
+	if transmissions < 0 || transmissions > 15 {
+		return errors.New("confirmed transmissions must be between 0 and 15")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.confirmedTransmissions = transmissions
+	return nil
+}
+
+// transmissions returns how many times an uplink is transmitted at most.
+// Must be called with the lock held.
+func (d *Device) transmissions(confirmed bool) int {
+	if confirmed && d.confirmedTransmissions > 0 {
+		return d.confirmedTransmissions
+	}
+	return d.nbTrans
+}
+
+// trackConfirmedUplink records a confirmed uplink waiting for its ACK,
+// forgetting the oldest ones.
+// Must be called with the lock held.
+func (d *Device) trackConfirmedUplink(fCnt uint32, uplinkTime time.Time) *ConfirmedUplink {
+	c := &ConfirmedUplink{FCnt: fCnt, Time: uplinkTime, Transmissions: 1, Status: AckPending}
+	d.confirmedUplinks = append(d.confirmedUplinks, c)
+	if len(d.confirmedUplinks) > maxConfirmedUplinks {
+		d.confirmedUplinks = d.confirmedUplinks[len(d.confirmedUplinks)-maxConfirmedUplinks:]
+	}
+	return c
+}
+
+// acknowledge marks the pending confirmed uplink as acknowledged by a
+// downlink with the ACK bit. Unconfirmed uplinks stop being repeated on any
+// downlink, confirmed ones only on the ACK.
+// Must be called with the lock held.
+func (d *Device) acknowledge(ack bool) {
+	r := d.retransmission
+	if r == nil {
+		return
+	}
+	if r.confirmed == nil {
+		d.cancelRetransmission()
+		return
+	}
+	if !ack {
+		return
+	}
+
+	now := time.Now()
+	r.confirmed.Status = AckReceived
+	r.confirmed.AckTime = &now
+	d.cancelRetransmission()
+}
+
+// missAck marks a confirmed uplink as not acknowledged.
+// Must be called with the lock held.
+func (d *Device) missAck(c *ConfirmedUplink) {
+	if c.Status != AckPending {
+		return
+	}
+	c.Status = AckMissing
+	d.emit(EventUplinkUnacknowledged, fmt.Sprintf("confirmed uplink FCnt %d not acknowledged after %d transmissions", c.FCnt, c.Transmissions))
+}
+
+// confirmedUplinkInfo returns the last confirmed uplinks.
+// Must be called with the lock held.
+func (d *Device) confirmedUplinkInfo() []ConfirmedUplink {
+	var uplinks []ConfirmedUplink
+	for _, c := range d.confirmedUplinks {
+		uplinks = append(uplinks, *c)
+	}
+	return uplinks
+}
@@ -0,0 +1,121 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDevice_ConfirmedUplink(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	nwkSKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+
+	retransmission := retransmissionDelay
+	retransmissionDelay = 10 * time.Millisecond
+	t.Cleanup(func() { retransmissionDelay = retransmission })
+
+	newDevice := func() (*Device, chan radio.Uplink) {
+		uplinkCh := make(chan radio.Uplink, 10)
+		device := New(uplinkCh, devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, devAddr, lorawan.AES128Key{}, nwkSKey, 0, 0)
+		device.mu.Lock()
+		device.rx1Delay = 0 // RX2 after one second
+		device.mu.Unlock()
+		return device, uplinkCh
+	}
+
+	receive := func(t *testing.T, uplinkCh chan radio.Uplink, timeout time.Duration) lorawan.FHDR {
+		select {
+		case uplink := <-uplinkCh:
+			return uplink.PHYPayload.MACPayload.(*lorawan.MACPayload).FHDR
+		case <-time.After(timeout):
+			t.Fatal("uplink not broadcast")
+			return lorawan.FHDR{}
+		}
+	}
+
+	downlink := func(t *testing.T, device *Device, fCnt uint32, ack bool) {
+		phy := lorawan.PHYPayload{
+			MHDR:       lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{FHDR: lorawan.FHDR{DevAddr: devAddr, FCnt: fCnt, FCtrl: lorawan.FCtrl{ACK: ack}}},
+		}
+		assert.NoError(t, phy.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, nwkSKey))
+		assert.NoError(t, device.Downlink(phy))
+	}
+
+	t.Run("marks the uplink acknowledged on ACK", func(t *testing.T) {
+		device, uplinkCh := newDevice()
+
+		_, err := device.Uplink(1, []byte{0x01}, true)
+		assert.NoError(t, err)
+		receive(t, uplinkCh, time.Second)
+		uplinks := device.GetInfo().ConfirmedUplinks
+		if assert.Len(t, uplinks, 1) {
+			assert.Equal(t, AckPending, uplinks[0].Status)
+		}
+
+		downlink(t, device, 0, true)
+
+		uplinks = device.GetInfo().ConfirmedUplinks
+		if assert.Len(t, uplinks, 1) {
+			assert.Equal(t, uint32(0), uplinks[0].FCnt)
+			assert.Equal(t, AckReceived, uplinks[0].Status)
+			assert.Equal(t, 1, uplinks[0].Transmissions)
+			assert.NotNil(t, uplinks[0].AckTime)
+		}
+	})
+
+	t.Run("retransmits with the same FCnt until the ACK", func(t *testing.T) {
+		device, uplinkCh := newDevice()
+		assert.NoError(t, device.SetConfirmedTransmissions(2))
+
+		_, err := device.Uplink(1, []byte{0x01}, true)
+		assert.NoError(t, err)
+		first := receive(t, uplinkCh, time.Second)
+
+		// A downlink without ACK does not stop the retransmissions
+		downlink(t, device, 0, false)
+		assert.Equal(t, first.FCnt, receive(t, uplinkCh, 2*time.Second).FCnt)
+
+		assert.Eventually(t, func() bool {
+			uplinks := device.GetInfo().ConfirmedUplinks
+			return len(uplinks) == 1 && uplinks[0].Status == AckMissing
+		}, 2*time.Second, 10*time.Millisecond)
+
+		info := device.GetInfo()
+		assert.Equal(t, 2, info.ConfirmedUplinks[0].Transmissions)
+		if assert.NotNil(t, info.LastEvent) {
+			assert.Equal(t, EventUplinkUnacknowledged, info.LastEvent.Type)
+		}
+		select {
+		case <-uplinkCh:
+			t.Fatal("uplink transmitted more than twice")
+		default:
+		}
+	})
+
+	t.Run("gives up the ACK on the next uplink", func(t *testing.T) {
+		device, uplinkCh := newDevice()
+
+		_, err := device.Uplink(1, []byte{0x01}, true)
+		assert.NoError(t, err)
+		_, err = device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		receive(t, uplinkCh, time.Second)
+		receive(t, uplinkCh, time.Second)
+
+		uplinks := device.GetInfo().ConfirmedUplinks
+		if assert.Len(t, uplinks, 1) {
+			assert.Equal(t, AckMissing, uplinks[0].Status)
+		}
+	})
+
+	t.Run("rejects invalid confirmed transmissions", func(t *testing.T) {
+		device, _ := newDevice()
+		assert.Error(t, device.SetConfirmedTransmissions(16))
+		assert.Error(t, device.SetConfirmedTransmissions(-1))
+	})
+}
@@ -4,12 +4,24 @@ import (
 	"crypto/aes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
+	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
 )
 
+// MaxFPort is the highest FPort a device may use (224 is the LoRaWAN test port)
+const MaxFPort = 224
+
+// rxWindowTolerance is the maximum offset between the start of a downlink
+// and the opening of the RX window receiving it
+var rxWindowTolerance = 20 * time.Millisecond
+
 type Location struct {
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
@@ -26,11 +38,87 @@ type Device struct {
 	NwkSKey lorawan.AES128Key
 
 	FCntUp uint32
-	FCntDn uint32
+	FCntDn uint32 // next FCnt expected, NFCntDown in 1.1
+
+	// LoRaWAN 1.1
+	macVersion      MACVersion
+	keys11          LoRaWAN11Keys
+	session11       bool   // false after joining a 1.0 network server
+	rekeyPending    bool   // RekeyInd sent until RekeyConf is received
+	confirmedFCntUp uint32 // of the last confirmed uplink, in the MIC of its ACK
+	aFCntDn         uint32 // next AFCntDown expected
+	netID           lorawan.NetID
+	rjCount0        uint16 // Rejoin-requests type 0 and 2 of the session
+	rjCount1        uint16 // Rejoin-requests type 1
+	rejoin          *rejoinRequest
+
+	region   *region.Region
+	subBand  int
+	channels []region.Channel // uplink channel plan, unset channels have no frequency
+	chMask   []bool           // enabled uplink channels
+	dataRate int
+	txPower  float64 // dBm EIRP
+	maxEIRP  float64 // dBm, lowered by TxParamSetupReq
+	nbTrans  int     // transmissions of each unconfirmed uplink
+
+	// ADR
+	adr            bool
+	adrAckCnt      int             // uplinks since the last downlink
+	retransmission *retransmission // repetitions of the last uplink
+
+	// Confirmed uplinks
+	confirmedTransmissions int // 0 uses nbTrans
+	confirmedUplinks       []*ConfirmedUplink
+
+	// Confirmed downlinks
+	ackPending   bool   // ACK of a confirmed downlink for the next uplink
+	ackFCntDn    uint32 // FCnt of the confirmed downlink, signed in 1.1
+	autoAck      bool
+	autoAckDelay time.Duration // before an empty uplink carries the ACK
+
+	// RX window parameters
+	rx1DROffset  int
+	rx1Delay     time.Duration
+	rx2Frequency uint32
+	rx2DataRate  int
+	rxWindows    []rxWindow // opened by the last uplink
+
+	class           Class
+	classCDownlinks int // received outside the RX1 and RX2 windows
 
+	// Class B ping slots and beacons
+	pingSlotPeriodicity  int
+	pingSlotFrequency    uint32 // 0 hops on the channels of the region
+	pingSlotDataRate     int
+	beaconFrequency      uint32    // 0 hops on the channels of the region
+	lastBeacon           time.Time // start of the last beacon received
+	lastBeaconTime       uint32    // GPS time of the last beacon received
+	gpsOffset            time.Duration
+	timeSynced           bool
+	deviceTimeReq        time.Time // end of the uplink carrying DeviceTimeReq
+	pingSlotInfoAnswered bool
+	classBDownlinks      int
+
+	// MAC commands
+	macCommands       []lorawan.MACCommand // queued for the next uplinks
+	stickyMACCommands []lorawan.MACCommand // answers repeated until a downlink is received
+	maxDutyCycle      uint8                // aggregated duty cycle of 1/2^maxDutyCycle
+	dutyCycleUntil    time.Time            // end of the off period of the last uplink
+	dlFrequencies     map[int]uint32       // RX1 frequencies set by DlChannelReq, by uplink channel
+	uplinkDwellTime   bool                 // 400 ms maximum uplink airtime
+	downlinkDwellTime bool
+	battery           uint8     // DevStatusAns battery level
+	downlinkSNR       float64   // of the last downlink received, DevStatusAns margin
+	linkCheckReq      time.Time // uplink carrying LinkCheckReq
+	linkCheck         LinkCheckInfo
+	deviceTime        DeviceTimeInfo
+
+	lastEvent       *Event
+	events          []Event // history, oldest first
+	onEvent         func(Event)
 	location        *Location
 	mu              sync.RWMutex
-	broadcastUplink chan<- lorawan.PHYPayload
+	broadcastUplink chan<- radio.Uplink
 }
 
 type DeviceInfo struct {
@@ -46,9 +134,58 @@ type DeviceInfo struct {
 	FCntUp   uint32    `json:"fcntup"`
 	FCntDn   uint32    `json:"fcntdn"`
 	Location *Location `json:"location,omitempty"`
+
+	MACVersion   MACVersion     `json:"macVersion"`
+	LoRaWAN11    *LoRaWAN11Keys `json:"lorawan11,omitempty"`
+	RekeyPending bool           `json:"rekeyPending,omitempty"`
+	AFCntDn      uint32         `json:"afcntdn,omitempty"`
+	RJCount0     uint16         `json:"rjCount0,omitempty"`
+	RJCount1     uint16         `json:"rjCount1,omitempty"`
+
+	Region   region.Name `json:"region"`
+	SubBand  int         `json:"subBand,omitempty"`
+	DataRate int         `json:"dataRate"`
+	TxPower  float64     `json:"txPower"`
+
+	Channels  []ChannelInfo `json:"channels"`
+	MaxEIRP   float64       `json:"maxEIRP"`
+	NbTrans   int           `json:"nbTrans"`
+	ADR       bool          `json:"adr"`
+	ADRAckCnt int           `json:"adrAckCnt,omitempty"`
+
+	ConfirmedTransmissions int               `json:"confirmedTransmissions,omitempty"`
+	ConfirmedUplinks       []ConfirmedUplink `json:"confirmedUplinks,omitempty"`
+	AckPending             bool              `json:"ackPending,omitempty"`
+	AutoAck                *float64          `json:"autoAck,omitempty"` // s
+	MaxDutyCycle           uint8             `json:"maxDutyCycle,omitempty"`
+	UplinkDwellTime        bool              `json:"uplinkDwellTime,omitempty"`
+	DownlinkDwellTime      bool              `json:"downlinkDwellTime,omitempty"`
+	Battery                uint8             `json:"battery"`
+
+	LinkCheck  *LinkCheckInfo  `json:"linkCheck,omitempty"`
+	DeviceTime *DeviceTimeInfo `json:"deviceTime,omitempty"`
+
+	RX1DROffset  int    `json:"rx1DROffset"`
+	RX1Delay     int    `json:"rx1Delay"` // s
+	RX2Frequency uint32 `json:"rx2Frequency"`
+	RX2DataRate  int    `json:"rx2DataRate"`
+
+	Class           Class       `json:"class"`
+	ClassB          *ClassBInfo `json:"classB,omitempty"`
+	ClassCDownlinks int         `json:"classCDownlinks,omitempty"`
+
+	LastEvent *Event `json:"lastEvent,omitempty"`
+}
+
+// rxWindow is a receive slot opened by an uplink
+type rxWindow struct {
+	name      string // RX1 or RX2
+	time      time.Time
+	frequency uint32
+	dataRate  int
 }
 
-func New(broadcastUplink chan<- lorawan.PHYPayload,
+func New(broadcastUplink chan<- radio.Uplink,
 	DevEUI lorawan.EUI64,
 	JoinEUI lorawan.EUI64,
 	AppKey lorawan.AES128Key,
@@ -59,7 +196,7 @@ func New(broadcastUplink chan<- lorawan.PHYPayload,
 	FCntUp uint32,
 	FCntDn uint32,
 ) *Device {
-	return &Device{
+	d := &Device{
 		broadcastUplink: broadcastUplink,
 		DevEUI:          DevEUI,
 		JoinEUI:         JoinEUI,
@@ -71,10 +208,16 @@ func New(broadcastUplink chan<- lorawan.PHYPayload,
 		FCntUp:          FCntUp,
 		FCntDn:          FCntDn,
 		location:        nil,
+		class:           ClassA,
+		macVersion:      MACVersion1_0,
+		battery:         BatteryUnknown,
 	}
+	d.setDefaultRegion()
+
+	return d
 }
 
-func NewWithLocation(broadcastUplink chan<- lorawan.PHYPayload,
+func NewWithLocation(broadcastUplink chan<- radio.Uplink,
 	DevEUI lorawan.EUI64,
 	JoinEUI lorawan.EUI64,
 	AppKey lorawan.AES128Key,
@@ -86,7 +229,7 @@ func NewWithLocation(broadcastUplink chan<- lorawan.PHYPayload,
 	FCntDn uint32,
 	location *Location,
 ) *Device {
-	return &Device{
+	d := &Device{
 		broadcastUplink: broadcastUplink,
 		DevEUI:          DevEUI,
 		JoinEUI:         JoinEUI,
@@ -98,7 +241,13 @@ func NewWithLocation(broadcastUplink chan<- lorawan.PHYPayload,
 		FCntUp:          FCntUp,
 		FCntDn:          FCntDn,
 		location:        location,
+		class:           ClassA,
+		macVersion:      MACVersion1_0,
+		battery:         BatteryUnknown,
 	}
+	d.setDefaultRegion()
+
+	return d
 }
 
 func (d *Device) GetInfo() DeviceInfo {
@@ -116,10 +265,250 @@ func (d *Device) GetInfo() DeviceInfo {
 		FCntUp:   d.FCntUp,
 		FCntDn:   d.FCntDn,
 		Location: d.location,
+
+		MACVersion:   d.macVersion,
+		LoRaWAN11:    d.lorawan11Keys(),
+		RekeyPending: d.rekeyPending,
+		AFCntDn:      d.aFCntDn,
+		RJCount0:     d.rjCount0,
+		RJCount1:     d.rjCount1,
+
+		Region:   d.region.Name(),
+		SubBand:  d.subBand,
+		DataRate: d.dataRate,
+		TxPower:  d.txPower,
+
+		Channels:  d.channelInfo(),
+		MaxEIRP:   d.maxEIRP,
+		NbTrans:   d.nbTrans,
+		ADR:       d.adr,
+		ADRAckCnt: d.adrAckCnt,
+
+		ConfirmedTransmissions: d.confirmedTransmissions,
+		ConfirmedUplinks:       d.confirmedUplinkInfo(),
+		AckPending:             d.ackPending,
+		AutoAck:                d.autoAckInfo(),
+		MaxDutyCycle:           d.maxDutyCycle,
+		UplinkDwellTime:        d.uplinkDwellTime,
+		DownlinkDwellTime:      d.downlinkDwellTime,
+		Battery:                d.battery,
+
+		LinkCheck:  d.linkCheckInfo(),
+		DeviceTime: d.deviceTimeInfo(),
+
+		RX1DROffset:  d.rx1DROffset,
+		RX1Delay:     int(d.rx1Delay / time.Second),
+		RX2Frequency: d.rx2Frequency,
+		RX2DataRate:  d.rx2DataRate,
+
+		Class:           d.class,
+		ClassB:          d.classBInfo(),
+		ClassCDownlinks: d.classCDownlinks,
+
+		LastEvent: d.lastEvent,
+	}
+}
+
+func (d *Device) setDefaultRegion() {
+	r, err := region.Get(region.Default)
+	if err != nil {
+		panic(err)
 	}
+	d.SetRegion(r, 0)
+}
+
+// SetRegion sets the region of the device, enabling its default channels
+// (of the given sub-band, if the region has any), data rate, maximum TX
+// power and RX windows
+func (d *Device) SetRegion(r *region.Region, subBand int) error {
+	if _, err := r.ChannelMask(subBand); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.region = r
+	d.subBand = subBand
+	if r.SubBands() > 0 && subBand == 0 {
+		d.subBand = region.DefaultSubBand
+	}
+	d.dataRate = r.DefaultDataRate()
+	d.txPower = r.MaxEIRP()
+	d.resetMACParameters()
+	d.rx1DROffset = 0
+	d.rx1Delay = r.ReceiveDelay()
+	d.rx2Frequency, d.rx2DataRate = r.RX2()
+	d.rxWindows = nil
+	d.pingSlotFrequency = 0
+	d.pingSlotDataRate = r.BeaconDataRate()
+	d.beaconFrequency = 0
+	d.lastBeacon = time.Time{}
+
+	return nil
+}
+
+// SetDataRate sets the uplink data rate, which must be supported by at least
+// one of the enabled channels
+func (d *Device) SetDataRate(dr int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.supportsDataRate(d.chMask, dr) {
+		return fmt.Errorf("data rate %d not supported by the device channels", dr)
+	}
+	d.dataRate = dr
+
+	return nil
+}
+
+// SetTxPower sets the uplink TX power (dBm EIRP), up to the maximum of the
+// region or the one set by TxParamSetupReq
+func (d *Device) SetTxPower(txPower float64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if txPower > d.maxEIRP {
+		return fmt.Errorf("tx power above the maximum of %g dBm", d.maxEIRP)
+	}
+	d.txPower = txPower
+
+	return nil
+}
+
+// SetClass sets the class of the device. Switching to class B queues a
+// PingSlotInfoReq and a DeviceTimeReq for the next uplink.
+func (d *Device) SetClass(class Class) error {
+	class, err := ParseClass(string(class))
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if class == ClassB && d.class != ClassB {
+		d.switchToClassB()
+	}
+	d.class = class
+
+	return nil
+}
+
+// Receive handles a downlink transmitted by a gateway. Frames for the device
+// are only received in its RX1 and RX2 windows, at the frequency and data
+// rate of the window. Class B devices also receive data downlinks in their
+// ping slots, class C devices on the RX2 frequency and data rate at any time.
+func (d *Device) Receive(downlink radio.Downlink) error {
+	if downlink.Beacon != nil {
+		return d.receiveBeacon(downlink)
+	}
+
+	frame := downlink.PHYPayload
+
+	switch frame.MHDR.MType {
+	case lorawan.JoinAccept:
+		if err := d.decryptJoinAccept(&frame); err != nil {
+			return err
+		}
+		if err := d.receiveWindow(downlink, false); err != nil {
+			return err
+		}
+		return d.applyJoinAccept(frame)
+	case lorawan.UnconfirmedDataDown, lorawan.ConfirmedDataDown:
+		if err := d.validateDownlink(frame); err != nil {
+			return err
+		}
+		if err := d.receiveWindow(downlink, true); err != nil {
+			return err
+		}
+		return d.handleDownlink(frame)
+	default:
+		return errors.New("unsupported downlink message type")
+	}
+}
+
+// receiveWindow closes the RX window receiving the downlink, continuous is
+// true when a class B or C device may receive it outside the RX1 and RX2
+// windows.
+// A downlink for the device transmitted while it is not listening raises an
+// EventMissedRXWindow.
+func (d *Device) receiveWindow(downlink radio.Downlink, continuous bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, w := range d.rxWindows {
+		offset := downlink.Time.Sub(w.time)
+		if offset < 0 {
+			offset = -offset
+		}
+
+		if downlink.Region == d.region.Name() && downlink.Frequency == w.frequency && downlink.DataRate == w.dataRate && offset <= rxWindowTolerance {
+			// No other window is opened after a reception
+			d.rxWindows = nil
+			d.downlinkSNR = downlink.ReceivedSignal().SNR
+			log.Printf("[%s] downlink received in %s", d.DevEUI, w.name)
+			return nil
+		}
+	}
+
+	// Class B devices listen in their ping slots
+	if continuous && d.receivePingSlot(downlink) {
+		d.classBDownlinks++
+		d.downlinkSNR = downlink.ReceivedSignal().SNR
+		log.Printf("[%s] downlink received in class B ping slot", d.DevEUI)
+		return nil
+	}
+
+	// Class C devices keep listening on the RX2 parameters
+	if continuous && d.class == ClassC && downlink.Region == d.region.Name() && downlink.Frequency == d.rx2Frequency && downlink.DataRate == d.rx2DataRate {
+		d.classCDownlinks++
+		d.downlinkSNR = downlink.ReceivedSignal().SNR
+		log.Printf("[%s] downlink received in class C RX2", d.DevEUI)
+		return nil
+	}
+
+	err := fmt.Errorf("missed RX window: downlink on %d Hz DR%d at %s", downlink.Frequency, downlink.DataRate, downlink.Time.Format(time.RFC3339Nano))
+	d.emit(EventMissedRXWindow, err.Error())
+
+	return err
+}
+
+// openRXWindows opens the RX1 and RX2 windows following an uplink. Join
+// accepts are received with the default parameters of the region.
+// Must be called with the lock held.
+func (d *Device) openRXWindows(uplink radio.Uplink, join bool) {
+	delay := d.rx1Delay
+	rx1DROffset := d.rx1DROffset
+	rx2Frequency, rx2DataRate := d.rx2Frequency, d.rx2DataRate
+	if join {
+		delay = d.region.JoinAcceptDelay()
+		rx1DROffset = 0
+		rx2Frequency, rx2DataRate = d.region.RX2()
+	}
+
+	d.rxWindows = nil
+	rx1Frequency, rx1DataRate, err := d.region.RX1(uplink.Frequency, uplink.DataRate, rx1DROffset)
+	if f, ok := d.dlFrequencies[d.channelIndex(uplink.Frequency)]; ok && !join {
+		rx1Frequency = f
+	}
+	if err == nil {
+		d.rxWindows = append(d.rxWindows, rxWindow{name: "RX1", time: uplink.Time.Add(delay), frequency: rx1Frequency, dataRate: rx1DataRate})
+	}
+	d.rxWindows = append(d.rxWindows, rxWindow{name: "RX2", time: uplink.Time.Add(delay + time.Second), frequency: rx2Frequency, dataRate: rx2DataRate})
 }
 
 func (d *Device) JoinAccept(frame lorawan.PHYPayload) error {
+	if err := d.decryptJoinAccept(&frame); err != nil {
+		return err
+	}
+
+	return d.applyJoinAccept(frame)
+}
+
+// decryptJoinAccept decrypts a join accept, failing when it is for another
+// device
+func (d *Device) decryptJoinAccept(frame *lorawan.PHYPayload) error {
 	phyBytes, err := frame.MarshalBinary()
 	if err != nil {
 		log.Printf("[%s] failed to marshal PHYPayload: %v", d.DevEUI, err)
@@ -127,13 +516,23 @@ func (d *Device) JoinAccept(frame lorawan.PHYPayload) error {
 	}
 	log.Printf("[%s] received join accept: %x", d.DevEUI, phyBytes)
 
-	err = frame.DecryptJoinAcceptPayload(d.AppKey)
+	d.mu.RLock()
+	key, jsIntKey, joinReqType, devNonce := d.joinAcceptKeys()
+	optNeg := d.macVersion == MACVersion1_1
+	d.mu.RUnlock()
+
+	err = frame.DecryptJoinAcceptPayload(key)
 	if err != nil {
 		log.Printf("[%s] decryption error %v", d.DevEUI, err)
 		return err
 	}
 
-	ok, err := frame.ValidateDownlinkJoinMIC(lorawan.JoinRequestType, d.JoinEUI, d.DevNonce-1, d.AppKey)
+	// A LoRaWAN 1.1 network server sets OptNeg and signs with the JSIntKey
+	if joinAccept, ok := frame.MACPayload.(*lorawan.JoinAcceptPayload); ok && optNeg && joinAccept.DLSettings.OptNeg {
+		key = jsIntKey
+	}
+
+	ok, err := frame.ValidateDownlinkJoinMIC(joinReqType, d.JoinEUI, devNonce, key)
 	if err != nil {
 		log.Printf("[%s] MIC error %v", d.DevEUI, err)
 		return err
@@ -142,45 +541,73 @@ func (d *Device) JoinAccept(frame lorawan.PHYPayload) error {
 		// Join Accept is for another device
 		log.Printf("[%s] invalid MIC", d.DevEUI)
 		return errors.New("invalid MIC")
-	} else {
-		// Join Accept is for this device
-		joinAccept, ok := frame.MACPayload.(*lorawan.JoinAcceptPayload)
-		if !ok {
-			log.Printf("[%s] invalid MAC payload for data downlink", d.DevEUI)
-			return errors.New("invalid MAC payload")
-		}
+	}
+
+	return nil
+}
 
-		d.mu.Lock()
-		defer d.mu.Unlock()
+// applyJoinAccept activates the device with a decrypted join accept
+func (d *Device) applyJoinAccept(frame lorawan.PHYPayload) error {
+	joinAccept, ok := frame.MACPayload.(*lorawan.JoinAcceptPayload)
+	if !ok {
+		log.Printf("[%s] invalid MAC payload for data downlink", d.DevEUI)
+		return errors.New("invalid MAC payload")
+	}
 
-		// DevAddr
-		d.DevAddr = joinAccept.DevAddr
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-		// Derive NwkSKey
-		d.NwkSKey, err = deriveSessionKey(0x01, d.AppKey, joinAccept.JoinNonce, joinAccept.HomeNetID, d.DevNonce-1)
-		if err != nil {
-			log.Printf("[%s] failed to derive NwkSKey: %v", d.DevEUI, err)
-			return err
-		}
+	var err error
 
-		// Derive AppSKey
-		d.AppSKey, err = deriveSessionKey(0x02, d.AppKey, joinAccept.JoinNonce, joinAccept.HomeNetID, d.DevNonce-1)
-		if err != nil {
-			log.Printf("[%s] failed to derive AppSKey: %v", d.DevEUI, err)
-			return err
-		}
+	// DevAddr
+	d.DevAddr = joinAccept.DevAddr
 
-		// Reset frame counters
-		d.FCntUp = 0
-		d.FCntDn = 0
+	// Session keys, a Rejoin-request replaces the DevNonce with its RJcount
+	if d.macVersion == MACVersion1_1 && joinAccept.DLSettings.OptNeg {
+		_, _, _, devNonce := d.joinAcceptKeys()
+		err = d.deriveSessionKeys11(joinAccept.JoinNonce, devNonce)
+	} else {
+		err = d.deriveSessionKeys(joinAccept.JoinNonce, joinAccept.HomeNetID)
+	}
+	if err != nil {
+		return err
+	}
+	d.netID = joinAccept.HomeNetID
+	d.rejoin = nil
+	d.rjCount0 = 0
+	d.resetMACParameters()
 
-		log.Printf("[%s] join successful - DevAddr: %s", d.DevEUI, d.DevAddr)
+	// Reset frame counters
+	d.FCntUp = 0
+	d.FCntDn = 0
+	d.aFCntDn = 0
 
+	// RX windows of the session
+	d.rx1DROffset = int(joinAccept.DLSettings.RX1DROffset)
+	d.rx2DataRate = int(joinAccept.DLSettings.RX2DataRate)
+	d.rx1Delay = time.Duration(joinAccept.RXDelay) * time.Second
+	if d.rx1Delay == 0 {
+		d.rx1Delay = time.Second
 	}
+
+	log.Printf("[%s] join successful - DevAddr: %s", d.DevEUI, d.DevAddr)
+	d.record(Event{Type: EventJoinAccept, Message: fmt.Sprintf("DevAddr %s", d.DevAddr)})
+
 	return nil
 }
 
 func (d *Device) Downlink(frame lorawan.PHYPayload) error {
+	if err := d.validateDownlink(frame); err != nil {
+		return err
+	}
+
+	return d.handleDownlink(frame)
+}
+
+// validateDownlink checks the MIC of a data downlink, failing when it is for
+// another device, and its frame counter. The FHDR of a valid downlink holds
+// its 32-bit FCnt.
+func (d *Device) validateDownlink(frame lorawan.PHYPayload) error {
 	phyBytes, err := frame.MarshalBinary()
 	if err != nil {
 		log.Printf("[%s] failed to marshal PHYPayload: %v", d.DevEUI, err)
@@ -188,54 +615,144 @@ func (d *Device) Downlink(frame lorawan.PHYPayload) error {
 	}
 	log.Printf("[%s] received downlink: %x", d.DevEUI, phyBytes)
 
-	ok, err := frame.ValidateDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, d.NwkSKey)
-	if err != nil {
-		log.Printf("[%s] MIC error %v", d.DevEUI, err)
-		return err
-	}
+	macPL, ok := frame.MACPayload.(*lorawan.MACPayload)
 	if !ok {
-		log.Printf("[%s] invalid MIC", d.DevEUI)
-		return errors.New("invalid MIC")
-	} else {
-		if err := frame.DecodeFOptsToMACCommands(); err != nil {
-			log.Printf("[%s] MAC Commands decoding error %v", d.DevEUI, err)
+		log.Printf("[%s] MACPayload expected", d.DevEUI)
+		return errors.New("MACPayload expected")
+	}
+
+	// In 1.1 the ACK of a confirmed uplink signs its FCnt
+	d.mu.RLock()
+	macVersion := d.lorawanVersion()
+	key := d.sNwkSIntKey()
+	var confFCnt uint32
+	if macPL.FHDR.FCtrl.ACK {
+		confFCnt = d.confirmedFCntUp
+	}
+	candidates := fCntCandidates(*d.fCntDn(macPL), uint16(macPL.FHDR.FCnt))
+	d.mu.RUnlock()
+
+	// The MIC signs the 32-bit FCnt, of which the FHDR only carries the 16
+	// least-significant bits
+	valid := false
+	for _, fCnt := range candidates {
+		macPL.FHDR.FCnt = fCnt
+		ok, err := frame.ValidateDownlinkDataMIC(macVersion, confFCnt, key)
+		if err != nil {
+			log.Printf("[%s] MIC error %v", d.DevEUI, err)
 			return err
 		}
+		if ok {
+			valid = true
+			break
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-		if err := frame.DecryptFRMPayload(d.AppSKey); err != nil {
-			log.Printf("[%s] FRMPaylod decription error %v", d.DevEUI, err)
-			return err
+	if !valid {
+		d.emit(EventInvalidMIC, fmt.Sprintf("data downlink FCnt %d", uint16(macPL.FHDR.FCnt)))
+		return errors.New("invalid MIC")
+	}
+
+	return d.checkFCntDn(macPL)
+}
+
+// handleDownlink decrypts and processes a validated data downlink
+func (d *Device) handleDownlink(frame lorawan.PHYPayload) error {
+	d.mu.RLock()
+	session11 := d.session11
+	nwkSEncKey := d.nwkSEncKey()
+	d.mu.RUnlock()
+
+	// FOpts are encrypted with the NwkSEncKey in 1.1
+	decodeFOpts := frame.DecodeFOptsToMACCommands
+	if session11 {
+		decodeFOpts = func() error { return frame.DecryptFOpts(nwkSEncKey) }
+	}
+	if err := decodeFOpts(); err != nil {
+		log.Printf("[%s] MAC Commands decoding error %v", d.DevEUI, err)
+		return err
+	}
+
+	macPL, ok := frame.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		log.Printf("[%s] MACPayload expected", d.DevEUI)
+		return errors.New("MACPayload expected")
+	}
+
+	// FPort 0 carries MAC commands encrypted with the NwkSKey (NwkSEncKey)
+	macOnly := macPL.FPort != nil && *macPL.FPort == 0
+	d.mu.RLock()
+	key := d.AppSKey
+	if macOnly {
+		key = nwkSEncKey
+	}
+	d.mu.RUnlock()
+
+	if err := frame.DecryptFRMPayload(key); err != nil {
+		log.Printf("[%s] FRMPaylod decription error %v", d.DevEUI, err)
+		return err
+	}
+
+	// Decrypting FPort 0 decodes its MAC commands
+	macCommands := macPL.FHDR.FOpts
+	if macOnly {
+		macCommands = append(macCommands, macPL.FRMPayload...)
+	}
+	// Receiving a downlink stops the repeated answers and transmissions and
+	// restarts the ADR backoff
+	d.mu.Lock()
+	if err := d.checkFCntDn(macPL); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	*d.fCntDn(macPL) = macPL.FHDR.FCnt + 1
+	d.stickyMACCommands = nil
+	d.adrAckCnt = 0
+	d.acknowledge(macPL.FHDR.FCtrl.ACK)
+	if frame.MHDR.MType == lorawan.ConfirmedDataDown {
+		d.receiveConfirmedDownlink(macPL.FHDR.FCnt)
+	}
+	d.handleMACCommands(macCommands)
+	var payload []byte
+	if len(macPL.FRMPayload) > 0 && !macOnly {
+		if pl, ok := macPL.FRMPayload[0].(*lorawan.DataPayload); ok {
+			payload = pl.Bytes
 		}
+	}
+	d.record(frameEvent(EventDownlink, fmt.Sprintf("FCnt %d", macPL.FHDR.FCnt), frame.MHDR.MType, macPL, payload, macCommands))
+	d.mu.Unlock()
 
-		macPL, ok := frame.MACPayload.(*lorawan.MACPayload)
+	// Check if FRMPayload has content
+	if len(macPL.FRMPayload) > 0 && !macOnly {
+		pl, ok := macPL.FRMPayload[0].(*lorawan.DataPayload)
 		if !ok {
-			log.Printf("[%s] MACPayload expected", d.DevEUI)
-			return errors.New("MACPayload expected")
+			log.Printf("[%s] DataPayload expected", d.DevEUI)
+			return errors.New("DataPayload expected")
 		}
 
-		// Check if FRMPayload has content
-		if len(macPL.FRMPayload) > 0 {
-			pl, ok := macPL.FRMPayload[0].(*lorawan.DataPayload)
-			if !ok {
-				log.Printf("[%s] DataPayload expected", d.DevEUI)
-				return errors.New("DataPayload expected")
-			}
-
-			if macPL.FPort != nil {
-				log.Printf("[%s] downlink FCnt %d - FPort: %d - FRMPayload: %x", d.DevEUI, macPL.FHDR.FCnt, *macPL.FPort, pl.Bytes)
-			} else {
-				log.Printf("[%s] downlink FCnt %d - FRMPayload: %x", d.DevEUI, macPL.FHDR.FCnt, pl.Bytes)
-			}
+		if macPL.FPort != nil {
+			log.Printf("[%s] downlink FCnt %d - FPort: %d - FRMPayload: %x", d.DevEUI, macPL.FHDR.FCnt, *macPL.FPort, pl.Bytes)
 		} else {
-			// MAC-only message (no application payload)
-			log.Printf("[%s] downlink FCnt %d - MAC-only message (no FRMPayload)", d.DevEUI, macPL.FHDR.FCnt)
+			log.Printf("[%s] downlink FCnt %d - FRMPayload: %x", d.DevEUI, macPL.FHDR.FCnt, pl.Bytes)
 		}
+	} else {
+		// MAC-only message (no application payload)
+		log.Printf("[%s] downlink FCnt %d - MAC-only message (no FRMPayload)", d.DevEUI, macPL.FHDR.FCnt)
 	}
+
 	return nil
 }
 
 func (d *Device) JoinRequest() (lorawan.PHYPayload, error) {
 	d.mu.Lock()
+	uplink, err := d.nextUplink()
+	if err != nil {
+		d.mu.Unlock()
+		return lorawan.PHYPayload{}, err
+	}
+
 	phy := lorawan.PHYPayload{
 		MHDR: lorawan.MHDR{
 			MType: lorawan.JoinRequest,
@@ -248,89 +765,280 @@ func (d *Device) JoinRequest() (lorawan.PHYPayload, error) {
 		},
 	}
 
+	d.record(Event{Type: EventJoinRequest, Message: fmt.Sprintf("DevNonce %d", d.DevNonce)})
+
 	// Increment DevNonce for next Join Request
 	d.DevNonce++
+	d.rejoin = nil
 
-	// Prepare AppKey for MIC
-	appkey := d.AppKey
+	d.openRXWindows(uplink, true)
+
+	// Prepare the root key (AppKey, NwkKey in 1.1) for MIC
+	key := d.joinKey()
 
 	d.mu.Unlock()
 
-	if err := phy.SetUplinkJoinMIC(appkey); err != nil {
+	if err := phy.SetUplinkJoinMIC(key); err != nil {
 		return lorawan.PHYPayload{}, err
 	}
 
-	d.broadcast(phy)
+	uplink.PHYPayload = phy
+	d.broadcast(uplink)
 
 	return phy, nil
 }
 
-func (d *Device) Uplink() (lorawan.PHYPayload, error) {
-	fPort := uint8(1)
+// MaxPayloadSize returns the maximum payload size in bytes at the current
+// uplink data rate
+func (d *Device) MaxPayloadSize() (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.region.MaxPayloadSize(d.dataRate)
+}
+
+// Uplink sends a data uplink with the given FPort and application payload.
+// FPort 0 is reserved for MAC commands, so its payload is encrypted with the
+// NwkSKey instead of the AppSKey. An empty payload produces a frame without
+// FPort and FRMPayload.
+func (d *Device) Uplink(fPort uint8, payload []byte, confirmed bool) (lorawan.PHYPayload, error) {
+	if fPort > MaxFPort {
+		return lorawan.PHYPayload{}, fmt.Errorf("invalid FPort %d", fPort)
+	}
+
+	mType := lorawan.UnconfirmedDataUp
+	if confirmed {
+		mType = lorawan.ConfirmedDataUp
+	}
 
 	d.mu.Lock()
+	if err := d.checkFCntUp(); err != nil {
+		d.mu.Unlock()
+		return lorawan.PHYPayload{}, err
+	}
+	d.adrBackoff()
+	uplink, err := d.nextUplink()
+	if err != nil {
+		d.mu.Unlock()
+		return lorawan.PHYPayload{}, err
+	}
+	d.cancelRetransmission()
+
+	// Payload must fit the data rate
+	maxSize, err := d.region.MaxPayloadSize(uplink.DataRate)
+	if err != nil {
+		d.mu.Unlock()
+		return lorawan.PHYPayload{}, err
+	}
+	if len(payload) > maxSize {
+		d.mu.Unlock()
+		return lorawan.PHYPayload{}, fmt.Errorf("payload too large for DR%d: %d bytes, max %d", uplink.DataRate, len(payload), maxSize)
+	}
+
+	macPL := &lorawan.MACPayload{
+		FHDR: lorawan.FHDR{
+			DevAddr: d.DevAddr, // Use the actual DevAddr from the device
+			FCtrl: lorawan.FCtrl{
+				ADR:       d.adr,
+				ADRACKReq: d.adrAckReq(),
+				ACK:       d.ackPending,
+				ClassB:    d.class == ClassB && d.beaconLocked(uplink.Time),
+			},
+			FCnt: d.FCntUp,
+		},
+	}
+
+	// MAC commands are piggybacked in FOpts, except on FPort 0 which carries
+	// its own
+	if fPort != 0 || len(payload) == 0 {
+		macPL.FHDR.FOpts = d.takeMACCommands(uplink.Time)
+	}
+
+	// FPort and FRMPayload are only present when there is a payload
+	if len(payload) > 0 {
+		macPL.FPort = &fPort
+		macPL.FRMPayload = []lorawan.Payload{&lorawan.DataPayload{Bytes: append([]byte(nil), payload...)}}
+	}
+
 	phy := lorawan.PHYPayload{
 		MHDR: lorawan.MHDR{
-			MType: lorawan.ConfirmedDataUp,
+			MType: mType,
 			Major: lorawan.LoRaWANR1,
 		},
-		MACPayload: &lorawan.MACPayload{
-			FHDR: lorawan.FHDR{
-				DevAddr: d.DevAddr, // Use the actual DevAddr from the device
-				FCtrl: lorawan.FCtrl{
-					ADR:       false,
-					ADRACKReq: false,
-					ACK:       false,
-				},
-				FCnt: d.FCntUp,
-			},
-			FPort:      &fPort,
-			FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte{1, 2, 3, 4}}},
-		},
+		MACPayload: macPL,
+	}
+
+	// The ACK of a confirmed uplink signs its FCnt in 1.1
+	if confirmed {
+		d.confirmedFCntUp = d.FCntUp
 	}
 
 	// Increment FCntup
 	d.FCntUp++
+	if d.adr {
+		d.adrAckCnt++
+	}
+
+	// The ACK of a confirmed downlink signs its FCnt in 1.1
+	var confFCnt uint32
+	if macPL.FHDR.FCtrl.ACK {
+		confFCnt = d.ackFCntDn
+		d.ackPending = false
+	}
+
+	d.openRXWindows(uplink, false)
+	d.record(frameEvent(EventUplink, fmt.Sprintf("FCnt %d on %d Hz DR%d", macPL.FHDR.FCnt, uplink.Frequency, uplink.DataRate), mType, macPL, payload, macPL.FHDR.FOpts))
+
+	// MHDR, FHDR, FOpts, FPort, FRMPayload and MIC
+	size := 1 + 7 + 4
+	for _, cmd := range macPL.FHDR.FOpts {
+		b, _ := cmd.MarshalBinary()
+		size += len(b)
+	}
+	if len(payload) > 0 {
+		size += 1 + len(payload)
+	}
+	d.applyDutyCycle(uplink.Time, uplink.DataRate, size)
+
+	// The 1.1 MIC signs the channel and data rate of the uplink
+	var txCh int
+	if d.session11 {
+		txCh, err = d.region.UplinkChannelIndex(uplink.Frequency, uplink.DataRate)
+		if err != nil {
+			d.mu.Unlock()
+			return lorawan.PHYPayload{}, err
+		}
+	}
 
 	// Prepare session keys for encryption and MIC
+	macVersion := d.lorawanVersion()
+	session11 := d.session11
 	appskey := d.AppSKey
 	nwkskey := d.NwkSKey
+	sNwkSIntKey := d.sNwkSIntKey()
+	nwkSEncKey := d.nwkSEncKey()
 
 	d.mu.Unlock()
 
-	if err := phy.EncryptFRMPayload(appskey); err != nil {
-		return lorawan.PHYPayload{}, err
+	if len(payload) > 0 {
+		encKey := appskey
+		if fPort == 0 {
+			encKey = nwkSEncKey
+		}
+		if err := phy.EncryptFRMPayload(encKey); err != nil {
+			return lorawan.PHYPayload{}, err
+		}
+	}
+
+	// FOpts are encrypted with the NwkSEncKey in 1.1
+	if session11 && len(macPL.FHDR.FOpts) > 0 {
+		if err := phy.EncryptFOpts(nwkSEncKey); err != nil {
+			return lorawan.PHYPayload{}, err
+		}
 	}
 
-	if err := phy.SetUplinkDataMIC(lorawan.LoRaWAN1_0, 0, 0, 0, nwkskey, lorawan.AES128Key{}); err != nil {
+	if err := phy.SetUplinkDataMIC(macVersion, confFCnt, uint8(uplink.DataRate), uint8(txCh), nwkskey, sNwkSIntKey); err != nil {
 		return lorawan.PHYPayload{}, err
 	}
 
-	d.broadcast(phy)
+	// Repeated up to NbTrans times, confirmed uplinks until the ACK
+	d.mu.Lock()
+	var confirmedUplink *ConfirmedUplink
+	if confirmed {
+		confirmedUplink = d.trackConfirmedUplink(macPL.FHDR.FCnt, uplink.Time)
+	}
+	d.scheduleRetransmission(phy, confFCnt, d.transmissions(confirmed)-1, confirmedUplink)
+	d.mu.Unlock()
+
+	uplink.PHYPayload = phy
+	d.broadcast(uplink)
 
 	return phy, nil
 }
 
-func (d *Device) broadcast(phy lorawan.PHYPayload) {
+// nextUplink picks a random enabled channel for the current data rate.
+// Must be called with the lock held.
+func (d *Device) nextUplink() (radio.Uplink, error) {
+	var channels []region.Channel
+	for i, c := range d.channels {
+		if d.chMask[i] && d.dataRate >= c.MinDR && d.dataRate <= c.MaxDR {
+			channels = append(channels, c)
+		}
+	}
+	if len(channels) == 0 {
+		return radio.Uplink{}, fmt.Errorf("no channel available for DR%d", d.dataRate)
+	}
+
+	// DutyCycleReq keeps the device silent after each uplink
+	if now := time.Now(); now.Before(d.dutyCycleUntil) {
+		return radio.Uplink{}, fmt.Errorf("duty cycle: next uplink allowed in %s", d.dutyCycleUntil.Sub(now).Round(time.Millisecond))
+	}
+
+	uplink := radio.Uplink{
+		Region:    d.region.Name(),
+		Frequency: channels[rand.Intn(len(channels))].Frequency,
+		DataRate:  d.dataRate,
+		TxPower:   d.txPower,
+		Time:      time.Now(),
+	}
+	if d.location != nil {
+		uplink.Location = &radio.Location{
+			Latitude:  d.location.Latitude,
+			Longitude: d.location.Longitude,
+		}
+	}
+
+	return uplink, nil
+}
+
+func (d *Device) broadcast(uplink radio.Uplink) {
 	// Broadcast to gateways
 	d.mu.RLock()
 	broadcastCh := d.broadcastUplink
 	d.mu.RUnlock()
 
 	if broadcastCh != nil {
-		phyBytes, err := phy.MarshalBinary()
+		phyBytes, err := uplink.PHYPayload.MarshalBinary()
 		if err != nil {
 			log.Printf("[%s] failed to marshal PHYPayload: %v", d.DevEUI, err)
 			return
 		}
-		log.Printf("[%s] broadcasting uplink: %x", d.DevEUI, phyBytes)
+		log.Printf("[%s] broadcasting uplink on %d Hz DR%d: %x", d.DevEUI, uplink.Frequency, uplink.DataRate, phyBytes)
 
 		go func() {
-			broadcastCh <- phy
+			broadcastCh <- uplink
 		}()
 	}
 }
 
+// deriveSessionKeys derives the NwkSKey and AppSKey of a LoRaWAN 1.0
+// session from the root key of the join, also when a 1.1 device joins a 1.0
+// network server.
+// Must be called with the lock held.
+func (d *Device) deriveSessionKeys(joinNonce lorawan.JoinNonce, netID lorawan.NetID) error {
+	var err error
+	key := d.joinKey()
+
+	// Derive NwkSKey
+	d.NwkSKey, err = deriveSessionKey(0x01, key, joinNonce, netID, d.DevNonce-1)
+	if err != nil {
+		log.Printf("[%s] failed to derive NwkSKey: %v", d.DevEUI, err)
+		return err
+	}
+
+	// Derive AppSKey
+	d.AppSKey, err = deriveSessionKey(0x02, key, joinNonce, netID, d.DevNonce-1)
+	if err != nil {
+		log.Printf("[%s] failed to derive AppSKey: %v", d.DevEUI, err)
+		return err
+	}
+
+	d.session11 = false
+	d.rekeyPending = false
+
+	return nil
+}
+
 // deriveSessionKey derives NwkSKey (typ=0x01) or AppSKey (typ=0x02)
 // Following LoRaWAN 1.0.x specification
 func deriveSessionKey(typ byte, appKey lorawan.AES128Key, joinNonce lorawan.JoinNonce, netID lorawan.NetID, devNonce lorawan.DevNonce) (lorawan.AES128Key, error) {
@@ -3,14 +3,17 @@ package device
 import (
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
 	"github.com/stretchr/testify/assert"
 )
 
 // Helper function to create a device with uplink channel for testing
 func newTestDevice(devEUI lorawan.EUI64, joinEUI lorawan.EUI64, appKey lorawan.AES128Key, devNonce lorawan.DevNonce) *Device {
-	uplinkCh := make(chan lorawan.PHYPayload, 10)
+	uplinkCh := make(chan radio.Uplink, 10)
 	return New(uplinkCh, devEUI, joinEUI, appKey, devNonce, lorawan.DevAddr{}, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0)
 }
 
@@ -421,7 +424,7 @@ func TestDevice_Uplink(t *testing.T) {
 		device.NwkSKey = lorawan.AES128Key{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20}
 		device.FCntUp = 0
 
-		phy, err := device.Uplink()
+		phy, err := device.Uplink(1, []byte{1, 2, 3, 4}, true)
 		assert.NoError(t, err)
 
 		// Verify MHDR
@@ -457,13 +460,13 @@ func TestDevice_Uplink(t *testing.T) {
 		device.NwkSKey = lorawan.AES128Key{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20}
 
 		// First uplink
-		phy1, err := device.Uplink()
+		phy1, err := device.Uplink(1, []byte{1, 2, 3, 4}, true)
 		assert.NoError(t, err)
 		macPL1, _ := phy1.MACPayload.(*lorawan.MACPayload)
 		assert.Equal(t, uint32(0), macPL1.FHDR.FCnt)
 
 		// Second uplink should have incremented FCnt
-		phy2, err := device.Uplink()
+		phy2, err := device.Uplink(1, []byte{1, 2, 3, 4}, true)
 		assert.NoError(t, err)
 		macPL2, _ := phy2.MACPayload.(*lorawan.MACPayload)
 		assert.Equal(t, uint32(1), macPL2.FHDR.FCnt)
@@ -485,7 +488,7 @@ func TestDevice_Uplink(t *testing.T) {
 		device.AppSKey = lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
 		device.NwkSKey = lorawan.AES128Key{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20}
 
-		phy, err := device.Uplink()
+		phy, err := device.Uplink(1, []byte{1, 2, 3, 4}, true)
 		assert.NoError(t, err)
 
 		// FRMPayload should be encrypted (not [1, 2, 3, 4])
@@ -516,7 +519,7 @@ func TestDevice_Uplink(t *testing.T) {
 		for i := 0; i < numUplinks; i++ {
 			go func() {
 				defer wg.Done()
-				_, err := device.Uplink()
+				_, err := device.Uplink(1, []byte{1, 2, 3, 4}, true)
 				assert.NoError(t, err)
 			}()
 		}
@@ -527,6 +530,98 @@ func TestDevice_Uplink(t *testing.T) {
 		info := device.GetInfo()
 		assert.Equal(t, uint32(numUplinks), info.FCntUp)
 	})
+
+	t.Run("sends unconfirmed uplink with custom FPort and payload", func(t *testing.T) {
+		devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+		joinEUI := lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+		appKey := lorawan.AES128Key{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+		device := newTestDevice(devEUI, joinEUI, appKey, lorawan.DevNonce(100))
+
+		// Set device as joined
+		device.DevAddr = lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+		device.AppSKey = lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+		device.NwkSKey = lorawan.AES128Key{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20}
+
+		payload := []byte{0xde, 0xad, 0xbe, 0xef, 0x42}
+		phy, err := device.Uplink(42, payload, false)
+		assert.NoError(t, err)
+		assert.Equal(t, lorawan.UnconfirmedDataUp, phy.MHDR.MType)
+
+		macPL, _ := phy.MACPayload.(*lorawan.MACPayload)
+		assert.Equal(t, uint8(42), *macPL.FPort)
+
+		// MIC must be valid
+		ok, err := phy.ValidateUplinkDataMIC(lorawan.LoRaWAN1_0, 0, 0, 0, device.NwkSKey, lorawan.AES128Key{})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		// Decrypting with the AppSKey must give back the original payload
+		err = phy.DecryptFRMPayload(device.AppSKey)
+		assert.NoError(t, err)
+		dataPayload, ok := macPL.FRMPayload[0].(*lorawan.DataPayload)
+		assert.True(t, ok)
+		assert.Equal(t, payload, dataPayload.Bytes)
+	})
+
+	t.Run("encrypts FPort 0 payload with NwkSKey", func(t *testing.T) {
+		devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+		joinEUI := lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+		appKey := lorawan.AES128Key{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+		device := newTestDevice(devEUI, joinEUI, appKey, lorawan.DevNonce(100))
+
+		// Set device as joined
+		device.DevAddr = lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+		device.AppSKey = lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+		device.NwkSKey = lorawan.AES128Key{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20}
+
+		// LinkCheckReq MAC command
+		payload := []byte{0x02}
+		phy, err := device.Uplink(0, payload, false)
+		assert.NoError(t, err)
+
+		macPL, _ := phy.MACPayload.(*lorawan.MACPayload)
+		assert.Equal(t, uint8(0), *macPL.FPort)
+
+		// Decrypting with the NwkSKey must give back the MAC command
+		err = phy.DecryptFRMPayload(device.NwkSKey)
+		assert.NoError(t, err)
+		assert.Len(t, macPL.FRMPayload, 1)
+		macCmd, ok := macPL.FRMPayload[0].(*lorawan.MACCommand)
+		assert.True(t, ok)
+		assert.Equal(t, lorawan.LinkCheckReq, macCmd.CID)
+	})
+
+	t.Run("omits FPort and FRMPayload when payload is empty", func(t *testing.T) {
+		devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+		joinEUI := lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+		appKey := lorawan.AES128Key{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+		device := newTestDevice(devEUI, joinEUI, appKey, lorawan.DevNonce(100))
+		device.DevAddr = lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+
+		phy, err := device.Uplink(10, nil, true)
+		assert.NoError(t, err)
+
+		macPL, _ := phy.MACPayload.(*lorawan.MACPayload)
+		assert.Nil(t, macPL.FPort)
+		assert.Empty(t, macPL.FRMPayload)
+
+		// Frame must still be serializable
+		_, err = phy.MarshalBinary()
+		assert.NoError(t, err)
+	})
+
+	t.Run("rejects RFU FPort", func(t *testing.T) {
+		devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+		joinEUI := lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+		appKey := lorawan.AES128Key{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+		device := newTestDevice(devEUI, joinEUI, appKey, lorawan.DevNonce(100))
+
+		_, err := device.Uplink(225, []byte{0x01}, false)
+		assert.Error(t, err)
+
+		// FCntUp must not be consumed by a rejected uplink
+		assert.Equal(t, uint32(0), device.GetInfo().FCntUp)
+	})
 }
 
 func TestDevice_Downlink(t *testing.T) {
@@ -713,3 +808,376 @@ func TestDevice_Downlink(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestDevice_Region(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	joinEUI := lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+	appKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+
+	receiveUplink := func(t *testing.T, uplinkCh chan radio.Uplink) radio.Uplink {
+		select {
+		case uplink := <-uplinkCh:
+			return uplink
+		case <-time.After(time.Second):
+			t.Fatal("uplink not broadcast")
+			return radio.Uplink{}
+		}
+	}
+
+	t.Run("defaults to EU868 DR5", func(t *testing.T) {
+		uplinkCh := make(chan radio.Uplink, 10)
+		device := New(uplinkCh, devEUI, joinEUI, appKey, 0, lorawan.DevAddr{}, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0)
+
+		info := device.GetInfo()
+		assert.Equal(t, region.EU868, info.Region)
+		assert.Equal(t, 5, info.DataRate)
+
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+
+		uplink := receiveUplink(t, uplinkCh)
+		assert.Equal(t, region.EU868, uplink.Region)
+		assert.Equal(t, 5, uplink.DataRate)
+		assert.Contains(t, []uint32{868100000, 868300000, 868500000}, uplink.Frequency)
+		assert.Equal(t, 16.0, uplink.TxPower)
+		assert.Nil(t, uplink.Location)
+	})
+
+	t.Run("transmits with tx power and location", func(t *testing.T) {
+		uplinkCh := make(chan radio.Uplink, 10)
+		device := NewWithLocation(uplinkCh, devEUI, joinEUI, appKey, 0, lorawan.DevAddr{}, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, &Location{Latitude: 45.07, Longitude: 7.69})
+
+		assert.NoError(t, device.SetTxPower(8))
+		assert.Equal(t, 8.0, device.GetInfo().TxPower)
+
+		_, err := device.JoinRequest()
+		assert.NoError(t, err)
+
+		uplink := receiveUplink(t, uplinkCh)
+		assert.Equal(t, 8.0, uplink.TxPower)
+		assert.Equal(t, &radio.Location{Latitude: 45.07, Longitude: 7.69}, uplink.Location)
+	})
+
+	t.Run("rejects tx power above the region maximum", func(t *testing.T) {
+		device := newTestDevice(devEUI, joinEUI, appKey, 0)
+
+		err := device.SetTxPower(20)
+		assert.Error(t, err)
+		assert.Equal(t, 16.0, device.GetInfo().TxPower)
+
+		us915, _ := region.Get(region.US915)
+		assert.NoError(t, device.SetRegion(us915, 0))
+		assert.Equal(t, 30.0, device.GetInfo().TxPower)
+		assert.NoError(t, device.SetTxPower(20))
+	})
+
+	t.Run("uses sub-band channels in US915", func(t *testing.T) {
+		uplinkCh := make(chan radio.Uplink, 10)
+		device := New(uplinkCh, devEUI, joinEUI, appKey, 0, lorawan.DevAddr{}, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0)
+
+		us915, err := region.Get(region.US915)
+		assert.NoError(t, err)
+		assert.NoError(t, device.SetRegion(us915, 1))
+
+		info := device.GetInfo()
+		assert.Equal(t, region.US915, info.Region)
+		assert.Equal(t, 1, info.SubBand)
+		assert.Equal(t, 3, info.DataRate)
+
+		for i := 0; i < 10; i++ {
+			_, err := device.JoinRequest()
+			assert.NoError(t, err)
+
+			uplink := receiveUplink(t, uplinkCh)
+			assert.Equal(t, 3, uplink.DataRate)
+			// Sub-band 1: 902.3 - 903.7 MHz
+			assert.GreaterOrEqual(t, uplink.Frequency, uint32(902300000))
+			assert.LessOrEqual(t, uplink.Frequency, uint32(903700000))
+			assert.True(t, us915.IsUplinkChannel(uplink.Frequency, uplink.DataRate))
+		}
+
+		// DR4 is only available on the 500 kHz channel
+		assert.NoError(t, device.SetDataRate(4))
+		_, err = device.JoinRequest()
+		assert.NoError(t, err)
+		uplink := receiveUplink(t, uplinkCh)
+		assert.Equal(t, uint32(903000000), uplink.Frequency)
+	})
+
+	t.Run("sets the device class", func(t *testing.T) {
+		device := New(nil, devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, lorawan.DevAddr{}, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0)
+		assert.Equal(t, ClassA, device.GetInfo().Class)
+
+		assert.NoError(t, device.SetClass(ClassC))
+		assert.Equal(t, ClassC, device.GetInfo().Class)
+
+		assert.Error(t, device.SetClass("D"))
+		assert.Equal(t, ClassC, device.GetInfo().Class)
+	})
+
+	t.Run("rejects invalid sub-band", func(t *testing.T) {
+		device := newTestDevice(devEUI, joinEUI, appKey, 0)
+
+		eu868, _ := region.Get(region.EU868)
+		assert.Error(t, device.SetRegion(eu868, 2))
+
+		au915, _ := region.Get(region.AU915)
+		assert.Error(t, device.SetRegion(au915, 9))
+		assert.Equal(t, region.EU868, device.GetInfo().Region)
+	})
+
+	t.Run("rejects data rate not supported by the channels", func(t *testing.T) {
+		device := newTestDevice(devEUI, joinEUI, appKey, 0)
+
+		err := device.SetDataRate(7)
+		assert.Error(t, err)
+		assert.Equal(t, 5, device.GetInfo().DataRate)
+	})
+
+	t.Run("rejects payload too large for the data rate", func(t *testing.T) {
+		device := newTestDevice(devEUI, joinEUI, appKey, 0)
+		assert.NoError(t, device.SetDataRate(0))
+
+		_, err := device.Uplink(1, make([]byte, 52), false)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "payload too large")
+		assert.Equal(t, uint32(0), device.GetInfo().FCntUp)
+
+		_, err = device.Uplink(1, make([]byte, 51), false)
+		assert.NoError(t, err)
+	})
+}
+
+func TestDevice_Receive(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	joinEUI := lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+	appKey := lorawan.AES128Key{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+	joinAccept := func(t *testing.T, key lorawan.AES128Key, devNonce lorawan.DevNonce) lorawan.PHYPayload {
+		phy := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{
+				MType: lorawan.JoinAccept,
+				Major: lorawan.LoRaWANR1,
+			},
+			MACPayload: &lorawan.JoinAcceptPayload{
+				JoinNonce:  lorawan.JoinNonce(0x123456),
+				HomeNetID:  lorawan.NetID{0x00, 0x00, 0x01},
+				DevAddr:    lorawan.DevAddr{0x01, 0x02, 0x03, 0x04},
+				DLSettings: lorawan.DLSettings{RX2DataRate: 3, RX1DROffset: 1},
+				RXDelay:    5,
+			},
+		}
+		assert.NoError(t, phy.SetDownlinkJoinMIC(lorawan.JoinRequestType, joinEUI, devNonce, key))
+		assert.NoError(t, phy.EncryptJoinAcceptPayload(key))
+		return phy
+	}
+
+	dataDown := func(t *testing.T, info DeviceInfo) lorawan.PHYPayload {
+		fPort := uint8(10)
+		phy := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{
+				MType: lorawan.UnconfirmedDataDown,
+				Major: lorawan.LoRaWANR1,
+			},
+			MACPayload: &lorawan.MACPayload{
+				FHDR:       lorawan.FHDR{DevAddr: info.DevAddr, FCnt: info.FCntDn},
+				FPort:      &fPort,
+				FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte{0xaa}}},
+			},
+		}
+		assert.NoError(t, phy.EncryptFRMPayload(info.AppSKey))
+		assert.NoError(t, phy.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, info.NwkSKey))
+		return phy
+	}
+
+	receiveUplink := func(t *testing.T, uplinkCh chan radio.Uplink) radio.Uplink {
+		select {
+		case uplink := <-uplinkCh:
+			return uplink
+		case <-time.After(time.Second):
+			t.Fatal("uplink not broadcast")
+			return radio.Uplink{}
+		}
+	}
+
+	// join activates a device through a join accept received in RX1
+	join := func(t *testing.T) (*Device, chan radio.Uplink) {
+		uplinkCh := make(chan radio.Uplink, 10)
+		device := New(uplinkCh, devEUI, joinEUI, appKey, 0, lorawan.DevAddr{}, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0)
+
+		_, err := device.JoinRequest()
+		assert.NoError(t, err)
+		uplink := receiveUplink(t, uplinkCh)
+		assert.False(t, uplink.Time.IsZero())
+
+		err = device.Receive(radio.Downlink{
+			PHYPayload: joinAccept(t, appKey, 0),
+			Region:     region.EU868,
+			Frequency:  uplink.Frequency,
+			DataRate:   uplink.DataRate,
+			Time:       uplink.Time.Add(5 * time.Second),
+		})
+		assert.NoError(t, err)
+
+		return device, uplinkCh
+	}
+
+	t.Run("receives join accept in RX1 and applies its RX settings", func(t *testing.T) {
+		device, _ := join(t)
+
+		info := device.GetInfo()
+		assert.Equal(t, lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}, info.DevAddr)
+		assert.Equal(t, 1, info.RX1DROffset)
+		assert.Equal(t, 5, info.RX1Delay)
+		assert.Equal(t, uint32(869525000), info.RX2Frequency)
+		assert.Equal(t, 3, info.RX2DataRate)
+		assert.Nil(t, info.LastEvent)
+	})
+
+	t.Run("receives data downlink in RX1 with DR offset", func(t *testing.T) {
+		device, uplinkCh := join(t)
+
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		uplink := receiveUplink(t, uplinkCh)
+
+		err = device.Receive(radio.Downlink{
+			PHYPayload: dataDown(t, device.GetInfo()),
+			Region:     region.EU868,
+			Frequency:  uplink.Frequency,
+			DataRate:   4,
+			Time:       uplink.Time.Add(5*time.Second + 5*time.Millisecond),
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("receives data downlink in RX2", func(t *testing.T) {
+		device, uplinkCh := join(t)
+
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		uplink := receiveUplink(t, uplinkCh)
+
+		downlink := radio.Downlink{
+			PHYPayload: dataDown(t, device.GetInfo()),
+			Region:     region.EU868,
+			Frequency:  869525000,
+			DataRate:   3,
+			Time:       uplink.Time.Add(6 * time.Second),
+		}
+		assert.NoError(t, device.Receive(downlink))
+
+		// The windows are closed after a reception
+		err = device.Receive(downlink)
+		assert.Error(t, err)
+	})
+
+	t.Run("misses downlink outside the RX windows", func(t *testing.T) {
+		device, uplinkCh := join(t)
+
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		uplink := receiveUplink(t, uplinkCh)
+
+		downlinks := []radio.Downlink{
+			// RX1 timing of the previous session
+			{Region: region.EU868, Frequency: uplink.Frequency, DataRate: 4, Time: uplink.Time.Add(time.Second)},
+			// RX2 with the default data rate
+			{Region: region.EU868, Frequency: 869525000, DataRate: 0, Time: uplink.Time.Add(6 * time.Second)},
+			// RX1 on another frequency
+			{Region: region.EU868, Frequency: 869525000, DataRate: 4, Time: uplink.Time.Add(5 * time.Second)},
+		}
+		for _, downlink := range downlinks {
+			downlink.PHYPayload = dataDown(t, device.GetInfo())
+			err := device.Receive(downlink)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "missed RX window")
+
+			info := device.GetInfo()
+			assert.NotNil(t, info.LastEvent)
+			assert.Equal(t, EventMissedRXWindow, info.LastEvent.Type)
+		}
+	})
+
+	t.Run("receives class C data downlink on RX2 at any time", func(t *testing.T) {
+		device, _ := join(t)
+		assert.NoError(t, device.SetClass(ClassC))
+
+		downlink := radio.Downlink{
+			Region:    region.EU868,
+			Frequency: 869525000,
+			DataRate:  3,
+			Time:      time.Now(),
+		}
+		for i := 0; i < 2; i++ {
+			downlink.PHYPayload = dataDown(t, device.GetInfo())
+			assert.NoError(t, device.Receive(downlink))
+		}
+
+		info := device.GetInfo()
+		assert.Equal(t, ClassC, info.Class)
+		assert.Equal(t, 2, info.ClassCDownlinks)
+		assert.Nil(t, info.LastEvent)
+
+		// Only on the RX2 parameters
+		downlink.PHYPayload = dataDown(t, device.GetInfo())
+		downlink.DataRate = 0
+		err := device.Receive(downlink)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "missed RX window")
+		assert.Equal(t, 2, device.GetInfo().ClassCDownlinks)
+	})
+
+	t.Run("receives class C data downlink in RX1", func(t *testing.T) {
+		device, uplinkCh := join(t)
+		assert.NoError(t, device.SetClass(ClassC))
+
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		uplink := receiveUplink(t, uplinkCh)
+
+		err = device.Receive(radio.Downlink{
+			PHYPayload: dataDown(t, device.GetInfo()),
+			Region:     region.EU868,
+			Frequency:  uplink.Frequency,
+			DataRate:   4,
+			Time:       uplink.Time.Add(5 * time.Second),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, device.GetInfo().ClassCDownlinks)
+	})
+
+	t.Run("misses class A data downlink on RX2 outside the RX windows", func(t *testing.T) {
+		device, _ := join(t)
+
+		err := device.Receive(radio.Downlink{
+			PHYPayload: dataDown(t, device.GetInfo()),
+			Region:     region.EU868,
+			Frequency:  869525000,
+			DataRate:   3,
+			Time:       time.Now(),
+		})
+		assert.Error(t, err)
+		assert.Equal(t, ClassA, device.GetInfo().Class)
+	})
+
+	t.Run("ignores join accept for another device", func(t *testing.T) {
+		uplinkCh := make(chan radio.Uplink, 10)
+		device := New(uplinkCh, devEUI, joinEUI, appKey, 0, lorawan.DevAddr{}, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0)
+
+		_, err := device.JoinRequest()
+		assert.NoError(t, err)
+		uplink := receiveUplink(t, uplinkCh)
+
+		otherKey := lorawan.AES128Key{0xff, 0xee, 0xdd, 0xcc, 0xbb, 0xaa, 0x99, 0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11, 0x00}
+		err = device.Receive(radio.Downlink{
+			PHYPayload: joinAccept(t, otherKey, 0),
+			Region:     region.EU868,
+			Frequency:  869525000,
+			DataRate:   0,
+			Time:       uplink.Time,
+		})
+		assert.Error(t, err)
+		assert.Nil(t, device.GetInfo().LastEvent)
+	})
+}
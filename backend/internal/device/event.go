@@ -0,0 +1,157 @@
+package device
+
+import (
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+// maxEvents is the number of events kept per device, the oldest are dropped.
+// Variable so that tests can shorten it.
+var maxEvents = 200
+
+// EventType identifies something that happened to a device
+type EventType string
+
+const (
+	// EventMissedRXWindow is raised by a downlink for the device transmitted
+	// while it was not listening
+	EventMissedRXWindow EventType = "missed_rx_window"
+	// EventDataRateChanged is raised when the network server (LinkADRReq) or
+	// the ADR backoff changes the uplink data rate
+	EventDataRateChanged EventType = "data_rate_changed"
+	// EventUplinkUnacknowledged is raised when a confirmed uplink gets no
+	// ACK
+	EventUplinkUnacknowledged EventType = "uplink_unacknowledged"
+	// EventDownlinkRejected is raised by a data downlink for the device with
+	// a replayed frame counter, or one too far ahead
+	EventDownlinkRejected EventType = "downlink_rejected"
+	// EventFCntUpExhausted is raised when the uplink frame counter cannot be
+	// incremented without reusing a value
+	EventFCntUpExhausted EventType = "fcnt_up_exhausted"
+	// EventInvalidMIC is raised by a data downlink for the DevAddr of the
+	// device with an invalid MIC
+	EventInvalidMIC EventType = "invalid_mic"
+
+	// Frames sent and received, kept in the history without replacing the
+	// last event
+	EventJoinRequest   EventType = "join_request"
+	EventRejoinRequest EventType = "rejoin_request"
+	EventJoinAccept    EventType = "join_accept"
+	EventUplink        EventType = "uplink"
+	EventDownlink      EventType = "downlink"
+)
+
+// Event is something that happened to a device
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+
+	// Data frames sent and received
+	FCnt        *uint32  `json:"fcnt,omitempty"`
+	FPort       *uint8   `json:"fport,omitempty"`
+	Payload     string   `json:"payload,omitempty"` // hex, decrypted
+	MACCommands []string `json:"macCommands,omitempty"`
+	Confirmed   bool     `json:"confirmed,omitempty"`
+	ACK         bool     `json:"ack,omitempty"`
+}
+
+// EventFilter selects events of the history
+type EventFilter struct {
+	Types []EventType // all types when empty
+	Since time.Time   // no lower bound when zero
+	Until time.Time   // no upper bound when zero
+}
+
+// match reports whether the filter selects the event
+func (f EventFilter) match(event Event) bool {
+	if !f.Since.IsZero() && event.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && event.Time.After(f.Until) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if event.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Events returns the events of the history selected by the filter, oldest
+// first
+func (d *Device) Events(filter EventFilter) []Event {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	events := []Event{}
+	for _, event := range d.events {
+		if filter.match(event) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// emit records an event of the device, reported as its last event.
+// Must be called with the lock held.
+func (d *Device) emit(eventType EventType, message string) {
+	event := Event{Type: eventType, Time: time.Now(), Message: message}
+	d.lastEvent = &event
+	d.record(event)
+
+	log.Printf("[%s] %s: %s", d.DevEUI, eventType, message)
+}
+
+// record adds an event to the bounded history.
+// Must be called with the lock held.
+func (d *Device) record(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	d.events = append(d.events, event)
+	if len(d.events) > maxEvents {
+		d.events = append([]Event(nil), d.events[len(d.events)-maxEvents:]...)
+	}
+
+	if d.onEvent != nil {
+		d.onEvent(event)
+	}
+}
+
+// SetEventHandler sets the function called with each event of the device.
+// It is called with the lock held and must not block.
+func (d *Device) SetEventHandler(handler func(Event)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.onEvent = handler
+}
+
+// frameEvent returns the event of a data frame with its decrypted payload
+// and MAC commands
+func frameEvent(eventType EventType, message string, mType lorawan.MType, macPL *lorawan.MACPayload, payload []byte, macCommands []lorawan.Payload) Event {
+	fCnt := macPL.FHDR.FCnt
+	event := Event{
+		Type:      eventType,
+		Message:   message,
+		FCnt:      &fCnt,
+		FPort:     macPL.FPort,
+		Payload:   hex.EncodeToString(payload),
+		Confirmed: mType == lorawan.ConfirmedDataUp || mType == lorawan.ConfirmedDataDown,
+		ACK:       macPL.FHDR.FCtrl.ACK,
+	}
+	for _, pl := range macCommands {
+		if cmd, ok := pl.(*lorawan.MACCommand); ok {
+			event.MACCommands = append(event.MACCommands, cmd.CID.String())
+		}
+	}
+	return event
+}
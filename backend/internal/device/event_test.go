@@ -0,0 +1,83 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDevice_Events(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	nwkSKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+
+	newDevice := func() *Device {
+		return New(make(chan radio.Uplink, 10), devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, devAddr, lorawan.AES128Key{}, nwkSKey, 0, 0)
+	}
+
+	t.Run("keeps the last events", func(t *testing.T) {
+		limit := maxEvents
+		maxEvents = 3
+		t.Cleanup(func() { maxEvents = limit })
+
+		device := newDevice()
+		for i := 0; i < 5; i++ {
+			_, err := device.Uplink(2, []byte{byte(i)}, i == 4)
+			assert.NoError(t, err)
+		}
+
+		events := device.Events(EventFilter{})
+		if assert.Len(t, events, 3) {
+			for i, event := range events {
+				assert.Equal(t, EventUplink, event.Type)
+				assert.Equal(t, uint32(i+2), *event.FCnt)
+				assert.Equal(t, uint8(2), *event.FPort)
+			}
+			assert.Equal(t, "04", events[2].Payload)
+			assert.True(t, events[2].Confirmed)
+		}
+
+		// Traffic does not replace the last event
+		assert.Nil(t, device.GetInfo().LastEvent)
+	})
+
+	t.Run("records downlinks with their MAC commands and invalid MICs", func(t *testing.T) {
+		device := newDevice()
+		start := time.Now()
+
+		downlink := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{MType: lorawan.ConfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{FHDR: lorawan.FHDR{
+				DevAddr: devAddr,
+				FOpts:   []lorawan.Payload{&lorawan.MACCommand{CID: lorawan.DevStatusReq}},
+			}},
+		}
+		assert.NoError(t, downlink.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, nwkSKey))
+		b, err := downlink.MarshalBinary()
+		assert.NoError(t, err)
+		var received lorawan.PHYPayload
+		assert.NoError(t, received.UnmarshalBinary(b))
+		assert.NoError(t, device.Downlink(received))
+
+		assert.NoError(t, downlink.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, lorawan.AES128Key{}))
+		assert.Error(t, device.Downlink(downlink))
+
+		events := device.Events(EventFilter{Types: []EventType{EventDownlink}})
+		if assert.Len(t, events, 1) {
+			assert.True(t, events[0].Confirmed)
+			assert.Nil(t, events[0].FPort)
+			assert.Equal(t, []string{"DevStatusReq"}, events[0].MACCommands)
+		}
+
+		events = device.Events(EventFilter{Types: []EventType{EventInvalidMIC}, Since: start})
+		if assert.Len(t, events, 1) {
+			assert.Equal(t, "data downlink FCnt 0", events[0].Message)
+		}
+		assert.Equal(t, EventInvalidMIC, device.GetInfo().LastEvent.Type)
+
+		assert.Empty(t, device.Events(EventFilter{Until: start}))
+	})
+}
@@ -0,0 +1,72 @@
+package device
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/brocaar/lorawan"
+)
+
+// maxFCntGap is the largest jump of the downlink frame counter accepted by a
+// device, frames further ahead are rejected
+const maxFCntGap = 16384
+
+// fCntDn returns the downlink frame counter of a data downlink, the next FCnt
+// expected by the device. A 1.1 session counts application downlinks
+// (FPort > 0) in AFCntDown and the others in NFCntDown.
+// Must be called with the lock held.
+func (d *Device) fCntDn(macPL *lorawan.MACPayload) *uint32 {
+	if d.session11 && macPL.FPort != nil && *macPL.FPort > 0 {
+		return &d.aFCntDn
+	}
+	return &d.FCntDn
+}
+
+// fCntCandidates returns the 32-bit values of the 16-bit FCnt of a frame,
+// given the next FCnt expected: the closest value ahead, rolling over the 16
+// least-significant bits, then the one behind it identifying a replay.
+func fCntCandidates(next uint32, fCnt uint16) []uint32 {
+	full := next&^0xffff | uint32(fCnt)
+	if full >= next {
+		return []uint32{full}
+	}
+	if full+0x10000 < full {
+		// No value ahead before the 32-bit counter wraps around
+		return []uint32{full}
+	}
+	return []uint32{full + 0x10000, full}
+}
+
+// checkFCntDn rejects a replayed data downlink, or one too far ahead of the
+// next FCnt expected, with an EventDownlinkRejected. The FHDR holds the
+// 32-bit FCnt.
+// Must be called with the lock held.
+func (d *Device) checkFCntDn(macPL *lorawan.MACPayload) error {
+	next := *d.fCntDn(macPL)
+	fCnt := macPL.FHDR.FCnt
+
+	var reason string
+	switch {
+	case fCnt < next:
+		reason = fmt.Sprintf("replayed FCnt %d, expected %d or more", fCnt, next)
+	case fCnt-next >= maxFCntGap:
+		reason = fmt.Sprintf("FCnt %d too far ahead of %d", fCnt, next)
+	default:
+		return nil
+	}
+
+	d.emit(EventDownlinkRejected, reason)
+	return fmt.Errorf("downlink rejected: %s", reason)
+}
+
+// checkFCntUp fails once the 32-bit uplink frame counter has been used up,
+// the device must join again (or be reactivated) before sending more uplinks.
+// Must be called with the lock held.
+func (d *Device) checkFCntUp() error {
+	if d.FCntUp < math.MaxUint32 {
+		return nil
+	}
+
+	d.emit(EventFCntUpExhausted, fmt.Sprintf("FCnt %d reached, join again", d.FCntUp))
+	return fmt.Errorf("uplink frame counter exhausted")
+}
@@ -0,0 +1,166 @@
+package device
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFCntCandidates(t *testing.T) {
+	assert.Equal(t, []uint32{5}, fCntCandidates(5, 5))
+	assert.Equal(t, []uint32{0x10007}, fCntCandidates(0x10005, 7))
+	assert.Equal(t, []uint32{0x10003, 3}, fCntCandidates(5, 3))
+	assert.Equal(t, []uint32{0x10001, 1}, fCntCandidates(0xfffe, 1))
+	assert.Equal(t, []uint32{0xffff0000}, fCntCandidates(0xfffffff0, 0))
+}
+
+func TestDevice_FCnt(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	appSKey := lorawan.AES128Key{0x10, 0x0f, 0x0e, 0x0d, 0x0c, 0x0b, 0x0a, 0x09, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}
+	nwkSKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+
+	newDevice := func(fCntUp, fCntDn uint32) (*Device, chan radio.Uplink) {
+		uplinkCh := make(chan radio.Uplink, 10)
+		return New(uplinkCh, devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, devAddr, appSKey, nwkSKey, fCntUp, fCntDn), uplinkCh
+	}
+
+	// downlink returns a data downlink as received over the air, with the 16
+	// least-significant bits of its FCnt
+	downlink := func(t *testing.T, version lorawan.MACVersion, key lorawan.AES128Key, fPort *uint8, fCnt uint32) lorawan.PHYPayload {
+		phy := lorawan.PHYPayload{
+			MHDR:       lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{FHDR: lorawan.FHDR{DevAddr: devAddr, FCnt: fCnt}, FPort: fPort},
+		}
+		if fPort != nil {
+			phy.MACPayload.(*lorawan.MACPayload).FRMPayload = []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte{0xaa}}}
+			assert.NoError(t, phy.EncryptFRMPayload(appSKey))
+		}
+		assert.NoError(t, phy.SetDownlinkDataMIC(version, 0, key))
+
+		b, err := phy.MarshalBinary()
+		assert.NoError(t, err)
+		var received lorawan.PHYPayload
+		assert.NoError(t, received.UnmarshalBinary(b))
+		return received
+	}
+
+	t.Run("tracks the downlink frame counter", func(t *testing.T) {
+		device, _ := newDevice(0, 0)
+
+		assert.NoError(t, device.Downlink(downlink(t, lorawan.LoRaWAN1_0, nwkSKey, nil, 0)))
+		assert.Equal(t, uint32(1), device.GetInfo().FCntDn)
+
+		// Frames may be lost
+		assert.NoError(t, device.Downlink(downlink(t, lorawan.LoRaWAN1_0, nwkSKey, nil, 10)))
+		assert.Equal(t, uint32(11), device.GetInfo().FCntDn)
+		assert.Nil(t, device.GetInfo().LastEvent)
+	})
+
+	t.Run("rejects replayed downlinks", func(t *testing.T) {
+		device, _ := newDevice(0, 0)
+		frame := downlink(t, lorawan.LoRaWAN1_0, nwkSKey, nil, 3)
+		assert.NoError(t, device.Downlink(frame))
+
+		for _, fCnt := range []uint32{3, 2} {
+			err := device.Downlink(downlink(t, lorawan.LoRaWAN1_0, nwkSKey, nil, fCnt))
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "replayed FCnt")
+		}
+
+		info := device.GetInfo()
+		assert.Equal(t, uint32(4), info.FCntDn)
+		if assert.NotNil(t, info.LastEvent) {
+			assert.Equal(t, EventDownlinkRejected, info.LastEvent.Type)
+			assert.Equal(t, "replayed FCnt 2, expected 4 or more", info.LastEvent.Message)
+		}
+	})
+
+	t.Run("rejects downlinks too far ahead", func(t *testing.T) {
+		device, _ := newDevice(0, 0)
+
+		err := device.Downlink(downlink(t, lorawan.LoRaWAN1_0, nwkSKey, nil, maxFCntGap))
+		assert.Error(t, err)
+		info := device.GetInfo()
+		assert.Equal(t, uint32(0), info.FCntDn)
+		if assert.NotNil(t, info.LastEvent) {
+			assert.Equal(t, EventDownlinkRejected, info.LastEvent.Type)
+		}
+
+		assert.NoError(t, device.Downlink(downlink(t, lorawan.LoRaWAN1_0, nwkSKey, nil, maxFCntGap-1)))
+	})
+
+	t.Run("rolls over the 16-bit downlink counter", func(t *testing.T) {
+		device, _ := newDevice(0, 0xfffe)
+
+		// FCnt 0x10001 is received as 1 and signed as 0x10001
+		fPort := uint8(10)
+		assert.NoError(t, device.Downlink(downlink(t, lorawan.LoRaWAN1_0, nwkSKey, &fPort, 0x10001)))
+		assert.Equal(t, uint32(0x10002), device.GetInfo().FCntDn)
+
+		// A frame signed with the 16-bit value is invalid
+		err := device.Downlink(downlink(t, lorawan.LoRaWAN1_0, nwkSKey, nil, 2))
+		assert.EqualError(t, err, "invalid MIC")
+	})
+
+	t.Run("counts 1.1 application downlinks separately", func(t *testing.T) {
+		keys := LoRaWAN11Keys{
+			SNwkSIntKey: lorawan.AES128Key{0x03},
+			NwkSEncKey:  lorawan.AES128Key{0x04},
+		}
+		device, _ := newDevice(0, 0)
+		assert.NoError(t, device.SetMACVersion(MACVersion1_1, keys))
+
+		fPort := uint8(10)
+		assert.NoError(t, device.Downlink(downlink(t, lorawan.LoRaWAN1_1, keys.SNwkSIntKey, nil, 5)))
+		assert.NoError(t, device.Downlink(downlink(t, lorawan.LoRaWAN1_1, keys.SNwkSIntKey, &fPort, 0)))
+		assert.NoError(t, device.Downlink(downlink(t, lorawan.LoRaWAN1_1, keys.SNwkSIntKey, &fPort, 1)))
+
+		info := device.GetInfo()
+		assert.Equal(t, uint32(6), info.FCntDn)
+		assert.Equal(t, uint32(2), info.AFCntDn)
+	})
+
+	t.Run("signs uplinks with the 32-bit counter", func(t *testing.T) {
+		device, uplinkCh := newDevice(0x10005, 0)
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+
+		var uplink radio.Uplink
+		select {
+		case uplink = <-uplinkCh:
+		case <-time.After(time.Second):
+			t.Fatal("uplink not broadcast")
+		}
+		b, err := uplink.PHYPayload.MarshalBinary()
+		assert.NoError(t, err)
+		var received lorawan.PHYPayload
+		assert.NoError(t, received.UnmarshalBinary(b))
+
+		macPL := received.MACPayload.(*lorawan.MACPayload)
+		assert.Equal(t, uint32(5), macPL.FHDR.FCnt)
+		macPL.FHDR.FCnt = 0x10005
+		ok, err := received.ValidateUplinkDataMIC(lorawan.LoRaWAN1_0, 0, 0, 0, nwkSKey, nwkSKey)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("stops uplinks when the counter is exhausted", func(t *testing.T) {
+		device, uplinkCh := newDevice(math.MaxUint32-1, 0)
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		<-uplinkCh
+
+		_, err = device.Uplink(1, []byte{0x01}, false)
+		assert.EqualError(t, err, "uplink frame counter exhausted")
+		info := device.GetInfo()
+		assert.Equal(t, uint32(math.MaxUint32), info.FCntUp)
+		if assert.NotNil(t, info.LastEvent) {
+			assert.Equal(t, EventFCntUpExhausted, info.LastEvent.Type)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package device
+
+import (
+	"log"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/gps"
+)
+
+// LinkCheckInfo is the last LinkCheckAns received by a device
+type LinkCheckInfo struct {
+	Pending  bool       `json:"pending"`            // LinkCheckReq waiting for its answer
+	Margin   uint8      `json:"margin"`             // dB above the demodulation floor
+	GwCnt    uint8      `json:"gwCnt"`              // gateways receiving the uplink
+	Received *time.Time `json:"received,omitempty"` // of the last LinkCheckAns
+}
+
+// DeviceTimeInfo is the last DeviceTimeAns received by a device
+type DeviceTimeInfo struct {
+	Pending     bool       `json:"pending"`               // DeviceTimeReq waiting for its answer
+	NetworkTime *time.Time `json:"networkTime,omitempty"` // at the end of the uplink, as answered
+	OffsetMs    float64    `json:"offsetMs"`              // network time minus device time
+	Received    *time.Time `json:"received,omitempty"`    // of the last DeviceTimeAns
+}
+
+// RequestLinkCheck queues a LinkCheckReq for the next uplink
+func (d *Device) RequestLinkCheck() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.requestMACCommand(lorawan.LinkCheckReq)
+}
+
+// RequestDeviceTime queues a DeviceTimeReq for the next uplink
+func (d *Device) RequestDeviceTime() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.requestMACCommand(lorawan.DeviceTimeReq)
+}
+
+// requestMACCommand queues a request without payload, unless already queued.
+// Must be called with the lock held.
+func (d *Device) requestMACCommand(cid lorawan.CID) {
+	if !d.macCommandQueued(cid) {
+		d.queueMACCommand(cid, nil)
+	}
+}
+
+// handleLinkCheckAns records the link margin and gateway count of the uplink
+// carrying the LinkCheckReq.
+// Must be called with the lock held.
+func (d *Device) handleLinkCheckAns(ans *lorawan.LinkCheckAnsPayload) {
+	if d.linkCheckReq.IsZero() {
+		log.Printf("[%s] LinkCheckAns without LinkCheckReq", d.DevEUI)
+	}
+
+	now := time.Now()
+	d.linkCheckReq = time.Time{}
+	d.linkCheck = LinkCheckInfo{Margin: ans.Margin, GwCnt: ans.GwCnt, Received: &now}
+	log.Printf("[%s] LinkCheckAns: margin %d dB, %d gateways", d.DevEUI, ans.Margin, ans.GwCnt)
+}
+
+// linkCheckInfo returns the LinkCheckReq state, nil when never requested.
+// Must be called with the lock held.
+func (d *Device) linkCheckInfo() *LinkCheckInfo {
+	pending := !d.linkCheckReq.IsZero() || d.macCommandQueued(lorawan.LinkCheckReq)
+	if !pending && d.linkCheck.Received == nil {
+		return nil
+	}
+
+	info := d.linkCheck
+	info.Pending = pending
+	return &info
+}
+
+// deviceTimeInfo returns the DeviceTimeReq state, nil when never requested.
+// Must be called with the lock held.
+func (d *Device) deviceTimeInfo() *DeviceTimeInfo {
+	pending := !d.deviceTimeReq.IsZero() || d.macCommandQueued(lorawan.DeviceTimeReq)
+	if !pending && d.deviceTime.Received == nil {
+		return nil
+	}
+
+	info := d.deviceTime
+	info.Pending = pending
+	return &info
+}
+
+// recordDeviceTime records a DeviceTimeAns answering the uplink at the given
+// time.
+// Must be called with the lock held.
+func (d *Device) recordDeviceTime(uplinkTime time.Time, ans *lorawan.DeviceTimeAnsPayload) {
+	now := time.Now()
+	networkTime := time.Time(gps.NewTimeFromTimeSinceGPSEpoch(ans.TimeSinceGPSEpoch))
+	d.deviceTime = DeviceTimeInfo{
+		NetworkTime: &networkTime,
+		OffsetMs:    float64(networkTime.Sub(uplinkTime)) / float64(time.Millisecond),
+		Received:    &now,
+	}
+}
+
+// macCommandQueued reports whether a MAC command waits for the next uplink.
+// Must be called with the lock held.
+func (d *Device) macCommandQueued(cid lorawan.CID) bool {
+	for _, cmd := range d.macCommands {
+		if cmd.CID == cid {
+			return true
+		}
+	}
+	return false
+}
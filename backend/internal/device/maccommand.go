@@ -0,0 +1,440 @@
+package device
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+)
+
+// maxFOptsLen is the maximum size of the MAC commands piggybacked in the
+// FOpts of an uplink
+const maxFOptsLen = 15
+
+// BatteryUnknown is the DevStatusAns battery level of a device unable to
+// measure it, 0 is an external power source and 1-254 the battery level
+const BatteryUnknown uint8 = 255
+
+// ChannelInfo is an enabled uplink channel of a device
+type ChannelInfo struct {
+	Index       int    `json:"index"`
+	Frequency   uint32 `json:"frequency"`
+	MinDR       int    `json:"minDR"`
+	MaxDR       int    `json:"maxDR"`
+	DlFrequency uint32 `json:"dlFrequency,omitempty"` // RX1 frequency set by DlChannelReq
+}
+
+// SetBattery sets the battery level reported by DevStatusAns
+func (d *Device) SetBattery(battery uint8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.battery = battery
+}
+
+// queueMACCommand queues a MAC command for the next uplinks.
+// Must be called with the lock held.
+func (d *Device) queueMACCommand(cid lorawan.CID, payload lorawan.MACCommandPayload) {
+	d.macCommands = append(d.macCommands, lorawan.MACCommand{CID: cid, Payload: payload})
+}
+
+// takeMACCommands removes the queued MAC commands fitting in FOpts, in
+// order, and returns them. The others wait for the next uplink.
+// Must be called with the lock held.
+func (d *Device) takeMACCommands(uplinkTime time.Time) []lorawan.Payload {
+	// A 1.1 session is confirmed with RekeyInd until the RekeyConf
+	if d.rekeyPending && (len(d.macCommands) == 0 || d.macCommands[0].CID != lorawan.RekeyInd) {
+		d.macCommands = append([]lorawan.MACCommand{{
+			CID:     lorawan.RekeyInd,
+			Payload: &lorawan.RekeyIndPayload{DevLoRaWANVersion: lorawan.Version{Minor: 1}},
+		}}, d.macCommands...)
+	}
+
+	var fOpts []lorawan.Payload
+	size := 0
+
+	// Answers to RXParamSetupReq, RXTimingSetupReq and DlChannelReq are
+	// repeated until a downlink is received
+	for _, cmd := range d.stickyMACCommands {
+		b, err := cmd.MarshalBinary()
+		if err != nil || size+len(b) > maxFOptsLen {
+			break
+		}
+		size += len(b)
+		fOpts = append(fOpts, &cmd)
+	}
+
+	for len(d.macCommands) > 0 {
+		cmd := d.macCommands[0]
+		b, err := cmd.MarshalBinary()
+		if err != nil {
+			log.Printf("[%s] dropping invalid MAC command 0x%02x: %v", d.DevEUI, byte(cmd.CID), err)
+			d.macCommands = d.macCommands[1:]
+			continue
+		}
+		if size+len(b) > maxFOptsLen {
+			break
+		}
+		size += len(b)
+		fOpts = append(fOpts, &cmd)
+		d.macCommands = d.macCommands[1:]
+
+		// DeviceTimeAns refers to the end of the uplink carrying the request
+		switch cmd.CID {
+		case lorawan.DeviceTimeReq:
+			d.deviceTimeReq = uplinkTime
+		case lorawan.LinkCheckReq:
+			d.linkCheckReq = uplinkTime
+		}
+	}
+	return fOpts
+}
+
+// handleMACCommands processes the MAC commands of a downlink, queueing the
+// answers for the next uplink.
+// Must be called with the lock held.
+func (d *Device) handleMACCommands(cmds []lorawan.Payload) {
+	for i := 0; i < len(cmds); i++ {
+		cmd, ok := cmds[i].(*lorawan.MACCommand)
+		if !ok {
+			continue
+		}
+
+		switch cmd.CID {
+		case lorawan.LinkADRReq:
+			// Contiguous LinkADRReq are a single block, answered by as many
+			// LinkADRAns
+			var reqs []*lorawan.LinkADRReqPayload
+			for ; i < len(cmds); i++ {
+				next, ok := cmds[i].(*lorawan.MACCommand)
+				if !ok || next.CID != lorawan.LinkADRReq {
+					break
+				}
+				if req, ok := next.Payload.(*lorawan.LinkADRReqPayload); ok {
+					reqs = append(reqs, req)
+				}
+			}
+			i--
+			if len(reqs) > 0 {
+				ans := d.handleLinkADRReq(reqs)
+				for range reqs {
+					d.queueMACCommand(lorawan.LinkADRAns, ans)
+				}
+			}
+		case lorawan.DutyCycleReq:
+			if req, ok := cmd.Payload.(*lorawan.DutyCycleReqPayload); ok {
+				d.handleDutyCycleReq(req)
+				d.queueMACCommand(lorawan.DutyCycleAns, nil)
+			}
+		case lorawan.RXParamSetupReq:
+			if req, ok := cmd.Payload.(*lorawan.RXParamSetupReqPayload); ok {
+				d.stickyMACCommands = append(d.stickyMACCommands, lorawan.MACCommand{CID: lorawan.RXParamSetupAns, Payload: d.handleRXParamSetupReq(req)})
+			}
+		case lorawan.DevStatusReq:
+			d.queueMACCommand(lorawan.DevStatusAns, d.handleDevStatusReq())
+		case lorawan.NewChannelReq:
+			if req, ok := cmd.Payload.(*lorawan.NewChannelReqPayload); ok {
+				if ans := d.handleNewChannelReq(req); ans != nil {
+					d.queueMACCommand(lorawan.NewChannelAns, ans)
+				}
+			}
+		case lorawan.RXTimingSetupReq:
+			if req, ok := cmd.Payload.(*lorawan.RXTimingSetupReqPayload); ok {
+				d.handleRXTimingSetupReq(req)
+				d.stickyMACCommands = append(d.stickyMACCommands, lorawan.MACCommand{CID: lorawan.RXTimingSetupAns})
+			}
+		case lorawan.TXParamSetupReq:
+			if req, ok := cmd.Payload.(*lorawan.TXParamSetupReqPayload); ok && d.handleTxParamSetupReq(req) {
+				d.queueMACCommand(lorawan.TXParamSetupAns, nil)
+			}
+		case lorawan.DLChannelReq:
+			if req, ok := cmd.Payload.(*lorawan.DLChannelReqPayload); ok {
+				if ans := d.handleDlChannelReq(req); ans != nil {
+					d.stickyMACCommands = append(d.stickyMACCommands, lorawan.MACCommand{CID: lorawan.DLChannelAns, Payload: ans})
+				}
+			}
+		case lorawan.LinkCheckAns:
+			if ans, ok := cmd.Payload.(*lorawan.LinkCheckAnsPayload); ok {
+				d.handleLinkCheckAns(ans)
+			}
+		case lorawan.DeviceTimeAns:
+			if ans, ok := cmd.Payload.(*lorawan.DeviceTimeAnsPayload); ok {
+				d.handleDeviceTimeAns(ans)
+			}
+		case lorawan.RekeyConf:
+			if d.rekeyPending {
+				log.Printf("[%s] RekeyConf: LoRaWAN 1.1 session confirmed", d.DevEUI)
+			}
+			d.rekeyPending = false
+		case lorawan.PingSlotInfoAns:
+			d.pingSlotInfoAnswered = true
+		case lorawan.PingSlotChannelReq:
+			if req, ok := cmd.Payload.(*lorawan.PingSlotChannelReqPayload); ok {
+				d.queueMACCommand(lorawan.PingSlotChannelAns, d.handlePingSlotChannelReq(req))
+			}
+		case lorawan.BeaconFreqReq:
+			if req, ok := cmd.Payload.(*lorawan.BeaconFreqReqPayload); ok {
+				d.queueMACCommand(lorawan.BeaconFreqAns, d.handleBeaconFreqReq(req))
+			}
+		default:
+			log.Printf("[%s] unsupported MAC command 0x%02x", d.DevEUI, byte(cmd.CID))
+		}
+	}
+}
+
+// handleLinkADRReq applies a block of LinkADRReq: the channel masks in order,
+// then the data rate, TX power and NbTrans of the last one. Nothing is
+// applied unless the whole block is accepted.
+// Must be called with the lock held.
+func (d *Device) handleLinkADRReq(reqs []*lorawan.LinkADRReqPayload) *lorawan.LinkADRAnsPayload {
+	ans := &lorawan.LinkADRAnsPayload{ChannelMaskACK: true, DataRateACK: true, PowerACK: true}
+
+	chMask := d.chMask
+	for _, req := range reqs {
+		mask, err := d.region.ApplyChannelMask(d.channels, chMask, req.Redundancy.ChMaskCntl, req.ChMask)
+		if err != nil {
+			log.Printf("[%s] LinkADRReq: %v", d.DevEUI, err)
+			ans.ChannelMaskACK = false
+			break
+		}
+		chMask = mask
+	}
+
+	// 15 keeps the current data rate or TX power
+	last := reqs[len(reqs)-1]
+	dataRate := d.dataRate
+	if last.DataRate != 15 {
+		dataRate = int(last.DataRate)
+	}
+	if _, err := d.region.DataRate(dataRate); err != nil || !d.supportsDataRate(chMask, dataRate) {
+		ans.DataRateACK = false
+	}
+	txPower := d.txPower
+	if last.TXPower != 15 {
+		offset, err := d.region.TxPowerOffset(int(last.TXPower))
+		if err != nil {
+			ans.PowerACK = false
+		}
+		txPower = d.maxEIRP + offset
+	}
+
+	if !ans.ChannelMaskACK || !ans.DataRateACK || !ans.PowerACK {
+		log.Printf("[%s] LinkADRReq rejected: DR%d, TXPower %d", d.DevEUI, last.DataRate, last.TXPower)
+		return ans
+	}
+
+	d.chMask = chMask
+	d.setDataRate(dataRate, "LinkADRReq")
+	d.txPower = txPower
+	d.nbTrans = int(last.Redundancy.NbRep)
+	if d.nbTrans == 0 {
+		d.nbTrans = 1
+	}
+	log.Printf("[%s] LinkADRReq: DR%d, %g dBm, NbTrans %d", d.DevEUI, d.dataRate, d.txPower, d.nbTrans)
+
+	return ans
+}
+
+// handleDutyCycleReq limits the aggregated duty cycle of the device to
+// 1/2^MaxDCycle, 0 removes the limit.
+// Must be called with the lock held.
+func (d *Device) handleDutyCycleReq(req *lorawan.DutyCycleReqPayload) {
+	d.maxDutyCycle = req.MaxDCycle
+	if d.maxDutyCycle > 15 {
+		d.maxDutyCycle = 0
+	}
+	log.Printf("[%s] DutyCycleReq: MaxDCycle %d", d.DevEUI, d.maxDutyCycle)
+}
+
+// handleRXParamSetupReq changes the RX1 data rate offset and the RX2
+// channel, when all of them are valid.
+// Must be called with the lock held.
+func (d *Device) handleRXParamSetupReq(req *lorawan.RXParamSetupReqPayload) *lorawan.RXParamSetupAnsPayload {
+	_, err := d.region.DataRate(int(req.DLSettings.RX2DataRate))
+	ans := &lorawan.RXParamSetupAnsPayload{
+		ChannelACK:     d.region.IsFrequency(req.Frequency),
+		RX2DataRateACK: err == nil,
+		RX1DROffsetACK: d.region.IsRX1DROffset(int(req.DLSettings.RX1DROffset)),
+	}
+	if ans.ChannelACK && ans.RX2DataRateACK && ans.RX1DROffsetACK {
+		d.rx1DROffset = int(req.DLSettings.RX1DROffset)
+		d.rx2DataRate = int(req.DLSettings.RX2DataRate)
+		d.rx2Frequency = req.Frequency
+		log.Printf("[%s] RXParamSetupReq: RX1DROffset %d, RX2 %d Hz DR%d", d.DevEUI, d.rx1DROffset, d.rx2Frequency, d.rx2DataRate)
+	}
+	return ans
+}
+
+// handleDevStatusReq reports the battery level and the SNR of the last
+// downlink received.
+// Must be called with the lock held.
+func (d *Device) handleDevStatusReq() *lorawan.DevStatusAnsPayload {
+	margin := math.Round(d.downlinkSNR)
+	margin = math.Max(-32, math.Min(31, margin))
+	return &lorawan.DevStatusAnsPayload{Battery: d.battery, Margin: int8(margin)}
+}
+
+// handleNewChannelReq creates, modifies or (frequency 0) disables an uplink
+// channel beyond the default ones. Regions with a fixed channel plan ignore
+// it.
+// Must be called with the lock held.
+func (d *Device) handleNewChannelReq(req *lorawan.NewChannelReqPayload) *lorawan.NewChannelAnsPayload {
+	if !d.region.SupportsNewChannel() {
+		log.Printf("[%s] NewChannelReq not supported by region %s", d.DevEUI, d.region.Name())
+		return nil
+	}
+
+	index := int(req.ChIndex)
+	_, minErr := d.region.DataRate(int(req.MinDR))
+	_, maxErr := d.region.DataRate(int(req.MaxDR))
+	ans := &lorawan.NewChannelAnsPayload{
+		ChannelFrequencyOK: index >= d.region.DefaultChannels() && index < len(d.channels) && (req.Freq == 0 || d.region.IsFrequency(req.Freq)),
+		DataRateRangeOK:    req.Freq == 0 || (minErr == nil && maxErr == nil && req.MinDR <= req.MaxDR),
+	}
+	if !ans.ChannelFrequencyOK || !ans.DataRateRangeOK {
+		return ans
+	}
+
+	d.channels[index] = region.Channel{Frequency: req.Freq, MinDR: int(req.MinDR), MaxDR: int(req.MaxDR)}
+	d.chMask[index] = req.Freq != 0
+	delete(d.dlFrequencies, index)
+	log.Printf("[%s] NewChannelReq: channel %d on %d Hz DR%d-%d", d.DevEUI, index, req.Freq, req.MinDR, req.MaxDR)
+
+	return ans
+}
+
+// handleRXTimingSetupReq changes the delay of the RX1 window, 0 is one
+// second.
+// Must be called with the lock held.
+func (d *Device) handleRXTimingSetupReq(req *lorawan.RXTimingSetupReqPayload) {
+	d.rx1Delay = time.Duration(req.Delay) * time.Second
+	if d.rx1Delay == 0 {
+		d.rx1Delay = time.Second
+	}
+	log.Printf("[%s] RXTimingSetupReq: RX1 delay %s", d.DevEUI, d.rx1Delay)
+}
+
+// handleTxParamSetupReq sets the maximum EIRP and dwell times, lowering the
+// TX power when needed. It is false in regions not implementing it, where
+// it is not answered.
+// Must be called with the lock held.
+func (d *Device) handleTxParamSetupReq(req *lorawan.TXParamSetupReqPayload) bool {
+	if !d.region.SupportsTxParamSetup() {
+		log.Printf("[%s] TxParamSetupReq not supported by region %s", d.DevEUI, d.region.Name())
+		return false
+	}
+
+	maxEIRP, err := lorawan.GetTXParamSetupEIRP(req.MaxEIRP)
+	if err != nil {
+		return false
+	}
+	d.maxEIRP = float64(maxEIRP)
+	d.txPower = math.Min(d.txPower, d.maxEIRP)
+	d.uplinkDwellTime = req.UplinkDwellTime == lorawan.DwellTime400ms
+	d.downlinkDwellTime = req.DownlinkDwelltime == lorawan.DwellTime400ms
+	log.Printf("[%s] TxParamSetupReq: max EIRP %g dBm, uplink dwell time %t, downlink dwell time %t", d.DevEUI, d.maxEIRP, d.uplinkDwellTime, d.downlinkDwellTime)
+
+	return true
+}
+
+// handleDlChannelReq moves the RX1 window of an uplink channel to another
+// frequency. Regions with a fixed channel plan ignore it.
+// Must be called with the lock held.
+func (d *Device) handleDlChannelReq(req *lorawan.DLChannelReqPayload) *lorawan.DLChannelAnsPayload {
+	if !d.region.SupportsNewChannel() {
+		log.Printf("[%s] DlChannelReq not supported by region %s", d.DevEUI, d.region.Name())
+		return nil
+	}
+
+	index := int(req.ChIndex)
+	ans := &lorawan.DLChannelAnsPayload{
+		UplinkFrequencyExists: index < len(d.channels) && d.channels[index].Frequency != 0,
+		ChannelFrequencyOK:    d.region.IsFrequency(req.Freq),
+	}
+	if ans.UplinkFrequencyExists && ans.ChannelFrequencyOK {
+		if d.dlFrequencies == nil {
+			d.dlFrequencies = make(map[int]uint32)
+		}
+		d.dlFrequencies[index] = req.Freq
+		log.Printf("[%s] DlChannelReq: RX1 of channel %d on %d Hz", d.DevEUI, index, req.Freq)
+	}
+	return ans
+}
+
+// resetMACParameters restores the channel plan of the region and sub-band
+// and the other parameters set by MAC commands, for a new session.
+// Must be called with the lock held.
+func (d *Device) resetMACParameters() {
+	d.channels = d.region.ChannelPlan()
+	chMask, err := d.region.ChannelMask(d.subBand)
+	if err != nil {
+		log.Printf("[%s] invalid sub-band %d: %v", d.DevEUI, d.subBand, err)
+	}
+	d.chMask = append(chMask, make([]bool, len(d.channels)-len(chMask))...)
+	d.maxEIRP = d.region.MaxEIRP()
+	d.txPower = math.Min(d.txPower, d.maxEIRP)
+	d.uplinkDwellTime = false
+	d.downlinkDwellTime = false
+	d.nbTrans = 1
+	d.maxDutyCycle = 0
+	d.dutyCycleUntil = time.Time{}
+	d.dlFrequencies = nil
+	d.stickyMACCommands = nil
+	d.adrAckCnt = 0
+	d.cancelRetransmission()
+	d.ackPending = false
+}
+
+// applyDutyCycle silences the device after an uplink of the given size
+// (bytes) to respect the duty cycle set by DutyCycleReq.
+// Must be called with the lock held.
+func (d *Device) applyDutyCycle(uplinkTime time.Time, dataRate int, size int) {
+	if d.maxDutyCycle == 0 {
+		return
+	}
+
+	airtime, err := d.region.Airtime(dataRate, size)
+	if err != nil {
+		log.Printf("[%s] duty cycle not applied: %v", d.DevEUI, err)
+		return
+	}
+	d.dutyCycleUntil = uplinkTime.Add(airtime * time.Duration(1<<d.maxDutyCycle-1))
+}
+
+// supportsDataRate reports whether one of the enabled channels supports the
+// data rate.
+// Must be called with the lock held.
+func (d *Device) supportsDataRate(chMask []bool, dr int) bool {
+	for i, c := range d.channels {
+		if chMask[i] && dr >= c.MinDR && dr <= c.MaxDR {
+			return true
+		}
+	}
+	return false
+}
+
+// channelIndex returns the index of the uplink channel of a frequency, -1
+// when it is not in the channel plan.
+// Must be called with the lock held.
+func (d *Device) channelIndex(frequency uint32) int {
+	for i, c := range d.channels {
+		if c.Frequency == frequency {
+			return i
+		}
+	}
+	return -1
+}
+
+// channelInfo returns the enabled uplink channels.
+// Must be called with the lock held.
+func (d *Device) channelInfo() []ChannelInfo {
+	var channels []ChannelInfo
+	for i, c := range d.channels {
+		if d.chMask[i] {
+			channels = append(channels, ChannelInfo{Index: i, Frequency: c.Frequency, MinDR: c.MinDR, MaxDR: c.MaxDR, DlFrequency: d.dlFrequencies[i]})
+		}
+	}
+	return channels
+}
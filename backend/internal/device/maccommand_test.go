@@ -0,0 +1,288 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/gps"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDevice_MACCommands(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	nwkSKey := lorawan.AES128Key{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	appSKey := lorawan.AES128Key{0x10, 0x0f, 0x0e, 0x0d, 0x0c, 0x0b, 0x0a, 0x09, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}
+
+	newDevice := func(t *testing.T, name region.Name) (*Device, chan radio.Uplink) {
+		uplinkCh := make(chan radio.Uplink, 10)
+		device := New(uplinkCh, devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, devAddr, appSKey, nwkSKey, 0, 0)
+		r, err := region.Get(name)
+		assert.NoError(t, err)
+		assert.NoError(t, device.SetRegion(r, 0))
+		return device, uplinkCh
+	}
+
+	// send sends the MAC commands in the FOpts of a downlink, or in its
+	// FRMPayload on FPort 0
+	fCntDn := uint32(0)
+	send := func(t *testing.T, device *Device, fPort0 bool, cmds ...lorawan.MACCommand) {
+		var pls []lorawan.Payload
+		for i := range cmds {
+			pls = append(pls, &cmds[i])
+		}
+		macPL := &lorawan.MACPayload{FHDR: lorawan.FHDR{DevAddr: devAddr, FCnt: fCntDn}}
+		if fPort0 {
+			fPort := uint8(0)
+			macPL.FPort = &fPort
+			macPL.FRMPayload = pls
+		} else {
+			macPL.FHDR.FOpts = pls
+		}
+		phy := lorawan.PHYPayload{
+			MHDR:       lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: macPL,
+		}
+		fCntDn++
+		if fPort0 {
+			assert.NoError(t, phy.EncryptFRMPayload(nwkSKey))
+		}
+		assert.NoError(t, phy.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, nwkSKey))
+
+		b, err := phy.MarshalBinary()
+		assert.NoError(t, err)
+		var received lorawan.PHYPayload
+		assert.NoError(t, received.UnmarshalBinary(b))
+		assert.NoError(t, device.Downlink(received))
+	}
+	downlink := func(t *testing.T, device *Device, cmds ...lorawan.MACCommand) {
+		send(t, device, false, cmds...)
+	}
+
+	// uplink sends an uplink and returns the MAC commands of its FOpts
+	uplink := func(t *testing.T, device *Device, uplinkCh chan radio.Uplink) []lorawan.MACCommand {
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+
+		var phy lorawan.PHYPayload
+		select {
+		case uplink := <-uplinkCh:
+			b, err := uplink.PHYPayload.MarshalBinary()
+			assert.NoError(t, err)
+			assert.NoError(t, phy.UnmarshalBinary(b))
+		case <-time.After(time.Second):
+			t.Fatal("uplink not broadcast")
+		}
+
+		assert.NoError(t, phy.DecodeFOptsToMACCommands())
+		var cmds []lorawan.MACCommand
+		for _, pl := range phy.MACPayload.(*lorawan.MACPayload).FHDR.FOpts {
+			cmds = append(cmds, *pl.(*lorawan.MACCommand))
+		}
+		return cmds
+	}
+
+	t.Run("applies LinkADRReq", func(t *testing.T) {
+		device, uplinkCh := newDevice(t, region.EU868)
+
+		downlink(t, device, lorawan.MACCommand{CID: lorawan.LinkADRReq, Payload: &lorawan.LinkADRReqPayload{
+			DataRate:   3,
+			TXPower:    2,
+			ChMask:     lorawan.ChMask{true, true},
+			Redundancy: lorawan.Redundancy{NbRep: 2},
+		}})
+
+		info := device.GetInfo()
+		assert.Equal(t, 3, info.DataRate)
+		assert.Equal(t, float64(12), info.TxPower)
+		assert.Equal(t, 2, info.NbTrans)
+		assert.Len(t, info.Channels, 2)
+
+		cmds := uplink(t, device, uplinkCh)
+		if assert.Len(t, cmds, 1) {
+			assert.Equal(t, lorawan.LinkADRAns, cmds[0].CID)
+			assert.Equal(t, &lorawan.LinkADRAnsPayload{ChannelMaskACK: true, DataRateACK: true, PowerACK: true}, cmds[0].Payload)
+		}
+	})
+
+	t.Run("rejects the whole LinkADRReq block", func(t *testing.T) {
+		device, uplinkCh := newDevice(t, region.EU868)
+
+		downlink(t, device,
+			lorawan.MACCommand{CID: lorawan.LinkADRReq, Payload: &lorawan.LinkADRReqPayload{DataRate: 15, TXPower: 15, ChMask: lorawan.ChMask{true}}},
+			lorawan.MACCommand{CID: lorawan.LinkADRReq, Payload: &lorawan.LinkADRReqPayload{DataRate: 2, TXPower: 15, ChMask: lorawan.ChMask{5: true}}},
+		)
+
+		info := device.GetInfo()
+		assert.Equal(t, 5, info.DataRate)
+		assert.Len(t, info.Channels, 3)
+
+		cmds := uplink(t, device, uplinkCh)
+		if assert.Len(t, cmds, 2) {
+			for _, cmd := range cmds {
+				assert.Equal(t, lorawan.LinkADRAns, cmd.CID)
+				assert.Equal(t, &lorawan.LinkADRAnsPayload{ChannelMaskACK: false, DataRateACK: true, PowerACK: true}, cmd.Payload)
+			}
+		}
+	})
+
+	t.Run("adds channels and moves their RX1 frequency", func(t *testing.T) {
+		device, uplinkCh := newDevice(t, region.EU868)
+
+		// Too long for FOpts, sent on FPort 0
+		send(t, device, true,
+			lorawan.MACCommand{CID: lorawan.NewChannelReq, Payload: &lorawan.NewChannelReqPayload{ChIndex: 3, Freq: 867100000, MaxDR: 5}},
+			lorawan.MACCommand{CID: lorawan.NewChannelReq, Payload: &lorawan.NewChannelReqPayload{ChIndex: 1, Freq: 867300000, MaxDR: 5}},
+			lorawan.MACCommand{CID: lorawan.DLChannelReq, Payload: &lorawan.DLChannelReqPayload{ChIndex: 3, Freq: 869000000}},
+		)
+
+		info := device.GetInfo()
+		if assert.Len(t, info.Channels, 4) {
+			assert.Equal(t, ChannelInfo{Index: 3, Frequency: 867100000, MaxDR: 5, DlFrequency: 869000000}, info.Channels[3])
+		}
+
+		// DlChannelAns is repeated until a downlink is received, the
+		// NewChannelAns are sent once
+		for _, count := range []int{3, 1} {
+			cmds := uplink(t, device, uplinkCh)
+			if assert.Len(t, cmds, count) {
+				assert.Equal(t, lorawan.DLChannelAns, cmds[0].CID)
+				assert.Equal(t, &lorawan.DLChannelAnsPayload{UplinkFrequencyExists: true, ChannelFrequencyOK: true}, cmds[0].Payload)
+			}
+		}
+		downlink(t, device)
+		assert.Empty(t, uplink(t, device, uplinkCh))
+	})
+
+	t.Run("ignores NewChannelReq with a fixed channel plan", func(t *testing.T) {
+		device, uplinkCh := newDevice(t, region.US915)
+
+		downlink(t, device, lorawan.MACCommand{CID: lorawan.NewChannelReq, Payload: &lorawan.NewChannelReqPayload{ChIndex: 3, Freq: 905000000, MaxDR: 3}})
+
+		assert.Len(t, device.GetInfo().Channels, 9)
+		assert.Empty(t, uplink(t, device, uplinkCh))
+	})
+
+	t.Run("applies RXParamSetupReq and RXTimingSetupReq", func(t *testing.T) {
+		device, uplinkCh := newDevice(t, region.EU868)
+
+		downlink(t, device,
+			lorawan.MACCommand{CID: lorawan.RXParamSetupReq, Payload: &lorawan.RXParamSetupReqPayload{
+				Frequency:  869525000,
+				DLSettings: lorawan.DLSettings{RX2DataRate: 3, RX1DROffset: 2},
+			}},
+			lorawan.MACCommand{CID: lorawan.RXTimingSetupReq, Payload: &lorawan.RXTimingSetupReqPayload{Delay: 3}},
+		)
+
+		info := device.GetInfo()
+		assert.Equal(t, 2, info.RX1DROffset)
+		assert.Equal(t, 3, info.RX2DataRate)
+		assert.Equal(t, 3, info.RX1Delay)
+
+		cmds := uplink(t, device, uplinkCh)
+		if assert.Len(t, cmds, 2) {
+			assert.Equal(t, &lorawan.RXParamSetupAnsPayload{ChannelACK: true, RX2DataRateACK: true, RX1DROffsetACK: true}, cmds[0].Payload)
+			assert.Equal(t, lorawan.RXTimingSetupAns, cmds[1].CID)
+		}
+	})
+
+	t.Run("answers DevStatusReq with the battery level", func(t *testing.T) {
+		device, uplinkCh := newDevice(t, region.EU868)
+		assert.Equal(t, BatteryUnknown, device.GetInfo().Battery)
+		device.SetBattery(128)
+
+		downlink(t, device, lorawan.MACCommand{CID: lorawan.DevStatusReq})
+
+		cmds := uplink(t, device, uplinkCh)
+		if assert.Len(t, cmds, 1) {
+			assert.Equal(t, lorawan.DevStatusAns, cmds[0].CID)
+			assert.Equal(t, &lorawan.DevStatusAnsPayload{Battery: 128}, cmds[0].Payload)
+		}
+	})
+
+	t.Run("waits for the off period of DutyCycleReq", func(t *testing.T) {
+		device, uplinkCh := newDevice(t, region.EU868)
+
+		downlink(t, device, lorawan.MACCommand{CID: lorawan.DutyCycleReq, Payload: &lorawan.DutyCycleReqPayload{MaxDCycle: 10}})
+		assert.Equal(t, uint8(10), device.GetInfo().MaxDutyCycle)
+
+		cmds := uplink(t, device, uplinkCh)
+		if assert.Len(t, cmds, 1) {
+			assert.Equal(t, lorawan.DutyCycleAns, cmds[0].CID)
+		}
+
+		_, err := device.Uplink(1, []byte{0x01}, false)
+		assert.ErrorContains(t, err, "duty cycle")
+	})
+
+	t.Run("lowers the TX power on TxParamSetupReq", func(t *testing.T) {
+		device, uplinkCh := newDevice(t, region.AS923)
+
+		downlink(t, device, lorawan.MACCommand{CID: lorawan.TXParamSetupReq, Payload: &lorawan.TXParamSetupReqPayload{
+			UplinkDwellTime: lorawan.DwellTime400ms,
+			MaxEIRP:         0,
+		}})
+
+		info := device.GetInfo()
+		assert.Equal(t, float64(8), info.MaxEIRP)
+		assert.Equal(t, float64(8), info.TxPower)
+		assert.True(t, info.UplinkDwellTime)
+
+		cmds := uplink(t, device, uplinkCh)
+		if assert.Len(t, cmds, 1) {
+			assert.Equal(t, lorawan.TXParamSetupAns, cmds[0].CID)
+		}
+		assert.Error(t, device.SetTxPower(10))
+	})
+
+	t.Run("ignores TxParamSetupReq in regions not implementing it", func(t *testing.T) {
+		device, uplinkCh := newDevice(t, region.EU868)
+
+		downlink(t, device, lorawan.MACCommand{CID: lorawan.TXParamSetupReq, Payload: &lorawan.TXParamSetupReqPayload{MaxEIRP: 0}})
+
+		assert.Equal(t, float64(16), device.GetInfo().MaxEIRP)
+		assert.Empty(t, uplink(t, device, uplinkCh))
+	})
+
+	t.Run("sends LinkCheckReq and DeviceTimeReq on request", func(t *testing.T) {
+		device, uplinkCh := newDevice(t, region.EU868)
+		assert.Nil(t, device.GetInfo().LinkCheck)
+		assert.Nil(t, device.GetInfo().DeviceTime)
+
+		device.RequestLinkCheck()
+		device.RequestLinkCheck()
+		device.RequestDeviceTime()
+		info := device.GetInfo()
+		assert.True(t, info.LinkCheck.Pending)
+		assert.True(t, info.DeviceTime.Pending)
+
+		cmds := uplink(t, device, uplinkCh)
+		if assert.Len(t, cmds, 2, "requested once") {
+			assert.Equal(t, lorawan.LinkCheckReq, cmds[0].CID)
+			assert.Equal(t, lorawan.DeviceTimeReq, cmds[1].CID)
+		}
+		assert.True(t, device.GetInfo().LinkCheck.Pending)
+
+		networkTime := time.Now().Add(1500 * time.Millisecond)
+		downlink(t, device,
+			lorawan.MACCommand{CID: lorawan.LinkCheckAns, Payload: &lorawan.LinkCheckAnsPayload{Margin: 12, GwCnt: 3}},
+			lorawan.MACCommand{CID: lorawan.DeviceTimeAns, Payload: &lorawan.DeviceTimeAnsPayload{TimeSinceGPSEpoch: gps.Time(networkTime).TimeSinceGPSEpoch()}},
+		)
+
+		info = device.GetInfo()
+		if assert.NotNil(t, info.LinkCheck) {
+			assert.False(t, info.LinkCheck.Pending)
+			assert.Equal(t, uint8(12), info.LinkCheck.Margin)
+			assert.Equal(t, uint8(3), info.LinkCheck.GwCnt)
+			assert.NotNil(t, info.LinkCheck.Received)
+		}
+		if assert.NotNil(t, info.DeviceTime) {
+			assert.False(t, info.DeviceTime.Pending)
+			assert.WithinDuration(t, networkTime, *info.DeviceTime.NetworkTime, 5*time.Millisecond, "1/256 s resolution")
+			assert.InDelta(t, 1500, info.DeviceTime.OffsetMs, 100)
+		}
+	})
+}
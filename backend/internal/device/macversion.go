@@ -0,0 +1,190 @@
+package device
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/brocaar/lorawan"
+)
+
+// MACVersion is the LoRaWAN version implemented by the device
+type MACVersion string
+
+const (
+	// MACVersion1_0 derives the NwkSKey and AppSKey from the AppKey
+	MACVersion1_0 MACVersion = "1.0"
+	// MACVersion1_1 separates the network keys, derived from the NwkKey,
+	// from the application keys, derived from the AppKey
+	MACVersion1_1 MACVersion = "1.1"
+)
+
+// ParseMACVersion validates a MAC version, an empty version selects 1.0
+func ParseMACVersion(name string) (MACVersion, error) {
+	switch MACVersion(name) {
+	case "", MACVersion1_0:
+		return MACVersion1_0, nil
+	case MACVersion1_1:
+		return MACVersion1_1, nil
+	default:
+		return "", fmt.Errorf("unsupported MAC version %q", name)
+	}
+}
+
+// LoRaWAN11Keys are the keys of a LoRaWAN 1.1 device beyond the AppKey,
+// AppSKey and NwkSKey, which is the FNwkSIntKey of a 1.1 session
+type LoRaWAN11Keys struct {
+	NwkKey      lorawan.AES128Key `json:"nwkkey"`
+	SNwkSIntKey lorawan.AES128Key `json:"snwksintkey"`
+	NwkSEncKey  lorawan.AES128Key `json:"nwksenckey"`
+	JSIntKey    lorawan.AES128Key `json:"jsintkey"` // derived from the NwkKey
+	JSEncKey    lorawan.AES128Key `json:"jsenckey"` // derived from the NwkKey
+}
+
+// SetMACVersion sets the LoRaWAN version of the device. The NwkKey, and the
+// SNwkSIntKey and NwkSEncKey of an activated device, are only used by 1.1.
+func (d *Device) SetMACVersion(version MACVersion, keys LoRaWAN11Keys) error {
+	version, err := ParseMACVersion(string(version))
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.macVersion = version
+	d.keys11 = LoRaWAN11Keys{}
+	d.session11 = version == MACVersion1_1
+	d.rekeyPending = false
+	if version == MACVersion1_1 {
+		d.keys11 = keys
+		d.keys11.JSIntKey, err = deriveJSKey(0x06, keys.NwkKey, d.DevEUI)
+		if err != nil {
+			return err
+		}
+		d.keys11.JSEncKey, err = deriveJSKey(0x05, keys.NwkKey, d.DevEUI)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lorawanVersion returns the version of the current session.
+// Must be called with the lock held.
+func (d *Device) lorawanVersion() lorawan.MACVersion {
+	if d.session11 {
+		return lorawan.LoRaWAN1_1
+	}
+	return lorawan.LoRaWAN1_0
+}
+
+// sNwkSIntKey returns the key of the downlink MIC, the NwkSKey in 1.0.
+// Must be called with the lock held.
+func (d *Device) sNwkSIntKey() lorawan.AES128Key {
+	if d.session11 {
+		return d.keys11.SNwkSIntKey
+	}
+	return d.NwkSKey
+}
+
+// nwkSEncKey returns the key of the MAC commands, the NwkSKey in 1.0.
+// Must be called with the lock held.
+func (d *Device) nwkSEncKey() lorawan.AES128Key {
+	if d.session11 {
+		return d.keys11.NwkSEncKey
+	}
+	return d.NwkSKey
+}
+
+// joinKey returns the root key of the join procedure: the NwkKey in 1.1,
+// the AppKey in 1.0.
+// Must be called with the lock held.
+func (d *Device) joinKey() lorawan.AES128Key {
+	if d.macVersion == MACVersion1_1 {
+		return d.keys11.NwkKey
+	}
+	return d.AppKey
+}
+
+// deriveSessionKeys11 derives the keys of a LoRaWAN 1.1 session, the network
+// keys from the NwkKey and the AppSKey from the AppKey. The device confirms
+// the session with RekeyInd until the network server answers RekeyConf.
+// Must be called with the lock held.
+func (d *Device) deriveSessionKeys11(joinNonce lorawan.JoinNonce, devNonce lorawan.DevNonce) error {
+	keys := []struct {
+		typ  byte
+		root lorawan.AES128Key
+		key  *lorawan.AES128Key
+	}{
+		{0x01, d.keys11.NwkKey, &d.NwkSKey},
+		{0x02, d.AppKey, &d.AppSKey},
+		{0x03, d.keys11.NwkKey, &d.keys11.SNwkSIntKey},
+		{0x04, d.keys11.NwkKey, &d.keys11.NwkSEncKey},
+	}
+	for _, k := range keys {
+		key, err := deriveSessionKey11(k.typ, k.root, joinNonce, d.JoinEUI, devNonce)
+		if err != nil {
+			log.Printf("[%s] failed to derive session key 0x%02x: %v", d.DevEUI, k.typ, err)
+			return err
+		}
+		*k.key = key
+	}
+
+	d.session11 = true
+	d.rekeyPending = true
+
+	return nil
+}
+
+// lorawan11Keys returns the LoRaWAN 1.1 keys, nil for 1.0 devices.
+// Must be called with the lock held.
+func (d *Device) lorawan11Keys() *LoRaWAN11Keys {
+	if d.macVersion != MACVersion1_1 {
+		return nil
+	}
+	keys := d.keys11
+	return &keys
+}
+
+// deriveSessionKey11 derives the FNwkSIntKey (typ=0x01), AppSKey (0x02),
+// SNwkSIntKey (0x03) or NwkSEncKey (0x04) of a LoRaWAN 1.1 session
+func deriveSessionKey11(typ byte, key lorawan.AES128Key, joinNonce lorawan.JoinNonce, joinEUI lorawan.EUI64, devNonce lorawan.DevNonce) (lorawan.AES128Key, error) {
+	// type | JoinNonce | JoinEUI | DevNonce | pad, little endian
+	plaintext := make([]byte, 16)
+	plaintext[0] = typ
+	plaintext[1], plaintext[2], plaintext[3] = byte(joinNonce), byte(joinNonce>>8), byte(joinNonce>>16)
+	for i := 0; i < 8; i++ {
+		plaintext[4+i] = joinEUI[7-i]
+	}
+	binary.LittleEndian.PutUint16(plaintext[12:], uint16(devNonce))
+
+	return encryptKey(key, plaintext)
+}
+
+// deriveJSKey derives the JSEncKey (typ=0x05) or JSIntKey (0x06) of a
+// LoRaWAN 1.1 device
+func deriveJSKey(typ byte, nwkKey lorawan.AES128Key, devEUI lorawan.EUI64) (lorawan.AES128Key, error) {
+	// type | DevEUI | pad, little endian
+	plaintext := make([]byte, 16)
+	plaintext[0] = typ
+	for i := 0; i < 8; i++ {
+		plaintext[1+i] = devEUI[7-i]
+	}
+
+	return encryptKey(nwkKey, plaintext)
+}
+
+func encryptKey(key lorawan.AES128Key, plaintext []byte) (lorawan.AES128Key, error) {
+	var derived lorawan.AES128Key
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return derived, err
+	}
+	block.Encrypt(derived[:], plaintext)
+
+	return derived, nil
+}
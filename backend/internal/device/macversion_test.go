@@ -0,0 +1,197 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMACVersion(t *testing.T) {
+	version, err := ParseMACVersion("")
+	assert.NoError(t, err)
+	assert.Equal(t, MACVersion1_0, version)
+
+	version, err = ParseMACVersion("1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, MACVersion1_1, version)
+
+	_, err = ParseMACVersion("1.2")
+	assert.Error(t, err)
+}
+
+// newTestDevice11 returns a LoRaWAN 1.1 device joined with the given OptNeg
+func newTestDevice11(t *testing.T, nwkKey lorawan.AES128Key, optNeg bool) (*Device, chan radio.Uplink) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	joinEUI := lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+	appKey := lorawan.AES128Key{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+	uplinkCh := make(chan radio.Uplink, 10)
+	device := New(uplinkCh, devEUI, joinEUI, appKey, 100, lorawan.DevAddr{}, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0)
+	assert.NoError(t, device.SetMACVersion(MACVersion1_1, LoRaWAN11Keys{NwkKey: nwkKey}))
+
+	joinRequest, err := device.JoinRequest()
+	assert.NoError(t, err)
+	ok, err := joinRequest.ValidateUplinkJoinMIC(nwkKey)
+	assert.NoError(t, err)
+	assert.True(t, ok, "join request signed with the NwkKey")
+	<-uplinkCh
+
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{MType: lorawan.JoinAccept, Major: lorawan.LoRaWANR1},
+		MACPayload: &lorawan.JoinAcceptPayload{
+			JoinNonce:  0x123456,
+			HomeNetID:  lorawan.NetID{0x00, 0x00, 0x01},
+			DevAddr:    lorawan.DevAddr{0x01, 0x02, 0x03, 0x04},
+			DLSettings: lorawan.DLSettings{OptNeg: optNeg},
+			RXDelay:    1,
+		},
+	}
+	micKey := nwkKey
+	if optNeg {
+		micKey = device.GetInfo().LoRaWAN11.JSIntKey
+	}
+	assert.NoError(t, phy.SetDownlinkJoinMIC(lorawan.JoinRequestType, joinEUI, 100, micKey))
+	assert.NoError(t, phy.EncryptJoinAcceptPayload(nwkKey))
+	assert.NoError(t, device.JoinAccept(phy))
+
+	return device, uplinkCh
+}
+
+func TestDevice_LoRaWAN11(t *testing.T) {
+	joinEUI := lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+	appKey := lorawan.AES128Key{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	nwkKey := lorawan.AES128Key{0xff, 0xee, 0xdd, 0xcc, 0xbb, 0xaa, 0x99, 0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11, 0x00}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+
+	uplink := func(t *testing.T, device *Device, uplinkCh chan radio.Uplink, confirmed bool) radio.Uplink {
+		_, err := device.Uplink(1, []byte{0x01}, confirmed)
+		assert.NoError(t, err)
+		select {
+		case uplink := <-uplinkCh:
+			return uplink
+		case <-time.After(time.Second):
+			t.Fatal("uplink not broadcast")
+			return radio.Uplink{}
+		}
+	}
+
+	// overTheAir returns the frame as received by the other side, its
+	// encrypted FOpts not decoded
+	overTheAir := func(t *testing.T, phy lorawan.PHYPayload) lorawan.PHYPayload {
+		b, err := phy.MarshalBinary()
+		assert.NoError(t, err)
+		var received lorawan.PHYPayload
+		assert.NoError(t, received.UnmarshalBinary(b))
+		return received
+	}
+
+	t.Run("derives the 1.1 session keys on an OptNeg join accept", func(t *testing.T) {
+		device, _ := newTestDevice11(t, nwkKey, true)
+
+		info := device.GetInfo()
+		assert.Equal(t, MACVersion1_1, info.MACVersion)
+		assert.True(t, info.RekeyPending)
+		assert.Equal(t, devAddr, info.DevAddr)
+
+		keys := []lorawan.AES128Key{info.NwkSKey, info.AppSKey, info.LoRaWAN11.SNwkSIntKey, info.LoRaWAN11.NwkSEncKey}
+		for i, key := range keys {
+			assert.NotEqual(t, lorawan.AES128Key{}, key)
+			for _, other := range keys[i+1:] {
+				assert.NotEqual(t, other, key)
+			}
+		}
+
+		// The AppSKey is derived from the AppKey
+		appSKey, err := deriveSessionKey11(0x02, appKey, 0x123456, joinEUI, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, appSKey, info.AppSKey)
+	})
+
+	t.Run("falls back to 1.0 without OptNeg", func(t *testing.T) {
+		device, uplinkCh := newTestDevice11(t, nwkKey, false)
+
+		info := device.GetInfo()
+		assert.False(t, info.RekeyPending)
+
+		// The 1.0 session keys are derived from the NwkKey
+		nwkSKey, err := deriveSessionKey(0x01, nwkKey, 0x123456, lorawan.NetID{0x00, 0x00, 0x01}, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, nwkSKey, info.NwkSKey)
+
+		received := uplink(t, device, uplinkCh, false)
+		ok, err := received.PHYPayload.ValidateUplinkDataMIC(lorawan.LoRaWAN1_0, 0, 0, 0, nwkSKey, lorawan.AES128Key{})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("signs uplinks and encrypts FOpts with the 1.1 keys", func(t *testing.T) {
+		device, uplinkCh := newTestDevice11(t, nwkKey, true)
+		info := device.GetInfo()
+
+		received := uplink(t, device, uplinkCh, false)
+		txCh, err := device.region.UplinkChannelIndex(received.Frequency, received.DataRate)
+		assert.NoError(t, err)
+		phy := overTheAir(t, received.PHYPayload)
+
+		ok, err := phy.ValidateUplinkDataMIC(lorawan.LoRaWAN1_1, 0, uint8(received.DataRate), uint8(txCh), info.NwkSKey, info.LoRaWAN11.SNwkSIntKey)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		// RekeyInd is sent until the RekeyConf
+		assert.NoError(t, phy.DecryptFOpts(info.LoRaWAN11.NwkSEncKey))
+		fOpts := phy.MACPayload.(*lorawan.MACPayload).FHDR.FOpts
+		if assert.Len(t, fOpts, 1) {
+			cmd := fOpts[0].(*lorawan.MACCommand)
+			assert.Equal(t, lorawan.RekeyInd, cmd.CID)
+			assert.Equal(t, &lorawan.RekeyIndPayload{DevLoRaWANVersion: lorawan.Version{Minor: 1}}, cmd.Payload)
+		}
+
+		phy = overTheAir(t, uplink(t, device, uplinkCh, false).PHYPayload)
+		assert.NoError(t, phy.DecryptFOpts(info.LoRaWAN11.NwkSEncKey))
+		assert.Len(t, phy.MACPayload.(*lorawan.MACPayload).FHDR.FOpts, 1)
+	})
+
+	t.Run("stops RekeyInd on RekeyConf", func(t *testing.T) {
+		device, uplinkCh := newTestDevice11(t, nwkKey, true)
+		info := device.GetInfo()
+		uplink(t, device, uplinkCh, true)
+
+		// The ACK of the confirmed uplink signs its FCnt
+		downlink := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{
+				FHDR: lorawan.FHDR{
+					DevAddr: devAddr,
+					FCtrl:   lorawan.FCtrl{ACK: true},
+					FOpts: []lorawan.Payload{&lorawan.MACCommand{
+						CID:     lorawan.RekeyConf,
+						Payload: &lorawan.RekeyConfPayload{ServLoRaWANVersion: lorawan.Version{Minor: 1}},
+					}},
+				},
+			},
+		}
+		assert.NoError(t, downlink.EncryptFOpts(info.LoRaWAN11.NwkSEncKey))
+		assert.NoError(t, downlink.SetDownlinkDataMIC(lorawan.LoRaWAN1_1, 0, info.LoRaWAN11.SNwkSIntKey))
+		assert.NoError(t, device.Downlink(overTheAir(t, downlink)))
+
+		assert.False(t, device.GetInfo().RekeyPending)
+		phy := overTheAir(t, uplink(t, device, uplinkCh, false).PHYPayload)
+		assert.Empty(t, phy.MACPayload.(*lorawan.MACPayload).FHDR.FOpts)
+	})
+
+	t.Run("rejects a downlink signed with the 1.0 key", func(t *testing.T) {
+		device, uplinkCh := newTestDevice11(t, nwkKey, true)
+		info := device.GetInfo()
+		uplink(t, device, uplinkCh, false)
+
+		downlink := lorawan.PHYPayload{
+			MHDR:       lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{FHDR: lorawan.FHDR{DevAddr: devAddr, FCnt: 1}},
+		}
+		assert.NoError(t, downlink.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, info.NwkSKey))
+		assert.Error(t, device.Downlink(downlink))
+	})
+}
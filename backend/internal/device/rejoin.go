@@ -0,0 +1,105 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/brocaar/lorawan"
+)
+
+// rejoinRequest is a Rejoin-request waiting for its join accept
+type rejoinRequest struct {
+	rejoinType lorawan.JoinType
+	rjCount    uint16 // DevNonce of the join accept MIC and key derivation
+}
+
+// ParseRejoinType validates a Rejoin-request type (0, 1 or 2)
+func ParseRejoinType(rejoinType int) (lorawan.JoinType, error) {
+	switch rejoinType {
+	case 0, 1, 2:
+		return lorawan.JoinType(rejoinType), nil
+	default:
+		return 0, fmt.Errorf("invalid rejoin type %d", rejoinType)
+	}
+}
+
+// Rejoin sends a Rejoin-request of a LoRaWAN 1.1 session. Types 0 and 2
+// carry the NetID and RJcount0 and are signed with the SNwkSIntKey, type 1
+// carries the JoinEUI and RJcount1 and is signed with the JSIntKey. The join
+// accept answering it is encrypted with the JSEncKey.
+func (d *Device) Rejoin(rejoinType lorawan.JoinType) (lorawan.PHYPayload, error) {
+	d.mu.Lock()
+	if !d.session11 || d.macVersion != MACVersion1_1 {
+		d.mu.Unlock()
+		return lorawan.PHYPayload{}, errors.New("rejoin requires a LoRaWAN 1.1 session")
+	}
+
+	uplink, err := d.nextUplink()
+	if err != nil {
+		d.mu.Unlock()
+		return lorawan.PHYPayload{}, err
+	}
+
+	var macPL lorawan.Payload
+	var key lorawan.AES128Key
+	rejoin := &rejoinRequest{rejoinType: rejoinType}
+	switch rejoinType {
+	case lorawan.RejoinRequestType0, lorawan.RejoinRequestType2:
+		rejoin.rjCount = d.rjCount0
+		d.rjCount0++
+		key = d.sNwkSIntKey()
+		macPL = &lorawan.RejoinRequestType02Payload{
+			RejoinType: rejoinType,
+			NetID:      d.netID,
+			DevEUI:     d.DevEUI,
+			RJCount0:   rejoin.rjCount,
+		}
+	case lorawan.RejoinRequestType1:
+		rejoin.rjCount = d.rjCount1
+		d.rjCount1++
+		key = d.keys11.JSIntKey
+		macPL = &lorawan.RejoinRequestType1Payload{
+			RejoinType: rejoinType,
+			JoinEUI:    d.JoinEUI,
+			DevEUI:     d.DevEUI,
+			RJCount1:   rejoin.rjCount,
+		}
+	default:
+		d.mu.Unlock()
+		return lorawan.PHYPayload{}, fmt.Errorf("invalid rejoin type %d", rejoinType)
+	}
+
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.RejoinRequest,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: macPL,
+	}
+
+	d.rejoin = rejoin
+	d.openRXWindows(uplink, true)
+	d.record(Event{Type: EventRejoinRequest, Message: fmt.Sprintf("type %d, RJcount %d", rejoinType, rejoin.rjCount)})
+
+	d.mu.Unlock()
+
+	if err := phy.SetUplinkJoinMIC(key); err != nil {
+		return lorawan.PHYPayload{}, err
+	}
+
+	uplink.PHYPayload = phy
+	d.broadcast(uplink)
+
+	return phy, nil
+}
+
+// joinAcceptKeys returns the keys decrypting and signing the join accept of
+// the last Join-request or Rejoin-request, with the JoinReqType and DevNonce
+// of its MIC.
+// Must be called with the lock held.
+func (d *Device) joinAcceptKeys() (encKey, intKey lorawan.AES128Key, joinReqType lorawan.JoinType, devNonce lorawan.DevNonce) {
+	if d.rejoin != nil {
+		return d.keys11.JSEncKey, d.keys11.JSIntKey, d.rejoin.rejoinType, lorawan.DevNonce(d.rejoin.rjCount)
+	}
+	return d.joinKey(), d.keys11.JSIntKey, lorawan.JoinRequestType, d.DevNonce - 1
+}
@@ -0,0 +1,125 @@
+package device
+
+import (
+	"testing"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRejoinType(t *testing.T) {
+	rejoinType, err := ParseRejoinType(2)
+	assert.NoError(t, err)
+	assert.Equal(t, lorawan.RejoinRequestType2, rejoinType)
+
+	_, err = ParseRejoinType(3)
+	assert.Error(t, err)
+}
+
+func TestDevice_Rejoin(t *testing.T) {
+	joinEUI := lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+	appKey := lorawan.AES128Key{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	nwkKey := lorawan.AES128Key{0xff, 0xee, 0xdd, 0xcc, 0xbb, 0xaa, 0x99, 0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11, 0x00}
+
+	// joinAccept returns the join accept of a Rejoin-request, as sent by the
+	// join server
+	joinAccept := func(t *testing.T, device *Device, rejoinType lorawan.JoinType, rjCount uint16, devAddr lorawan.DevAddr) lorawan.PHYPayload {
+		keys := device.GetInfo().LoRaWAN11
+		phy := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{MType: lorawan.JoinAccept, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.JoinAcceptPayload{
+				JoinNonce:  0x123457,
+				HomeNetID:  lorawan.NetID{0x00, 0x00, 0x01},
+				DevAddr:    devAddr,
+				DLSettings: lorawan.DLSettings{OptNeg: true},
+				RXDelay:    1,
+			},
+		}
+		assert.NoError(t, phy.SetDownlinkJoinMIC(rejoinType, joinEUI, lorawan.DevNonce(rjCount), keys.JSIntKey))
+		assert.NoError(t, phy.EncryptJoinAcceptPayload(keys.JSEncKey))
+		return phy
+	}
+
+	t.Run("sends type 0 rejoin request signed with the SNwkSIntKey", func(t *testing.T) {
+		device, uplinkCh := newTestDevice11(t, nwkKey, true)
+		info := device.GetInfo()
+
+		for i := 0; i < 2; i++ {
+			phy, err := device.Rejoin(lorawan.RejoinRequestType0)
+			assert.NoError(t, err)
+			uplink := <-uplinkCh
+			assert.Equal(t, lorawan.RejoinRequest, uplink.PHYPayload.MHDR.MType)
+
+			ok, err := phy.ValidateUplinkJoinMIC(info.LoRaWAN11.SNwkSIntKey)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			rejoin := phy.MACPayload.(*lorawan.RejoinRequestType02Payload)
+			assert.Equal(t, lorawan.NetID{0x00, 0x00, 0x01}, rejoin.NetID)
+			assert.Equal(t, info.DevEUI, rejoin.DevEUI)
+			assert.Equal(t, uint16(i), rejoin.RJCount0)
+		}
+		assert.Equal(t, uint16(2), device.GetInfo().RJCount0)
+	})
+
+	t.Run("sends type 1 rejoin request signed with the JSIntKey", func(t *testing.T) {
+		device, uplinkCh := newTestDevice11(t, nwkKey, true)
+
+		phy, err := device.Rejoin(lorawan.RejoinRequestType1)
+		assert.NoError(t, err)
+		<-uplinkCh
+
+		ok, err := phy.ValidateUplinkJoinMIC(device.GetInfo().LoRaWAN11.JSIntKey)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		rejoin := phy.MACPayload.(*lorawan.RejoinRequestType1Payload)
+		assert.Equal(t, joinEUI, rejoin.JoinEUI)
+		assert.Equal(t, uint16(0), rejoin.RJCount1)
+		assert.Equal(t, uint16(1), device.GetInfo().RJCount1)
+	})
+
+	t.Run("applies the join accept of a rejoin request", func(t *testing.T) {
+		device, uplinkCh := newTestDevice11(t, nwkKey, true)
+		_, err := device.Rejoin(lorawan.RejoinRequestType0)
+		assert.NoError(t, err)
+		_, err = device.Rejoin(lorawan.RejoinRequestType2)
+		assert.NoError(t, err)
+		<-uplinkCh
+		<-uplinkCh
+
+		newDevAddr := lorawan.DevAddr{0x05, 0x06, 0x07, 0x08}
+		assert.NoError(t, device.JoinAccept(joinAccept(t, device, lorawan.RejoinRequestType2, 1, newDevAddr)))
+
+		info := device.GetInfo()
+		assert.Equal(t, newDevAddr, info.DevAddr)
+		assert.True(t, info.RekeyPending)
+		assert.Equal(t, uint16(0), info.RJCount0, "RJcount0 restarts with the session")
+
+		// The RJcount replaces the DevNonce in the key derivation
+		appSKey, err := deriveSessionKey11(0x02, appKey, 0x123457, joinEUI, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, appSKey, info.AppSKey)
+	})
+
+	t.Run("rejects the join accept of another rejoin request", func(t *testing.T) {
+		device, uplinkCh := newTestDevice11(t, nwkKey, true)
+		_, err := device.Rejoin(lorawan.RejoinRequestType1)
+		assert.NoError(t, err)
+		<-uplinkCh
+
+		assert.Error(t, device.JoinAccept(joinAccept(t, device, lorawan.RejoinRequestType0, 0, lorawan.DevAddr{0x05, 0x06, 0x07, 0x08})))
+		assert.Equal(t, lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}, device.GetInfo().DevAddr)
+	})
+
+	t.Run("rejects rejoin without a 1.1 session", func(t *testing.T) {
+		device, _ := newTestDevice11(t, nwkKey, false)
+		_, err := device.Rejoin(lorawan.RejoinRequestType0)
+		assert.Error(t, err)
+
+		device = New(make(chan radio.Uplink, 10), lorawan.EUI64{}, joinEUI, appKey, 0, lorawan.DevAddr{}, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0)
+		_, err = device.Rejoin(lorawan.RejoinRequestType1)
+		assert.Error(t, err)
+	})
+}
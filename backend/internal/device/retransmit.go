@@ -0,0 +1,121 @@
+package device
+
+import (
+	"log"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+// retransmissionDelay is the time between the RX2 window of a transmission
+// and its repetition. Variable so that tests can shorten it.
+var retransmissionDelay = time.Second
+
+// retransmission repeats an uplink, with the same FCnt, once the RX windows
+// of the previous transmission closed
+type retransmission struct {
+	phy       lorawan.PHYPayload
+	confFCnt  uint32 // of the acknowledged downlink, signed in 1.1
+	remaining int
+	confirmed *ConfirmedUplink // nil for unconfirmed uplinks
+	timer     *time.Timer
+}
+
+// scheduleRetransmission repeats a data uplink the given number of times,
+// until a downlink (with ACK, for a confirmed uplink) is received or another
+// uplink is sent. A confirmed uplink is not acknowledged when the RX windows
+// of its last transmission close without ACK.
+// Must be called with the lock held.
+func (d *Device) scheduleRetransmission(phy lorawan.PHYPayload, confFCnt uint32, count int, confirmed *ConfirmedUplink) {
+	d.cancelRetransmission()
+	if count <= 0 && confirmed == nil {
+		return
+	}
+
+	r := &retransmission{phy: phy, confFCnt: confFCnt, remaining: count, confirmed: confirmed}
+	r.timer = time.AfterFunc(d.retransmissionWait(), func() { d.retransmit(r) })
+	d.retransmission = r
+}
+
+// cancelRetransmission stops the repetitions of the last uplink.
+// Must be called with the lock held.
+func (d *Device) cancelRetransmission() {
+	r := d.retransmission
+	if r == nil {
+		return
+	}
+	r.timer.Stop()
+	d.retransmission = nil
+	if r.confirmed != nil {
+		d.missAck(r.confirmed)
+	}
+}
+
+// retransmissionWait returns the time until the next repetition, after the
+// RX2 window of the last transmission.
+// Must be called with the lock held.
+func (d *Device) retransmissionWait() time.Duration {
+	return d.rx1Delay + time.Second + retransmissionDelay
+}
+
+// retransmit sends a repetition on a new channel, signed again in 1.1 for
+// the channel and data rate
+func (d *Device) retransmit(r *retransmission) {
+	d.mu.Lock()
+	if d.retransmission != r {
+		d.mu.Unlock()
+		return
+	}
+	if r.remaining <= 0 {
+		d.cancelRetransmission()
+		d.mu.Unlock()
+		return
+	}
+
+	uplink, err := d.nextUplink()
+	if err != nil {
+		log.Printf("[%s] retransmission dropped: %v", d.DevEUI, err)
+		d.cancelRetransmission()
+		d.mu.Unlock()
+		return
+	}
+
+	var txCh int
+	if d.session11 {
+		txCh, err = d.region.UplinkChannelIndex(uplink.Frequency, uplink.DataRate)
+		if err != nil {
+			log.Printf("[%s] retransmission dropped: %v", d.DevEUI, err)
+			d.cancelRetransmission()
+			d.mu.Unlock()
+			return
+		}
+	}
+
+	phy := r.phy
+	if err := phy.SetUplinkDataMIC(d.lorawanVersion(), r.confFCnt, uint8(uplink.DataRate), uint8(txCh), d.NwkSKey, d.sNwkSIntKey()); err != nil {
+		log.Printf("[%s] retransmission dropped: %v", d.DevEUI, err)
+		d.cancelRetransmission()
+		d.mu.Unlock()
+		return
+	}
+
+	if b, err := phy.MarshalBinary(); err == nil {
+		d.applyDutyCycle(uplink.Time, uplink.DataRate, len(b))
+	}
+	d.openRXWindows(uplink, false)
+
+	r.remaining--
+	if r.confirmed != nil {
+		r.confirmed.Transmissions++
+	}
+	if r.remaining > 0 || r.confirmed != nil {
+		r.timer = time.AfterFunc(d.retransmissionWait(), func() { d.retransmit(r) })
+	} else {
+		d.retransmission = nil
+	}
+	d.mu.Unlock()
+
+	log.Printf("[%s] retransmission of FCnt %d, %d left", d.DevEUI, phy.MACPayload.(*lorawan.MACPayload).FHDR.FCnt, r.remaining)
+	uplink.PHYPayload = phy
+	d.broadcast(uplink)
+}
@@ -0,0 +1,168 @@
+package device
+
+import (
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+)
+
+// Snapshot is the state of a device kept across restarts of the simulator:
+// its keys, session and frame counters, so that it neither reuses a DevNonce
+// nor replays an FCnt, and its configuration. The MAC parameters set by the
+// network server fall back to the defaults of the region.
+type Snapshot struct {
+	DevEUI   lorawan.EUI64     `json:"deveui"`
+	JoinEUI  lorawan.EUI64     `json:"joineui"`
+	AppKey   lorawan.AES128Key `json:"appkey"`
+	DevNonce lorawan.DevNonce  `json:"devnonce"`
+
+	DevAddr lorawan.DevAddr   `json:"devaddr"`
+	AppSKey lorawan.AES128Key `json:"appskey"`
+	NwkSKey lorawan.AES128Key `json:"nwkskey"`
+
+	FCntUp  uint32 `json:"fcntup"`
+	FCntDn  uint32 `json:"fcntdn"`
+	AFCntDn uint32 `json:"afcntdn,omitempty"`
+
+	MACVersion MACVersion     `json:"macVersion"`
+	LoRaWAN11  *LoRaWAN11Keys `json:"lorawan11,omitempty"`
+	Session11  bool           `json:"session11,omitempty"`
+	NetID      lorawan.NetID  `json:"netID"`
+	RJCount0   uint16         `json:"rjCount0,omitempty"`
+	RJCount1   uint16         `json:"rjCount1,omitempty"`
+
+	Region   region.Name `json:"region"`
+	SubBand  int         `json:"subBand,omitempty"`
+	DataRate int         `json:"dataRate"`
+	TxPower  float64     `json:"txPower"`
+	ADR      bool        `json:"adr"`
+
+	ConfirmedTransmissions int      `json:"confirmedTransmissions,omitempty"`
+	AutoAck                *float64 `json:"autoAck,omitempty"` // s
+	Battery                uint8    `json:"battery"`
+
+	RX1DROffset  int    `json:"rx1DROffset"`
+	RX1Delay     int    `json:"rx1Delay"` // s
+	RX2Frequency uint32 `json:"rx2Frequency"`
+	RX2DataRate  int    `json:"rx2DataRate"`
+
+	Class               Class     `json:"class"`
+	PingSlotPeriodicity int       `json:"pingSlotPeriodicity,omitempty"`
+	Location            *Location `json:"location,omitempty"`
+}
+
+// Snapshot returns the state of the device to restore after a restart
+func (d *Device) Snapshot() Snapshot {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return Snapshot{
+		DevEUI:   d.DevEUI,
+		JoinEUI:  d.JoinEUI,
+		AppKey:   d.AppKey,
+		DevNonce: d.DevNonce,
+		DevAddr:  d.DevAddr,
+		AppSKey:  d.AppSKey,
+		NwkSKey:  d.NwkSKey,
+
+		FCntUp:  d.FCntUp,
+		FCntDn:  d.FCntDn,
+		AFCntDn: d.aFCntDn,
+
+		MACVersion: d.macVersion,
+		LoRaWAN11:  d.lorawan11Keys(),
+		Session11:  d.session11,
+		NetID:      d.netID,
+		RJCount0:   d.rjCount0,
+		RJCount1:   d.rjCount1,
+
+		Region:   d.region.Name(),
+		SubBand:  d.subBand,
+		DataRate: d.dataRate,
+		TxPower:  d.txPower,
+		ADR:      d.adr,
+
+		ConfirmedTransmissions: d.confirmedTransmissions,
+		AutoAck:                d.autoAckInfo(),
+		Battery:                d.battery,
+
+		RX1DROffset:  d.rx1DROffset,
+		RX1Delay:     int(d.rx1Delay / time.Second),
+		RX2Frequency: d.rx2Frequency,
+		RX2DataRate:  d.rx2DataRate,
+
+		Class:               d.class,
+		PingSlotPeriodicity: d.pingSlotPeriodicity,
+		Location:            d.location,
+	}
+}
+
+// Restore resumes the session and configuration of a snapshot, the DevEUI
+// of the device is kept
+func (d *Device) Restore(s Snapshot) error {
+	r, err := region.Get(s.Region)
+	if err != nil {
+		return err
+	}
+	if err := d.SetRegion(r, s.SubBand); err != nil {
+		return err
+	}
+
+	var keys LoRaWAN11Keys
+	if s.LoRaWAN11 != nil {
+		keys = *s.LoRaWAN11
+	}
+	if err := d.SetMACVersion(s.MACVersion, keys); err != nil {
+		return err
+	}
+	if err := d.SetDataRate(s.DataRate); err != nil {
+		return err
+	}
+	if err := d.SetTxPower(s.TxPower); err != nil {
+		return err
+	}
+	if err := d.SetConfirmedTransmissions(s.ConfirmedTransmissions); err != nil {
+		return err
+	}
+	if s.AutoAck != nil {
+		delay := time.Duration(*s.AutoAck * float64(time.Second))
+		if err := d.SetAutoAck(true, delay); err != nil {
+			return err
+		}
+	}
+	if err := d.SetPingSlotPeriodicity(s.PingSlotPeriodicity); err != nil {
+		return err
+	}
+	if err := d.SetClass(s.Class); err != nil {
+		return err
+	}
+	d.SetADR(s.ADR)
+	d.SetBattery(s.Battery)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.JoinEUI = s.JoinEUI
+	d.AppKey = s.AppKey
+	d.DevNonce = s.DevNonce
+	d.DevAddr = s.DevAddr
+	d.AppSKey = s.AppSKey
+	d.NwkSKey = s.NwkSKey
+	d.FCntUp = s.FCntUp
+	d.FCntDn = s.FCntDn
+	d.aFCntDn = s.AFCntDn
+
+	d.session11 = s.Session11
+	d.netID = s.NetID
+	d.rjCount0 = s.RJCount0
+	d.rjCount1 = s.RJCount1
+
+	d.rx1DROffset = s.RX1DROffset
+	d.rx1Delay = time.Duration(s.RX1Delay) * time.Second
+	d.rx2Frequency = s.RX2Frequency
+	d.rx2DataRate = s.RX2DataRate
+	d.location = s.Location
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package eventbus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+// subscriberBuffer is the number of events queued for a subscriber, events
+// are dropped while it is full
+const subscriberBuffer = 256
+
+// Source is the kind of entity raising an event
+type Source string
+
+const (
+	SourceNetworkServer Source = "networkServer"
+	SourceGateway       Source = "gateway"
+	SourceDevice        Source = "device"
+)
+
+// Event is something that happened in the simulator
+type Event struct {
+	Source        Source         `json:"source"`
+	Type          string         `json:"type"`
+	Time          time.Time      `json:"time"`
+	NetworkServer string         `json:"networkServer"`
+	GatewayEUI    *lorawan.EUI64 `json:"gatewayeui,omitempty"`
+	DevEUI        *lorawan.EUI64 `json:"deveui,omitempty"`
+	Message       string         `json:"message,omitempty"`
+	Data          any            `json:"data,omitempty"` // e.g. the device event
+}
+
+// Filter selects the events of a subscription, unset fields match any event
+type Filter struct {
+	NetworkServer string
+	GatewayEUI    *lorawan.EUI64
+	DevEUI        *lorawan.EUI64
+}
+
+// match reports whether the filter selects the event
+func (f Filter) match(event Event) bool {
+	if f.NetworkServer != "" && event.NetworkServer != f.NetworkServer {
+		return false
+	}
+	if f.GatewayEUI != nil && (event.GatewayEUI == nil || *event.GatewayEUI != *f.GatewayEUI) {
+		return false
+	}
+	if f.DevEUI != nil && (event.DevEUI == nil || *event.DevEUI != *f.DevEUI) {
+		return false
+	}
+	return true
+}
+
+// Bus delivers the published events to the matching subscriptions
+type Bus struct {
+	mu            sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+}
+
+// Subscription receives the events selected by its filter on C until it is
+// closed
+type Subscription struct {
+	C <-chan Event
+
+	ch     chan Event
+	filter Filter
+	bus    *Bus
+}
+
+func New() *Bus {
+	return &Bus{
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish delivers an event without blocking, a nil bus drops it
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for s := range b.subscriptions {
+		if !s.filter.match(event) {
+			continue
+		}
+		select {
+		case s.ch <- event:
+		default:
+			// Dropped for a slow subscriber
+		}
+	}
+}
+
+// Subscribe returns a subscription to the events selected by the filter
+func (b *Bus) Subscribe(filter Filter) *Subscription {
+	ch := make(chan Event, subscriberBuffer)
+	s := &Subscription{C: ch, ch: ch, filter: filter, bus: b}
+
+	b.mu.Lock()
+	b.subscriptions[s] = struct{}{}
+	b.mu.Unlock()
+
+	return s
+}
+
+// Close stops the subscription and closes its channel
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, exists := s.bus.subscriptions[s]; !exists {
+		return
+	}
+	delete(s.bus.subscriptions, s)
+	close(s.ch)
+}
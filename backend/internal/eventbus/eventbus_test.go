@@ -0,0 +1,86 @@
+package eventbus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter_Match(t *testing.T) {
+	gatewayEUI := lorawan.EUI64{0x01}
+	devEUI := lorawan.EUI64{0x02}
+	otherEUI := lorawan.EUI64{0x03}
+
+	gatewayEvent := Event{NetworkServer: "ns1", GatewayEUI: &gatewayEUI}
+	deviceEvent := Event{NetworkServer: "ns1", DevEUI: &devEUI}
+
+	assert.True(t, Filter{}.match(gatewayEvent))
+	assert.True(t, Filter{NetworkServer: "ns1"}.match(deviceEvent))
+	assert.False(t, Filter{NetworkServer: "ns2"}.match(deviceEvent))
+
+	assert.True(t, Filter{GatewayEUI: &gatewayEUI}.match(gatewayEvent))
+	assert.False(t, Filter{GatewayEUI: &otherEUI}.match(gatewayEvent))
+	assert.False(t, Filter{GatewayEUI: &gatewayEUI}.match(deviceEvent))
+
+	assert.True(t, Filter{NetworkServer: "ns1", DevEUI: &devEUI}.match(deviceEvent))
+	assert.False(t, Filter{DevEUI: &otherEUI}.match(deviceEvent))
+}
+
+func TestBus(t *testing.T) {
+	devEUI := lorawan.EUI64{0x02}
+
+	receive := func(t *testing.T, s *Subscription) Event {
+		select {
+		case event := <-s.C:
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("event not received")
+			return Event{}
+		}
+	}
+
+	t.Run("delivers the events to the matching subscriptions", func(t *testing.T) {
+		b := New()
+		all := b.Subscribe(Filter{})
+		device := b.Subscribe(Filter{DevEUI: &devEUI})
+		other := b.Subscribe(Filter{NetworkServer: "other"})
+
+		b.Publish(Event{Source: SourceNetworkServer, Type: "synced", NetworkServer: "ns1"})
+		b.Publish(Event{Source: SourceDevice, Type: "uplink", NetworkServer: "ns1", DevEUI: &devEUI})
+
+		assert.Equal(t, "synced", receive(t, all).Type)
+		event := receive(t, all)
+		assert.Equal(t, "uplink", event.Type)
+		assert.False(t, event.Time.IsZero())
+		assert.Equal(t, "uplink", receive(t, device).Type)
+		assert.Empty(t, device.C)
+		assert.Empty(t, other.C)
+	})
+
+	t.Run("drops the events of a slow subscriber", func(t *testing.T) {
+		b := New()
+		s := b.Subscribe(Filter{})
+		for i := 0; i < subscriberBuffer+10; i++ {
+			b.Publish(Event{Type: "uplink"})
+		}
+		assert.Len(t, s.C, subscriberBuffer)
+	})
+
+	t.Run("closes the subscription", func(t *testing.T) {
+		b := New()
+		s := b.Subscribe(Filter{})
+		s.Close()
+		s.Close()
+
+		b.Publish(Event{Type: "uplink"})
+		_, ok := <-s.C
+		assert.False(t, ok)
+	})
+
+	t.Run("drops the events of a nil bus", func(t *testing.T) {
+		var b *Bus
+		assert.NotPanics(t, func() { b.Publish(Event{Type: "uplink"}) })
+	})
+}
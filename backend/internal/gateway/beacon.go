@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"log"
+	"time"
+
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/classb"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+)
+
+// beaconLoop transmits a class B beacon at the start of every beacon period
+// of the GPS time, as configured by the bcning section of router_config,
+// until the data connection is closed
+func (g *Gateway) beaconLoop(routerConfig <-chan struct{}, done <-chan struct{}) {
+	select {
+	case <-routerConfig:
+	case <-done:
+		return
+	}
+
+	for {
+		// The GPS time follows the LNS through timesync
+		g.mu.RLock()
+		clock := g.stationClock()
+		g.mu.RUnlock()
+
+		now := time.Now()
+		beaconTime, elapsed := classb.BeaconTime(time.Duration(clock.gpsTime(now)) * time.Microsecond)
+		beaconTime += uint32(classb.BeaconPeriod / time.Second)
+		instant := now.Add(classb.BeaconPeriod - elapsed)
+
+		timer := time.NewTimer(time.Until(instant))
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return
+		}
+
+		g.beacon(beaconTime, instant)
+	}
+}
+
+// beacon transmits the beacon of the given beacon time, if the LNS enabled
+// beaconing
+func (g *Gateway) beacon(beaconTime uint32, instant time.Time) {
+	g.mu.RLock()
+	var beaconing *Beaconing
+	if g.routerConfig != nil {
+		beaconing = g.routerConfig.Beaconing
+	}
+	var location *radio.Location
+	if g.location != nil {
+		location = &radio.Location{Latitude: g.location.Latitude, Longitude: g.location.Longitude}
+	}
+	g.mu.RUnlock()
+
+	if beaconing == nil {
+		return
+	}
+
+	frame, err := classb.EncodeBeacon(beaconing.Layout, beaconTime, location)
+	if err != nil {
+		log.Printf("[%s] failed to encode beacon: %v", g.eui, err)
+		return
+	}
+
+	// With several frequencies the beacon hops at every beacon period
+	period := beaconTime / uint32(classb.BeaconPeriod/time.Second)
+	frequency := beaconing.Frequencies[int(period%uint32(len(beaconing.Frequencies)))]
+
+	log.Printf("[%s] beacon of GPS time %d", g.eui, beaconTime)
+	g.transmit(radio.Downlink{
+		Beacon:    frame,
+		Frequency: frequency,
+		DataRate:  beaconing.DataRate,
+		Time:      instant,
+	}, nil)
+}
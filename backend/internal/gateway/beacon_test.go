@@ -0,0 +1,78 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/gps"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/classb"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBeacon(t *testing.T) {
+	newGateway := func(beaconing *Beaconing) (*Gateway, chan radio.Downlink) {
+		downlinkCh := make(chan radio.Downlink, 10)
+		gw := NewWithLocation(downlinkCh, lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}, "ws://discovery.test", nil, &Location{Latitude: 45, Longitude: 9})
+		gw.routerConfig = &RouterConfig{Beaconing: beaconing}
+		return gw, downlinkCh
+	}
+	usBeaconing := &Beaconing{DataRate: 8, Layout: classb.Layout{5, 11, 23}, Frequencies: []uint32{923300000, 923900000, 924500000}}
+
+	t.Run("transmits the beacon frame", func(t *testing.T) {
+		gw, downlinkCh := newGateway(usBeaconing)
+
+		gw.beacon(1280, time.Now())
+
+		select {
+		case downlink := <-downlinkCh:
+			beaconTime, err := classb.DecodeBeacon(usBeaconing.Layout, downlink.Beacon)
+			assert.NoError(t, err)
+			assert.Equal(t, uint32(1280), beaconTime)
+			assert.Equal(t, 8, downlink.DataRate)
+			assert.Equal(t, &radio.Location{Latitude: 45, Longitude: 9}, downlink.Location)
+			// Beacon period 10 hops to the second frequency
+			assert.Equal(t, uint32(923900000), downlink.Frequency)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for beacon")
+		}
+	})
+
+	t.Run("does not transmit without bcning", func(t *testing.T) {
+		gw, downlinkCh := newGateway(nil)
+
+		gw.beacon(1280, time.Now())
+
+		select {
+		case <-downlinkCh:
+			t.Fatal("Unexpected beacon")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("transmits at the start of the beacon periods of the GPS time", func(t *testing.T) {
+		gw, downlinkCh := newGateway(&Beaconing{DataRate: 3, Layout: classb.Layout{2, 8, 17}, Frequencies: []uint32{869525000}})
+
+		// Shift the GPS time of the gateway to the end of a beacon period
+		elapsed := gps.Time(time.Now()).TimeSinceGPSEpoch() % classb.BeaconPeriod
+		gw.gpsOffset = classb.BeaconPeriod - elapsed - 100*time.Millisecond
+
+		routerConfig := make(chan struct{})
+		close(routerConfig)
+		done := make(chan struct{})
+		defer close(done)
+		go gw.beaconLoop(routerConfig, done)
+
+		select {
+		case downlink := <-downlinkCh:
+			gpstime := time.Duration(gw.stationClock().gpsTime(downlink.Time)) * time.Microsecond
+			beaconTime, err := classb.DecodeBeacon(classb.Layout{2, 8, 17}, downlink.Beacon)
+			assert.NoError(t, err)
+			assert.InDelta(t, float64(time.Duration(beaconTime)*time.Second), float64(gpstime), float64(time.Millisecond))
+			assert.Equal(t, time.Duration(0), (time.Duration(beaconTime)*time.Second)%classb.BeaconPeriod)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for beacon")
+		}
+	})
+}
@@ -7,15 +7,21 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
 	"github.com/gorilla/websocket"
 )
 
+// dataWriteTimeout bounds the write of a message, so that a stuck connection
+// is detected as dropped
+var dataWriteTimeout = 10 * time.Second
+
 func (g *Gateway) lnsDataConnect() error {
 	// Connecting
 	g.mu.Lock()
-	g.dataState = StateConnecting
+	g.setDataState(StateConnecting)
 	headers := g.headers
 	g.mu.Unlock()
 	log.Printf("[%s] data connecting", g.eui)
@@ -27,7 +33,7 @@ func (g *Gateway) lnsDataConnect() error {
 		// Connection error
 		log.Printf("[%s] data connection error: %v", g.eui, connErr)
 		g.mu.Lock()
-		g.dataState = StateDisconnected
+		g.setDataState(StateDisconnected)
 		g.mu.Unlock()
 
 		return connErr
@@ -36,31 +42,87 @@ func (g *Gateway) lnsDataConnect() error {
 	// Connected
 	g.mu.Lock()
 	g.dataWs = conn
-	g.dataState = StateConnected
+	g.setDataState(StateConnected)
 	g.dataSendCh = make(chan string)
 	g.dataDone = make(chan struct{})
+	g.dataStart = time.Now()
+	g.xtimeSession = newXTimeSession(g.xtimeSession)
+	g.routerConfig = nil
+	g.routerConfigCh = make(chan struct{})
+	routerConfigCh := g.routerConfigCh
+	start := g.dataStart
+	dataSendCh := g.dataSendCh
+	dataDone := g.dataDone
 	g.mu.Unlock()
 	log.Printf("[%s] data connected", g.eui)
 
-	go g.lnsDataReadLoop()
-	go g.lnsDataWriteLoop()
+	go g.lnsDataReadLoop(conn, dataDone)
+	go g.lnsDataWriteLoop(conn, dataSendCh, dataDone)
 
 	// Send version message to receive router_config
 	versionMsg := `{"msgtype":"version","station":"lorawan-simulator","package":"github.com/emanuele-dedonatis/lorawan-simulator","protocol":2}`
 	g.send(versionMsg)
 
-	// TODO: create timeout for router_config
+	// Drop the connection if router_config never arrives
+	go g.routerConfigWatchdog(conn, routerConfigCh, dataDone)
+
+	// Synchronize the GPS time with the LNS
+	go g.timesyncLoop(start, routerConfigCh, dataDone)
+
+	// Transmit the class B beacons requested by router_config
+	go g.beaconLoop(routerConfigCh, dataDone)
 
 	return nil
 }
 
-func (g *Gateway) lnsDataReadLoop() {
-	defer close(g.dataDone)
+func (g *Gateway) routerConfigWatchdog(conn *websocket.Conn, received <-chan struct{}, done <-chan struct{}) {
+	timer := time.NewTimer(routerConfigTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-received:
+		return
+	case <-done:
+		return
+	case <-timer.C:
+	}
+
+	log.Printf("[%s] router_config timeout", g.eui)
+	g.lnsDataDrop(conn, errors.New("router_config timeout"))
+}
+
+// lnsDataDrop closes a data connection lost without Disconnect, if it is
+// still the current one
+func (g *Gateway) lnsDataDrop(conn *websocket.Conn, err error) {
+	g.mu.Lock()
+	if g.dataWs != conn || g.dataState != StateConnected {
+		// Already disconnecting or dropped
+		g.mu.Unlock()
+		return
+	}
+	g.dataWs = nil
+	g.dataSendCh = nil
+	g.dropped(err)
+	g.mu.Unlock()
+
+	conn.Close()
+}
+
+// Device classes of the dnmsg dC field
+const (
+	stationClassA = 0
+	stationClassB = 1
+	stationClassC = 2
+)
+
+func (g *Gateway) lnsDataReadLoop(conn *websocket.Conn, done chan struct{}) {
+	defer close(done)
 
 	for {
-		_, msg, err := g.dataWs.ReadMessage()
+		_, msg, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("[%s] data read error: %v", g.eui, err)
+			g.lnsDataDrop(conn, err)
 			return
 		}
 		log.Printf("[%s] data read: %s", g.eui, msg)
@@ -69,32 +131,101 @@ func (g *Gateway) lnsDataReadLoop() {
 	}
 }
 
-func (g *Gateway) lnsDataWriteLoop() {
-	for msg := range g.dataSendCh {
-		err := g.dataWs.WriteMessage(websocket.TextMessage, []byte(msg))
-		if err != nil {
-			log.Printf("[%s] data write error: %v", g.eui, err)
+func (g *Gateway) lnsDataWriteLoop(conn *websocket.Conn, sendCh chan string, done chan struct{}) {
+	for {
+		select {
+		case <-done:
 			return
+		case msg := <-sendCh:
+			conn.SetWriteDeadline(time.Now().Add(dataWriteTimeout))
+			err := conn.WriteMessage(websocket.TextMessage, []byte(msg))
+			if err != nil {
+				log.Printf("[%s] data write error: %v", g.eui, err)
+				// Unblock the read loop, that handles the drop
+				conn.Close()
+				return
+			}
+			log.Printf("[%s] data write: %s", g.eui, msg)
 		}
-		log.Printf("[%s] data write: %s", g.eui, msg)
 	}
 }
 
 func (g *Gateway) send(message string) error {
 	g.mu.RLock()
 	dataSendCh := g.dataSendCh
+	dataDone := g.dataDone
 	g.mu.RUnlock()
 
 	if dataSendCh == nil {
 		log.Printf("[%s] data write error: not allowed", g.eui)
 		return errors.New("not allowed")
 	}
-	dataSendCh <- message
 
-	return nil
+	select {
+	case dataSendCh <- message:
+		return nil
+	case <-dataDone:
+		log.Printf("[%s] data write error: connection closed", g.eui)
+		return errors.New("connection closed")
+	}
+}
+
+// sendIfConnected sends a message if the data connection started at start is
+// still open
+func (g *Gateway) sendIfConnected(start time.Time, message string) error {
+	g.mu.RLock()
+	connected := g.dataState == StateConnected && g.dataStart.Equal(start)
+	g.mu.RUnlock()
+
+	if !connected {
+		log.Printf("[%s] data write error: connection closed", g.eui)
+		return errors.New("connection closed")
+	}
+
+	return g.send(message)
 }
 
-func (g *Gateway) Forward(frame lorawan.PHYPayload) error {
+func (g *Gateway) Forward(uplink radio.Uplink) error {
+	g.mu.RLock()
+	r := g.region
+	rc := g.routerConfig
+	protocol := g.protocol
+	clock := g.stationClock()
+	g.mu.RUnlock()
+
+	// The gateway only listens to the channels of its region
+	if uplink.Region != r.Name() {
+		return fmt.Errorf("uplink region %s does not match gateway region %s", uplink.Region, r.Name())
+	}
+
+	switch protocol {
+	case ProtocolSemtechUDP, ProtocolChirpStackMQTT:
+		// Without router_config the gateway listens to the whole channel plan
+		if !r.IsUplinkChannel(uplink.Frequency, uplink.DataRate) {
+			return fmt.Errorf("invalid uplink channel %d Hz DR%d", uplink.Frequency, uplink.DataRate)
+		}
+		if protocol == ProtocolSemtechUDP {
+			return g.udpForward(uplink, r)
+		}
+		return g.mqttForward(uplink, r)
+	}
+
+	// and only forwards what the LNS configured
+	if rc == nil {
+		return errors.New("router_config not received")
+	}
+	if err := rc.allowsUplink(uplink); err != nil {
+		return err
+	}
+
+	frame := uplink.PHYPayload
+	signal := uplink.ReceivedSignal()
+	uplinkTime := uplink.Time
+	if uplinkTime.IsZero() {
+		uplinkTime = time.Now()
+	}
+	xtime := clock.xtime(uplinkTime)
+	gpstime := clock.gpsTime(uplinkTime)
 	switch frame.MHDR.MType {
 	case lorawan.JoinRequest:
 		// Type assert MACPayload to JoinRequestPayload
@@ -103,6 +234,10 @@ func (g *Gateway) Forward(frame lorawan.PHYPayload) error {
 			return errors.New("invalid join request payload")
 		}
 
+		if !rc.allowsJoinEUI(joinReq.JoinEUI) {
+			return fmt.Errorf("JoinEUI %s filtered by router_config", joinReq.JoinEUI)
+		}
+
 		// Convert MHDR to number
 		mhdr, err := frame.MHDR.MarshalBinary()
 		if err != nil {
@@ -112,13 +247,19 @@ func (g *Gateway) Forward(frame lorawan.PHYPayload) error {
 		// Convert MIC to signed int32
 		mic := int32(binary.LittleEndian.Uint32(frame.MIC[:]))
 
-		// TODO: dynamic DR, freq and upinfo
-		updfMsg := fmt.Sprintf(`{"msgtype":"jreq","MHdr":%d,"JoinEui":"%s","DevEui":"%s","DevNonce":%d,"MIC":%d,"DR":5,"Freq":868300000,"upinfo":{"rctx":0,"xtime":26740123065958450,"gpstime":0,"rssi":-50,"snr":9}}`,
+		// The simulated gateway has a single radio unit, rctx 0
+		updfMsg := fmt.Sprintf(`{"msgtype":"jreq","MHdr":%d,"JoinEui":"%s","DevEui":"%s","DevNonce":%d,"MIC":%d,"DR":%d,"Freq":%d,"upinfo":{"rctx":0,"xtime":%d,"gpstime":%d,"rssi":%g,"snr":%g}}`,
 			mhdr[0],
 			formatEUI(joinReq.JoinEUI),
 			formatEUI(joinReq.DevEUI),
 			joinReq.DevNonce,
 			mic,
+			uplink.DataRate,
+			uplink.Frequency,
+			xtime,
+			gpstime,
+			signal.RSSI,
+			signal.SNR,
 		)
 		return g.send(updfMsg)
 	case lorawan.UnconfirmedDataUp, lorawan.ConfirmedDataUp:
@@ -128,6 +269,10 @@ func (g *Gateway) Forward(frame lorawan.PHYPayload) error {
 			return errors.New("invalid MAC payload")
 		}
 
+		if !rc.allowsDevAddr(macPL.FHDR.DevAddr) {
+			return fmt.Errorf("DevAddr %s filtered by router_config", macPL.FHDR.DevAddr)
+		}
+
 		// Convert MHDR to number
 		mhdr, err := frame.MHDR.MarshalBinary()
 		if err != nil {
@@ -168,18 +313,48 @@ func (g *Gateway) Forward(frame lorawan.PHYPayload) error {
 			}
 		}
 
-		// TODO: dynamic DR, freq and upinfo
-		updfMsg := fmt.Sprintf(`{"msgtype":"updf","MHdr":%d,"DevAddr":%d,"FCtrl":%d,"FCnt":%d,"FOpts":"%s","FPort":%d,"FRMPayload":"%s","MIC":%d,"DR":5,"Freq":868300000,"upinfo":{"rctx":0,"xtime":26740123065958450,"gpstime":0,"rssi":-50,"snr":9}}`,
+		// FPort is -1 when the frame has no FRMPayload
+		fPort := -1
+		if macPL.FPort != nil {
+			fPort = int(*macPL.FPort)
+		}
+
+		// The simulated gateway has a single radio unit, rctx 0
+		updfMsg := fmt.Sprintf(`{"msgtype":"updf","MHdr":%d,"DevAddr":%d,"FCtrl":%d,"FCnt":%d,"FOpts":"%s","FPort":%d,"FRMPayload":"%s","MIC":%d,"DR":%d,"Freq":%d,"upinfo":{"rctx":0,"xtime":%d,"gpstime":%d,"rssi":%g,"snr":%g}}`,
 			mhdr[0],
 			devaddr,
 			fctrlByte[0],
 			macPL.FHDR.FCnt,
 			fOptsHex,
-			*macPL.FPort,
+			fPort,
 			frmPayloadHex,
 			mic,
+			uplink.DataRate,
+			uplink.Frequency,
+			xtime,
+			gpstime,
+			signal.RSSI,
+			signal.SNR,
 		)
 		return g.send(updfMsg)
+	case lorawan.RejoinRequest:
+		// Basics Station has no message for Rejoin-requests, the whole frame
+		// is forwarded as a proprietary frame
+		phyBytes, err := frame.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("failed to marshal rejoin request: %w", err)
+		}
+
+		propdfMsg := fmt.Sprintf(`{"msgtype":"propdf","FRMPayload":"%s","DR":%d,"Freq":%d,"upinfo":{"rctx":0,"xtime":%d,"gpstime":%d,"rssi":%g,"snr":%g}}`,
+			hex.EncodeToString(phyBytes),
+			uplink.DataRate,
+			uplink.Frequency,
+			xtime,
+			gpstime,
+			signal.RSSI,
+			signal.SNR,
+		)
+		return g.send(propdfMsg)
 	default:
 		return errors.New("unsupported uplink message type")
 	}
@@ -198,17 +373,49 @@ func (g *Gateway) parseIncomingMessage(msg string) {
 
 	// Switch based on msgtype
 	switch baseMsg.MsgType {
+	case "router_config":
+		g.handleRouterConfig(msg)
 	case "dnmsg":
 		g.handleDownlinkMessage(msg)
+	case "timesync":
+		g.handleTimesync(msg)
 	default:
 		log.Printf("[%s] unknown msgtype: %s", g.eui, baseMsg.MsgType)
 	}
 }
 
+func (g *Gateway) handleRouterConfig(msg string) {
+	rc, err := parseRouterConfig(msg)
+	if err != nil {
+		log.Printf("[%s] failed to parse router_config: %v", g.eui, err)
+		return
+	}
+
+	g.mu.Lock()
+	first := g.routerConfig == nil
+	g.routerConfig = rc
+	if first && g.routerConfigCh != nil {
+		close(g.routerConfigCh)
+	}
+	g.mu.Unlock()
+
+	log.Printf("[%s] router_config received - region: %s, hwspec: %s, %d upchannels", g.eui, rc.Region, rc.HWSpec, len(rc.UpChannels))
+}
+
 func (g *Gateway) handleDownlinkMessage(msg string) {
 	var dnmsg struct {
-		DevEui string `json:"DevEui"`
-		Pdu    string `json:"pdu"`
+		DevEui  string `json:"DevEui"`
+		DC      int    `json:"dC"`
+		Diid    int64  `json:"diid"`
+		Pdu     string `json:"pdu"`
+		RxDelay int    `json:"RxDelay"`
+		RX1DR   int    `json:"RX1DR"`
+		RX1Freq uint32 `json:"RX1Freq"`
+		RX2DR   int    `json:"RX2DR"`
+		RX2Freq uint32 `json:"RX2Freq"`
+		XTime   int64  `json:"xtime"`
+		GPSTime int64  `json:"gpstime"`
+		RCtx    int64  `json:"rctx"`
 	}
 
 	if err := json.Unmarshal([]byte(msg), &dnmsg); err != nil {
@@ -232,44 +439,102 @@ func (g *Gateway) handleDownlinkMessage(msg string) {
 		return
 	}
 
-	// Broadcast to devices
 	g.mu.RLock()
-	broadcastCh := g.broadcastDownlink
+	start := g.dataStart
+	clock := g.stationClock()
 	g.mu.RUnlock()
 
-	if broadcastCh != nil {
-		log.Printf("[%s] broadcasting downlink", g.eui)
-		go func() {
-			broadcastCh <- phyPayload
-		}()
+	downlink := radio.Downlink{PHYPayload: phyPayload}
+	switch dnmsg.DC {
+	case stationClassA:
+		// RX1 opens RxDelay seconds after the uplink, RX2 one second later
+		rxDelay := time.Duration(dnmsg.RxDelay) * time.Second
+		if rxDelay == 0 {
+			rxDelay = time.Second
+		}
+		uplinkEnd, ok := clock.time(dnmsg.XTime)
+		if !ok {
+			log.Printf("[%s] downlink for DevEui %s dropped: xtime of another session", g.eui, dnmsg.DevEui)
+			return
+		}
+		rx1 := uplinkEnd.Add(rxDelay)
+		rx2 := rx1.Add(time.Second)
+
+		now := time.Now()
+		switch {
+		case dnmsg.RX1Freq != 0 && rx1.After(now):
+			downlink.Frequency, downlink.DataRate, downlink.Time = dnmsg.RX1Freq, dnmsg.RX1DR, rx1
+		case dnmsg.RX2Freq != 0 && rx2.After(now):
+			downlink.Frequency, downlink.DataRate, downlink.Time = dnmsg.RX2Freq, dnmsg.RX2DR, rx2
+		default:
+			log.Printf("[%s] downlink for DevEui %s too late for RX1 and RX2", g.eui, dnmsg.DevEui)
+			return
+		}
+	case stationClassB:
+		// Ping slots are scheduled on the GPS time
+		downlink.Frequency, downlink.DataRate = dnmsg.RX2Freq, dnmsg.RX2DR
+		downlink.Time = clock.gpsInstant(dnmsg.GPSTime)
+		if !downlink.Time.After(time.Now()) {
+			log.Printf("[%s] downlink for DevEui %s too late for its ping slot", g.eui, dnmsg.DevEui)
+			return
+		}
+	case stationClassC:
+		// Class C devices listen to RX2 whenever they are not transmitting
+		downlink.Frequency, downlink.DataRate = dnmsg.RX2Freq, dnmsg.RX2DR
+	default:
+		log.Printf("[%s] unsupported device class %d for DevEui %s", g.eui, dnmsg.DC, dnmsg.DevEui)
+		return
+	}
+
+	if g.txFailed() {
+		log.Printf("[%s] downlink %d for DevEui %s not transmitted (simulated TX failure)", g.eui, dnmsg.Diid, dnmsg.DevEui)
+		return
 	}
+
+	// Broadcast to devices and confirm the transmission to the LNS
+	g.transmit(downlink, func(downlink radio.Downlink) {
+		dntxedMsg := fmt.Sprintf(`{"msgtype":"dntxed","diid":%d,"DevEui":"%s","rctx":%d,"xtime":%d,"txtime":%f,"gpstime":%d}`,
+			dnmsg.Diid,
+			dnmsg.DevEui,
+			dnmsg.RCtx,
+			clock.xtime(downlink.Time),
+			float64(downlink.Time.UnixMicro())/1e6,
+			clock.gpsTime(downlink.Time),
+		)
+		g.sendIfConnected(start, dntxedMsg)
+	})
 }
 
 func (g *Gateway) lnsDataDisconnect() error {
 	g.mu.Lock()
-	g.dataState = StateDisconnecting
-	g.mu.Unlock()
-
+	conn := g.dataWs
+	dataDone := g.dataDone
+	if conn == nil {
+		g.mu.Unlock()
+		return errors.New("not connected")
+	}
+	g.setDataState(StateDisconnecting)
 	// Don't allow sending messages anymore
-	close(g.dataSendCh)
+	g.dataSendCh = nil
+	g.mu.Unlock()
 
 	// Close the connection
 	log.Printf("[%s] data disconnecting", g.eui)
-	err := g.dataWs.Close()
+	err := conn.Close()
 	if err != nil {
 		g.mu.Lock()
-		g.dataState = StateDisconnectionError
+		g.setDataState(StateDisconnectionError)
 		g.mu.Unlock()
 		log.Printf("[%s] data disconnection error: %v", g.eui, err)
 		return err
 	}
 
 	// Wait for lnsDataReadLoop termination
-	<-g.dataDone
+	<-dataDone
 
 	g.mu.Lock()
 	g.dataWs = nil
-	g.dataState = StateDisconnected
+	g.setDataState(StateDisconnected)
 	g.mu.Unlock()
 	log.Printf("[%s] data disconnected", g.eui)
 
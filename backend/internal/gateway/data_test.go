@@ -2,6 +2,7 @@ package gateway
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -10,16 +11,55 @@ import (
 	"time"
 
 	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
 // Helper function to create a gateway with downlink channel for testing
 func newTestGateway(eui lorawan.EUI64, discoveryURI string) *Gateway {
-	downlinkCh := make(chan lorawan.PHYPayload, 10)
+	downlinkCh := make(chan radio.Downlink, 10)
 	return New(downlinkCh, eui, discoveryURI, nil)
 }
 
+// EU868 router_config as sent by an LNS to a 8 channel sx1301 station
+const testRouterConfig = `{"msgtype":"router_config","NetID":null,"JoinEui":null,"region":"EU863","hwspec":"sx1301/1","freq_range":[863000000,870000000],` +
+	`"DRs":[[12,125,0],[11,125,0],[10,125,0],[9,125,0],[8,125,0],[7,125,0],[7,250,0],[0,0,0],[-1,0,0],[-1,0,0],[-1,0,0],[-1,0,0],[-1,0,0],[-1,0,0],[-1,0,0],[-1,0,0]],` +
+	`"sx1301_conf":[{"radio_0":{"enable":true,"freq":867500000},"radio_1":{"enable":true,"freq":868500000},` +
+	`"chan_FSK":{"enable":true,"radio":1,"if":300000},"chan_Lora_std":{"enable":true,"radio":1,"if":-200000,"bandwidth":250000,"spread_factor":7},` +
+	`"chan_multiSF_0":{"enable":true,"radio":1,"if":-400000},"chan_multiSF_1":{"enable":true,"radio":1,"if":-200000},"chan_multiSF_2":{"enable":true,"radio":1,"if":0},` +
+	`"chan_multiSF_3":{"enable":true,"radio":0,"if":-400000},"chan_multiSF_4":{"enable":true,"radio":0,"if":-200000},"chan_multiSF_5":{"enable":true,"radio":0,"if":0},` +
+	`"chan_multiSF_6":{"enable":true,"radio":0,"if":200000},"chan_multiSF_7":{"enable":true,"radio":0,"if":400000}}],"nocca":true,"nodc":true,"nodwell":true}`
+
+// Helper function to wait until the gateway received router_config
+func waitForRouterConfig(t *testing.T, gw *Gateway) {
+	assert.Eventually(t, func() bool {
+		return gw.GetInfo().RouterConfig != nil
+	}, time.Second, 5*time.Millisecond, "router_config not received")
+}
+
+// Helper function to read the next message of the station, skipping the
+// timesync requests
+func readStationMessage(conn *websocket.Conn) ([]byte, error) {
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil || !strings.Contains(string(msg), `"msgtype":"timesync"`) {
+			return msg, err
+		}
+	}
+}
+
+// Helper function to wrap a frame into an EU868 uplink on 868.3 MHz DR5
+func newTestUplink(phy lorawan.PHYPayload) radio.Uplink {
+	return radio.Uplink{
+		PHYPayload: phy,
+		Region:     region.EU868,
+		Frequency:  868300000,
+		DataRate:   5,
+	}
+}
+
 // Mock WebSocket server that simulates LNS data endpoint
 func mockDataServer(t *testing.T, behavior string) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -51,17 +91,7 @@ func mockDataServer(t *testing.T, behavior string) *httptest.Server {
 			}
 
 			// Send back router_config
-			routerConfig := map[string]interface{}{
-				"msgtype":    "router_config",
-				"NetID":      []int{1, 2, 3},
-				"JoinEui":    [][]int{{1, 2, 3, 4, 5, 6, 7, 8}},
-				"region":     "EU863",
-				"hwspec":     "sx1301/1",
-				"freq_range": []int{863000000, 870000000},
-				"DRs":        [][]int{{7, 125, 0}, {8, 125, 0}},
-			}
-			responseBytes, _ := json.Marshal(routerConfig)
-			conn.WriteMessage(websocket.TextMessage, responseBytes)
+			conn.WriteMessage(websocket.TextMessage, []byte(testRouterConfig))
 
 			// Keep connection alive for additional messages
 			for {
@@ -73,6 +103,15 @@ func mockDataServer(t *testing.T, behavior string) *httptest.Server {
 				conn.WriteMessage(websocket.TextMessage, []byte(`{"msgtype":"ack"}`))
 			}
 
+		case "no_router_config":
+			// Never answer to the version message
+			for {
+				_, _, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+			}
+
 		case "immediate_close":
 			// Close connection immediately after upgrade
 			return
@@ -97,6 +136,7 @@ func mockDataServer(t *testing.T, behavior string) *httptest.Server {
 
 		case "echo":
 			// Simple echo server for testing writes
+			conn.WriteMessage(websocket.TextMessage, []byte(testRouterConfig))
 			for {
 				_, msg, err := conn.ReadMessage()
 				if err != nil {
@@ -132,6 +172,33 @@ func TestLnsDataConnect_Success(t *testing.T) {
 	assert.Equal(t, "connected", info.DataState)
 	assert.NotNil(t, gw.dataWs)
 	assert.NotNil(t, gw.dataSendCh)
+
+	// Verify router_config is exposed
+	waitForRouterConfig(t, gw)
+	rc := gw.GetInfo().RouterConfig
+	assert.Equal(t, "EU863", rc.Region)
+	assert.Len(t, rc.UpChannels, 10)
+}
+
+func TestLnsDataConnect_RouterConfigTimeout(t *testing.T) {
+	server := mockDataServer(t, "no_router_config")
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	gw := newTestGateway(eui, "ws://discovery.test")
+	gw.dataURI = wsURL
+
+	err := gw.lnsDataConnect()
+	assert.NoError(t, err)
+	assert.Equal(t, "connected", gw.GetInfo().DataState)
+
+	// The connection is dropped once the timeout expires
+	assert.Eventually(t, func() bool {
+		return gw.GetInfo().DataState == "disconnected"
+	}, routerConfigTimeout+time.Second, 50*time.Millisecond)
+	assert.Nil(t, gw.GetInfo().RouterConfig)
 }
 
 func TestLnsDataConnect_ConnectionError(t *testing.T) {
@@ -275,9 +342,11 @@ func TestLnsDataWriteLoop_SendsMessages(t *testing.T) {
 		}
 		defer conn.Close()
 
+		conn.WriteMessage(websocket.TextMessage, []byte(testRouterConfig))
+
 		// Collect all messages
 		for {
-			_, msg, err := conn.ReadMessage()
+			msg, err := readStationMessage(conn)
 			if err != nil {
 				return
 			}
@@ -294,6 +363,7 @@ func TestLnsDataWriteLoop_SendsMessages(t *testing.T) {
 
 	err := gw.lnsDataConnect()
 	assert.NoError(t, err)
+	waitForRouterConfig(t, gw)
 
 	// Create test PHY payloads
 	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
@@ -325,8 +395,8 @@ func TestLnsDataWriteLoop_SendsMessages(t *testing.T) {
 		MIC: [4]byte{0x05, 0x06, 0x07, 0x08},
 	}
 
-	gw.Forward(phy1)
-	gw.Forward(phy2)
+	gw.Forward(newTestUplink(phy1))
+	gw.Forward(newTestUplink(phy2))
 
 	// Collect messages
 	var messages []string
@@ -383,7 +453,7 @@ func TestLnsDataWriteLoop_HandlesWriteError(t *testing.T) {
 
 	// Try to send a message after connection is closed
 	// This should cause a write error (logged but not panicking)
-	gw.Forward(phy)
+	gw.Forward(newTestUplink(phy))
 
 	// Give time for write to be attempted
 	time.Sleep(50 * time.Millisecond)
@@ -403,9 +473,7 @@ func TestForward(t *testing.T) {
 
 	err := gw.lnsDataConnect()
 	assert.NoError(t, err)
-
-	// Give time for connection to establish
-	time.Sleep(50 * time.Millisecond)
+	waitForRouterConfig(t, gw)
 
 	// Create a test PHY payload
 	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
@@ -425,7 +493,7 @@ func TestForward(t *testing.T) {
 	}
 
 	// Send the message
-	err = gw.Forward(phy)
+	err = gw.Forward(newTestUplink(phy))
 	assert.NoError(t, err)
 
 	// Give time for message to be sent and echoed
@@ -434,6 +502,519 @@ func TestForward(t *testing.T) {
 	// If we got here without blocking or panicking, the send worked
 }
 
+func TestForward_RouterConfig(t *testing.T) {
+	messagesReceived := make(chan string, 10)
+	routerConfig := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Skip version message
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(<-routerConfig))
+
+		for {
+			msg, err := readStationMessage(conn)
+			if err != nil {
+				return
+			}
+			messagesReceived <- string(msg)
+		}
+	}))
+	defer server.Close()
+
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	gw := newTestGateway(eui, "ws://discovery.test")
+	gw.dataURI = "ws" + strings.TrimPrefix(server.URL, "http")
+
+	err := gw.lnsDataConnect()
+	assert.NoError(t, err)
+
+	joinReq := func(joinEUI lorawan.EUI64) lorawan.PHYPayload {
+		return lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{
+				MType: lorawan.JoinRequest,
+				Major: lorawan.LoRaWANR1,
+			},
+			MACPayload: &lorawan.JoinRequestPayload{
+				JoinEUI:  joinEUI,
+				DevEUI:   lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+				DevNonce: lorawan.DevNonce(100),
+			},
+		}
+	}
+	dataUp := func(devAddr lorawan.DevAddr) lorawan.PHYPayload {
+		return lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{
+				MType: lorawan.UnconfirmedDataUp,
+				Major: lorawan.LoRaWANR1,
+			},
+			MACPayload: &lorawan.MACPayload{
+				FHDR: lorawan.FHDR{DevAddr: devAddr},
+			},
+		}
+	}
+
+	t.Run("rejects uplink before router_config", func(t *testing.T) {
+		err := gw.Forward(newTestUplink(joinReq(lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "router_config not received")
+	})
+
+	// TTN NetID and a single JoinEUI
+	routerConfig <- strings.Replace(testRouterConfig, `"NetID":null,"JoinEui":null`, `"NetID":[19],"JoinEui":[[72623859790382856,72623859790382856]]`, 1)
+	waitForRouterConfig(t, gw)
+
+	t.Run("forwards join request with allowed JoinEUI", func(t *testing.T) {
+		err := gw.Forward(newTestUplink(joinReq(lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})))
+		assert.NoError(t, err)
+
+		select {
+		case msg := <-messagesReceived:
+			assert.Contains(t, msg, `"msgtype":"jreq"`)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for jreq")
+		}
+	})
+
+	t.Run("drops join request with filtered JoinEUI", func(t *testing.T) {
+		err := gw.Forward(newTestUplink(joinReq(lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18})))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "JoinEUI 1112131415161718 filtered by router_config")
+	})
+
+	t.Run("forwards data uplink with allowed DevAddr", func(t *testing.T) {
+		err := gw.Forward(newTestUplink(dataUp(lorawan.DevAddr{0x26, 0x01, 0x02, 0x03})))
+		assert.NoError(t, err)
+
+		select {
+		case msg := <-messagesReceived:
+			assert.Contains(t, msg, `"msgtype":"updf"`)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for updf")
+		}
+	})
+
+	t.Run("drops data uplink with filtered DevAddr", func(t *testing.T) {
+		err := gw.Forward(newTestUplink(dataUp(lorawan.DevAddr{0x01, 0x02, 0x03, 0x04})))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "DevAddr 01020304 filtered by router_config")
+	})
+
+	t.Run("drops uplink on unconfigured channel", func(t *testing.T) {
+		uplink := newTestUplink(dataUp(lorawan.DevAddr{0x26, 0x01, 0x02, 0x03}))
+		uplink.Frequency = 869525000
+		err := gw.Forward(uplink)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "channel 869525000 Hz DR5 not configured by router_config")
+	})
+
+	assert.Empty(t, messagesReceived)
+}
+
+func TestForward_Region(t *testing.T) {
+	messagesReceived := make(chan string, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// US915 sub-band 2
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"msgtype":"router_config","region":"US902","hwspec":"sx1301/1",`+
+			`"DRs":[[10,125,0],[9,125,0],[8,125,0],[7,125,0],[8,500,0],[-1,0,0],[-1,0,0],[-1,0,0],`+
+			`[12,500,1],[11,500,1],[10,500,1],[9,500,1],[8,500,1],[7,500,1],[-1,0,0],[-1,0,0]],`+
+			`"upchannels":[[903900000,0,3],[904100000,0,3],[904300000,0,3],[904500000,0,3],`+
+			`[904700000,0,3],[904900000,0,3],[905100000,0,3],[905300000,0,3],[904600000,4,4]]}`))
+
+		for {
+			msg, err := readStationMessage(conn)
+			if err != nil {
+				return
+			}
+			messagesReceived <- string(msg)
+		}
+	}))
+	defer server.Close()
+
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	gw := newTestGateway(eui, "ws://discovery.test")
+	gw.dataURI = "ws" + strings.TrimPrefix(server.URL, "http")
+
+	us915, err := region.Get(region.US915)
+	assert.NoError(t, err)
+	gw.SetRegion(us915)
+	assert.Equal(t, region.US915, gw.GetInfo().Region)
+
+	err = gw.lnsDataConnect()
+	assert.NoError(t, err)
+	waitForRouterConfig(t, gw)
+
+	// Skip version message
+	<-messagesReceived
+
+	fPort := uint8(1)
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataUp,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.MACPayload{
+			FHDR:       lorawan.FHDR{DevAddr: lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}},
+			FPort:      &fPort,
+			FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte{0x01}}},
+		},
+	}
+
+	t.Run("forwards uplink with its DR and frequency", func(t *testing.T) {
+		err := gw.Forward(radio.Uplink{PHYPayload: phy, Region: region.US915, Frequency: 904300000, DataRate: 2})
+		assert.NoError(t, err)
+
+		select {
+		case msg := <-messagesReceived:
+			assert.Contains(t, msg, `"DR":2,"Freq":904300000`)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for updf")
+		}
+	})
+
+	t.Run("reports the received signal", func(t *testing.T) {
+		uplink := radio.Uplink{PHYPayload: phy, Region: region.US915, Frequency: 904300000, DataRate: 2}
+		err := gw.Forward(uplink)
+		assert.NoError(t, err)
+
+		select {
+		case msg := <-messagesReceived:
+			assert.Contains(t, msg, `"rssi":-50,"snr":9}`)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for updf")
+		}
+
+		uplink.Signal = &radio.Signal{RSSI: -121, SNR: -11.75}
+		err = gw.Forward(uplink)
+		assert.NoError(t, err)
+
+		select {
+		case msg := <-messagesReceived:
+			assert.Contains(t, msg, `"rssi":-121,"snr":-11.75}`)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for updf")
+		}
+	})
+
+	t.Run("reports the xtime and GPS time of the end of the uplink", func(t *testing.T) {
+		gw.mu.RLock()
+		clock := gw.stationClock()
+		gw.mu.RUnlock()
+
+		uplinkTime := clock.start.Add(1500 * time.Millisecond)
+		uplink := radio.Uplink{PHYPayload: phy, Region: region.US915, Frequency: 904300000, DataRate: 2, Time: uplinkTime}
+		err := gw.Forward(uplink)
+		assert.NoError(t, err)
+
+		select {
+		case msg := <-messagesReceived:
+			xtime := clock.session<<56 | 1500000
+			assert.Contains(t, msg, fmt.Sprintf(`"xtime":%d,"gpstime":%d,`, xtime, clock.gpsTime(uplinkTime)))
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for updf")
+		}
+	})
+
+	t.Run("forwards uplink without FPort", func(t *testing.T) {
+		noPort := phy
+		noPort.MACPayload = &lorawan.MACPayload{FHDR: lorawan.FHDR{DevAddr: lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}}}
+
+		err := gw.Forward(radio.Uplink{PHYPayload: noPort, Region: region.US915, Frequency: 904300000, DataRate: 2})
+		assert.NoError(t, err)
+
+		select {
+		case msg := <-messagesReceived:
+			assert.Contains(t, msg, `"FPort":-1`)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for updf")
+		}
+	})
+
+	t.Run("forwards rejoin request as proprietary frame", func(t *testing.T) {
+		rejoin := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{
+				MType: lorawan.RejoinRequest,
+				Major: lorawan.LoRaWANR1,
+			},
+			MACPayload: &lorawan.RejoinRequestType02Payload{
+				RejoinType: lorawan.RejoinRequestType0,
+				DevEUI:     lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+				RJCount0:   1,
+			},
+		}
+
+		err := gw.Forward(radio.Uplink{PHYPayload: rejoin, Region: region.US915, Frequency: 904300000, DataRate: 2})
+		assert.NoError(t, err)
+
+		select {
+		case msg := <-messagesReceived:
+			assert.Contains(t, msg, `"msgtype":"propdf","FRMPayload":"c0000000000807060504030201010000000000","DR":2,"Freq":904300000`)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for propdf")
+		}
+	})
+
+	t.Run("rejects uplink from another region", func(t *testing.T) {
+		err := gw.Forward(newTestUplink(phy))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "does not match gateway region")
+	})
+
+	t.Run("rejects uplink outside the channel plan", func(t *testing.T) {
+		// DR4 is only allowed on 500 kHz channels
+		err := gw.Forward(radio.Uplink{PHYPayload: phy, Region: region.US915, Frequency: 904300000, DataRate: 4})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "not configured by router_config")
+	})
+
+	t.Run("rejects uplink on a channel of another sub-band", func(t *testing.T) {
+		err := gw.Forward(radio.Uplink{PHYPayload: phy, Region: region.US915, Frequency: 902300000, DataRate: 0})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "channel 902300000 Hz DR0 not configured by router_config")
+	})
+}
+
+func TestHandleDownlinkMessage(t *testing.T) {
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataDown,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.MACPayload{
+			FHDR: lorawan.FHDR{DevAddr: lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}, FCnt: 7},
+		},
+		MIC: [4]byte{0x01, 0x02, 0x03, 0x04},
+	}
+	phyBytes, err := phy.MarshalBinary()
+	assert.NoError(t, err)
+
+	newGateway := func() (*Gateway, chan radio.Downlink) {
+		downlinkCh := make(chan radio.Downlink, 10)
+		gw := NewWithLocation(downlinkCh, lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}, "ws://discovery.test", nil, &Location{Latitude: 45.4642, Longitude: 9.19})
+		gw.dataStart = time.Now()
+		gw.clockStart = gw.dataStart.Add(-time.Minute)
+		gw.xtimeSession = 1
+		return gw, downlinkCh
+	}
+
+	// dnmsg for a class A uplink that ended at the given xtime
+	dnmsg := func(xtime int64, rxDelay int) string {
+		return fmt.Sprintf(`{"msgtype":"dnmsg","DevEui":"01-02-03-04-05-06-07-08","dC":0,"diid":1,"pdu":"%x","RxDelay":%d,`+
+			`"RX1DR":5,"RX1Freq":868100000,"RX2DR":0,"RX2Freq":869525000,"priority":0,"xtime":%d,"rctx":0,"MuxTime":1.0}`,
+			phyBytes, rxDelay, xtime)
+	}
+
+	receive := func(t *testing.T, downlinkCh chan radio.Downlink) radio.Downlink {
+		select {
+		case downlink := <-downlinkCh:
+			assert.False(t, time.Now().Before(downlink.Time))
+			return downlink
+		case <-time.After(3 * time.Second):
+			t.Fatal("Timeout waiting for downlink")
+			return radio.Downlink{}
+		}
+	}
+
+	t.Run("transmits in RX1", func(t *testing.T) {
+		gw, downlinkCh := newGateway()
+		uplinkTime := time.Now()
+
+		gw.parseIncomingMessage(dnmsg(gw.stationClock().xtime(uplinkTime), 1))
+
+		downlink := receive(t, downlinkCh)
+		macPL, ok := downlink.PHYPayload.MACPayload.(*lorawan.MACPayload)
+		assert.True(t, ok)
+		assert.Equal(t, uint32(7), macPL.FHDR.FCnt)
+		assert.Equal(t, region.EU868, downlink.Region)
+		assert.Equal(t, uint32(868100000), downlink.Frequency)
+		assert.Equal(t, 5, downlink.DataRate)
+		assert.Equal(t, float64(14), downlink.TxPower)
+		assert.Equal(t, &radio.Location{Latitude: 45.4642, Longitude: 9.19}, downlink.Location)
+		assert.WithinDuration(t, uplinkTime.Add(time.Second), downlink.Time, time.Millisecond)
+	})
+
+	t.Run("falls back to RX2 when RX1 is over", func(t *testing.T) {
+		gw, downlinkCh := newGateway()
+		uplinkTime := time.Now().Add(-1500 * time.Millisecond)
+
+		// RxDelay 0 stands for 1 second
+		gw.parseIncomingMessage(dnmsg(gw.stationClock().xtime(uplinkTime), 0))
+
+		downlink := receive(t, downlinkCh)
+		assert.Equal(t, uint32(869525000), downlink.Frequency)
+		assert.Equal(t, 0, downlink.DataRate)
+		assert.Equal(t, float64(27), downlink.TxPower)
+		assert.WithinDuration(t, uplinkTime.Add(2*time.Second), downlink.Time, time.Millisecond)
+	})
+
+	t.Run("drops downlink too late for RX2", func(t *testing.T) {
+		gw, downlinkCh := newGateway()
+		uplinkTime := time.Now().Add(-3 * time.Second)
+
+		gw.parseIncomingMessage(dnmsg(gw.stationClock().xtime(uplinkTime), 1))
+
+		select {
+		case <-downlinkCh:
+			t.Fatal("Unexpected downlink")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("drops downlink with xtime of a previous session", func(t *testing.T) {
+		gw, downlinkCh := newGateway()
+		previous := gw.stationClock()
+		gw.xtimeSession = newXTimeSession(previous.session)
+
+		gw.parseIncomingMessage(dnmsg(previous.xtime(time.Now()), 1))
+
+		select {
+		case <-downlinkCh:
+			t.Fatal("Unexpected downlink")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("transmits class C downlink immediately in RX2", func(t *testing.T) {
+		gw, downlinkCh := newGateway()
+
+		gw.parseIncomingMessage(fmt.Sprintf(`{"msgtype":"dnmsg","DevEui":"01-02-03-04-05-06-07-08","dC":2,"diid":2,"pdu":"%x","RX2DR":0,"RX2Freq":869525000,"priority":0,"MuxTime":1.0}`, phyBytes))
+
+		downlink := receive(t, downlinkCh)
+		assert.Equal(t, uint32(869525000), downlink.Frequency)
+		assert.Equal(t, 0, downlink.DataRate)
+		assert.WithinDuration(t, time.Now(), downlink.Time, 100*time.Millisecond)
+	})
+
+	// dnmsg for a class B ping slot at the given GPS time
+	pingSlot := func(gpstime int64) string {
+		return fmt.Sprintf(`{"msgtype":"dnmsg","DevEui":"01-02-03-04-05-06-07-08","dC":1,"diid":3,"pdu":"%x","RX2DR":3,"RX2Freq":869525000,"priority":0,"gpstime":%d,"MuxTime":1.0}`, phyBytes, gpstime)
+	}
+
+	t.Run("transmits class B downlink at its GPS time", func(t *testing.T) {
+		gw, downlinkCh := newGateway()
+		gw.gpsOffset = 2 * time.Second
+		slot := time.Now().Add(200 * time.Millisecond)
+
+		gw.parseIncomingMessage(pingSlot(gw.stationClock().gpsTime(slot)))
+
+		downlink := receive(t, downlinkCh)
+		assert.Equal(t, uint32(869525000), downlink.Frequency)
+		assert.Equal(t, 3, downlink.DataRate)
+		assert.WithinDuration(t, slot, downlink.Time, time.Millisecond)
+	})
+
+	t.Run("drops class B downlink too late for its ping slot", func(t *testing.T) {
+		gw, downlinkCh := newGateway()
+
+		gw.parseIncomingMessage(pingSlot(gw.stationClock().gpsTime(time.Now().Add(-time.Second))))
+
+		select {
+		case <-downlinkCh:
+			t.Fatal("Unexpected downlink")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func TestHandleDownlinkMessage_Dntxed(t *testing.T) {
+	messagesReceived := make(chan string, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, []byte(testRouterConfig))
+		for {
+			msg, err := readStationMessage(conn)
+			if err != nil {
+				return
+			}
+			messagesReceived <- string(msg)
+		}
+	}))
+	defer server.Close()
+
+	gw := newTestGateway(lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}, "ws://discovery.test")
+	gw.dataURI = "ws" + strings.TrimPrefix(server.URL, "http")
+	assert.NoError(t, gw.lnsDataConnect())
+	defer gw.lnsDataDisconnect()
+	waitForRouterConfig(t, gw)
+
+	// Skip version message
+	<-messagesReceived
+
+	phy := lorawan.PHYPayload{
+		MHDR:       lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+		MACPayload: &lorawan.MACPayload{FHDR: lorawan.FHDR{DevAddr: lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}}},
+	}
+	phyBytes, err := phy.MarshalBinary()
+	assert.NoError(t, err)
+
+	gw.mu.RLock()
+	clock := gw.stationClock()
+	gw.mu.RUnlock()
+
+	t.Run("confirms the transmission with dntxed", func(t *testing.T) {
+		xtime := clock.xtime(time.Now())
+		gw.parseIncomingMessage(fmt.Sprintf(`{"msgtype":"dnmsg","DevEui":"01-02-03-04-05-06-07-08","dC":0,"diid":42,"pdu":"%x","RxDelay":1,`+
+			`"RX1DR":5,"RX1Freq":868100000,"RX2DR":0,"RX2Freq":869525000,"priority":0,"xtime":%d,"rctx":3,"MuxTime":1.0}`, phyBytes, xtime))
+
+		select {
+		case msg := <-messagesReceived:
+			var dntxed struct {
+				MsgType string  `json:"msgtype"`
+				Diid    int64   `json:"diid"`
+				DevEui  string  `json:"DevEui"`
+				RCtx    int64   `json:"rctx"`
+				XTime   int64   `json:"xtime"`
+				TxTime  float64 `json:"txtime"`
+				GPSTime int64   `json:"gpstime"`
+			}
+			assert.NoError(t, json.Unmarshal([]byte(msg), &dntxed))
+			assert.Equal(t, "dntxed", dntxed.MsgType)
+			assert.Equal(t, int64(42), dntxed.Diid)
+			assert.Equal(t, "01-02-03-04-05-06-07-08", dntxed.DevEui)
+			assert.Equal(t, int64(3), dntxed.RCtx)
+			assert.Equal(t, xtime+1000000, dntxed.XTime)
+			assert.InDelta(t, float64(time.Now().UnixMicro())/1e6, dntxed.TxTime, 0.1)
+			assert.InDelta(t, clock.gpsTime(time.Now()), dntxed.GPSTime, 1e5)
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for dntxed")
+		}
+	})
+
+	t.Run("sends no dntxed when the transmission fails", func(t *testing.T) {
+		assert.NoError(t, gw.SetTxFailureRate(1))
+		defer gw.SetTxFailureRate(0)
+
+		gw.parseIncomingMessage(fmt.Sprintf(`{"msgtype":"dnmsg","DevEui":"01-02-03-04-05-06-07-08","dC":2,"diid":43,"pdu":"%x","RX2DR":0,"RX2Freq":869525000,"priority":0,"MuxTime":1.0}`, phyBytes))
+
+		select {
+		case msg := <-messagesReceived:
+			t.Fatalf("Unexpected message %s", msg)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
 func TestLnsDataConnect_ConcurrentSends(t *testing.T) {
 	messagesReceived := make(chan string, 100)
 
@@ -444,9 +1025,11 @@ func TestLnsDataConnect_ConcurrentSends(t *testing.T) {
 		}
 		defer conn.Close()
 
+		conn.WriteMessage(websocket.TextMessage, []byte(testRouterConfig))
+
 		// Collect all messages
 		for {
-			_, msg, err := conn.ReadMessage()
+			msg, err := readStationMessage(conn)
 			if err != nil {
 				return
 			}
@@ -463,9 +1046,7 @@ func TestLnsDataConnect_ConcurrentSends(t *testing.T) {
 
 	err := gw.lnsDataConnect()
 	assert.NoError(t, err)
-
-	// Give time for connection to establish
-	time.Sleep(50 * time.Millisecond)
+	waitForRouterConfig(t, gw)
 
 	// Send messages concurrently
 	const numGoroutines = 10
@@ -493,7 +1074,7 @@ func TestLnsDataConnect_ConcurrentSends(t *testing.T) {
 					},
 					MIC: [4]byte{byte(id), byte(j), 0x03, 0x04},
 				}
-				gw.Forward(phy)
+				gw.Forward(newTestUplink(phy))
 			}
 		}(i)
 	}
@@ -20,7 +20,7 @@ type discoveryResponse struct {
 func (g *Gateway) lnsDiscovery() (string, error) {
 	// Connecting
 	g.mu.Lock()
-	g.discoveryState = StateConnecting
+	g.setDiscoveryState(StateConnecting)
 	headers := g.headers
 	g.mu.Unlock()
 
@@ -31,7 +31,7 @@ func (g *Gateway) lnsDiscovery() (string, error) {
 		// Connection error
 		log.Printf("[%s] discovery connection error: %v", g.eui, connErr)
 		g.mu.Lock()
-		g.discoveryState = StateDisconnected
+		g.setDiscoveryState(StateDisconnected)
 		g.mu.Unlock()
 
 		return "", connErr
@@ -40,26 +40,26 @@ func (g *Gateway) lnsDiscovery() (string, error) {
 	// Connected
 	log.Printf("[%s] discovery connected", g.eui)
 	g.mu.Lock()
-	g.discoveryState = StateConnected
+	g.setDiscoveryState(StateConnected)
 	g.mu.Unlock()
 
 	// LNS Discovery connection not needed anymore when exiting this function
 	defer func() {
 		g.mu.Lock()
-		g.discoveryState = StateDisconnecting
+		g.setDiscoveryState(StateDisconnecting)
 		g.mu.Unlock()
 
 		err := conn.Close()
 		if err != nil {
 			g.mu.Lock()
-			g.discoveryState = StateDisconnectionError
+			g.setDiscoveryState(StateDisconnectionError)
 			g.mu.Unlock()
 			log.Printf("[%s] discovery disconnection error: %s", g.eui, err)
 			return
 		}
 		log.Printf("[%s] discovery disconnected", g.eui)
 		g.mu.Lock()
-		g.discoveryState = StateDisconnected
+		g.setDiscoveryState(StateDisconnected)
 		g.mu.Unlock()
 	}()
 
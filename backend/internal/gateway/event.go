@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventType identifies something that happened to a gateway
+type EventType string
+
+const (
+	// EventStateChanged is raised when the discovery or data connection
+	// changes state
+	EventStateChanged EventType = "state_changed"
+	// EventDownlink is raised when a downlink of the LNS is transmitted
+	EventDownlink EventType = "downlink"
+)
+
+// Event is something that happened to a gateway
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// SetEventHandler sets the function called with each event of the gateway.
+// It may be called with the lock held and must not block.
+func (g *Gateway) SetEventHandler(handler func(Event)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.onEvent = handler
+}
+
+// emit reports an event of the gateway.
+// Must be called with the lock held.
+func (g *Gateway) emit(eventType EventType, message string) {
+	if g.onEvent != nil {
+		g.onEvent(Event{Type: eventType, Time: time.Now(), Message: message})
+	}
+}
+
+// setDataState changes the state of the data connection.
+// Must be called with the lock held.
+func (g *Gateway) setDataState(state State) {
+	if g.dataState == state {
+		return
+	}
+	g.dataState = state
+	g.emit(EventStateChanged, fmt.Sprintf("data %s", state))
+}
+
+// setDiscoveryState changes the state of the discovery connection.
+// Must be called with the lock held.
+func (g *Gateway) setDiscoveryState(state State) {
+	if g.discoveryState == state {
+		return
+	}
+	g.discoveryState = state
+	g.emit(EventStateChanged, fmt.Sprintf("discovery %s", state))
+}
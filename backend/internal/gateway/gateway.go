@@ -2,10 +2,18 @@ package gateway
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/brocaar/lorawan"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
 	"github.com/gorilla/websocket"
 )
 
@@ -16,6 +24,7 @@ type Location struct {
 
 type Gateway struct {
 	eui               lorawan.EUI64
+	protocol          Protocol
 	discoveryURI      string
 	discoveryState    State
 	dataURI           string
@@ -23,61 +32,235 @@ type Gateway struct {
 	dataWs            *websocket.Conn
 	dataDone          chan struct{}
 	dataSendCh        chan string
+	dataStart         time.Time     // start of the data connection
+	clockStart        time.Time     // origin of the radio counter
+	xtimeSession      int64         // session of the xtime of the data connection
+	gpsOffset         time.Duration // GPS time correction learned with timesync
+	routerConfig      *RouterConfig
+	routerConfigCh    chan struct{} // closed when router_config is received
+	udpConn           *net.UDPConn
+	udpPullAckCh      chan struct{}
+	udpStart          time.Time
+	udpStats          udpStats
+	mqttConfig        MQTTConfig
+	mqttClient        mqtt.Client
+	mqttTopicPrefix   string
+	mqttStats         mqttStats
 	headers           http.Header
 	location          *Location
+	region            *region.Region
+	txFailureRate     float64
+	reconnectStop     chan struct{} // closed by Disconnect, nil when not connected by Connect
+	reconnectAttempts int
+	lastError         string
+	onEvent           func(Event)
 	mu                sync.RWMutex
-	broadcastDownlink chan<- lorawan.PHYPayload
+	broadcastDownlink chan<- radio.Downlink
 }
 
 type GatewayInfo struct {
 	EUI            lorawan.EUI64   `json:"eui"`
+	Protocol       Protocol        `json:"protocol"`
 	DiscoveryURI   string          `json:"discoveryUri"`
 	DiscoveryState string          `json:"discoveryState"`
 	DataURI        string          `json:"dataUri"`
 	DataState      string          `json:"dataState"`
 	Headers        http.Header     `json:"headers,omitempty"`
 	Location       *Location       `json:"location,omitempty"`
+	Region         region.Name     `json:"region"`
+	RouterConfig   *RouterConfig   `json:"routerConfig,omitempty"`
+	MQTT           *MQTTConfig     `json:"mqtt,omitempty"`
+	TxFailureRate  float64         `json:"txFailureRate,omitempty"`
+	// Reconnection attempts since the connection dropped, and the last
+	// connection error
+	ReconnectAttempts int    `json:"reconnectAttempts,omitempty"`
+	LastError         string `json:"lastError,omitempty"`
 }
 
-func New(broadcastDownlink chan<- lorawan.PHYPayload, EUI lorawan.EUI64, discoveryURI string, headers http.Header) *Gateway {
+func New(broadcastDownlink chan<- radio.Downlink, EUI lorawan.EUI64, discoveryURI string, headers http.Header) *Gateway {
 	return &Gateway{
 		eui:               EUI,
+		protocol:          ProtocolBasicsStation,
 		discoveryURI:      discoveryURI,
 		discoveryState:    StateDisconnected,
 		dataURI:           "",
 		dataState:         StateDisconnected,
 		headers:           headers,
 		location:          nil,
+		region:            defaultRegion(),
+		mqttConfig:        defaultMQTTConfig(),
+		clockStart:        time.Now(),
 		broadcastDownlink: broadcastDownlink,
 	}
 }
 
-func NewWithLocation(broadcastDownlink chan<- lorawan.PHYPayload, EUI lorawan.EUI64, discoveryURI string, headers http.Header, location *Location) *Gateway {
+func NewWithLocation(broadcastDownlink chan<- radio.Downlink, EUI lorawan.EUI64, discoveryURI string, headers http.Header, location *Location) *Gateway {
 	return &Gateway{
 		eui:               EUI,
+		protocol:          ProtocolBasicsStation,
 		discoveryURI:      discoveryURI,
 		discoveryState:    StateDisconnected,
 		dataURI:           "",
 		dataState:         StateDisconnected,
 		headers:           headers,
 		location:          location,
+		region:            defaultRegion(),
+		mqttConfig:        defaultMQTTConfig(),
+		clockStart:        time.Now(),
 		broadcastDownlink: broadcastDownlink,
 	}
 }
 
+func defaultRegion() *region.Region {
+	r, err := region.Get(region.Default)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
 func (g *Gateway) GetInfo() GatewayInfo {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
 
+	var mqttConfig *MQTTConfig
+	if g.protocol == ProtocolChirpStackMQTT {
+		config := g.mqttConfig
+		mqttConfig = &config
+	}
+
 	return GatewayInfo{
 		EUI:            g.eui,
+		Protocol:       g.protocol,
 		DiscoveryURI:   g.discoveryURI,
 		DiscoveryState: g.discoveryState.String(),
 		DataURI:        g.dataURI,
 		DataState:      g.dataState.String(),
 		Headers:        g.headers,
 		Location:       g.location,
+		Region:         g.region.Name(),
+		RouterConfig:   g.routerConfig,
+		MQTT:           mqttConfig,
+		TxFailureRate:  g.txFailureRate,
+
+		ReconnectAttempts: g.reconnectAttempts,
+		LastError:         g.lastError,
+	}
+}
+
+// SetRegion sets the region whose channels the gateway listens to
+func (g *Gateway) SetRegion(r *region.Region) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.region = r
+}
+
+// SetProtocol selects the protocol used to connect to the LNS, the
+// discovery URI of a Semtech UDP gateway is the host:port of the server
+// and the one of a ChirpStack MQTT gateway the URL of the broker
+func (g *Gateway) SetProtocol(p Protocol) error {
+	if _, err := ParseProtocol(string(p)); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.dataState != StateDisconnected {
+		return errors.New("cannot change protocol while connected")
+	}
+	g.protocol = p
+
+	return nil
+}
+
+// SetMQTTConfig sets the encoding and topic prefix of a ChirpStack MQTT gateway
+func (g *Gateway) SetMQTTConfig(config MQTTConfig) error {
+	config, err := config.validate()
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.dataState != StateDisconnected {
+		return errors.New("cannot change MQTT configuration while connected")
+	}
+	g.mqttConfig = config
+
+	return nil
+}
+
+// SetTxFailureRate sets the probability (0-1) that a downlink fails to be
+// transmitted, to simulate a busy or faulty gateway
+func (g *Gateway) SetTxFailureRate(rate float64) error {
+	if rate < 0 || rate > 1 {
+		return errors.New("TX failure rate must be between 0 and 1")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.txFailureRate = rate
+
+	return nil
+}
+
+// txFailed draws whether the transmission of a downlink fails
+func (g *Gateway) txFailed() bool {
+	g.mu.RLock()
+	rate := g.txFailureRate
+	g.mu.RUnlock()
+
+	return rate > 0 && rand.Float64() < rate
+}
+
+// transmit broadcasts a downlink received from the LNS to the devices at its
+// transmission time, a zero time transmits it immediately. transmitted, if
+// not nil, is called once the downlink is on air.
+func (g *Gateway) transmit(downlink radio.Downlink, transmitted func(radio.Downlink)) {
+	g.mu.RLock()
+	broadcastCh := g.broadcastDownlink
+	r := g.region
+	location := g.location
+	g.mu.RUnlock()
+
+	if broadcastCh == nil {
+		return
+	}
+
+	downlink.Region = r.Name()
+	if downlink.TxPower == 0 {
+		downlink.TxPower = r.DownlinkTxPower(downlink.Frequency)
+	}
+	if location != nil {
+		downlink.Location = &radio.Location{Latitude: location.Latitude, Longitude: location.Longitude}
+	}
+	if downlink.Time.IsZero() {
+		downlink.Time = time.Now()
 	}
+
+	log.Printf("[%s] transmitting downlink on %d Hz DR%d in %s", g.eui, downlink.Frequency, downlink.DataRate, time.Until(downlink.Time).Round(time.Millisecond))
+	time.AfterFunc(time.Until(downlink.Time), func() {
+		broadcastCh <- downlink
+		if transmitted != nil {
+			transmitted(downlink)
+		}
+		if downlink.Beacon == nil {
+			g.mu.RLock()
+			g.emit(EventDownlink, fmt.Sprintf("%d Hz DR%d", downlink.Frequency, downlink.DataRate))
+			g.mu.RUnlock()
+		}
+	})
+}
+
+// counterTime returns the time at which a 32-bit microsecond counter of the
+// concentrator reads the given value, knowing its value now. The counter
+// wraps every ~71 minutes, the closest time to now is returned.
+func counterTime(counter uint32, now time.Time, nowCounter uint32) time.Time {
+	return now.Add(time.Duration(int32(counter-nowCounter)) * time.Microsecond)
 }
 
 func (g *Gateway) Connect() error {
@@ -90,12 +273,43 @@ func (g *Gateway) Connect() error {
 	}
 
 	// Check if connection is in progress
-	if g.discoveryState == StateConnecting || g.dataState == StateConnecting {
+	if g.discoveryState == StateConnecting || g.dataState == StateConnecting || g.dataState == StateReconnecting {
 		g.mu.RUnlock()
 		return errors.New("already connecting")
 	}
 	g.mu.RUnlock()
 
+	if err := g.connect(); err != nil {
+		g.mu.Lock()
+		g.lastError = err.Error()
+		g.mu.Unlock()
+		return err
+	}
+
+	// From now on a dropped connection is reconnected until Disconnect
+	g.mu.Lock()
+	g.reconnectStop = make(chan struct{})
+	g.reconnectAttempts = 0
+	g.lastError = ""
+	g.mu.Unlock()
+
+	return nil
+}
+
+// connect connects to the LNS with the protocol of the gateway
+func (g *Gateway) connect() error {
+	g.mu.RLock()
+	protocol := g.protocol
+	g.mu.RUnlock()
+
+	// Semtech UDP and ChirpStack MQTT have no discovery
+	switch protocol {
+	case ProtocolSemtechUDP:
+		return g.udpConnect()
+	case ProtocolChirpStackMQTT:
+		return g.mqttConnect()
+	}
+
 	// Get LNS Data URI from LNS Discovery
 	uri, discoveryErr := g.lnsDiscovery()
 	if discoveryErr != nil {
@@ -112,12 +326,41 @@ func (g *Gateway) Connect() error {
 }
 
 func (g *Gateway) Disconnect() error {
-	g.mu.RLock()
+	g.mu.Lock()
+	reconnecting := g.reconnectStop != nil && (g.dataState == StateReconnecting || g.dataState == StateConnecting)
+	if g.reconnectStop != nil {
+		close(g.reconnectStop)
+		g.reconnectStop = nil
+	}
+
+	// The connection is down, stopping the reconnection is enough
+	if reconnecting {
+		if g.dataState == StateReconnecting {
+			g.setDataState(StateDisconnected)
+		}
+		g.mu.Unlock()
+		log.Printf("[%s] reconnection stopped", g.eui)
+		return nil
+	}
+
 	if g.discoveryState == StateDisconnected && g.dataState == StateDisconnected {
-		g.mu.RUnlock()
+		g.mu.Unlock()
 		return errors.New("already disconnected")
 	}
-	g.mu.RUnlock()
+	protocol := g.protocol
+	g.mu.Unlock()
+
+	return g.disconnect(protocol)
+}
+
+// disconnect closes the LNS connection of the given protocol
+func (g *Gateway) disconnect(protocol Protocol) error {
+	switch protocol {
+	case ProtocolSemtechUDP:
+		return g.udpDisconnect()
+	case ProtocolChirpStackMQTT:
+		return g.mqttDisconnect()
+	}
 
 	return g.lnsDataDisconnect()
 }
@@ -98,6 +98,22 @@ func TestGateway_GetInfo(t *testing.T) {
 	})
 }
 
+func TestGateway_SetTxFailureRate(t *testing.T) {
+	gw := newTestGateway(lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, "wss://gateway.example.com:6887")
+	assert.False(t, gw.txFailed())
+
+	assert.NoError(t, gw.SetTxFailureRate(1))
+	assert.Equal(t, 1.0, gw.GetInfo().TxFailureRate)
+	assert.True(t, gw.txFailed())
+
+	assert.Error(t, gw.SetTxFailureRate(-0.1))
+	assert.Error(t, gw.SetTxFailureRate(1.5))
+	assert.Equal(t, 1.0, gw.GetInfo().TxFailureRate)
+
+	assert.NoError(t, gw.SetTxFailureRate(0))
+	assert.False(t, gw.txFailed())
+}
+
 func TestGateway_Connect(t *testing.T) {
 	t.Run("changes state to connected", func(t *testing.T) {
 		t.Skip("Skipping test that requires real WebSocket server")
@@ -0,0 +1,468 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/common"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// MQTTEncoding is the payload encoding of the ChirpStack Gateway Bridge topics
+type MQTTEncoding string
+
+const (
+	MQTTEncodingProtobuf MQTTEncoding = "protobuf"
+	MQTTEncodingJSON     MQTTEncoding = "json"
+)
+
+// MQTTConfig configures a ChirpStack MQTT gateway
+type MQTTConfig struct {
+	Encoding    MQTTEncoding `json:"encoding"`
+	TopicPrefix string       `json:"topicPrefix,omitempty"` // defaults to the lowercase region name
+}
+
+// Variables so that tests can shorten them
+var (
+	mqttConnectTimeout = 5 * time.Second
+	mqttStatsInterval  = 30 * time.Second
+)
+
+// mqttStats are the counters reported by the stats event, reset at every report
+type mqttStats struct {
+	rxReceived   uint32
+	rxReceivedOk uint32
+	txReceived   uint32
+	txEmitted    uint32
+}
+
+func defaultMQTTConfig() MQTTConfig {
+	return MQTTConfig{Encoding: MQTTEncodingProtobuf}
+}
+
+func (c MQTTConfig) validate() (MQTTConfig, error) {
+	switch c.Encoding {
+	case "":
+		c.Encoding = MQTTEncodingProtobuf
+	case MQTTEncodingProtobuf, MQTTEncodingJSON:
+	default:
+		return c, fmt.Errorf("unsupported MQTT encoding %q", c.Encoding)
+	}
+
+	if strings.ContainsAny(c.TopicPrefix, "+#") {
+		return c, fmt.Errorf("invalid MQTT topic prefix %q", c.TopicPrefix)
+	}
+	c.TopicPrefix = strings.Trim(c.TopicPrefix, "/")
+
+	return c, nil
+}
+
+func (c MQTTConfig) marshal(m proto.Message) ([]byte, error) {
+	if c.Encoding == MQTTEncodingJSON {
+		return protojson.Marshal(m)
+	}
+	return proto.Marshal(m)
+}
+
+func (c MQTTConfig) unmarshal(b []byte, m proto.Message) error {
+	if c.Encoding == MQTTEncodingJSON {
+		return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(b, m)
+	}
+	return proto.Unmarshal(b, m)
+}
+
+// mqttTopic returns the ChirpStack Gateway Bridge topic of the gateway,
+// e.g. eu868/gateway/0102030405060708/event/up
+func (g *Gateway) mqttTopic(prefix string, suffix string) string {
+	return fmt.Sprintf("%s/gateway/%s/%s", prefix, g.eui, suffix)
+}
+
+func (g *Gateway) mqttConnect() error {
+	// Connecting
+	g.mu.Lock()
+	g.setDataState(StateConnecting)
+	broker := g.discoveryURI
+	config := g.mqttConfig
+	if config.TopicPrefix == "" {
+		config.TopicPrefix = strings.ToLower(string(g.region.Name()))
+	}
+	g.mu.Unlock()
+	log.Printf("[%s] mqtt connecting to %s", g.eui, broker)
+
+	offline, err := config.marshal(&gw.ConnState{GatewayId: g.eui.String(), State: gw.ConnState_OFFLINE})
+	if err != nil {
+		g.mu.Lock()
+		g.setDataState(StateDisconnected)
+		g.mu.Unlock()
+		return err
+	}
+
+	dataDone := make(chan struct{})
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID("lorawan-simulator-"+g.eui.String()).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetConnectTimeout(mqttConnectTimeout).
+		SetBinaryWill(g.mqttTopic(config.TopicPrefix, "state/conn"), offline, 0, true).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			g.mu.Lock()
+			if g.mqttClient != client {
+				// Already disconnecting
+				g.mu.Unlock()
+				return
+			}
+			g.mqttClient = nil
+			g.dropped(err)
+			g.mu.Unlock()
+			log.Printf("[%s] mqtt connection lost: %v", g.eui, err)
+			close(dataDone)
+		})
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttConnectTimeout) || token.Error() != nil {
+		connErr := token.Error()
+		if connErr == nil {
+			connErr = errors.New("connection timeout")
+		}
+
+		// Connection error
+		log.Printf("[%s] mqtt connection error: %v", g.eui, connErr)
+		client.Disconnect(0)
+		g.mu.Lock()
+		g.setDataState(StateDisconnected)
+		g.mu.Unlock()
+
+		return connErr
+	}
+
+	// Receive downlinks
+	token = client.Subscribe(g.mqttTopic(config.TopicPrefix, "command/down"), 0, func(_ mqtt.Client, msg mqtt.Message) {
+		g.handleMQTTDownlink(msg.Payload())
+	})
+	if !token.WaitTimeout(mqttConnectTimeout) || token.Error() != nil {
+		log.Printf("[%s] mqtt subscribe error: %v", g.eui, token.Error())
+		client.Disconnect(0)
+		g.mu.Lock()
+		g.setDataState(StateDisconnected)
+		g.mu.Unlock()
+
+		return fmt.Errorf("failed to subscribe to downlinks: %v", token.Error())
+	}
+
+	// Connected
+	g.mu.Lock()
+	g.mqttClient = client
+	g.mqttTopicPrefix = config.TopicPrefix
+	g.mqttStats = mqttStats{}
+	g.dataURI = broker
+	g.dataDone = dataDone
+	g.setDataState(StateConnected)
+	g.mu.Unlock()
+	log.Printf("[%s] mqtt connected", g.eui)
+
+	g.mqttPublish("state/conn", &gw.ConnState{GatewayId: g.eui.String(), State: gw.ConnState_ONLINE}, true)
+
+	go g.mqttStatsLoop(dataDone, mqttStatsInterval)
+
+	return nil
+}
+
+func (g *Gateway) mqttStatsLoop(done chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			g.mqttPublishStats()
+		}
+	}
+}
+
+// mqttPublish publishes an event on a topic of the gateway
+func (g *Gateway) mqttPublish(suffix string, m proto.Message, retained bool) error {
+	g.mu.RLock()
+	client := g.mqttClient
+	prefix := g.mqttTopicPrefix
+	config := g.mqttConfig
+	g.mu.RUnlock()
+
+	if client == nil {
+		log.Printf("[%s] mqtt publish error: not allowed", g.eui)
+		return errors.New("not allowed")
+	}
+
+	payload, err := config.marshal(m)
+	if err != nil {
+		return err
+	}
+
+	topic := g.mqttTopic(prefix, suffix)
+	token := client.Publish(topic, 0, retained, payload)
+	if !token.WaitTimeout(mqttConnectTimeout) || token.Error() != nil {
+		log.Printf("[%s] mqtt publish error: %v", g.eui, token.Error())
+		return fmt.Errorf("failed to publish %s: %v", topic, token.Error())
+	}
+	log.Printf("[%s] mqtt publish %s: %x", g.eui, topic, payload)
+
+	return nil
+}
+
+func (g *Gateway) mqttPublishStats() error {
+	g.mu.Lock()
+	stats := g.mqttStats
+	g.mqttStats = mqttStats{}
+	location := g.location
+	g.mu.Unlock()
+
+	gatewayStats := &gw.GatewayStats{
+		GatewayId:           g.eui.String(),
+		Time:                timestamppb.Now(),
+		RxPacketsReceived:   stats.rxReceived,
+		RxPacketsReceivedOk: stats.rxReceivedOk,
+		TxPacketsReceived:   stats.txReceived,
+		TxPacketsEmitted:    stats.txEmitted,
+	}
+	if location != nil {
+		gatewayStats.Location = &common.Location{
+			Latitude:  location.Latitude,
+			Longitude: location.Longitude,
+		}
+	}
+
+	return g.mqttPublish("event/stats", gatewayStats, false)
+}
+
+func (g *Gateway) mqttForward(uplink radio.Uplink, r *region.Region) error {
+	dr, err := r.DataRate(uplink.DataRate)
+	if err != nil {
+		return err
+	}
+
+	data, err := uplink.PHYPayload.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to marshal PHYPayload: %w", err)
+	}
+
+	modulation := &gw.Modulation{}
+	switch dr.Modulation {
+	case "LORA":
+		modulation.Parameters = &gw.Modulation_Lora{Lora: &gw.LoraModulationInfo{
+			Bandwidth:       uint32(dr.Bandwidth) * 1000,
+			SpreadingFactor: uint32(dr.SpreadFactor),
+			CodeRate:        gw.CodeRate_CR_4_5,
+		}}
+	case "FSK":
+		modulation.Parameters = &gw.Modulation_Fsk{Fsk: &gw.FskModulationInfo{
+			Datarate: uint32(dr.BitRate),
+		}}
+	default:
+		return fmt.Errorf("unsupported modulation %s", dr.Modulation)
+	}
+
+	// Concentrator counter at the end of the uplink, echoed back by the
+	// network server in downlinks
+	uplinkTime := uplink.Time
+	if uplinkTime.IsZero() {
+		uplinkTime = time.Now()
+	}
+	context := make([]byte, 4)
+	binary.BigEndian.PutUint32(context, uint32(uplinkTime.UnixMicro()))
+
+	signal := uplink.ReceivedSignal()
+	frame := &gw.UplinkFrame{
+		PhyPayload: data,
+		TxInfo: &gw.UplinkTxInfo{
+			Frequency:  uplink.Frequency,
+			Modulation: modulation,
+		},
+		RxInfo: &gw.UplinkRxInfo{
+			GatewayId: g.eui.String(),
+			UplinkId:  rand.Uint32(),
+			GwTime:    timestamppb.Now(),
+			Rssi:      int32(signal.RSSI),
+			Snr:       float32(signal.SNR),
+			Context:   context,
+			CrcStatus: gw.CRCStatus_CRC_OK,
+		},
+	}
+
+	if err := g.mqttPublish("event/up", frame, false); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	g.mqttStats.rxReceived++
+	g.mqttStats.rxReceivedOk++
+	g.mu.Unlock()
+
+	return nil
+}
+
+func (g *Gateway) handleMQTTDownlink(payload []byte) {
+	g.mu.RLock()
+	config := g.mqttConfig
+	g.mu.RUnlock()
+
+	var frame gw.DownlinkFrame
+	if err := config.unmarshal(payload, &frame); err != nil {
+		log.Printf("[%s] failed to parse downlink frame: %v", g.eui, err)
+		return
+	}
+	if len(frame.Items) == 0 {
+		log.Printf("[%s] downlink frame %d without items", g.eui, frame.DownlinkId)
+		return
+	}
+
+	g.mu.Lock()
+	g.mqttStats.txReceived++
+	g.mu.Unlock()
+
+	// The first item is emitted, the following ones are only tried when
+	// the previous one can't be scheduled
+	ack := &gw.DownlinkTxAck{
+		GatewayId:  g.eui.String(),
+		DownlinkId: frame.DownlinkId,
+		Items:      make([]*gw.DownlinkTxAckItem, len(frame.Items)),
+	}
+	for i := range ack.Items {
+		ack.Items[i] = &gw.DownlinkTxAckItem{Status: gw.TxAckStatus_IGNORED}
+	}
+
+	g.mu.RLock()
+	r := g.region
+	g.mu.RUnlock()
+
+	for i, item := range frame.Items {
+		downlink, status := g.mqttScheduleDownlink(item, r)
+		ack.Items[i].Status = status
+		if status != gw.TxAckStatus_OK {
+			log.Printf("[%s] downlink message %d item %d: %s", g.eui, frame.DownlinkId, i, status)
+			continue
+		}
+
+		g.mu.Lock()
+		g.mqttStats.txEmitted++
+		g.mu.Unlock()
+
+		g.mqttPublish("event/ack", ack, false)
+
+		log.Printf("[%s] downlink message %d on %d Hz", g.eui, frame.DownlinkId, downlink.Frequency)
+		g.transmit(downlink, nil)
+		return
+	}
+
+	g.mqttPublish("event/ack", ack, false)
+}
+
+// mqttScheduleDownlink returns the downlink of a frame item and whether it can
+// be emitted
+func (g *Gateway) mqttScheduleDownlink(item *gw.DownlinkFrameItem, r *region.Region) (radio.Downlink, gw.TxAckStatus) {
+	// Unmarshal bytes into PHYPayload
+	var phyPayload lorawan.PHYPayload
+	if err := phyPayload.UnmarshalBinary(item.PhyPayload); err != nil {
+		log.Printf("[%s] failed to unmarshal PHYPayload: %v", g.eui, err)
+		return radio.Downlink{}, gw.TxAckStatus_INTERNAL_ERROR
+	}
+
+	txInfo := item.GetTxInfo()
+	downlink := radio.Downlink{
+		PHYPayload: phyPayload,
+		Frequency:  txInfo.GetFrequency(),
+		TxPower:    float64(txInfo.GetPower()),
+	}
+
+	dr, err := mqttDataRate(txInfo.GetModulation())
+	if err == nil {
+		downlink.DataRate, err = r.DownlinkDataRateIndex(dr)
+	}
+	if err != nil {
+		log.Printf("[%s] invalid downlink modulation: %v", g.eui, err)
+		return radio.Downlink{}, gw.TxAckStatus_TX_FREQ
+	}
+
+	switch timing := txInfo.GetTiming().GetParameters().(type) {
+	case nil, *gw.Timing_Immediately:
+	case *gw.Timing_Delay:
+		// The delay starts at the end of the uplink identified by the context
+		if len(txInfo.GetContext()) != 4 {
+			log.Printf("[%s] invalid downlink context %x", g.eui, txInfo.GetContext())
+			return radio.Downlink{}, gw.TxAckStatus_INTERNAL_ERROR
+		}
+		now := time.Now()
+		counter := binary.BigEndian.Uint32(txInfo.GetContext())
+		downlink.Time = counterTime(counter, now, uint32(now.UnixMicro())).Add(timing.Delay.GetDelay().AsDuration())
+		if !downlink.Time.After(now) {
+			return radio.Downlink{}, gw.TxAckStatus_TOO_LATE
+		}
+	case *gw.Timing_GpsEpoch:
+		return radio.Downlink{}, gw.TxAckStatus_GPS_UNLOCKED
+	}
+
+	if g.txFailed() {
+		log.Printf("[%s] downlink not transmitted (simulated TX failure)", g.eui)
+		return radio.Downlink{}, gw.TxAckStatus_COLLISION_PACKET
+	}
+
+	return downlink, gw.TxAckStatus_OK
+}
+
+// mqttDataRate returns the data rate of a downlink modulation
+func mqttDataRate(modulation *gw.Modulation) (region.DataRate, error) {
+	switch m := modulation.GetParameters().(type) {
+	case *gw.Modulation_Lora:
+		return region.DataRate{
+			Modulation:   "LORA",
+			SpreadFactor: int(m.Lora.GetSpreadingFactor()),
+			Bandwidth:    int(m.Lora.GetBandwidth() / 1000),
+		}, nil
+	case *gw.Modulation_Fsk:
+		return region.DataRate{Modulation: "FSK", BitRate: int(m.Fsk.GetDatarate())}, nil
+	default:
+		return region.DataRate{}, errors.New("unsupported modulation")
+	}
+}
+
+func (g *Gateway) mqttDisconnect() error {
+	g.mu.Lock()
+	g.setDataState(StateDisconnecting)
+	g.mu.Unlock()
+	log.Printf("[%s] mqtt disconnecting", g.eui)
+
+	// A clean disconnect doesn't trigger the will message
+	g.mqttPublish("state/conn", &gw.ConnState{GatewayId: g.eui.String(), State: gw.ConnState_OFFLINE}, true)
+
+	g.mu.Lock()
+	client := g.mqttClient
+	g.mqttClient = nil
+	dataDone := g.dataDone
+	g.mu.Unlock()
+
+	if client != nil {
+		client.Disconnect(250)
+		close(dataDone)
+	}
+
+	g.mu.Lock()
+	g.setDataState(StateDisconnected)
+	g.mu.Unlock()
+	log.Printf("[%s] mqtt disconnected", g.eui)
+
+	return nil
+}
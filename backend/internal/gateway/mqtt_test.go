@@ -0,0 +1,725 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+type mqttTestMessage struct {
+	topic   string
+	payload []byte
+}
+
+// Embedded MQTT 3.1.1 broker (QoS 0 delivery, retained and will messages)
+// that simulates the broker of a ChirpStack deployment
+type mockMQTTBroker struct {
+	listener net.Listener
+	messages chan mqttTestMessage
+	mu       sync.Mutex
+	clients  map[net.Conn][]string
+	retained map[string][]byte
+	wmu      sync.Mutex
+}
+
+func newMockMQTTBroker(t *testing.T) *mockMQTTBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	b := &mockMQTTBroker{
+		listener: listener,
+		messages: make(chan mqttTestMessage, 100),
+		clients:  make(map[net.Conn][]string),
+		retained: make(map[string][]byte),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *mockMQTTBroker) URI() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// Close stops the broker and drops the client connections
+func (b *mockMQTTBroker) Close() {
+	b.listener.Close()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.clients {
+		conn.Close()
+	}
+}
+
+// dropClients closes the client connections, keeping the broker running
+func (b *mockMQTTBroker) dropClients() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.clients {
+		conn.Close()
+	}
+}
+
+func (b *mockMQTTBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var will *mqttTestMessage
+	var willRetain bool
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := readMQTTPacket(r)
+		if err != nil {
+			break
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			_, rest := readMQTTString(body) // protocol name
+			flags := rest[1]
+			rest = rest[4:]
+			_, rest = readMQTTString(rest) // client identifier
+			if flags&0x04 != 0 {
+				var topic, payload string
+				topic, rest = readMQTTString(rest)
+				payload, _ = readMQTTString(rest)
+				will = &mqttTestMessage{topic: topic, payload: []byte(payload)}
+				willRetain = flags&0x20 != 0
+			}
+
+			b.mu.Lock()
+			b.clients[conn] = nil
+			b.mu.Unlock()
+			b.write(conn, 0x20, []byte{0x00, 0x00})
+		case 3: // PUBLISH
+			topic, rest := readMQTTString(body)
+			if qos := (header >> 1) & 0x03; qos > 0 {
+				b.write(conn, 0x40, rest[:2])
+				rest = rest[2:]
+			}
+			b.publish(topic, rest, header&0x01 != 0)
+		case 8: // SUBSCRIBE
+			id, rest := body[:2], body[2:]
+			granted := []byte{}
+			var filters []string
+			for len(rest) > 0 {
+				var filter string
+				filter, rest = readMQTTString(rest)
+				rest = rest[1:]
+				filters = append(filters, filter)
+				granted = append(granted, 0x00)
+			}
+
+			b.mu.Lock()
+			b.clients[conn] = append(b.clients[conn], filters...)
+			var retained []mqttTestMessage
+			for topic, payload := range b.retained {
+				for _, filter := range filters {
+					if matchMQTTTopic(filter, topic) {
+						retained = append(retained, mqttTestMessage{topic: topic, payload: payload})
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+			b.write(conn, 0x90, append(id, granted...))
+			for _, msg := range retained {
+				b.write(conn, 0x31, append(mqttString(msg.topic), msg.payload...))
+			}
+		case 10: // UNSUBSCRIBE
+			b.write(conn, 0xb0, body[:2])
+		case 12: // PINGREQ
+			b.write(conn, 0xd0, nil)
+		case 14: // DISCONNECT
+			will = nil
+		}
+	}
+
+	b.mu.Lock()
+	delete(b.clients, conn)
+	b.mu.Unlock()
+
+	if will != nil {
+		b.publish(will.topic, will.payload, willRetain)
+	}
+}
+
+// publish routes a message to the subscribed clients
+func (b *mockMQTTBroker) publish(topic string, payload []byte, retain bool) {
+	payload = append([]byte(nil), payload...)
+	select {
+	case b.messages <- mqttTestMessage{topic: topic, payload: payload}:
+	default:
+	}
+
+	b.mu.Lock()
+	if retain {
+		b.retained[topic] = payload
+	}
+	var subscribers []net.Conn
+	for conn, filters := range b.clients {
+		for _, filter := range filters {
+			if matchMQTTTopic(filter, topic) {
+				subscribers = append(subscribers, conn)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	packet := append(mqttString(topic), payload...)
+	for _, conn := range subscribers {
+		b.write(conn, 0x30, packet)
+	}
+}
+
+// next returns the next message published on the given topic
+func (b *mockMQTTBroker) next(t *testing.T, topic string) []byte {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case msg := <-b.messages:
+			if msg.topic == topic {
+				return msg.payload
+			}
+		case <-timeout:
+			t.Fatalf("Timeout waiting for %s", topic)
+			return nil
+		}
+	}
+}
+
+func (b *mockMQTTBroker) write(conn net.Conn, header byte, body []byte) {
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	conn.Write(append(packet, body...))
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func readMQTTString(b []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func matchMQTTTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func newTestMQTTGateway(t *testing.T, broker *mockMQTTBroker, config MQTTConfig) (*Gateway, chan radio.Downlink) {
+	downlinkCh := make(chan radio.Downlink, 10)
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	g := New(downlinkCh, eui, broker.URI(), nil)
+	assert.NoError(t, g.SetProtocol(ProtocolChirpStackMQTT))
+	assert.NoError(t, g.SetMQTTConfig(config))
+	return g, downlinkCh
+}
+
+func TestMatchMQTTTopic(t *testing.T) {
+	assert.True(t, matchMQTTTopic("eu868/gateway/+/event/up", "eu868/gateway/0102030405060708/event/up"))
+	assert.True(t, matchMQTTTopic("eu868/gateway/#", "eu868/gateway/0102030405060708/event/up"))
+	assert.False(t, matchMQTTTopic("eu868/gateway/+/event/up", "eu868/gateway/0102030405060708/event/stats"))
+	assert.False(t, matchMQTTTopic("eu868/gateway/+", "eu868/gateway/0102030405060708/event/up"))
+}
+
+func TestGateway_SetMQTTConfig(t *testing.T) {
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	gw := newTestGateway(eui, "tcp://localhost:1883")
+	assert.Nil(t, gw.GetInfo().MQTT)
+
+	assert.NoError(t, gw.SetProtocol(ProtocolChirpStackMQTT))
+	assert.Equal(t, &MQTTConfig{Encoding: MQTTEncodingProtobuf}, gw.GetInfo().MQTT)
+
+	assert.NoError(t, gw.SetMQTTConfig(MQTTConfig{Encoding: MQTTEncodingJSON, TopicPrefix: "/us915_1/"}))
+	assert.Equal(t, &MQTTConfig{Encoding: MQTTEncodingJSON, TopicPrefix: "us915_1"}, gw.GetInfo().MQTT)
+
+	assert.NoError(t, gw.SetMQTTConfig(MQTTConfig{}))
+	assert.Equal(t, MQTTEncodingProtobuf, gw.GetInfo().MQTT.Encoding)
+
+	err := gw.SetMQTTConfig(MQTTConfig{Encoding: "xml"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported MQTT encoding")
+
+	err = gw.SetMQTTConfig(MQTTConfig{TopicPrefix: "eu868/#"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid MQTT topic prefix")
+
+	gw.dataState = StateConnected
+	err = gw.SetMQTTConfig(MQTTConfig{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "while connected")
+}
+
+func TestMQTT_ConnectDisconnect(t *testing.T) {
+	broker := newMockMQTTBroker(t)
+	defer broker.Close()
+
+	gateway, _ := newTestMQTTGateway(t, broker, MQTTConfig{})
+
+	err := gateway.Connect()
+	assert.NoError(t, err)
+
+	var state gw.ConnState
+	assert.NoError(t, proto.Unmarshal(broker.next(t, "eu868/gateway/aabbccddeeff0011/state/conn"), &state))
+	assert.Equal(t, gw.ConnState_ONLINE, state.State)
+	assert.Equal(t, "aabbccddeeff0011", state.GatewayId)
+
+	info := gateway.GetInfo()
+	assert.Equal(t, "connected", info.DataState)
+	assert.Equal(t, "disconnected", info.DiscoveryState)
+	assert.Equal(t, broker.URI(), info.DataURI)
+
+	err = gateway.Connect()
+	assert.Error(t, err)
+	assert.Equal(t, "already connected", err.Error())
+
+	err = gateway.Disconnect()
+	assert.NoError(t, err)
+	assert.Equal(t, "disconnected", gateway.GetInfo().DataState)
+
+	assert.NoError(t, proto.Unmarshal(broker.next(t, "eu868/gateway/aabbccddeeff0011/state/conn"), &state))
+	assert.Equal(t, gw.ConnState_OFFLINE, state.State)
+}
+
+func TestMQTT_ConnectError(t *testing.T) {
+	broker := newMockMQTTBroker(t)
+	uri := broker.URI()
+	broker.Close()
+
+	downlinkCh := make(chan radio.Downlink, 10)
+	gateway := New(downlinkCh, lorawan.EUI64{0x01}, uri, nil)
+	assert.NoError(t, gateway.SetProtocol(ProtocolChirpStackMQTT))
+
+	err := gateway.Connect()
+	assert.Error(t, err)
+	assert.Equal(t, "disconnected", gateway.GetInfo().DataState)
+}
+
+func TestMQTT_ConnectionLost(t *testing.T) {
+	broker := newMockMQTTBroker(t)
+
+	gateway, _ := newTestMQTTGateway(t, broker, MQTTConfig{})
+	assert.NoError(t, gateway.Connect())
+
+	broker.Close()
+
+	assert.Eventually(t, func() bool {
+		return gateway.GetInfo().DataState == "reconnecting"
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NotEmpty(t, gateway.GetInfo().LastError)
+
+	err := gateway.Forward(newTestUplink(lorawan.PHYPayload{
+		MHDR:       lorawan.MHDR{MType: lorawan.UnconfirmedDataUp, Major: lorawan.LoRaWANR1},
+		MACPayload: &lorawan.MACPayload{},
+	}))
+	assert.Error(t, err)
+	assert.Equal(t, "not allowed", err.Error())
+
+	// Disconnect stops the reconnection
+	assert.NoError(t, gateway.Disconnect())
+	assert.Equal(t, "disconnected", gateway.GetInfo().DataState)
+}
+
+func TestMQTT_Reconnect(t *testing.T) {
+	defer func(min, max time.Duration) {
+		reconnectMinBackoff, reconnectMaxBackoff = min, max
+	}(reconnectMinBackoff, reconnectMaxBackoff)
+	reconnectMinBackoff, reconnectMaxBackoff = 20*time.Millisecond, 100*time.Millisecond
+
+	broker := newMockMQTTBroker(t)
+	defer broker.Close()
+
+	gateway, _ := newTestMQTTGateway(t, broker, MQTTConfig{})
+	assert.NoError(t, gateway.Connect())
+	defer gateway.Disconnect()
+	broker.next(t, "eu868/gateway/aabbccddeeff0011/state/conn")
+
+	broker.dropClients()
+	assert.Eventually(t, func() bool {
+		return gateway.GetInfo().LastError != ""
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// The gateway is back online on the same broker
+	assert.Eventually(t, func() bool {
+		return gateway.GetInfo().DataState == "connected"
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, gateway.GetInfo().ReconnectAttempts)
+
+	// The will reports the drop, the reconnection reports the gateway online
+	var state gw.ConnState
+	assert.NoError(t, proto.Unmarshal(broker.next(t, "eu868/gateway/aabbccddeeff0011/state/conn"), &state))
+	assert.Equal(t, gw.ConnState_OFFLINE, state.State)
+	assert.NoError(t, proto.Unmarshal(broker.next(t, "eu868/gateway/aabbccddeeff0011/state/conn"), &state))
+	assert.Equal(t, gw.ConnState_ONLINE, state.State)
+}
+
+func TestMQTT_Forward(t *testing.T) {
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.JoinRequest,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.JoinRequestPayload{
+			JoinEUI:  lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18},
+			DevEUI:   lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			DevNonce: lorawan.DevNonce(100),
+		},
+		MIC: [4]byte{0x01, 0x02, 0x03, 0x04},
+	}
+	phyBytes, err := phy.MarshalBinary()
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		config    MQTTConfig
+		topic     string
+		unmarshal func([]byte, proto.Message) error
+	}{
+		{"protobuf", MQTTConfig{Encoding: MQTTEncodingProtobuf}, "eu868/gateway/aabbccddeeff0011/event/up", proto.Unmarshal},
+		{"json", MQTTConfig{Encoding: MQTTEncodingJSON}, "eu868/gateway/aabbccddeeff0011/event/up", protojson.Unmarshal},
+		{"topic prefix", MQTTConfig{TopicPrefix: "eu868_test"}, "eu868_test/gateway/aabbccddeeff0011/event/up", proto.Unmarshal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newMockMQTTBroker(t)
+			defer broker.Close()
+
+			gateway, _ := newTestMQTTGateway(t, broker, tt.config)
+			assert.NoError(t, gateway.Connect())
+			defer gateway.Disconnect()
+
+			uplink := newTestUplink(phy)
+			uplink.Signal = &radio.Signal{RSSI: -112, SNR: -3.25}
+			err := gateway.Forward(uplink)
+			assert.NoError(t, err)
+
+			var frame gw.UplinkFrame
+			assert.NoError(t, tt.unmarshal(broker.next(t, tt.topic), &frame))
+			assert.Equal(t, phyBytes, frame.PhyPayload)
+			assert.Equal(t, uint32(868300000), frame.TxInfo.Frequency)
+			assert.Equal(t, uint32(7), frame.TxInfo.Modulation.GetLora().SpreadingFactor)
+			assert.Equal(t, uint32(125000), frame.TxInfo.Modulation.GetLora().Bandwidth)
+			assert.Equal(t, gw.CodeRate_CR_4_5, frame.TxInfo.Modulation.GetLora().CodeRate)
+			assert.Equal(t, "aabbccddeeff0011", frame.RxInfo.GatewayId)
+			assert.Equal(t, gw.CRCStatus_CRC_OK, frame.RxInfo.CrcStatus)
+			assert.NotNil(t, frame.RxInfo.GwTime)
+			assert.Len(t, frame.RxInfo.Context, 4)
+			assert.Equal(t, int32(-112), frame.RxInfo.Rssi)
+			assert.Equal(t, float32(-3.25), frame.RxInfo.Snr)
+		})
+	}
+
+	t.Run("rejects uplink outside the channel plan", func(t *testing.T) {
+		broker := newMockMQTTBroker(t)
+		defer broker.Close()
+
+		gateway, _ := newTestMQTTGateway(t, broker, MQTTConfig{})
+		assert.NoError(t, gateway.Connect())
+		defer gateway.Disconnect()
+
+		uplink := newTestUplink(phy)
+		uplink.Frequency = 869525000
+		err := gateway.Forward(uplink)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid uplink channel")
+	})
+}
+
+func TestMQTT_Downlink(t *testing.T) {
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataDown,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.MACPayload{
+			FHDR: lorawan.FHDR{DevAddr: lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}, FCnt: 7},
+		},
+		MIC: [4]byte{0x01, 0x02, 0x03, 0x04},
+	}
+	phyBytes, err := phy.MarshalBinary()
+	assert.NoError(t, err)
+
+	lora := func(sf uint32) *gw.Modulation {
+		return &gw.Modulation{Parameters: &gw.Modulation_Lora{Lora: &gw.LoraModulationInfo{
+			Bandwidth:       125000,
+			SpreadingFactor: sf,
+			CodeRate:        gw.CodeRate_CR_4_5,
+		}}}
+	}
+	immediately := &gw.Timing{Parameters: &gw.Timing_Immediately{Immediately: &gw.ImmediatelyTimingInfo{}}}
+	delay := func(uplinkTime time.Time, d time.Duration) (*gw.Timing, []byte) {
+		context := make([]byte, 4)
+		binary.BigEndian.PutUint32(context, uint32(uplinkTime.UnixMicro()))
+		return &gw.Timing{Parameters: &gw.Timing_Delay{Delay: &gw.DelayTimingInfo{Delay: durationpb.New(d)}}}, context
+	}
+
+	downlink := &gw.DownlinkFrame{
+		DownlinkId: 1234,
+		GatewayId:  "aabbccddeeff0011",
+		Items: []*gw.DownlinkFrameItem{
+			{PhyPayload: phyBytes, TxInfo: &gw.DownlinkTxInfo{Frequency: 868100000, Power: 14, Modulation: lora(7), Timing: immediately}},
+			{PhyPayload: phyBytes, TxInfo: &gw.DownlinkTxInfo{Frequency: 869525000, Power: 14, Modulation: lora(12), Timing: immediately}},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		encoding  MQTTEncoding
+		marshal   func(proto.Message) ([]byte, error)
+		unmarshal func([]byte, proto.Message) error
+	}{
+		{"protobuf", MQTTEncodingProtobuf, proto.Marshal, proto.Unmarshal},
+		{"json", MQTTEncodingJSON, protojson.Marshal, protojson.Unmarshal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newMockMQTTBroker(t)
+			defer broker.Close()
+
+			gateway, downlinkCh := newTestMQTTGateway(t, broker, MQTTConfig{Encoding: tt.encoding})
+			assert.NoError(t, gateway.Connect())
+			defer gateway.Disconnect()
+
+			payload, err := tt.marshal(downlink)
+			assert.NoError(t, err)
+			broker.publish("eu868/gateway/aabbccddeeff0011/command/down", payload, false)
+
+			select {
+			case received := <-downlinkCh:
+				macPL, ok := received.PHYPayload.MACPayload.(*lorawan.MACPayload)
+				assert.True(t, ok)
+				assert.Equal(t, uint32(7), macPL.FHDR.FCnt)
+				assert.Equal(t, region.EU868, received.Region)
+				assert.Equal(t, uint32(868100000), received.Frequency)
+				assert.Equal(t, 5, received.DataRate)
+				assert.Equal(t, float64(14), received.TxPower)
+			case <-time.After(time.Second):
+				t.Fatal("Timeout waiting for downlink")
+			}
+
+			var ack gw.DownlinkTxAck
+			assert.NoError(t, tt.unmarshal(broker.next(t, "eu868/gateway/aabbccddeeff0011/event/ack"), &ack))
+			assert.Equal(t, uint32(1234), ack.DownlinkId)
+			assert.Equal(t, "aabbccddeeff0011", ack.GatewayId)
+			assert.Len(t, ack.Items, 2)
+			assert.Equal(t, gw.TxAckStatus_OK, ack.Items[0].Status)
+			assert.Equal(t, gw.TxAckStatus_IGNORED, ack.Items[1].Status)
+		})
+	}
+
+	t.Run("schedules the delay after the uplink context", func(t *testing.T) {
+		broker := newMockMQTTBroker(t)
+		defer broker.Close()
+
+		gateway, downlinkCh := newTestMQTTGateway(t, broker, MQTTConfig{})
+		assert.NoError(t, gateway.Connect())
+		defer gateway.Disconnect()
+
+		uplinkTime := time.Now()
+		timing, context := delay(uplinkTime, time.Second)
+		payload, err := proto.Marshal(&gw.DownlinkFrame{
+			DownlinkId: 1235,
+			Items: []*gw.DownlinkFrameItem{
+				{PhyPayload: phyBytes, TxInfo: &gw.DownlinkTxInfo{Frequency: 868100000, Modulation: lora(7), Timing: timing, Context: context}},
+			},
+		})
+		assert.NoError(t, err)
+		broker.publish("eu868/gateway/aabbccddeeff0011/command/down", payload, false)
+
+		select {
+		case received := <-downlinkCh:
+			assert.WithinDuration(t, uplinkTime.Add(time.Second), received.Time, time.Millisecond)
+			assert.False(t, time.Now().Before(received.Time))
+			// The TX power defaults to the one of the region
+			assert.Equal(t, float64(14), received.TxPower)
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for downlink")
+		}
+	})
+
+	t.Run("tries the next item when one can't be scheduled", func(t *testing.T) {
+		broker := newMockMQTTBroker(t)
+		defer broker.Close()
+
+		gateway, downlinkCh := newTestMQTTGateway(t, broker, MQTTConfig{})
+		assert.NoError(t, gateway.Connect())
+		defer gateway.Disconnect()
+
+		timing, context := delay(time.Now().Add(-2*time.Second), time.Second)
+		gpsEpoch := &gw.Timing{Parameters: &gw.Timing_GpsEpoch{GpsEpoch: &gw.GPSEpochTimingInfo{}}}
+		payload, err := proto.Marshal(&gw.DownlinkFrame{
+			DownlinkId: 1236,
+			Items: []*gw.DownlinkFrameItem{
+				{PhyPayload: phyBytes, TxInfo: &gw.DownlinkTxInfo{Frequency: 868100000, Modulation: lora(7), Timing: timing, Context: context}},
+				{PhyPayload: phyBytes, TxInfo: &gw.DownlinkTxInfo{Frequency: 869525000, Modulation: lora(12), Timing: gpsEpoch}},
+				{PhyPayload: phyBytes, TxInfo: &gw.DownlinkTxInfo{Frequency: 869525000, Modulation: lora(12), Timing: immediately}},
+				{PhyPayload: phyBytes, TxInfo: &gw.DownlinkTxInfo{Frequency: 869525000, Modulation: lora(12), Timing: immediately}},
+			},
+		})
+		assert.NoError(t, err)
+		broker.publish("eu868/gateway/aabbccddeeff0011/command/down", payload, false)
+
+		select {
+		case received := <-downlinkCh:
+			assert.Equal(t, uint32(869525000), received.Frequency)
+			assert.Equal(t, 0, received.DataRate)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for downlink")
+		}
+
+		var ack gw.DownlinkTxAck
+		assert.NoError(t, proto.Unmarshal(broker.next(t, "eu868/gateway/aabbccddeeff0011/event/ack"), &ack))
+		assert.Len(t, ack.Items, 4)
+		assert.Equal(t, gw.TxAckStatus_TOO_LATE, ack.Items[0].Status)
+		assert.Equal(t, gw.TxAckStatus_GPS_UNLOCKED, ack.Items[1].Status)
+		assert.Equal(t, gw.TxAckStatus_OK, ack.Items[2].Status)
+		assert.Equal(t, gw.TxAckStatus_IGNORED, ack.Items[3].Status)
+	})
+
+	t.Run("reports simulated TX failure", func(t *testing.T) {
+		broker := newMockMQTTBroker(t)
+		defer broker.Close()
+
+		gateway, downlinkCh := newTestMQTTGateway(t, broker, MQTTConfig{})
+		assert.NoError(t, gateway.SetTxFailureRate(1))
+		assert.NoError(t, gateway.Connect())
+		defer gateway.Disconnect()
+
+		payload, err := proto.Marshal(downlink)
+		assert.NoError(t, err)
+		broker.publish("eu868/gateway/aabbccddeeff0011/command/down", payload, false)
+
+		var ack gw.DownlinkTxAck
+		assert.NoError(t, proto.Unmarshal(broker.next(t, "eu868/gateway/aabbccddeeff0011/event/ack"), &ack))
+		assert.Len(t, ack.Items, 2)
+		assert.Equal(t, gw.TxAckStatus_COLLISION_PACKET, ack.Items[0].Status)
+		assert.Equal(t, gw.TxAckStatus_COLLISION_PACKET, ack.Items[1].Status)
+
+		select {
+		case <-downlinkCh:
+			t.Fatal("Unexpected downlink")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("ignores downlinks of other gateways", func(t *testing.T) {
+		broker := newMockMQTTBroker(t)
+		defer broker.Close()
+
+		gateway, downlinkCh := newTestMQTTGateway(t, broker, MQTTConfig{})
+		assert.NoError(t, gateway.Connect())
+		defer gateway.Disconnect()
+
+		payload, err := proto.Marshal(downlink)
+		assert.NoError(t, err)
+		broker.publish("eu868/gateway/0102030405060708/command/down", payload, false)
+
+		select {
+		case <-downlinkCh:
+			t.Fatal("Unexpected downlink")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func TestMQTT_Stats(t *testing.T) {
+	interval := mqttStatsInterval
+	mqttStatsInterval = 50 * time.Millisecond
+	defer func() { mqttStatsInterval = interval }()
+
+	broker := newMockMQTTBroker(t)
+	defer broker.Close()
+
+	downlinkCh := make(chan radio.Downlink, 10)
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	gateway := NewWithLocation(downlinkCh, eui, broker.URI(), nil, &Location{Latitude: 45.4642, Longitude: 9.19})
+	assert.NoError(t, gateway.SetProtocol(ProtocolChirpStackMQTT))
+	us915, _ := region.Get(region.US915)
+	gateway.SetRegion(us915)
+	assert.NoError(t, gateway.Connect())
+	defer gateway.Disconnect()
+
+	var stats gw.GatewayStats
+	assert.NoError(t, proto.Unmarshal(broker.next(t, "us915/gateway/aabbccddeeff0011/event/stats"), &stats))
+	assert.Equal(t, "aabbccddeeff0011", stats.GatewayId)
+	assert.NotNil(t, stats.Time)
+	assert.Equal(t, 45.4642, stats.Location.Latitude)
+	assert.Equal(t, 9.19, stats.Location.Longitude)
+}
@@ -0,0 +1,27 @@
+package gateway
+
+import "fmt"
+
+// Protocol is the protocol spoken by the gateway towards the LNS
+type Protocol string
+
+const (
+	ProtocolBasicsStation  Protocol = "basicsstation"
+	ProtocolSemtechUDP     Protocol = "semtech-udp"
+	ProtocolChirpStackMQTT Protocol = "chirpstack-mqtt"
+)
+
+// ParseProtocol validates a protocol name, an empty name selects
+// LoRa Basics Station
+func ParseProtocol(name string) (Protocol, error) {
+	switch Protocol(name) {
+	case "", ProtocolBasicsStation:
+		return ProtocolBasicsStation, nil
+	case ProtocolSemtechUDP:
+		return ProtocolSemtechUDP, nil
+	case ProtocolChirpStackMQTT:
+		return ProtocolChirpStackMQTT, nil
+	default:
+		return "", fmt.Errorf("unsupported protocol %q", name)
+	}
+}
@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Variables so that tests can shorten them
+var (
+	reconnectMinBackoff = 1 * time.Second
+	reconnectMaxBackoff = 2 * time.Minute
+)
+
+// reconnectBackoff returns the delay before a reconnection attempt (starting
+// at 1), doubling at every attempt up to reconnectMaxBackoff. Half of it is
+// random so that gateways dropped together don't reconnect together.
+func reconnectBackoff(attempt int) time.Duration {
+	backoff := reconnectMaxBackoff
+	if attempt < 32 {
+		backoff = min(reconnectMinBackoff<<(attempt-1), reconnectMaxBackoff)
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// dropped handles the loss of the LNS connection, the gateway reconnects
+// when it was connected by Connect.
+// Must be called with the lock held.
+func (g *Gateway) dropped(err error) {
+	log.Printf("[%s] connection dropped: %v", g.eui, err)
+	g.lastError = err.Error()
+
+	if g.reconnectStop == nil {
+		g.setDataState(StateDisconnected)
+		return
+	}
+
+	g.setDataState(StateReconnecting)
+	go g.reconnect(g.reconnectStop)
+}
+
+// reconnect connects again to the LNS, discovery included, with an
+// exponential backoff between attempts until it succeeds or stop is closed
+func (g *Gateway) reconnect(stop chan struct{}) {
+	for attempt := 1; ; attempt++ {
+		backoff := reconnectBackoff(attempt)
+		log.Printf("[%s] reconnecting in %s (attempt %d)", g.eui, backoff.Round(time.Millisecond), attempt)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		g.mu.Lock()
+		select {
+		case <-stop:
+			g.mu.Unlock()
+			return
+		default:
+		}
+		g.reconnectAttempts = attempt
+		protocol := g.protocol
+		g.mu.Unlock()
+
+		err := g.connect()
+
+		g.mu.Lock()
+		select {
+		case <-stop:
+			// Disconnect was called during the attempt
+			g.mu.Unlock()
+			if err == nil {
+				g.disconnect(protocol)
+			}
+			return
+		default:
+		}
+		if err == nil {
+			g.reconnectAttempts = 0
+			g.mu.Unlock()
+			log.Printf("[%s] reconnected after %d attempts", g.eui, attempt)
+			return
+		}
+		g.lastError = err.Error()
+		g.setDataState(StateReconnecting)
+		g.mu.Unlock()
+	}
+}
@@ -0,0 +1,140 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to shorten the reconnection backoff for the test
+func shortenReconnectBackoff(t *testing.T) {
+	minBackoff, maxBackoff := reconnectMinBackoff, reconnectMaxBackoff
+	reconnectMinBackoff, reconnectMaxBackoff = 20*time.Millisecond, 100*time.Millisecond
+	t.Cleanup(func() {
+		reconnectMinBackoff, reconnectMaxBackoff = minBackoff, maxBackoff
+	})
+}
+
+// Mock LNS serving discovery on /router-info and the data connection on
+// /traffic, the first data connection is closed after router_config
+func mockReconnectServer(t *testing.T, dataConnections *atomic.Int32) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		switch r.URL.Path {
+		case "/router-info":
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+			conn.WriteJSON(map[string]string{"uri": wsURL + "/traffic"})
+		case "/traffic":
+			n := dataConnections.Add(1)
+			if _, _, err := conn.ReadMessage(); err != nil { // version
+				return
+			}
+			conn.WriteMessage(websocket.TextMessage, []byte(testRouterConfig))
+			if n == 1 {
+				time.Sleep(50 * time.Millisecond)
+				return
+			}
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}
+	}))
+	return server
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	defer func(min, max time.Duration) {
+		reconnectMinBackoff, reconnectMaxBackoff = min, max
+	}(reconnectMinBackoff, reconnectMaxBackoff)
+	reconnectMinBackoff, reconnectMaxBackoff = time.Second, time.Minute
+
+	tests := []struct {
+		attempt int
+		backoff time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			backoff := reconnectBackoff(tt.attempt)
+			assert.GreaterOrEqual(t, backoff, tt.backoff/2, "attempt %d", tt.attempt)
+			assert.LessOrEqual(t, backoff, tt.backoff, "attempt %d", tt.attempt)
+		}
+	}
+}
+
+func TestGateway_Reconnect(t *testing.T) {
+	shortenReconnectBackoff(t)
+
+	var dataConnections atomic.Int32
+	server := mockReconnectServer(t, &dataConnections)
+	defer server.Close()
+
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	gw := newTestGateway(eui, "ws"+strings.TrimPrefix(server.URL, "http"))
+	assert.NoError(t, gw.Connect())
+	defer gw.Disconnect()
+
+	// The LNS drops the first data connection
+	assert.Eventually(t, func() bool {
+		return gw.GetInfo().LastError != ""
+	}, time.Second, 5*time.Millisecond)
+
+	// Discovery and data connection run again
+	assert.Eventually(t, func() bool {
+		return dataConnections.Load() == 2 && gw.GetInfo().DataState == "connected"
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, gw.GetInfo().ReconnectAttempts)
+	waitForRouterConfig(t, gw)
+}
+
+func TestGateway_DisconnectWhileReconnecting(t *testing.T) {
+	shortenReconnectBackoff(t)
+
+	var dataConnections atomic.Int32
+	server := mockReconnectServer(t, &dataConnections)
+
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	gw := newTestGateway(eui, "ws"+strings.TrimPrefix(server.URL, "http"))
+	assert.NoError(t, gw.Connect())
+
+	// The LNS goes away: every attempt fails
+	server.Close()
+	assert.Eventually(t, func() bool {
+		return gw.GetInfo().ReconnectAttempts >= 2
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.NotEmpty(t, gw.GetInfo().LastError)
+
+	assert.NoError(t, gw.Disconnect())
+	assert.Equal(t, "disconnected", gw.GetInfo().DataState)
+
+	// No further attempts
+	attempts := gw.GetInfo().ReconnectAttempts
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, attempts, gw.GetInfo().ReconnectAttempts)
+	assert.Equal(t, "disconnected", gw.GetInfo().DataState)
+	assert.Error(t, gw.Disconnect())
+}
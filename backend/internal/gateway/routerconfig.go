@@ -0,0 +1,274 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/classb"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+)
+
+const routerConfigTimeout = 5 * time.Second
+
+// RouterConfig is the station configuration sent by the LNS after the
+// version message
+type RouterConfig struct {
+	Region     string           `json:"region"`
+	HWSpec     string           `json:"hwspec"`
+	FreqRange  []uint32         `json:"freqRange"`
+	DRs        []RouterDataRate `json:"drs"`
+	UpChannels []region.Channel `json:"upchannels"`
+	NetIDs     []lorawan.NetID  `json:"netIds,omitempty"`
+	JoinEUIs   []JoinEUIRange   `json:"joinEuis,omitempty"`
+	NoCCA      bool             `json:"nocca"`
+	NoDC       bool             `json:"nodc"`
+	NoDwell    bool             `json:"nodwell"`
+	Beaconing  *Beaconing       `json:"beaconing,omitempty"`
+}
+
+// Beaconing is the bcning section of router_config, configuring the class B
+// beacons transmitted by the station
+type Beaconing struct {
+	DataRate    int           `json:"dataRate"`
+	Layout      classb.Layout `json:"layout"`
+	Frequencies []uint32      `json:"frequencies"` // one per beacon period, in turn
+}
+
+// RouterDataRate is an entry of the router_config DRs table,
+// spreading factor 0 means FSK and -1 an undefined data rate
+type RouterDataRate struct {
+	SpreadFactor int  `json:"spreadFactor"`
+	Bandwidth    int  `json:"bandwidth"` // kHz
+	DownlinkOnly bool `json:"downlinkOnly"`
+}
+
+type JoinEUIRange struct {
+	Min lorawan.EUI64 `json:"min"`
+	Max lorawan.EUI64 `json:"max"`
+}
+
+type sx1301Radio struct {
+	Enable bool   `json:"enable"`
+	Freq   uint32 `json:"freq"`
+}
+
+type sx1301Channel struct {
+	Enable       bool `json:"enable"`
+	Radio        int  `json:"radio"`
+	IF           int  `json:"if"`
+	Bandwidth    int  `json:"bandwidth"` // Hz
+	SpreadFactor int  `json:"spread_factor"`
+}
+
+func parseRouterConfig(msg string) (*RouterConfig, error) {
+	var raw struct {
+		NetID      []uint32                     `json:"NetID"`
+		JoinEui    [][]uint64                   `json:"JoinEui"`
+		Region     string                       `json:"region"`
+		HWSpec     string                       `json:"hwspec"`
+		FreqRange  []uint32                     `json:"freq_range"`
+		DRs        [][]int                      `json:"DRs"`
+		UpChannels [][]uint32                   `json:"upchannels"`
+		SX1301Conf []map[string]json.RawMessage `json:"sx1301_conf"`
+		NoCCA      bool                         `json:"nocca"`
+		NoDC       bool                         `json:"nodc"`
+		NoDwell    bool                         `json:"nodwell"`
+		Bcning     *struct {
+			DR     int      `json:"DR"`
+			Layout []int    `json:"layout"`
+			Freqs  []uint32 `json:"freqs"`
+		} `json:"bcning"`
+	}
+
+	if err := json.Unmarshal([]byte(msg), &raw); err != nil {
+		return nil, err
+	}
+
+	rc := &RouterConfig{
+		Region:    raw.Region,
+		HWSpec:    raw.HWSpec,
+		FreqRange: raw.FreqRange,
+		NoCCA:     raw.NoCCA,
+		NoDC:      raw.NoDC,
+		NoDwell:   raw.NoDwell,
+	}
+
+	if b := raw.Bcning; b != nil {
+		if len(b.Layout) != 3 || len(b.Freqs) == 0 {
+			return nil, fmt.Errorf("invalid bcning layout %v or freqs %v", b.Layout, b.Freqs)
+		}
+		layout := classb.Layout{b.Layout[0], b.Layout[1], b.Layout[2]}
+		if err := layout.Validate(); err != nil {
+			return nil, err
+		}
+		rc.Beaconing = &Beaconing{DataRate: b.DR, Layout: layout, Frequencies: b.Freqs}
+	}
+
+	for _, netID := range raw.NetID {
+		rc.NetIDs = append(rc.NetIDs, lorawan.NetID{byte(netID >> 16), byte(netID >> 8), byte(netID)})
+	}
+
+	for _, r := range raw.JoinEui {
+		if len(r) != 2 {
+			return nil, fmt.Errorf("invalid JoinEui range %v", r)
+		}
+		var joinEUIRange JoinEUIRange
+		binary.BigEndian.PutUint64(joinEUIRange.Min[:], r[0])
+		binary.BigEndian.PutUint64(joinEUIRange.Max[:], r[1])
+		rc.JoinEUIs = append(rc.JoinEUIs, joinEUIRange)
+	}
+
+	for _, dr := range raw.DRs {
+		if len(dr) != 3 {
+			return nil, fmt.Errorf("invalid DR %v", dr)
+		}
+		rc.DRs = append(rc.DRs, RouterDataRate{SpreadFactor: dr[0], Bandwidth: dr[1], DownlinkOnly: dr[2] != 0})
+	}
+
+	// Uplink channels are either listed explicitly or derived from the
+	// concentrator configuration
+	if len(raw.UpChannels) > 0 {
+		for _, c := range raw.UpChannels {
+			if len(c) != 3 {
+				return nil, fmt.Errorf("invalid upchannel %v", c)
+			}
+			rc.UpChannels = append(rc.UpChannels, region.Channel{Frequency: c[0], MinDR: int(c[1]), MaxDR: int(c[2])})
+		}
+	} else {
+		for _, conf := range raw.SX1301Conf {
+			channels, err := rc.sx1301Channels(conf)
+			if err != nil {
+				return nil, err
+			}
+			rc.UpChannels = append(rc.UpChannels, channels...)
+		}
+	}
+
+	sort.Slice(rc.UpChannels, func(i, j int) bool {
+		if rc.UpChannels[i].Frequency != rc.UpChannels[j].Frequency {
+			return rc.UpChannels[i].Frequency < rc.UpChannels[j].Frequency
+		}
+		return rc.UpChannels[i].MinDR < rc.UpChannels[j].MinDR
+	})
+
+	return rc, nil
+}
+
+// sx1301Channels derives the uplink channels of a sx1301_conf entry
+func (rc *RouterConfig) sx1301Channels(conf map[string]json.RawMessage) ([]region.Channel, error) {
+	var radios [2]sx1301Radio
+	for i := range radios {
+		if rawRadio, ok := conf[fmt.Sprintf("radio_%d", i)]; ok {
+			if err := json.Unmarshal(rawRadio, &radios[i]); err != nil {
+				return nil, fmt.Errorf("invalid radio_%d: %w", i, err)
+			}
+		}
+	}
+
+	var channels []region.Channel
+	for name, rawChannel := range conf {
+		if !strings.HasPrefix(name, "chan_") {
+			continue
+		}
+
+		var ch sx1301Channel
+		if err := json.Unmarshal(rawChannel, &ch); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		if !ch.Enable || ch.Radio < 0 || ch.Radio > 1 || !radios[ch.Radio].Enable {
+			continue
+		}
+
+		// Data rates accepted by the channel
+		minDR, maxDR := -1, -1
+		for dr, d := range rc.DRs {
+			if d.DownlinkOnly {
+				continue
+			}
+
+			var match bool
+			switch {
+			case strings.HasPrefix(name, "chan_multiSF_"):
+				match = d.SpreadFactor >= 7 && d.SpreadFactor <= 12 && d.Bandwidth == 125
+			case name == "chan_Lora_std":
+				match = d.SpreadFactor == ch.SpreadFactor && d.Bandwidth*1000 == ch.Bandwidth
+			case name == "chan_FSK":
+				match = d.SpreadFactor == 0
+			}
+			if !match {
+				continue
+			}
+
+			if minDR == -1 || dr < minDR {
+				minDR = dr
+			}
+			if dr > maxDR {
+				maxDR = dr
+			}
+		}
+		if minDR == -1 {
+			continue
+		}
+
+		channels = append(channels, region.Channel{
+			Frequency: uint32(int(radios[ch.Radio].Freq) + ch.IF),
+			MinDR:     minDR,
+			MaxDR:     maxDR,
+		})
+	}
+
+	return channels, nil
+}
+
+// allowsUplink reports whether the LNS configured the channel and data rate
+func (rc *RouterConfig) allowsUplink(uplink radio.Uplink) error {
+	if uplink.DataRate < 0 || uplink.DataRate >= len(rc.DRs) ||
+		rc.DRs[uplink.DataRate].SpreadFactor == -1 || rc.DRs[uplink.DataRate].DownlinkOnly {
+		return fmt.Errorf("DR%d not configured by router_config", uplink.DataRate)
+	}
+
+	for _, c := range rc.UpChannels {
+		if c.Frequency == uplink.Frequency && uplink.DataRate >= c.MinDR && uplink.DataRate <= c.MaxDR {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("channel %d Hz DR%d not configured by router_config", uplink.Frequency, uplink.DataRate)
+}
+
+// allowsJoinEUI applies the JoinEui filter, an empty filter allows all
+func (rc *RouterConfig) allowsJoinEUI(joinEUI lorawan.EUI64) bool {
+	if len(rc.JoinEUIs) == 0 {
+		return true
+	}
+
+	eui := binary.BigEndian.Uint64(joinEUI[:])
+	for _, r := range rc.JoinEUIs {
+		if eui >= binary.BigEndian.Uint64(r.Min[:]) && eui <= binary.BigEndian.Uint64(r.Max[:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsDevAddr applies the NetID filter, an empty filter allows all
+func (rc *RouterConfig) allowsDevAddr(devAddr lorawan.DevAddr) bool {
+	if len(rc.NetIDs) == 0 {
+		return true
+	}
+
+	for _, netID := range rc.NetIDs {
+		if devAddr.IsNetID(netID) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/classb"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRouterConfig(t *testing.T) {
+	t.Run("derives uplink channels from sx1301_conf", func(t *testing.T) {
+		rc, err := parseRouterConfig(testRouterConfig)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "EU863", rc.Region)
+		assert.Equal(t, "sx1301/1", rc.HWSpec)
+		assert.Equal(t, []uint32{863000000, 870000000}, rc.FreqRange)
+		assert.Len(t, rc.DRs, 16)
+		assert.Equal(t, RouterDataRate{SpreadFactor: 12, Bandwidth: 125}, rc.DRs[0])
+		assert.True(t, rc.NoCCA)
+		assert.True(t, rc.NoDC)
+		assert.True(t, rc.NoDwell)
+		assert.Empty(t, rc.NetIDs)
+		assert.Empty(t, rc.JoinEUIs)
+
+		assert.Equal(t, []region.Channel{
+			{Frequency: 867100000, MinDR: 0, MaxDR: 5},
+			{Frequency: 867300000, MinDR: 0, MaxDR: 5},
+			{Frequency: 867500000, MinDR: 0, MaxDR: 5},
+			{Frequency: 867700000, MinDR: 0, MaxDR: 5},
+			{Frequency: 867900000, MinDR: 0, MaxDR: 5},
+			{Frequency: 868100000, MinDR: 0, MaxDR: 5},
+			{Frequency: 868300000, MinDR: 0, MaxDR: 5},
+			{Frequency: 868300000, MinDR: 6, MaxDR: 6}, // Lora_std
+			{Frequency: 868500000, MinDR: 0, MaxDR: 5},
+			{Frequency: 868800000, MinDR: 7, MaxDR: 7}, // FSK
+		}, rc.UpChannels)
+	})
+
+	t.Run("parses upchannels and filters", func(t *testing.T) {
+		rc, err := parseRouterConfig(`{"msgtype":"router_config","NetID":[19,0],"JoinEui":[[1,2],[72623859790382856,72623859790382856]],` +
+			`"region":"US902","DRs":[[10,125,0],[9,125,0],[8,125,0],[7,125,0],[8,500,0]],` +
+			`"upchannels":[[904100000,0,3],[903900000,0,3],[904600000,4,4]]}`)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []lorawan.NetID{{0x00, 0x00, 0x13}, {0x00, 0x00, 0x00}}, rc.NetIDs)
+		assert.Equal(t, []JoinEUIRange{
+			{Min: lorawan.EUI64{0, 0, 0, 0, 0, 0, 0, 1}, Max: lorawan.EUI64{0, 0, 0, 0, 0, 0, 0, 2}},
+			{Min: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, Max: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}},
+		}, rc.JoinEUIs)
+		assert.Equal(t, []region.Channel{
+			{Frequency: 903900000, MinDR: 0, MaxDR: 3},
+			{Frequency: 904100000, MinDR: 0, MaxDR: 3},
+			{Frequency: 904600000, MinDR: 4, MaxDR: 4},
+		}, rc.UpChannels)
+	})
+
+	t.Run("parses bcning", func(t *testing.T) {
+		rc, err := parseRouterConfig(`{"msgtype":"router_config","DRs":[[12,125,0]],` +
+			`"bcning":{"DR":8,"layout":[5,11,23],"freqs":[923300000,923900000]}}`)
+		assert.NoError(t, err)
+		assert.Equal(t, &Beaconing{DataRate: 8, Layout: classb.Layout{5, 11, 23}, Frequencies: []uint32{923300000, 923900000}}, rc.Beaconing)
+
+		rc, err = parseRouterConfig(testRouterConfig)
+		assert.NoError(t, err)
+		assert.Nil(t, rc.Beaconing)
+	})
+
+	t.Run("ignores disabled radios and channels", func(t *testing.T) {
+		rc, err := parseRouterConfig(`{"msgtype":"router_config","DRs":[[12,125,0],[7,125,0]],"sx1301_conf":[{` +
+			`"radio_0":{"enable":true,"freq":867500000},"radio_1":{"enable":false,"freq":868500000},` +
+			`"chan_multiSF_0":{"enable":true,"radio":0,"if":-400000},"chan_multiSF_1":{"enable":false,"radio":0,"if":0},` +
+			`"chan_multiSF_2":{"enable":true,"radio":1,"if":0}}]}`)
+		assert.NoError(t, err)
+		assert.Equal(t, []region.Channel{{Frequency: 867100000, MinDR: 0, MaxDR: 1}}, rc.UpChannels)
+	})
+
+	t.Run("rejects malformed messages", func(t *testing.T) {
+		tests := []string{
+			`{"msgtype":"router_config","DRs":[[7,125]]}`,
+			`{"msgtype":"router_config","JoinEui":[[1]]}`,
+			`{"msgtype":"router_config","upchannels":[[868100000,0]]}`,
+			`{"msgtype":"router_config","sx1301_conf":[{"radio_0":"on"}]}`,
+			`{"msgtype":"router_config","sx1301_conf":[{"chan_FSK":[]}]}`,
+			`{"msgtype":"router_config","bcning":{"DR":3,"layout":[2,8],"freqs":[869525000]}}`,
+			`{"msgtype":"router_config","bcning":{"DR":3,"layout":[2,8,17],"freqs":[]}}`,
+			`{"msgtype":"router_config","bcning":{"DR":3,"layout":[8,2,17],"freqs":[869525000]}}`,
+			`not json`,
+		}
+		for _, msg := range tests {
+			_, err := parseRouterConfig(msg)
+			assert.Error(t, err, msg)
+		}
+	})
+}
+
+func TestRouterConfig_AllowsUplink(t *testing.T) {
+	rc, err := parseRouterConfig(testRouterConfig)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		frequency uint32
+		dataRate  int
+		allowed   bool
+	}{
+		{"multi-SF channel", 868100000, 0, true},
+		{"multi-SF channel fastest DR", 867900000, 5, true},
+		{"LoRa standard channel", 868300000, 6, true},
+		{"FSK channel", 868800000, 7, true},
+		{"DR not allowed on channel", 868100000, 6, false},
+		{"unconfigured channel", 869525000, 0, false},
+		{"undefined DR", 868100000, 8, false},
+		{"DR out of table", 868100000, 16, false},
+		{"negative DR", 868100000, -1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rc.allowsUplink(radio.Uplink{Region: region.EU868, Frequency: tt.frequency, DataRate: tt.dataRate})
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	t.Run("rejects downlink only DR", func(t *testing.T) {
+		rc := &RouterConfig{
+			DRs:        []RouterDataRate{{SpreadFactor: 12, Bandwidth: 500, DownlinkOnly: true}},
+			UpChannels: []region.Channel{{Frequency: 923300000, MinDR: 0, MaxDR: 0}},
+		}
+		err := rc.allowsUplink(radio.Uplink{Frequency: 923300000, DataRate: 0})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "DR0 not configured by router_config")
+	})
+}
+
+func TestRouterConfig_Filters(t *testing.T) {
+	t.Run("empty filters allow everything", func(t *testing.T) {
+		rc := &RouterConfig{}
+		assert.True(t, rc.allowsJoinEUI(lorawan.EUI64{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+		assert.True(t, rc.allowsDevAddr(lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}))
+	})
+
+	t.Run("JoinEui ranges are inclusive", func(t *testing.T) {
+		rc := &RouterConfig{JoinEUIs: []JoinEUIRange{
+			{Min: lorawan.EUI64{0x70, 0xb3, 0xd5, 0x7e, 0xd0, 0x00, 0x00, 0x00}, Max: lorawan.EUI64{0x70, 0xb3, 0xd5, 0x7e, 0xd0, 0x00, 0xff, 0xff}},
+		}}
+		assert.True(t, rc.allowsJoinEUI(lorawan.EUI64{0x70, 0xb3, 0xd5, 0x7e, 0xd0, 0x00, 0x00, 0x00}))
+		assert.True(t, rc.allowsJoinEUI(lorawan.EUI64{0x70, 0xb3, 0xd5, 0x7e, 0xd0, 0x00, 0x12, 0x34}))
+		assert.True(t, rc.allowsJoinEUI(lorawan.EUI64{0x70, 0xb3, 0xd5, 0x7e, 0xd0, 0x00, 0xff, 0xff}))
+		assert.False(t, rc.allowsJoinEUI(lorawan.EUI64{0x70, 0xb3, 0xd5, 0x7e, 0xd0, 0x01, 0x00, 0x00}))
+		assert.False(t, rc.allowsJoinEUI(lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}))
+	})
+
+	t.Run("NetID filter matches the DevAddr prefix", func(t *testing.T) {
+		rc := &RouterConfig{NetIDs: []lorawan.NetID{{0x00, 0x00, 0x13}}}
+		assert.True(t, rc.allowsDevAddr(lorawan.DevAddr{0x26, 0x01, 0x02, 0x03}))
+		assert.True(t, rc.allowsDevAddr(lorawan.DevAddr{0x27, 0xff, 0xff, 0xff}))
+		assert.False(t, rc.allowsDevAddr(lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}))
+	})
+}
+
+func TestRouterConfigTimeout_Constant(t *testing.T) {
+	assert.Equal(t, 5*time.Second, routerConfigTimeout)
+}
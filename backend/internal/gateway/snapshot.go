@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+)
+
+// Snapshot is the configuration of a gateway kept across restarts of the
+// simulator, and whether it was connected to the LNS
+type Snapshot struct {
+	EUI           lorawan.EUI64 `json:"eui"`
+	Protocol      Protocol      `json:"protocol"`
+	DiscoveryURI  string        `json:"discoveryUri"`
+	Headers       http.Header   `json:"headers,omitempty"`
+	Location      *Location     `json:"location,omitempty"`
+	Region        region.Name   `json:"region"`
+	MQTT          *MQTTConfig   `json:"mqtt,omitempty"`
+	TxFailureRate float64       `json:"txFailureRate,omitempty"`
+	Connected     bool          `json:"connected"`
+}
+
+// Snapshot returns the configuration of the gateway to restore after a
+// restart. A gateway is connected from the time Connect succeeds until
+// Disconnect, even while it reconnects.
+func (g *Gateway) Snapshot() Snapshot {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var mqttConfig *MQTTConfig
+	if g.protocol == ProtocolChirpStackMQTT {
+		config := g.mqttConfig
+		mqttConfig = &config
+	}
+
+	return Snapshot{
+		EUI:           g.eui,
+		Protocol:      g.protocol,
+		DiscoveryURI:  g.discoveryURI,
+		Headers:       g.headers,
+		Location:      g.location,
+		Region:        g.region.Name(),
+		MQTT:          mqttConfig,
+		TxFailureRate: g.txFailureRate,
+		Connected:     g.reconnectStop != nil,
+	}
+}
+
+// Restore applies the configuration of a snapshot to a disconnected gateway,
+// the caller connects it
+func (g *Gateway) Restore(s Snapshot) error {
+	r, err := region.Get(s.Region)
+	if err != nil {
+		return err
+	}
+	g.SetRegion(r)
+
+	protocol, err := ParseProtocol(string(s.Protocol))
+	if err != nil {
+		return err
+	}
+	if err := g.SetProtocol(protocol); err != nil {
+		return err
+	}
+	if s.MQTT != nil {
+		if err := g.SetMQTTConfig(*s.MQTT); err != nil {
+			return err
+		}
+	}
+
+	return g.SetTxFailureRate(s.TxFailureRate)
+}
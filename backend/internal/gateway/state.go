@@ -8,6 +8,7 @@ const (
 	StateConnected
 	StateDisconnecting
 	StateDisconnectionError
+	StateReconnecting
 )
 
 func (s State) String() string {
@@ -22,6 +23,8 @@ func (s State) String() string {
 		return "disconnecting"
 	case StateDisconnectionError:
 		return "disconnection error"
+	case StateReconnecting:
+		return "reconnecting"
 	default:
 		return "unknown"
 	}
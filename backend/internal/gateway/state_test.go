@@ -22,6 +22,11 @@ func TestState_String(t *testing.T) {
 		assert.Equal(t, "connected", state.String())
 	})
 
+	t.Run("StateReconnecting returns correct string", func(t *testing.T) {
+		state := StateReconnecting
+		assert.Equal(t, "reconnecting", state.String())
+	})
+
 	t.Run("unknown state returns correct string", func(t *testing.T) {
 		state := State(999)
 		assert.Equal(t, "unknown", state.String())
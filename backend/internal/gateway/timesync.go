@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/brocaar/lorawan/gps"
+)
+
+// Variables so that tests can shorten them
+var (
+	timesyncInterval = 30 * time.Second
+	timesyncMaxRTT   = 1 * time.Second
+)
+
+// Layout of a Basics Station xtime: the microseconds of the radio counter in
+// the lower 48 bits, the radio unit (rctx) in the next 8 bits and the session,
+// changed at every data connection, in bits 56-62
+const (
+	xtimeCounterMask  = 1<<48 - 1
+	xtimeSessionShift = 56
+	xtimeSessionMask  = 0x7f
+)
+
+// stationClock converts between instants and the xtime and GPS time of a
+// Basics Station data connection
+type stationClock struct {
+	start     time.Time     // origin of the radio counter
+	session   int64         // session of the data connection
+	gpsOffset time.Duration // correction of the GPS time learned with timesync
+}
+
+// stationClock returns the clock of the current data connection.
+// Must be called with the lock held.
+func (g *Gateway) stationClock() stationClock {
+	return stationClock{start: g.clockStart, session: g.xtimeSession, gpsOffset: g.gpsOffset}
+}
+
+// newXTimeSession returns a session different from the previous one
+func newXTimeSession(previous int64) int64 {
+	session := 1 + rand.Int63n(xtimeSessionMask)
+	if session == previous {
+		session = session%xtimeSessionMask + 1
+	}
+	return session
+}
+
+// ustime returns the microseconds of the radio counter at an instant. A zero
+// instant is now.
+func (c stationClock) ustime(t time.Time) int64 {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.Sub(c.start).Microseconds() & xtimeCounterMask
+}
+
+// xtime returns the xtime of an instant. A zero instant is now.
+func (c stationClock) xtime(t time.Time) int64 {
+	return c.session<<xtimeSessionShift | c.ustime(t)
+}
+
+// time returns the instant of an xtime, ok is false when the xtime belongs to
+// another session
+func (c stationClock) time(xtime int64) (t time.Time, ok bool) {
+	if xtime>>xtimeSessionShift&xtimeSessionMask != c.session {
+		return time.Time{}, false
+	}
+	return c.start.Add(time.Duration(xtime&xtimeCounterMask) * time.Microsecond), true
+}
+
+// gpsTime returns the microseconds since the GPS epoch of an instant, as
+// read by the gateway GPS receiver (the system clock) corrected by timesync
+func (c stationClock) gpsTime(t time.Time) int64 {
+	return (gps.Time(t).TimeSinceGPSEpoch() + c.gpsOffset).Microseconds()
+}
+
+// gpsInstant returns the instant of a GPS time in microseconds, the inverse of
+// gpsTime
+func (c stationClock) gpsInstant(gpstime int64) time.Time {
+	return time.Time(gps.NewTimeFromTimeSinceGPSEpoch(time.Duration(gpstime)*time.Microsecond - c.gpsOffset))
+}
+
+// timesyncLoop periodically sends timesync requests to the LNS once
+// router_config is received, until the data connection is closed
+func (g *Gateway) timesyncLoop(start time.Time, routerConfig <-chan struct{}, done <-chan struct{}) {
+	select {
+	case <-routerConfig:
+	case <-done:
+		return
+	}
+
+	ticker := time.NewTicker(timesyncInterval)
+	defer ticker.Stop()
+
+	for {
+		g.mu.RLock()
+		clock := g.stationClock()
+		g.mu.RUnlock()
+
+		msg := fmt.Sprintf(`{"msgtype":"timesync","txtime":%d}`, clock.ustime(time.Time{}))
+		if err := g.sendIfConnected(start, msg); err != nil {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// handleTimesync learns the GPS time of the LNS, either from the response to
+// a timesync request or from a timesync transferring the GPS time of an xtime
+func (g *Gateway) handleTimesync(msg string) {
+	var timesync struct {
+		TxTime  *int64 `json:"txtime"`
+		XTime   *int64 `json:"xtime"`
+		GPSTime int64  `json:"gpstime"`
+	}
+
+	if err := json.Unmarshal([]byte(msg), &timesync); err != nil {
+		log.Printf("[%s] failed to parse timesync: %v", g.eui, err)
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	clock := g.stationClock()
+	var at time.Time
+	switch {
+	case timesync.XTime != nil:
+		t, ok := clock.time(*timesync.XTime)
+		if !ok {
+			log.Printf("[%s] timesync ignored: xtime of another session", g.eui)
+			return
+		}
+		at = t
+	case timesync.TxTime != nil:
+		// The LNS read its GPS time half way through the round trip
+		sent := clock.start.Add(time.Duration(*timesync.TxTime) * time.Microsecond)
+		rtt := time.Since(sent)
+		if rtt < 0 || rtt > timesyncMaxRTT {
+			log.Printf("[%s] timesync ignored: round trip time %s", g.eui, rtt)
+			return
+		}
+		at = sent.Add(rtt / 2)
+	default:
+		log.Printf("[%s] timesync ignored: no txtime or xtime", g.eui)
+		return
+	}
+
+	clock.gpsOffset = 0
+	g.gpsOffset = time.Duration(timesync.GPSTime-clock.gpsTime(at)) * time.Microsecond
+	log.Printf("[%s] timesync: GPS time offset %s", g.eui, g.gpsOffset)
+}
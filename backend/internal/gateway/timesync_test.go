@@ -0,0 +1,197 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/gps"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStationClock(t *testing.T) {
+	start := time.Now()
+	clock := stationClock{start: start, session: 5}
+
+	t.Run("xtime holds the session and the radio counter", func(t *testing.T) {
+		xtime := clock.xtime(start.Add(1500 * time.Millisecond))
+		assert.Equal(t, int64(5)<<56|1500000, xtime)
+		assert.Equal(t, int64(1500000), clock.ustime(start.Add(1500*time.Millisecond)))
+	})
+
+	t.Run("converts xtime back to time", func(t *testing.T) {
+		instant := start.Add(42 * time.Second)
+		got, ok := clock.time(clock.xtime(instant))
+		assert.True(t, ok)
+		assert.True(t, instant.Equal(got))
+	})
+
+	t.Run("rejects xtime of another session", func(t *testing.T) {
+		previous := stationClock{start: start, session: 4}
+		_, ok := clock.time(previous.xtime(start))
+		assert.False(t, ok)
+	})
+
+	t.Run("derives GPS time with the timesync offset", func(t *testing.T) {
+		instant := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+		expected := gps.Time(instant).TimeSinceGPSEpoch().Microseconds()
+		assert.Equal(t, expected, clock.gpsTime(instant))
+
+		clock.gpsOffset = -3 * time.Millisecond
+		assert.Equal(t, expected-3000, clock.gpsTime(instant))
+	})
+
+	t.Run("changes session at every connection", func(t *testing.T) {
+		session := int64(0)
+		for i := 0; i < 1000; i++ {
+			next := newXTimeSession(session)
+			assert.NotEqual(t, session, next)
+			assert.GreaterOrEqual(t, next, int64(1))
+			assert.LessOrEqual(t, next, int64(127))
+			session = next
+		}
+	})
+}
+
+func TestTimesync(t *testing.T) {
+	defer func(interval time.Duration) { timesyncInterval = interval }(timesyncInterval)
+	timesyncInterval = 50 * time.Millisecond
+
+	// The LNS is 2 seconds ahead of the gateway GPS receiver
+	const lnsOffset = 2 * time.Second
+
+	requests := make(chan int64, 10)
+	updf := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, []byte(testRouterConfig))
+		lnsMsgs := make(chan string, 10)
+		defer close(lnsMsgs)
+		go func() {
+			for msg := range lnsMsgs {
+				conn.WriteMessage(websocket.TextMessage, []byte(msg))
+			}
+		}()
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var timesync struct {
+				MsgType string `json:"msgtype"`
+				TxTime  int64  `json:"txtime"`
+			}
+			json.Unmarshal(msg, &timesync)
+			switch timesync.MsgType {
+			case "timesync":
+				select {
+				case requests <- timesync.TxTime:
+				default:
+				}
+				gpstime := (gps.Time(time.Now()).TimeSinceGPSEpoch() + lnsOffset).Microseconds()
+				lnsMsgs <- fmt.Sprintf(`{"msgtype":"timesync","txtime":%d,"gpstime":%d}`, timesync.TxTime, gpstime)
+			case "updf":
+				updf <- string(msg)
+			}
+		}
+	}))
+	defer server.Close()
+
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	gw := newTestGateway(eui, "ws://discovery.test")
+	gw.dataURI = "ws" + strings.TrimPrefix(server.URL, "http")
+	assert.NoError(t, gw.lnsDataConnect())
+	defer gw.lnsDataDisconnect()
+
+	t.Run("sends timesync requests periodically", func(t *testing.T) {
+		var txtimes []int64
+		for len(txtimes) < 3 {
+			select {
+			case txtime := <-requests:
+				txtimes = append(txtimes, txtime)
+			case <-time.After(time.Second):
+				t.Fatal("Timeout waiting for timesync")
+			}
+		}
+		assert.Less(t, txtimes[0], txtimes[1])
+		assert.Less(t, txtimes[1], txtimes[2])
+	})
+
+	t.Run("learns the GPS time of the LNS", func(t *testing.T) {
+		assert.Eventually(t, func() bool {
+			gw.mu.RLock()
+			defer gw.mu.RUnlock()
+			offset := gw.gpsOffset - lnsOffset
+			return offset > -50*time.Millisecond && offset < 50*time.Millisecond
+		}, time.Second, 5*time.Millisecond)
+
+		// Uplinks carry the GPS time of the LNS
+		uplinkTime := time.Now()
+		assert.NoError(t, gw.Forward(newTestUplink(lorawan.PHYPayload{
+			MHDR:       lorawan.MHDR{MType: lorawan.UnconfirmedDataUp, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{},
+		})))
+		select {
+		case msg := <-updf:
+			var up struct {
+				UpInfo struct {
+					GPSTime int64 `json:"gpstime"`
+				} `json:"upinfo"`
+			}
+			assert.NoError(t, json.Unmarshal([]byte(msg), &up))
+			expected := (gps.Time(uplinkTime).TimeSinceGPSEpoch() + lnsOffset).Microseconds()
+			assert.InDelta(t, expected, up.UpInfo.GPSTime, 50000)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for updf")
+		}
+	})
+}
+
+func TestHandleTimesync(t *testing.T) {
+	newGateway := func() *Gateway {
+		gw := newTestGateway(lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}, "ws://discovery.test")
+		gw.clockStart = time.Now().Add(-time.Minute)
+		gw.xtimeSession = 3
+		return gw
+	}
+
+	t.Run("learns the GPS time of an xtime", func(t *testing.T) {
+		gw := newGateway()
+		clock := gw.stationClock()
+		xtime := clock.xtime(clock.start.Add(time.Second))
+		gpstime := clock.gpsTime(clock.start.Add(time.Second)) + 1500
+
+		gw.parseIncomingMessage(fmt.Sprintf(`{"msgtype":"timesync","xtime":%d,"gpstime":%d}`, xtime, gpstime))
+		assert.Equal(t, 1500*time.Microsecond, gw.stationClock().gpsOffset)
+	})
+
+	t.Run("ignores xtime of another session", func(t *testing.T) {
+		gw := newGateway()
+		previous := stationClock{start: gw.clockStart, session: 2}
+
+		gw.parseIncomingMessage(fmt.Sprintf(`{"msgtype":"timesync","xtime":%d,"gpstime":1}`, previous.xtime(time.Time{})))
+		assert.Equal(t, time.Duration(0), gw.stationClock().gpsOffset)
+	})
+
+	t.Run("ignores responses with a long round trip", func(t *testing.T) {
+		gw := newGateway()
+		clock := gw.stationClock()
+		txtime := clock.ustime(time.Now().Add(-2 * timesyncMaxRTT))
+
+		gw.parseIncomingMessage(fmt.Sprintf(`{"msgtype":"timesync","txtime":%d,"gpstime":1}`, txtime))
+		assert.Equal(t, time.Duration(0), gw.stationClock().gpsOffset)
+	})
+}
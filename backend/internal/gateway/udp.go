@@ -0,0 +1,520 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+)
+
+// Semtech UDP packet forwarder protocol v2
+// https://github.com/Lora-net/packet_forwarder/blob/master/PROTOCOL.TXT
+const (
+	udpProtocolVersion = 0x02
+
+	udpPushData = 0x00
+	udpPushAck  = 0x01
+	udpPullData = 0x02
+	udpPullResp = 0x03
+	udpPullAck  = 0x04
+	udpTxAck    = 0x05
+)
+
+// Variables so that tests can shorten them
+var (
+	udpPullAckTimeout    = 5 * time.Second
+	udpKeepaliveInterval = 10 * time.Second
+	udpStatInterval      = 30 * time.Second
+	// PULL_DATA left unanswered before the LNS is considered lost
+	udpMaxMissedPullAcks = 3
+)
+
+// udpStats are the counters reported by the stat message, reset at every report
+type udpStats struct {
+	rxnb      uint32
+	rxok      uint32
+	rxfw      uint32
+	pushSent  uint32
+	pushAcked uint32
+	dwnb      uint32
+	txnb      uint32
+}
+
+type udpRXPK struct {
+	Time string      `json:"time"`
+	Tmst uint32      `json:"tmst"`
+	Chan int         `json:"chan"`
+	RFCh int         `json:"rfch"`
+	Freq float64     `json:"freq"`
+	Stat int         `json:"stat"`
+	Modu string      `json:"modu"`
+	Datr interface{} `json:"datr"`
+	CodR string      `json:"codr,omitempty"`
+	RSSI int         `json:"rssi"`
+	LSNR float64     `json:"lsnr"`
+	Size int         `json:"size"`
+	Data string      `json:"data"`
+}
+
+type udpTXPK struct {
+	Imme bool            `json:"imme"`
+	Tmst uint32          `json:"tmst"`
+	Freq float64         `json:"freq"`
+	RFCh int             `json:"rfch"`
+	Powe int             `json:"powe"`
+	Modu string          `json:"modu"`
+	Datr json.RawMessage `json:"datr"`
+	CodR string          `json:"codr"`
+	IPol bool            `json:"ipol"`
+	Size int             `json:"size"`
+	Data string          `json:"data"`
+}
+
+type udpStat struct {
+	Time string   `json:"time"`
+	Lati *float64 `json:"lati,omitempty"`
+	Long *float64 `json:"long,omitempty"`
+	RXNb uint32   `json:"rxnb"`
+	RXOk uint32   `json:"rxok"`
+	RXFw uint32   `json:"rxfw"`
+	ACKR float64  `json:"ackr"`
+	DWNb uint32   `json:"dwnb"`
+	TXNb uint32   `json:"txnb"`
+}
+
+func (g *Gateway) udpConnect() error {
+	// Connecting
+	g.mu.Lock()
+	g.setDataState(StateConnecting)
+	addr := strings.TrimPrefix(g.discoveryURI, "udp://")
+	g.mu.Unlock()
+	log.Printf("[%s] udp connecting to %s", g.eui, addr)
+
+	var conn *net.UDPConn
+	raddr, connErr := net.ResolveUDPAddr("udp", addr)
+	if connErr == nil {
+		conn, connErr = net.DialUDP("udp", nil, raddr)
+	}
+
+	if connErr != nil {
+		// Connection error
+		log.Printf("[%s] udp connection error: %v", g.eui, connErr)
+		g.mu.Lock()
+		g.setDataState(StateDisconnected)
+		g.mu.Unlock()
+
+		return connErr
+	}
+
+	pullAckCh := make(chan struct{}, 1)
+	g.mu.Lock()
+	g.udpConn = conn
+	g.udpPullAckCh = pullAckCh
+	g.udpStart = time.Now()
+	g.udpStats = udpStats{}
+	g.dataURI = addr
+	g.dataDone = make(chan struct{})
+	dataDone := g.dataDone
+	g.mu.Unlock()
+
+	go g.udpReadLoop(conn, dataDone)
+
+	// UDP is connectionless, the first PULL_ACK proves the LNS is listening
+	g.udpPullData(conn)
+	select {
+	case <-pullAckCh:
+	case <-time.After(udpPullAckTimeout):
+		log.Printf("[%s] udp connection error: PULL_ACK timeout", g.eui)
+		conn.Close()
+		<-dataDone
+
+		g.mu.Lock()
+		g.udpConn = nil
+		g.setDataState(StateDisconnected)
+		g.mu.Unlock()
+
+		return errors.New("PULL_ACK timeout")
+	}
+
+	// Connected
+	g.mu.Lock()
+	g.setDataState(StateConnected)
+	g.mu.Unlock()
+	log.Printf("[%s] udp connected", g.eui)
+
+	go g.udpKeepaliveLoop(conn, pullAckCh, dataDone, udpKeepaliveInterval, udpStatInterval)
+
+	return nil
+}
+
+func (g *Gateway) udpReadLoop(conn *net.UDPConn, done chan struct{}) {
+	defer close(done)
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// e.g. ICMP port unreachable, keep listening as the LNS may come
+			// back, the keepalive notices when it does not
+			log.Printf("[%s] udp read error: %v", g.eui, err)
+			continue
+		}
+
+		g.handleUDPPacket(conn, append([]byte(nil), buf[:n]...))
+	}
+}
+
+// udpKeepaliveLoop sends PULL_DATA and stat messages, the connection is
+// dropped when udpMaxMissedPullAcks PULL_DATA in a row are not answered
+func (g *Gateway) udpKeepaliveLoop(conn *net.UDPConn, pullAckCh chan struct{}, done chan struct{}, keepaliveInterval, statInterval time.Duration) {
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	stat := time.NewTicker(statInterval)
+	defer stat.Stop()
+
+	// The PULL_DATA of the connection was answered
+	pending := false
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-pullAckCh:
+			pending = false
+			missed = 0
+		case <-keepalive.C:
+			if pending {
+				missed++
+				log.Printf("[%s] udp PULL_ACK missed (%d/%d)", g.eui, missed, udpMaxMissedPullAcks)
+				if missed >= udpMaxMissedPullAcks {
+					g.udpDrop(conn, fmt.Errorf("%d PULL_ACK missed", missed))
+					return
+				}
+			}
+			g.udpPullData(conn)
+			pending = true
+		case <-stat.C:
+			g.udpPushStat(conn)
+		}
+	}
+}
+
+// udpDrop closes a connection whose LNS was lost, if it is still the current
+// one
+func (g *Gateway) udpDrop(conn *net.UDPConn, err error) {
+	g.mu.Lock()
+	if g.udpConn != conn || g.dataState != StateConnected {
+		// Already disconnecting
+		g.mu.Unlock()
+		return
+	}
+	g.udpConn = nil
+	g.dropped(err)
+	g.mu.Unlock()
+
+	conn.Close()
+}
+
+func (g *Gateway) handleUDPPacket(conn *net.UDPConn, packet []byte) {
+	if len(packet) < 4 || packet[0] != udpProtocolVersion {
+		log.Printf("[%s] udp invalid packet: %x", g.eui, packet)
+		return
+	}
+	token := binary.BigEndian.Uint16(packet[1:3])
+
+	switch packet[3] {
+	case udpPushAck:
+		g.mu.Lock()
+		g.udpStats.pushAcked++
+		g.mu.Unlock()
+		log.Printf("[%s] udp PUSH_ACK %04x", g.eui, token)
+	case udpPullAck:
+		g.mu.RLock()
+		pullAckCh := g.udpPullAckCh
+		g.mu.RUnlock()
+		select {
+		case pullAckCh <- struct{}{}:
+		default:
+		}
+		log.Printf("[%s] udp PULL_ACK %04x", g.eui, token)
+	case udpPullResp:
+		log.Printf("[%s] udp PULL_RESP %04x: %s", g.eui, token, packet[4:])
+		g.handlePullResp(conn, token, packet[4:])
+	default:
+		log.Printf("[%s] udp unknown identifier: %d", g.eui, packet[3])
+	}
+}
+
+func (g *Gateway) handlePullResp(conn *net.UDPConn, token uint16, payload []byte) {
+	var resp struct {
+		TXPK *udpTXPK `json:"txpk"`
+	}
+	if err := json.Unmarshal(payload, &resp); err != nil || resp.TXPK == nil {
+		log.Printf("[%s] failed to parse txpk: %v", g.eui, err)
+		return
+	}
+
+	// Decode base64 string to bytes
+	data, err := base64.StdEncoding.DecodeString(resp.TXPK.Data)
+	if err != nil {
+		log.Printf("[%s] failed to decode txpk data: %v", g.eui, err)
+		return
+	}
+
+	// Unmarshal bytes into PHYPayload
+	var phyPayload lorawan.PHYPayload
+	if err := phyPayload.UnmarshalBinary(data); err != nil {
+		log.Printf("[%s] failed to unmarshal PHYPayload: %v", g.eui, err)
+		return
+	}
+
+	g.mu.RLock()
+	start := g.udpStart
+	r := g.region
+	g.mu.RUnlock()
+
+	g.mu.Lock()
+	g.udpStats.dwnb++
+	g.mu.Unlock()
+
+	downlink := radio.Downlink{
+		PHYPayload: phyPayload,
+		Frequency:  uint32(math.Round(resp.TXPK.Freq * 1e6)),
+		TxPower:    float64(resp.TXPK.Powe),
+	}
+	dr, err := udpDataRate(resp.TXPK.Modu, resp.TXPK.Datr)
+	if err == nil {
+		downlink.DataRate, err = r.DownlinkDataRateIndex(dr)
+	}
+	if err != nil {
+		log.Printf("[%s] invalid txpk data rate: %v", g.eui, err)
+		g.udpWrite(conn, token, udpTxAck, []byte(`{"txpk_ack":{"error":"TX_FREQ"}}`))
+		return
+	}
+
+	// The LNS schedules the downlink on the concentrator counter of the uplink
+	if !resp.TXPK.Imme {
+		now := time.Now()
+		downlink.Time = counterTime(resp.TXPK.Tmst, now, uint32(now.Sub(start).Microseconds()))
+		if !downlink.Time.After(now) {
+			log.Printf("[%s] downlink too late by %s", g.eui, now.Sub(downlink.Time))
+			g.udpWrite(conn, token, udpTxAck, []byte(`{"txpk_ack":{"error":"TOO_LATE"}}`))
+			return
+		}
+	}
+
+	if g.txFailed() {
+		log.Printf("[%s] downlink not transmitted (simulated TX failure)", g.eui)
+		g.udpWrite(conn, token, udpTxAck, []byte(`{"txpk_ack":{"error":"COLLISION_PACKET"}}`))
+		return
+	}
+
+	g.mu.Lock()
+	g.udpStats.txnb++
+	g.mu.Unlock()
+
+	g.udpWrite(conn, token, udpTxAck, []byte(`{"txpk_ack":{"error":"NONE"}}`))
+
+	log.Printf("[%s] downlink message on %.6f MHz %s", g.eui, resp.TXPK.Freq, resp.TXPK.Datr)
+	g.transmit(downlink, nil)
+}
+
+// udpDataRate parses the datr of a txpk, a string for LoRa and the bit rate
+// for FSK
+func udpDataRate(modu string, datr json.RawMessage) (region.DataRate, error) {
+	switch modu {
+	case "FSK":
+		var bitRate int
+		if err := json.Unmarshal(datr, &bitRate); err != nil {
+			return region.DataRate{}, fmt.Errorf("invalid FSK data rate %s", datr)
+		}
+		return region.DataRate{Modulation: "FSK", BitRate: bitRate}, nil
+	default:
+		var s string
+		if err := json.Unmarshal(datr, &s); err != nil {
+			return region.DataRate{}, fmt.Errorf("invalid LoRa data rate %s", datr)
+		}
+		return region.ParseDataRate(s)
+	}
+}
+
+func (g *Gateway) udpForward(uplink radio.Uplink, r *region.Region) error {
+	dr, err := r.DataRate(uplink.DataRate)
+	if err != nil {
+		return err
+	}
+
+	data, err := uplink.PHYPayload.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to marshal PHYPayload: %w", err)
+	}
+
+	g.mu.RLock()
+	conn := g.udpConn
+	state := g.dataState
+	start := g.udpStart
+	g.mu.RUnlock()
+
+	if conn == nil || state != StateConnected {
+		log.Printf("[%s] udp write error: not allowed", g.eui)
+		return errors.New("not allowed")
+	}
+
+	signal := uplink.ReceivedSignal()
+	rxpk := udpRXPK{
+		Time: time.Now().UTC().Format(time.RFC3339Nano),
+		Tmst: udpTmst(start, uplink.Time),
+		Freq: float64(uplink.Frequency) / 1e6,
+		Stat: 1,
+		RSSI: int(signal.RSSI),
+		LSNR: signal.SNR,
+		Size: len(data),
+		Data: base64.StdEncoding.EncodeToString(data),
+	}
+	switch dr.Modulation {
+	case "LORA":
+		rxpk.Modu = "LORA"
+		rxpk.Datr = dr.String()
+		rxpk.CodR = "4/5"
+	case "FSK":
+		rxpk.Modu = "FSK"
+		rxpk.Datr = dr.BitRate
+	default:
+		return fmt.Errorf("unsupported modulation %s", dr.Modulation)
+	}
+
+	payload, err := json.Marshal(struct {
+		RXPK []udpRXPK `json:"rxpk"`
+	}{[]udpRXPK{rxpk}})
+	if err != nil {
+		return err
+	}
+
+	if err := g.udpPushData(conn, payload); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	g.udpStats.rxnb++
+	g.udpStats.rxok++
+	g.udpStats.rxfw++
+	g.mu.Unlock()
+
+	return nil
+}
+
+// udpTmst returns the concentrator counter of an instant, i.e. the
+// microseconds elapsed since the connection. A zero instant is now.
+func udpTmst(start time.Time, t time.Time) uint32 {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return uint32(t.Sub(start).Microseconds())
+}
+
+func (g *Gateway) udpPullData(conn *net.UDPConn) error {
+	return g.udpWrite(conn, uint16(rand.Intn(1<<16)), udpPullData, nil)
+}
+
+func (g *Gateway) udpPushData(conn *net.UDPConn, payload []byte) error {
+	g.mu.Lock()
+	g.udpStats.pushSent++
+	g.mu.Unlock()
+
+	return g.udpWrite(conn, uint16(rand.Intn(1<<16)), udpPushData, payload)
+}
+
+func (g *Gateway) udpPushStat(conn *net.UDPConn) error {
+	g.mu.Lock()
+	stats := g.udpStats
+	g.udpStats = udpStats{}
+	location := g.location
+	g.mu.Unlock()
+
+	stat := udpStat{
+		Time: time.Now().UTC().Format("2006-01-02 15:04:05") + " GMT",
+		RXNb: stats.rxnb,
+		RXOk: stats.rxok,
+		RXFw: stats.rxfw,
+		DWNb: stats.dwnb,
+		TXNb: stats.txnb,
+	}
+	if stats.pushSent > 0 {
+		stat.ACKR = 100 * float64(stats.pushAcked) / float64(stats.pushSent)
+	}
+	if location != nil {
+		stat.Lati = &location.Latitude
+		stat.Long = &location.Longitude
+	}
+
+	payload, err := json.Marshal(struct {
+		Stat udpStat `json:"stat"`
+	}{stat})
+	if err != nil {
+		return err
+	}
+
+	return g.udpPushData(conn, payload)
+}
+
+// udpWrite sends a packet made of the protocol header followed by the payload
+func (g *Gateway) udpWrite(conn *net.UDPConn, token uint16, identifier byte, payload []byte) error {
+	packet := make([]byte, 12, 12+len(payload))
+	packet[0] = udpProtocolVersion
+	binary.BigEndian.PutUint16(packet[1:3], token)
+	packet[3] = identifier
+	copy(packet[4:12], g.eui[:])
+	packet = append(packet, payload...)
+
+	if _, err := conn.Write(packet); err != nil {
+		log.Printf("[%s] udp write error: %v", g.eui, err)
+		return err
+	}
+	log.Printf("[%s] udp write: %x %s", g.eui, packet[:12], payload)
+
+	return nil
+}
+
+func (g *Gateway) udpDisconnect() error {
+	g.mu.Lock()
+	g.setDataState(StateDisconnecting)
+	conn := g.udpConn
+	dataDone := g.dataDone
+	g.mu.Unlock()
+
+	// Close the socket
+	log.Printf("[%s] udp disconnecting", g.eui)
+	err := conn.Close()
+	if err != nil {
+		g.mu.Lock()
+		g.setDataState(StateDisconnectionError)
+		g.mu.Unlock()
+		log.Printf("[%s] udp disconnection error: %v", g.eui, err)
+		return err
+	}
+
+	// Wait for udpReadLoop termination
+	<-dataDone
+
+	g.mu.Lock()
+	g.udpConn = nil
+	g.setDataState(StateDisconnected)
+	g.mu.Unlock()
+	log.Printf("[%s] udp disconnected", g.eui)
+
+	return nil
+}
@@ -0,0 +1,472 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+	"github.com/stretchr/testify/assert"
+)
+
+type udpTestPacket struct {
+	token      uint16
+	identifier byte
+	eui        lorawan.EUI64
+	payload    []byte
+}
+
+// Mock UDP server that simulates a LNS packet forwarder endpoint
+type mockUDPServer struct {
+	conn    *net.UDPConn
+	packets chan udpTestPacket
+	gwAddr  chan *net.UDPAddr
+}
+
+func newMockUDPServer(t *testing.T, ack bool) *mockUDPServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+
+	s := &mockUDPServer{
+		conn:    conn,
+		packets: make(chan udpTestPacket, 100),
+		gwAddr:  make(chan *net.UDPAddr, 1),
+	}
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < 12 {
+				continue
+			}
+
+			p := udpTestPacket{
+				token:      binary.BigEndian.Uint16(buf[1:3]),
+				identifier: buf[3],
+				payload:    append([]byte(nil), buf[12:n]...),
+			}
+			copy(p.eui[:], buf[4:12])
+			s.packets <- p
+
+			if !ack {
+				continue
+			}
+			switch p.identifier {
+			case udpPushData:
+				conn.WriteToUDP([]byte{udpProtocolVersion, buf[1], buf[2], udpPushAck}, addr)
+			case udpPullData:
+				select {
+				case s.gwAddr <- addr:
+				default:
+				}
+				conn.WriteToUDP([]byte{udpProtocolVersion, buf[1], buf[2], udpPullAck}, addr)
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *mockUDPServer) URI() string {
+	return "udp://" + s.conn.LocalAddr().String()
+}
+
+func (s *mockUDPServer) Close() {
+	s.conn.Close()
+}
+
+// next returns the next packet with the given identifier
+func (s *mockUDPServer) next(t *testing.T, identifier byte) udpTestPacket {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case p := <-s.packets:
+			if p.identifier == identifier {
+				return p
+			}
+		case <-timeout:
+			t.Fatalf("Timeout waiting for packet %d", identifier)
+			return udpTestPacket{}
+		}
+	}
+}
+
+func newTestUDPGateway(t *testing.T, server *mockUDPServer) (*Gateway, chan radio.Downlink) {
+	downlinkCh := make(chan radio.Downlink, 10)
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	gw := New(downlinkCh, eui, server.URI(), nil)
+	assert.NoError(t, gw.SetProtocol(ProtocolSemtechUDP))
+	return gw, downlinkCh
+}
+
+func TestParseProtocol(t *testing.T) {
+	p, err := ParseProtocol("")
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolBasicsStation, p)
+
+	p, err = ParseProtocol("semtech-udp")
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolSemtechUDP, p)
+
+	_, err = ParseProtocol("mqtt")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported protocol")
+}
+
+func TestGateway_SetProtocol(t *testing.T) {
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	gw := newTestGateway(eui, "ws://discovery.test")
+	assert.Equal(t, ProtocolBasicsStation, gw.GetInfo().Protocol)
+
+	assert.Error(t, gw.SetProtocol("mqtt"))
+	assert.NoError(t, gw.SetProtocol(ProtocolSemtechUDP))
+	assert.Equal(t, ProtocolSemtechUDP, gw.GetInfo().Protocol)
+
+	gw.dataState = StateConnected
+	err := gw.SetProtocol(ProtocolBasicsStation)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "while connected")
+}
+
+func TestUDP_ConnectDisconnect(t *testing.T) {
+	server := newMockUDPServer(t, true)
+	defer server.Close()
+
+	gw, _ := newTestUDPGateway(t, server)
+
+	err := gw.Connect()
+	assert.NoError(t, err)
+
+	pull := server.next(t, udpPullData)
+	assert.Equal(t, gw.eui, pull.eui)
+	assert.Empty(t, pull.payload)
+
+	info := gw.GetInfo()
+	assert.Equal(t, "connected", info.DataState)
+	assert.Equal(t, "disconnected", info.DiscoveryState)
+	assert.Equal(t, server.conn.LocalAddr().String(), info.DataURI)
+
+	err = gw.Connect()
+	assert.Error(t, err)
+	assert.Equal(t, "already connected", err.Error())
+
+	err = gw.Disconnect()
+	assert.NoError(t, err)
+	assert.Equal(t, "disconnected", gw.GetInfo().DataState)
+
+	err = gw.Disconnect()
+	assert.Error(t, err)
+	assert.Equal(t, "already disconnected", err.Error())
+}
+
+func TestUDP_ConnectPullAckTimeout(t *testing.T) {
+	timeout := udpPullAckTimeout
+	udpPullAckTimeout = 100 * time.Millisecond
+	defer func() { udpPullAckTimeout = timeout }()
+
+	server := newMockUDPServer(t, false)
+	defer server.Close()
+
+	gw, _ := newTestUDPGateway(t, server)
+
+	err := gw.Connect()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "PULL_ACK timeout")
+	assert.Equal(t, "disconnected", gw.GetInfo().DataState)
+}
+
+func TestUDP_ConnectInvalidAddress(t *testing.T) {
+	downlinkCh := make(chan radio.Downlink, 10)
+	gw := New(downlinkCh, lorawan.EUI64{0x01}, "udp://invalid address", nil)
+	assert.NoError(t, gw.SetProtocol(ProtocolSemtechUDP))
+
+	err := gw.Connect()
+	assert.Error(t, err)
+	assert.Equal(t, "disconnected", gw.GetInfo().DataState)
+}
+
+func TestUDP_Forward(t *testing.T) {
+	server := newMockUDPServer(t, true)
+	defer server.Close()
+
+	gw, _ := newTestUDPGateway(t, server)
+
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.JoinRequest,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.JoinRequestPayload{
+			JoinEUI:  lorawan.EUI64{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18},
+			DevEUI:   lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			DevNonce: lorawan.DevNonce(100),
+		},
+		MIC: [4]byte{0x01, 0x02, 0x03, 0x04},
+	}
+	phyBytes, err := phy.MarshalBinary()
+	assert.NoError(t, err)
+
+	t.Run("rejects uplink when disconnected", func(t *testing.T) {
+		err := gw.Forward(newTestUplink(phy))
+		assert.Error(t, err)
+		assert.Equal(t, "not allowed", err.Error())
+	})
+
+	assert.NoError(t, gw.Connect())
+	defer gw.Disconnect()
+
+	t.Run("sends rxpk in PUSH_DATA", func(t *testing.T) {
+		err := gw.Forward(newTestUplink(phy))
+		assert.NoError(t, err)
+
+		push := server.next(t, udpPushData)
+		assert.Equal(t, gw.eui, push.eui)
+
+		var msg struct {
+			RXPK []map[string]interface{} `json:"rxpk"`
+		}
+		assert.NoError(t, json.Unmarshal(push.payload, &msg))
+		assert.Len(t, msg.RXPK, 1)
+		rxpk := msg.RXPK[0]
+		assert.Equal(t, 868.3, rxpk["freq"])
+		assert.Equal(t, "LORA", rxpk["modu"])
+		assert.Equal(t, "SF7BW125", rxpk["datr"])
+		assert.Equal(t, "4/5", rxpk["codr"])
+		assert.Equal(t, float64(1), rxpk["stat"])
+		assert.Equal(t, float64(len(phyBytes)), rxpk["size"])
+		assert.Equal(t, base64.StdEncoding.EncodeToString(phyBytes), rxpk["data"])
+		assert.Contains(t, rxpk, "tmst")
+		assert.Contains(t, rxpk, "time")
+		assert.Equal(t, float64(-50), rxpk["rssi"])
+		assert.Equal(t, float64(9), rxpk["lsnr"])
+	})
+
+	t.Run("reports the received signal", func(t *testing.T) {
+		uplink := newTestUplink(phy)
+		uplink.Signal = &radio.Signal{RSSI: -118, SNR: -6.5}
+		assert.NoError(t, gw.Forward(uplink))
+
+		var msg struct {
+			RXPK []udpRXPK `json:"rxpk"`
+		}
+		assert.NoError(t, json.Unmarshal(server.next(t, udpPushData).payload, &msg))
+		assert.Len(t, msg.RXPK, 1)
+		assert.Equal(t, -118, msg.RXPK[0].RSSI)
+		assert.Equal(t, -6.5, msg.RXPK[0].LSNR)
+	})
+
+	t.Run("rejects uplink outside the channel plan", func(t *testing.T) {
+		uplink := newTestUplink(phy)
+		uplink.Frequency = 869525000
+		err := gw.Forward(uplink)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid uplink channel")
+	})
+
+	t.Run("rejects uplink from another region", func(t *testing.T) {
+		err := gw.Forward(radio.Uplink{PHYPayload: phy, Region: region.US915, Frequency: 902300000, DataRate: 0})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "does not match gateway region")
+	})
+}
+
+func TestUDP_Downlink(t *testing.T) {
+	server := newMockUDPServer(t, true)
+	defer server.Close()
+
+	gw, downlinkCh := newTestUDPGateway(t, server)
+	assert.NoError(t, gw.Connect())
+	defer gw.Disconnect()
+
+	var gwAddr *net.UDPAddr
+	select {
+	case gwAddr = <-server.gwAddr:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for PULL_DATA")
+	}
+
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataDown,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.MACPayload{
+			FHDR: lorawan.FHDR{DevAddr: lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}, FCnt: 7},
+		},
+		MIC: [4]byte{0x01, 0x02, 0x03, 0x04},
+	}
+	phyBytes, err := phy.MarshalBinary()
+	assert.NoError(t, err)
+
+	pullResp := func(token uint16, imme bool, tmst uint32, freq float64, datr string) {
+		txpk := fmt.Sprintf(`{"txpk":{"imme":%t,"tmst":%d,"freq":%g,"rfch":0,"powe":14,"modu":"LORA","datr":"%s","codr":"4/5","ipol":true,"size":%d,"data":"%s"}}`,
+			imme, tmst, freq, datr, len(phyBytes), base64.StdEncoding.EncodeToString(phyBytes))
+		packet := []byte{udpProtocolVersion, byte(token >> 8), byte(token), udpPullResp}
+		_, err := server.conn.WriteToUDP(append(packet, txpk...), gwAddr)
+		assert.NoError(t, err)
+	}
+
+	t.Run("delivers immediate txpk and sends TX_ACK", func(t *testing.T) {
+		pullResp(0x1234, true, 0, 868.1, "SF7BW125")
+
+		select {
+		case downlink := <-downlinkCh:
+			macPL, ok := downlink.PHYPayload.MACPayload.(*lorawan.MACPayload)
+			assert.True(t, ok)
+			assert.Equal(t, uint32(7), macPL.FHDR.FCnt)
+			assert.Equal(t, region.EU868, downlink.Region)
+			assert.Equal(t, uint32(868100000), downlink.Frequency)
+			assert.Equal(t, 5, downlink.DataRate)
+			assert.Equal(t, float64(14), downlink.TxPower)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for downlink")
+		}
+
+		ack := server.next(t, udpTxAck)
+		assert.Equal(t, uint16(0x1234), ack.token)
+		assert.Equal(t, gw.eui, ack.eui)
+		assert.JSONEq(t, `{"txpk_ack":{"error":"NONE"}}`, string(ack.payload))
+	})
+
+	// Forward an uplink to learn its concentrator counter
+	uplink := newTestUplink(lorawan.PHYPayload{
+		MHDR:       lorawan.MHDR{MType: lorawan.JoinRequest, Major: lorawan.LoRaWANR1},
+		MACPayload: &lorawan.JoinRequestPayload{},
+	})
+	uplink.Time = time.Now()
+	assert.NoError(t, gw.Forward(uplink))
+	var msg struct {
+		RXPK []udpRXPK `json:"rxpk"`
+	}
+	assert.NoError(t, json.Unmarshal(server.next(t, udpPushData).payload, &msg))
+	assert.Len(t, msg.RXPK, 1)
+	tmst := msg.RXPK[0].Tmst
+
+	t.Run("transmits txpk at tmst", func(t *testing.T) {
+		pullResp(0x1235, false, tmst+1000000, 869.525, "SF12BW125")
+
+		select {
+		case downlink := <-downlinkCh:
+			assert.Equal(t, uint32(869525000), downlink.Frequency)
+			assert.Equal(t, 0, downlink.DataRate)
+			assert.WithinDuration(t, uplink.Time.Add(time.Second), downlink.Time, 5*time.Millisecond)
+			assert.False(t, time.Now().Before(downlink.Time))
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for downlink")
+		}
+
+		ack := server.next(t, udpTxAck)
+		assert.JSONEq(t, `{"txpk_ack":{"error":"NONE"}}`, string(ack.payload))
+	})
+
+	t.Run("rejects txpk in the past", func(t *testing.T) {
+		pullResp(0x1236, false, tmst-1000000, 868.1, "SF7BW125")
+
+		ack := server.next(t, udpTxAck)
+		assert.Equal(t, uint16(0x1236), ack.token)
+		assert.JSONEq(t, `{"txpk_ack":{"error":"TOO_LATE"}}`, string(ack.payload))
+
+		select {
+		case <-downlinkCh:
+			t.Fatal("Unexpected downlink")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("reports simulated TX failure", func(t *testing.T) {
+		assert.NoError(t, gw.SetTxFailureRate(1))
+		defer gw.SetTxFailureRate(0)
+
+		pullResp(0x1237, true, 0, 868.1, "SF7BW125")
+
+		ack := server.next(t, udpTxAck)
+		assert.Equal(t, uint16(0x1237), ack.token)
+		assert.JSONEq(t, `{"txpk_ack":{"error":"COLLISION_PACKET"}}`, string(ack.payload))
+
+		select {
+		case <-downlinkCh:
+			t.Fatal("Unexpected downlink")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("ignores invalid txpk", func(t *testing.T) {
+		_, err := server.conn.WriteToUDP(append([]byte{udpProtocolVersion, 0x12, 0x35, udpPullResp}, `{"txpk":{"data":"!"}}`...), gwAddr)
+		assert.NoError(t, err)
+
+		select {
+		case <-downlinkCh:
+			t.Fatal("Unexpected downlink")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func TestUDP_KeepaliveAndStat(t *testing.T) {
+	keepalive, stat := udpKeepaliveInterval, udpStatInterval
+	udpKeepaliveInterval = 50 * time.Millisecond
+	udpStatInterval = 120 * time.Millisecond
+	defer func() { udpKeepaliveInterval, udpStatInterval = keepalive, stat }()
+
+	server := newMockUDPServer(t, true)
+	defer server.Close()
+
+	downlinkCh := make(chan radio.Downlink, 10)
+	eui := lorawan.EUI64{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	gw := NewWithLocation(downlinkCh, eui, server.URI(), nil, &Location{Latitude: 45.4642, Longitude: 9.19})
+	assert.NoError(t, gw.SetProtocol(ProtocolSemtechUDP))
+	assert.NoError(t, gw.Connect())
+	defer gw.Disconnect()
+
+	// Connection PULL_DATA followed by keepalives
+	server.next(t, udpPullData)
+	server.next(t, udpPullData)
+
+	push := server.next(t, udpPushData)
+	var msg struct {
+		Stat map[string]interface{} `json:"stat"`
+	}
+	assert.NoError(t, json.Unmarshal(push.payload, &msg))
+	assert.NotNil(t, msg.Stat)
+	assert.Equal(t, 45.4642, msg.Stat["lati"])
+	assert.Equal(t, 9.19, msg.Stat["long"])
+	assert.Equal(t, float64(0), msg.Stat["rxnb"])
+	assert.Regexp(t, `^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} GMT$`, msg.Stat["time"])
+}
+
+func TestUDP_KeepaliveDropsLostLNS(t *testing.T) {
+	keepalive := udpKeepaliveInterval
+	udpKeepaliveInterval = 20 * time.Millisecond
+	defer func() { udpKeepaliveInterval = keepalive }()
+
+	server := newMockUDPServer(t, true)
+	gw, _ := newTestUDPGateway(t, server)
+	assert.NoError(t, gw.Connect())
+
+	// Answered keepalives keep the connection
+	server.next(t, udpPullData)
+	server.next(t, udpPullData)
+	server.next(t, udpPullData)
+	server.next(t, udpPullData)
+	assert.Equal(t, "connected", gw.GetInfo().DataState)
+
+	// The LNS goes away: the PULL_DATA are no longer answered
+	server.Close()
+	assert.Eventually(t, func() bool {
+		return gw.GetInfo().DataState == "reconnecting"
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "3 PULL_ACK missed", gw.GetInfo().LastError)
+
+	assert.NoError(t, gw.Disconnect())
+	assert.Equal(t, "disconnected", gw.GetInfo().DataState)
+}
@@ -2,14 +2,18 @@ package networkserver
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"sort"
 	"sync"
 
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/eventbus"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/gateway"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/propagation"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
 
 	"github.com/brocaar/lorawan"
 )
@@ -21,10 +25,29 @@ type NetworkServer struct {
 	devices           map[lorawan.EUI64]*device.Device
 	gateways          map[lorawan.EUI64]*gateway.Gateway
 	mu                sync.RWMutex
-	broadcastUplink   chan<- lorawan.PHYPayload
-	broadcastDownlink chan<- lorawan.PHYPayload
+	broadcastUplink   chan<- radio.Uplink
+	broadcastDownlink chan<- radio.Downlink
+	scheduler         *scheduler
+	propagation       propagation.Model
+	events            *eventbus.Bus // set by the pool, nil drops the events
 }
 
+// Events published by the network server, gateways and devices also publish
+// their own events
+const (
+	EventNetworkServerAdded   = "network_server_added"
+	EventNetworkServerRemoved = "network_server_removed"
+	EventGatewayAdded         = "gateway_added"
+	EventGatewayRemoved       = "gateway_removed"
+	EventDeviceAdded          = "device_added"
+	EventDeviceRemoved        = "device_removed"
+	EventSynced               = "synced"
+	EventSyncFailed           = "sync_failed"
+	// EventUplinkForwarded is published for the gateways forwarding an uplink
+	// to the LNS
+	EventUplinkForwarded = "uplink"
+)
+
 type NetworkServerInfo struct {
 	Name         string                          `json:"name"`
 	Config       integration.NetworkServerConfig `json:"config"`
@@ -32,13 +55,13 @@ type NetworkServerInfo struct {
 	GatewayCount int                             `json:"gatewayCount"`
 }
 
-func New(name string, config integration.NetworkServerConfig, broadcastUplink chan<- lorawan.PHYPayload, broadcastDownlink chan<- lorawan.PHYPayload) *NetworkServer {
+func New(name string, config integration.NetworkServerConfig, broadcastUplink chan<- radio.Uplink, broadcastDownlink chan<- radio.Downlink) *NetworkServer {
 	integrationClient, err := integration.NewIntegrationClient(config)
 	if err != nil {
 		return nil
 	}
 
-	return &NetworkServer{
+	ns := &NetworkServer{
 		name:              name,
 		config:            config,
 		integrationClient: integrationClient,
@@ -47,6 +70,10 @@ func New(name string, config integration.NetworkServerConfig, broadcastUplink ch
 		broadcastUplink:   broadcastUplink,
 		broadcastDownlink: broadcastDownlink,
 	}
+	ns.scheduler = newScheduler(ns.SendUplink)
+	ns.propagation, _ = propagation.New(propagation.DefaultConfig)
+
+	return ns
 }
 
 func (ns *NetworkServer) GetInfo() NetworkServerInfo {
@@ -61,6 +88,30 @@ func (ns *NetworkServer) GetInfo() NetworkServerInfo {
 	}
 }
 
+// GetPropagation returns the configuration of the path loss model between
+// devices and gateways
+func (ns *NetworkServer) GetPropagation() propagation.Config {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	return ns.propagation.Config()
+}
+
+// SetPropagation replaces the path loss model between devices and gateways
+func (ns *NetworkServer) SetPropagation(config propagation.Config) error {
+	model, err := propagation.New(config)
+	if err != nil {
+		return err
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	ns.propagation = model
+
+	return nil
+}
+
 // Gateway management methods
 
 func (ns *NetworkServer) AddGateway(EUI lorawan.EUI64, discoveryURI string, location *gateway.Location, headers http.Header) (*gateway.Gateway, error) {
@@ -71,8 +122,14 @@ func (ns *NetworkServer) AddGateway(EUI lorawan.EUI64, discoveryURI string, loca
 		return nil, errors.New("gateway already exists")
 	}
 
-	ns.gateways[EUI] = gateway.NewWithLocation(ns.broadcastDownlink, EUI, discoveryURI, headers, location)
-	return ns.gateways[EUI], nil
+	gw := gateway.NewWithLocation(ns.broadcastDownlink, EUI, discoveryURI, headers, location)
+	gw.SetEventHandler(func(event gateway.Event) {
+		ns.publish(eventbus.Event{Source: eventbus.SourceGateway, Type: string(event.Type), Time: event.Time, GatewayEUI: &EUI, Message: event.Message})
+	})
+	ns.gateways[EUI] = gw
+	ns.publish(eventbus.Event{Source: eventbus.SourceNetworkServer, Type: EventGatewayAdded, GatewayEUI: &EUI})
+
+	return gw, nil
 }
 
 func (ns *NetworkServer) GetGateway(EUI lorawan.EUI64) (*gateway.Gateway, error) {
@@ -108,35 +165,71 @@ func (ns *NetworkServer) RemoveGateway(EUI lorawan.EUI64) error {
 	ns.mu.Lock()
 	defer ns.mu.Unlock()
 
-	if _, exists := ns.gateways[EUI]; !exists {
+	gw, exists := ns.gateways[EUI]
+	if !exists {
 		return errors.New("gateway not found")
 	}
 
-	// TODO: disconnect gateway
+	// Close the LNS connection and stop reconnecting, if any
+	gw.Disconnect()
 
 	delete(ns.gateways, EUI)
+	ns.publish(eventbus.Event{Source: eventbus.SourceNetworkServer, Type: EventGatewayRemoved, GatewayEUI: &EUI})
 
 	return nil
 }
 
-func (ns *NetworkServer) ForwardUplink(uplink lorawan.PHYPayload) error {
+func (ns *NetworkServer) ForwardUplink(uplink radio.Uplink) error {
 	ns.mu.RLock()
 	defer ns.mu.RUnlock()
 
-	// TODO: filter by location
 	for _, gw := range ns.gateways {
-		log.Printf("[%s] propagating uplink to gateway %s", ns.name, gw.GetInfo().EUI)
-		go func(gw *gateway.Gateway) {
-			err := gw.Forward(uplink)
+		gwInfo := gw.GetInfo()
+		gwUplink, ok := ns.propagate(uplink, gwInfo.Location)
+		if !ok {
+			log.Printf("[%s] gateway %s out of range (RSSI %g dBm, SNR %g dB)", ns.name, gwInfo.EUI, gwUplink.Signal.RSSI, gwUplink.Signal.SNR)
+			continue
+		}
+
+		log.Printf("[%s] propagating uplink to gateway %s", ns.name, gwInfo.EUI)
+		go func(gw *gateway.Gateway, eui lorawan.EUI64) {
+			err := gw.Forward(gwUplink)
 			if err != nil {
-				log.Printf("[%s] gateway %s error: %v", ns.name, gw.GetInfo().EUI, err)
+				log.Printf("[%s] gateway %s error: %v", ns.name, eui, err)
+				return
 			}
-		}(gw)
+			signal := gwUplink.ReceivedSignal()
+			ns.publish(eventbus.Event{
+				Source:     eventbus.SourceGateway,
+				Type:       EventUplinkForwarded,
+				GatewayEUI: &eui,
+				Message:    fmt.Sprintf("%d Hz DR%d, RSSI %g dBm, SNR %g dB", gwUplink.Frequency, gwUplink.DataRate, signal.RSSI, signal.SNR),
+			})
+		}(gw, gwInfo.EUI)
 	}
 
 	return nil
 }
 
+// propagate computes the signal of the uplink at a gateway, ok is false when
+// it is below the gateway sensitivity. The signal is left unset when the
+// device or gateway location is unknown.
+// Must be called with the lock held.
+func (ns *NetworkServer) propagate(uplink radio.Uplink, location *gateway.Location) (radio.Uplink, bool) {
+	if uplink.Location == nil || location == nil {
+		return uplink, true
+	}
+
+	distance := propagation.Distance(*uplink.Location, radio.Location{
+		Latitude:  location.Latitude,
+		Longitude: location.Longitude,
+	})
+	signal, ok := propagation.Receive(ns.propagation, uplink, distance)
+	uplink.Signal = &signal
+
+	return uplink, ok
+}
+
 // Device management methods
 
 func (ns *NetworkServer) AddDevice(
@@ -158,8 +251,14 @@ func (ns *NetworkServer) AddDevice(
 		return nil, errors.New("device already exists")
 	}
 
-	ns.devices[DevEUI] = device.NewWithLocation(ns.broadcastUplink, DevEUI, JoinEUI, AppKey, DevNonce, DevAddr, AppSKey, NwkSKey, FCntUp, FCntDn, location)
-	return ns.devices[DevEUI], nil
+	dev := device.NewWithLocation(ns.broadcastUplink, DevEUI, JoinEUI, AppKey, DevNonce, DevAddr, AppSKey, NwkSKey, FCntUp, FCntDn, location)
+	dev.SetEventHandler(func(event device.Event) {
+		ns.publish(eventbus.Event{Source: eventbus.SourceDevice, Type: string(event.Type), Time: event.Time, DevEUI: &DevEUI, Message: event.Message, Data: event})
+	})
+	ns.devices[DevEUI] = dev
+	ns.publish(eventbus.Event{Source: eventbus.SourceNetworkServer, Type: EventDeviceAdded, DevEUI: &DevEUI})
+
+	return dev, nil
 }
 
 func (ns *NetworkServer) GetDevice(DevEUI lorawan.EUI64) (*device.Device, error) {
@@ -201,54 +300,99 @@ func (ns *NetworkServer) RemoveDevice(DevEUI lorawan.EUI64) error {
 
 	delete(ns.devices, DevEUI)
 
+	// Stop periodic uplinks, if any
+	ns.scheduler.stop(DevEUI)
+
+	ns.publish(eventbus.Event{Source: eventbus.SourceNetworkServer, Type: EventDeviceRemoved, DevEUI: &DevEUI})
+
 	return nil
 }
 
-func (ns *NetworkServer) ForwardDownlink(downlink lorawan.PHYPayload) error {
-	if downlink.MHDR.MType == lorawan.UnconfirmedDataDown || downlink.MHDR.MType == lorawan.ConfirmedDataDown {
-		// Unconfirmed or Confirmed Downlink
-		macPL, ok := downlink.MACPayload.(*lorawan.MACPayload)
+func (ns *NetworkServer) ForwardDownlink(downlink radio.Downlink) error {
+	// Data downlinks only reach the devices with the same DevAddr, join
+	// accepts are decrypted by every device to find the recipient and beacons
+	// reach every class B device
+	var devAddr *lorawan.DevAddr
+	switch downlink.PHYPayload.MHDR.MType {
+	case lorawan.UnconfirmedDataDown, lorawan.ConfirmedDataDown:
+		macPL, ok := downlink.PHYPayload.MACPayload.(*lorawan.MACPayload)
 		if !ok {
 			log.Printf("[%s] invalid MAC payload for data downlink", ns.name)
 			return errors.New("invalid MAC payload")
 		}
+		devAddr = &macPL.FHDR.DevAddr
+	}
 
-		devAddr := macPL.FHDR.DevAddr
-
-		ns.mu.RLock()
-		defer ns.mu.RUnlock()
-		for _, dev := range ns.devices {
-			// TODO: filter also by location and rxw
-			if dev.DevAddr == devAddr {
-				// Propagate only to devices with same DevAddr
-				log.Printf("[%s] propagating downlink to device %s (DevAddr: %s)", ns.name, dev.GetInfo().DevEUI, devAddr)
-				go func(dev *device.Device) {
-					err := dev.Downlink(downlink)
-					if err != nil {
-						log.Printf("[%s] device %s error: %v", ns.name, dev.GetInfo().DevEUI, err)
-					}
-				}(dev)
-			}
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	for _, dev := range ns.devices {
+		devInfo := dev.GetInfo()
+		if devAddr != nil && devInfo.DevAddr != *devAddr {
+			continue
 		}
-	} else {
-		// Join Accept
-		ns.mu.RLock()
-		defer ns.mu.RUnlock()
-		for _, dev := range ns.devices {
-			// TODO: filter also by location and rxw
-			log.Printf("[%s] propagating downlink to device %s", ns.name, dev.GetInfo().DevEUI)
-			go func(dev *device.Device) {
-				err := dev.JoinAccept(downlink)
-				if err != nil {
-					log.Printf("[%s] device %s error: %v", ns.name, dev.GetInfo().DevEUI, err)
-				}
-			}(dev)
+
+		devDownlink, ok := ns.propagateDownlink(downlink, devInfo.Location)
+		if !ok {
+			log.Printf("[%s] device %s out of range (RSSI %g dBm, SNR %g dB)", ns.name, devInfo.DevEUI, devDownlink.Signal.RSSI, devDownlink.Signal.SNR)
+			continue
 		}
+
+		// Devices decrypt the frame in place, each one gets its own copy
+		if downlink.Beacon == nil {
+			phy, err := copyPHYPayload(downlink.PHYPayload)
+			if err != nil {
+				log.Printf("[%s] invalid PHYPayload: %v", ns.name, err)
+				return err
+			}
+			devDownlink.PHYPayload = phy
+		}
+
+		log.Printf("[%s] propagating downlink to device %s", ns.name, devInfo.DevEUI)
+		go func(dev *device.Device) {
+			// The device checks whether its RX windows are open
+			err := dev.Receive(devDownlink)
+			if err != nil {
+				log.Printf("[%s] device %s error: %v", ns.name, devInfo.DevEUI, err)
+			}
+		}(dev)
 	}
 
 	return nil
 }
 
+// propagateDownlink computes the signal of the downlink at a device, ok is
+// false when it is below the device sensitivity. The signal is left unset
+// when the gateway or device location is unknown.
+// Must be called with the lock held.
+func (ns *NetworkServer) propagateDownlink(downlink radio.Downlink, location *device.Location) (radio.Downlink, bool) {
+	if downlink.Location == nil || location == nil {
+		return downlink, true
+	}
+
+	distance := propagation.Distance(*downlink.Location, radio.Location{
+		Latitude:  location.Latitude,
+		Longitude: location.Longitude,
+	})
+	signal, ok := propagation.ReceiveDownlink(ns.propagation, downlink, distance)
+	downlink.Signal = &signal
+
+	return downlink, ok
+}
+
+// copyPHYPayload returns a deep copy of a PHYPayload
+func copyPHYPayload(phy lorawan.PHYPayload) (lorawan.PHYPayload, error) {
+	var copied lorawan.PHYPayload
+
+	b, err := phy.MarshalBinary()
+	if err != nil {
+		return copied, err
+	}
+	err = copied.UnmarshalBinary(b)
+
+	return copied, err
+}
+
 func (ns *NetworkServer) SendJoinRequest(DevEUI lorawan.EUI64) error {
 	ns.mu.Lock()
 	defer ns.mu.Unlock()
@@ -267,7 +411,21 @@ func (ns *NetworkServer) SendJoinRequest(DevEUI lorawan.EUI64) error {
 	return nil
 }
 
-func (ns *NetworkServer) SendUplink(DevEUI lorawan.EUI64) error {
+// SendRejoinRequest sends a Rejoin-request of the given type (0, 1 or 2)
+func (ns *NetworkServer) SendRejoinRequest(DevEUI lorawan.EUI64, rejoinType lorawan.JoinType) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	device, exists := ns.devices[DevEUI]
+	if !exists {
+		return errors.New("device not found")
+	}
+
+	_, err := device.Rejoin(rejoinType)
+	return err
+}
+
+func (ns *NetworkServer) SendUplink(DevEUI lorawan.EUI64, fPort uint8, payload []byte, confirmed bool) error {
 	ns.mu.Lock()
 	defer ns.mu.Unlock()
 
@@ -277,7 +435,7 @@ func (ns *NetworkServer) SendUplink(DevEUI lorawan.EUI64) error {
 	}
 
 	// Prepare Uplink frame
-	_, err := device.Uplink()
+	_, err := device.Uplink(fPort, payload, confirmed)
 	if err != nil {
 		return err
 	}
@@ -285,13 +443,94 @@ func (ns *NetworkServer) SendUplink(DevEUI lorawan.EUI64) error {
 	return nil
 }
 
+// Schedule management methods
+
+// StartSchedule starts (or replaces) the periodic uplinks of a device
+func (ns *NetworkServer) StartSchedule(DevEUI lorawan.EUI64, config ScheduleConfig) error {
+	ns.mu.RLock()
+	dev, exists := ns.devices[DevEUI]
+	ns.mu.RUnlock()
+	if !exists {
+		return errors.New("device not found")
+	}
+
+	// A payload that does not fit would fail every uplink
+	maxSize, err := dev.MaxPayloadSize()
+	if err != nil {
+		return err
+	}
+	if len(config.Payload) > maxSize {
+		return fmt.Errorf("payload too large for the data rate of the device: %d bytes, max %d", len(config.Payload), maxSize)
+	}
+
+	return ns.scheduler.start(DevEUI, config)
+}
+
+func (ns *NetworkServer) StopSchedule(DevEUI lorawan.EUI64) error {
+	ns.mu.RLock()
+	_, exists := ns.devices[DevEUI]
+	ns.mu.RUnlock()
+	if !exists {
+		return errors.New("device not found")
+	}
+
+	return ns.scheduler.stop(DevEUI)
+}
+
+func (ns *NetworkServer) GetSchedule(DevEUI lorawan.EUI64) (ScheduleStatus, error) {
+	ns.mu.RLock()
+	_, exists := ns.devices[DevEUI]
+	ns.mu.RUnlock()
+	if !exists {
+		return ScheduleStatus{}, errors.New("device not found")
+	}
+
+	return ns.scheduler.status(DevEUI), nil
+}
+
+// DisconnectAllGateways closes the LNS connection of every gateway and stops
+// their reconnection
+func (ns *NetworkServer) DisconnectAllGateways() {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	for _, gw := range ns.gateways {
+		gw.Disconnect()
+	}
+}
+
+// StopAllSchedules stops the periodic uplinks of every device
+func (ns *NetworkServer) StopAllSchedules() {
+	ns.scheduler.stopAll()
+}
+
+// publish reports an event of the network server on the event bus
+func (ns *NetworkServer) publish(event eventbus.Event) {
+	event.NetworkServer = ns.name
+	ns.events.Publish(event)
+}
+
 // Sync syncs gateways and devices from the remote network server
 func (ns *NetworkServer) Sync() error {
+	gateways, devices, err := ns.sync()
+	if err != nil {
+		ns.publish(eventbus.Event{Source: eventbus.SourceNetworkServer, Type: EventSyncFailed, Message: err.Error()})
+		return err
+	}
+
+	ns.publish(eventbus.Event{Source: eventbus.SourceNetworkServer, Type: EventSynced, Message: fmt.Sprintf("%d gateways and %d devices added", gateways, devices)})
+	return nil
+}
+
+// sync adds the gateways and devices of the remote network server, returning
+// how many were added
+func (ns *NetworkServer) sync() (int, int, error) {
+	var gateways, devices int
 
 	// Sync gateways
 	nsGws, err := ns.integrationClient.ListGateways()
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	// Collect gateways to remove and to add
@@ -330,13 +569,15 @@ func (ns *NetworkServer) Sync() error {
 		_, err := ns.AddGateway(gw.EUI, gw.DiscoveryURI, gw.Location, gw.Headers)
 		if err != nil {
 			log.Printf("[%s] unable to add gateway %s: %v", ns.name, gw.EUI, err)
+			continue
 		}
+		gateways++
 	}
 
 	// Sync devices
 	nsDevs, err := ns.integrationClient.ListDevices()
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	// Collect devices to add
@@ -364,8 +605,10 @@ func (ns *NetworkServer) Sync() error {
 		_, err := ns.AddDevice(dev.DevEUI, dev.JoinEUI, dev.AppKey, dev.DevNonce, dev.DevAddr, dev.AppSKey, dev.NwkSKey, dev.FCntUp, dev.FCntDn, dev.Location)
 		if err != nil {
 			log.Printf("[%s] unable to add device %s: %v", ns.name, dev.DevEUI, err)
+			continue
 		}
+		devices++
 	}
 
-	return nil
+	return gateways, devices, nil
 }
@@ -1,17 +1,29 @@
 package networkserver
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/classb"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/gateway"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/propagation"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
 // Helper function to create a network server with channels for testing
 func newTestNetworkServer(name string) *NetworkServer {
-	uplinkCh := make(chan lorawan.PHYPayload, 10)
-	downlinkCh := make(chan lorawan.PHYPayload, 10)
+	uplinkCh := make(chan radio.Uplink, 10)
+	downlinkCh := make(chan radio.Downlink, 10)
 	config := integration.NetworkServerConfig{
 		Type: integration.NetworkServerTypeGeneric,
 	}
@@ -21,8 +33,8 @@ func newTestNetworkServer(name string) *NetworkServer {
 func TestNew(t *testing.T) {
 	t.Run("creates network server with valid name", func(t *testing.T) {
 		name := "my-network-server"
-		uplinkCh := make(chan lorawan.PHYPayload)
-		downlinkCh := make(chan lorawan.PHYPayload)
+		uplinkCh := make(chan radio.Uplink)
+		downlinkCh := make(chan radio.Downlink)
 		config := integration.NetworkServerConfig{
 			Type: integration.NetworkServerTypeGeneric,
 		}
@@ -38,15 +50,15 @@ func TestNew(t *testing.T) {
 
 	t.Run("multiple instances are independent", func(t *testing.T) {
 		name1 := "server-1"
-		uplinkCh1 := make(chan lorawan.PHYPayload)
-		downlinkCh1 := make(chan lorawan.PHYPayload)
+		uplinkCh1 := make(chan radio.Uplink)
+		downlinkCh1 := make(chan radio.Downlink)
 		config := integration.NetworkServerConfig{
 			Type: integration.NetworkServerTypeGeneric,
 		}
 		ns1 := New(name1, config, uplinkCh1, downlinkCh1)
 		name2 := "server-2"
-		uplinkCh2 := make(chan lorawan.PHYPayload)
-		downlinkCh2 := make(chan lorawan.PHYPayload)
+		uplinkCh2 := make(chan radio.Uplink)
+		downlinkCh2 := make(chan radio.Downlink)
 		ns2 := New(name2, config, uplinkCh2, downlinkCh2)
 
 		assert.NotEqual(t, ns1, ns2)
@@ -222,6 +234,78 @@ func TestNetworkServer_RemoveGateway(t *testing.T) {
 	})
 }
 
+// Mock Basics Station LNS closing every data connection once the gateway
+// sent its version, counting the discoveries
+func mockDroppingLNS(t *testing.T, discoveries *atomic.Int32) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		switch r.URL.Path {
+		case "/router-info":
+			discoveries.Add(1)
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			conn.WriteJSON(map[string]string{"uri": "ws" + strings.TrimPrefix(server.URL, "http") + "/traffic"})
+		case "/traffic":
+			conn.ReadMessage()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNetworkServer_RemoveReconnectingGateway(t *testing.T) {
+	eui := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+
+	// connect connects a gateway whose connection drops at once
+	connect := func(t *testing.T, ns *NetworkServer, discoveries *atomic.Int32) *gateway.Gateway {
+		server := mockDroppingLNS(t, discoveries)
+		gw, err := ns.AddGateway(eui, "ws"+strings.TrimPrefix(server.URL, "http"), nil, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, gw.Connect())
+		assert.Eventually(t, func() bool {
+			return gw.GetInfo().DataState == "reconnecting"
+		}, time.Second, 5*time.Millisecond)
+		return gw
+	}
+
+	// stopped checks that no reconnection is attempted, the first one is
+	// within a second
+	stopped := func(t *testing.T, gw *gateway.Gateway, discoveries *atomic.Int32) {
+		assert.Equal(t, "disconnected", gw.GetInfo().DataState)
+		attempts := discoveries.Load()
+		time.Sleep(1500 * time.Millisecond)
+		assert.Equal(t, attempts, discoveries.Load())
+	}
+
+	t.Run("removing the gateway stops its reconnection", func(t *testing.T) {
+		var discoveries atomic.Int32
+		ns := newTestNetworkServer("test-server")
+		gw := connect(t, ns, &discoveries)
+
+		assert.NoError(t, ns.RemoveGateway(eui))
+		stopped(t, gw, &discoveries)
+	})
+
+	t.Run("removing the network server stops the reconnection of its gateways", func(t *testing.T) {
+		var discoveries atomic.Int32
+		p := NewPool()
+		ns, err := p.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		assert.NoError(t, err)
+		gw := connect(t, ns, &discoveries)
+
+		assert.NoError(t, p.Remove("test-server"))
+		stopped(t, gw, &discoveries)
+	})
+}
+
 func TestNetworkServer_GetInfo(t *testing.T) {
 	t.Run("returns correct counts", func(t *testing.T) {
 		ns := newTestNetworkServer("test-server")
@@ -275,7 +359,7 @@ func TestNetworkServer_ForwardDownlink(t *testing.T) {
 		}
 
 		// Forward should broadcast to all devices (JoinAccept type)
-		err := ns.ForwardDownlink(phy)
+		err := ns.ForwardDownlink(radio.Downlink{PHYPayload: phy})
 		assert.NoError(t, err)
 
 		// Both devices should exist
@@ -326,7 +410,7 @@ func TestNetworkServer_ForwardDownlink(t *testing.T) {
 		}
 
 		// Forward downlink - should only go to dev1 (matching DevAddr)
-		err := ns.ForwardDownlink(phy)
+		err := ns.ForwardDownlink(radio.Downlink{PHYPayload: phy})
 		assert.NoError(t, err)
 
 		// Verify both devices still exist
@@ -345,7 +429,7 @@ func TestNetworkServer_ForwardDownlink(t *testing.T) {
 		}
 
 		// Should not panic when no devices exist
-		err := ns.ForwardDownlink(phy)
+		err := ns.ForwardDownlink(radio.Downlink{PHYPayload: phy})
 		assert.NoError(t, err)
 	})
 
@@ -395,7 +479,7 @@ func TestNetworkServer_ForwardDownlink(t *testing.T) {
 		}
 
 		// Forward - should only match dev2
-		err := ns.ForwardDownlink(phy)
+		err := ns.ForwardDownlink(radio.Downlink{PHYPayload: phy})
 		assert.NoError(t, err)
 
 		// All devices should still exist
@@ -441,8 +525,31 @@ func TestNetworkServer_ForwardDownlink(t *testing.T) {
 		}
 
 		// Should handle ConfirmedDataDown with DevAddr filtering
-		err := ns.ForwardDownlink(phy)
+		err := ns.ForwardDownlink(radio.Downlink{PHYPayload: phy})
+		assert.NoError(t, err)
+	})
+
+	t.Run("broadcasts beacons to all class B devices", func(t *testing.T) {
+		ns := newTestNetworkServer("test-server")
+
+		var devices []*device.Device
+		for i := byte(1); i <= 2; i++ {
+			dev, err := ns.AddDevice(lorawan.EUI64{i}, lorawan.EUI64{}, lorawan.AES128Key{}, 0, lorawan.DevAddr{i}, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+			assert.NoError(t, err)
+			assert.NoError(t, dev.SetClass(device.ClassB))
+			devices = append(devices, dev)
+		}
+
+		frame, err := classb.EncodeBeacon(classb.Layout{2, 8, 17}, 1476229120, nil)
+		assert.NoError(t, err)
+		err = ns.ForwardDownlink(radio.Downlink{Beacon: frame, Region: region.EU868, Frequency: 869525000, DataRate: 3, Time: time.Now()})
 		assert.NoError(t, err)
+
+		for _, dev := range devices {
+			assert.Eventually(t, func() bool {
+				return dev.GetInfo().ClassB.BeaconLocked
+			}, time.Second, 5*time.Millisecond)
+		}
 	})
 }
 
@@ -467,7 +574,7 @@ func TestNetworkServer_ForwardUplink(t *testing.T) {
 
 		// Forward should send to all gateways
 		assert.NotPanics(t, func() {
-			ns.ForwardUplink(phy)
+			ns.ForwardUplink(radio.Uplink{PHYPayload: phy, Region: region.EU868, Frequency: 868300000, DataRate: 5})
 		})
 
 		// Verify gateways still exist
@@ -487,11 +594,114 @@ func TestNetworkServer_ForwardUplink(t *testing.T) {
 
 		// Should not panic when no gateways exist
 		assert.NotPanics(t, func() {
-			ns.ForwardUplink(phy)
+			ns.ForwardUplink(radio.Uplink{PHYPayload: phy, Region: region.EU868, Frequency: 868300000, DataRate: 5})
 		})
 	})
 }
 
+func TestNetworkServer_Propagation(t *testing.T) {
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataUp,
+			Major: lorawan.LoRaWANR1,
+		},
+	}
+	uplink := radio.Uplink{
+		PHYPayload: phy,
+		Region:     region.EU868,
+		Frequency:  868300000,
+		DataRate:   5,
+		TxPower:    16,
+		Location:   &radio.Location{Latitude: 45.0703, Longitude: 7.6869},
+	}
+	near := &gateway.Location{Latitude: 45.0793, Longitude: 7.6869} // 1 km
+	far := &gateway.Location{Latitude: 45.1153, Longitude: 7.6869}  // 5 km
+
+	t.Run("defaults to free space", func(t *testing.T) {
+		ns := newTestNetworkServer("test-server")
+		assert.Equal(t, propagation.Config{Model: propagation.FreeSpace}, ns.GetPropagation())
+
+		gwUplink, ok := ns.propagate(uplink, far)
+		assert.True(t, ok)
+		assert.NotNil(t, gwUplink.Signal)
+		assert.Nil(t, uplink.Signal)
+	})
+
+	t.Run("keeps default signal without locations", func(t *testing.T) {
+		ns := newTestNetworkServer("test-server")
+
+		gwUplink, ok := ns.propagate(uplink, nil)
+		assert.True(t, ok)
+		assert.Nil(t, gwUplink.Signal)
+
+		noLocation := uplink
+		noLocation.Location = nil
+		gwUplink, ok = ns.propagate(noLocation, near)
+		assert.True(t, ok)
+		assert.Nil(t, gwUplink.Signal)
+	})
+
+	t.Run("drops uplink out of range", func(t *testing.T) {
+		ns := newTestNetworkServer("test-server")
+		assert.NoError(t, ns.SetPropagation(propagation.Config{Model: propagation.OkumuraHata}))
+
+		gwUplink, ok := ns.propagate(uplink, near)
+		assert.True(t, ok)
+		assert.Greater(t, gwUplink.Signal.SNR, -7.5)
+
+		gwUplink, ok = ns.propagate(uplink, far)
+		assert.False(t, ok)
+		assert.Less(t, gwUplink.Signal.RSSI, -130.0)
+
+		// Slower data rates reach further
+		slow := uplink
+		slow.DataRate = 0
+		_, ok = ns.propagate(slow, far)
+		assert.True(t, ok)
+	})
+
+	t.Run("drops downlink out of range of the device", func(t *testing.T) {
+		ns := newTestNetworkServer("test-server")
+		assert.NoError(t, ns.SetPropagation(propagation.Config{Model: propagation.OkumuraHata}))
+
+		// RX1 at DR5 from a gateway 5 km away
+		downlink := radio.Downlink{
+			PHYPayload: lorawan.PHYPayload{MHDR: lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1}},
+			Region:     region.EU868,
+			Frequency:  868300000,
+			DataRate:   5,
+			TxPower:    14,
+			Location:   &radio.Location{Latitude: far.Latitude, Longitude: far.Longitude},
+		}
+		devLocation := &device.Location{Latitude: 45.0703, Longitude: 7.6869}
+
+		_, ok := ns.propagateDownlink(downlink, devLocation)
+		assert.False(t, ok)
+
+		// RX2 at SF12 with 27 dBm
+		rx2 := downlink
+		rx2.Frequency = 869525000
+		rx2.DataRate = 0
+		rx2.TxPower = 27
+		devDownlink, ok := ns.propagateDownlink(rx2, devLocation)
+		assert.True(t, ok)
+		assert.NotNil(t, devDownlink.Signal)
+
+		// Without locations the downlink always reaches the device
+		devDownlink, ok = ns.propagateDownlink(downlink, nil)
+		assert.True(t, ok)
+		assert.Nil(t, devDownlink.Signal)
+	})
+
+	t.Run("rejects invalid model", func(t *testing.T) {
+		ns := newTestNetworkServer("test-server")
+
+		err := ns.SetPropagation(propagation.Config{Model: "two-ray"})
+		assert.Error(t, err)
+		assert.Equal(t, propagation.FreeSpace, ns.GetPropagation().Model)
+	})
+}
+
 func TestNetworkServer_SendUplink(t *testing.T) {
 	t.Run("triggers uplink for existing device", func(t *testing.T) {
 		ns := newTestNetworkServer("test-server")
@@ -512,7 +722,7 @@ func TestNetworkServer_SendUplink(t *testing.T) {
 		dev.FCntUp = 0
 
 		// Call SendUplink should not panic
-		err = ns.SendUplink(devEUI)
+		err = ns.SendUplink(devEUI, 1, []byte{0x01, 0x02, 0x03, 0x04}, true)
 		assert.NoError(t, err)
 
 		// Verify FCnt incremented
@@ -524,7 +734,7 @@ func TestNetworkServer_SendUplink(t *testing.T) {
 
 		// Try to send uplink for device that doesn't exist
 		devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
-		err := ns.SendUplink(devEUI)
+		err := ns.SendUplink(devEUI, 1, []byte{0x01, 0x02, 0x03, 0x04}, true)
 
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "not found")
@@ -544,7 +754,7 @@ func TestNetworkServer_SendUplink(t *testing.T) {
 
 		// Device has zero DevAddr (not joined)
 		// This should still work but the uplink will have empty DevAddr
-		err = ns.SendUplink(devEUI)
+		err = ns.SendUplink(devEUI, 1, []byte{0x01, 0x02, 0x03, 0x04}, true)
 		assert.NoError(t, err)
 	})
 
@@ -566,7 +776,7 @@ func TestNetworkServer_SendUplink(t *testing.T) {
 
 		// Send multiple uplinks
 		for i := uint32(0); i < 5; i++ {
-			err := ns.SendUplink(devEUI)
+			err := ns.SendUplink(devEUI, 1, []byte{0x01, 0x02, 0x03, 0x04}, true)
 			assert.NoError(t, err)
 			assert.Equal(t, i+1, dev.FCntUp)
 		}
@@ -6,22 +6,25 @@ import (
 	"sort"
 	"sync"
 
-	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/eventbus"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
 )
 
 type Pool struct {
 	mu                sync.RWMutex
 	ns                map[string]*NetworkServer
-	broadcastUplink   chan lorawan.PHYPayload
-	broadcastDownlink chan lorawan.PHYPayload
+	broadcastUplink   chan radio.Uplink
+	broadcastDownlink chan radio.Downlink
+	events            *eventbus.Bus
 }
 
 func NewPool() *Pool {
 	p := &Pool{
 		ns:                make(map[string]*NetworkServer),
-		broadcastUplink:   make(chan lorawan.PHYPayload),
-		broadcastDownlink: make(chan lorawan.PHYPayload),
+		broadcastUplink:   make(chan radio.Uplink),
+		broadcastDownlink: make(chan radio.Downlink),
+		events:            eventbus.New(),
 	}
 
 	go p.broadcastUplinkWorker()
@@ -73,8 +76,10 @@ func (p *Pool) Add(name string, config integration.NetworkServerConfig) (*Networ
 	}
 
 	ns := New(name, config, p.broadcastUplink, p.broadcastDownlink)
+	ns.events = p.events
 	p.ns[name] = ns
 	p.mu.Unlock()
+	ns.publish(eventbus.Event{Source: eventbus.SourceNetworkServer, Type: EventNetworkServerAdded})
 
 	// Sync gateways and devices (synchronously, but outside the lock)
 	log.Printf("[%s] starting sync", name)
@@ -85,6 +90,7 @@ func (p *Pool) Add(name string, config integration.NetworkServerConfig) (*Networ
 		p.mu.Lock()
 		delete(p.ns, name)
 		p.mu.Unlock()
+		ns.publish(eventbus.Event{Source: eventbus.SourceNetworkServer, Type: EventNetworkServerRemoved})
 		return nil, err
 	}
 	log.Printf("[%s] sync completed", name)
@@ -113,11 +119,66 @@ func (p *Pool) Remove(name string) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if _, exists := p.ns[name]; !exists {
+	ns, exists := p.ns[name]
+	if !exists {
 		return errors.New("network server not found")
 	}
 
+	// Stop periodic uplinks and gateway connections before dropping the
+	// network server
+	ns.StopAllSchedules()
+	ns.DisconnectAllGateways()
+
 	delete(p.ns, name)
+	ns.publish(eventbus.Event{Source: eventbus.SourceNetworkServer, Type: EventNetworkServerRemoved})
 
 	return nil
 }
+
+// Subscribe returns a subscription to the events of the network servers,
+// their gateways and devices
+func (p *Pool) Subscribe(filter eventbus.Filter) *eventbus.Subscription {
+	return p.events.Subscribe(filter)
+}
+
+// Snapshot returns the state of the network servers to restore after a
+// restart, sorted by name
+func (p *Pool) Snapshot() []Snapshot {
+	servers := p.List()
+
+	snapshots := make([]Snapshot, 0, len(servers))
+	for _, ns := range servers {
+		snapshots = append(snapshots, ns.Snapshot())
+	}
+
+	return snapshots
+}
+
+// Restore adds the network servers of the snapshots, syncs them, then
+// restores their gateways and devices. Unlike Add, a network server whose LNS
+// is unreachable is kept so that its state is not lost.
+func (p *Pool) Restore(snapshots []Snapshot) {
+	for _, s := range snapshots {
+		p.mu.Lock()
+		if _, exists := p.ns[s.Name]; exists {
+			p.mu.Unlock()
+			log.Printf("[pool] network server %s already exists", s.Name)
+			continue
+		}
+
+		ns := New(s.Name, s.Config, p.broadcastUplink, p.broadcastDownlink)
+		ns.events = p.events
+		p.ns[s.Name] = ns
+		p.mu.Unlock()
+		ns.publish(eventbus.Event{Source: eventbus.SourceNetworkServer, Type: EventNetworkServerAdded})
+
+		// Synced first, so that the gateways are connected with the
+		// discovery URI of the LNS
+		if err := ns.Sync(); err != nil {
+			log.Printf("[%s] sync error: %v", s.Name, err)
+		}
+
+		log.Printf("[%s] restoring %d gateways and %d devices", s.Name, len(s.Gateways), len(s.Devices))
+		ns.Restore(s)
+	}
+}
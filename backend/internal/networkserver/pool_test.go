@@ -3,8 +3,13 @@ package networkserver
 import (
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/eventbus"
 	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -213,6 +218,135 @@ func TestPool_Remove(t *testing.T) {
 	})
 }
 
+func TestPool_Subscribe(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+
+	receive := func(t *testing.T, s *eventbus.Subscription) eventbus.Event {
+		select {
+		case event := <-s.C:
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("event not received")
+			return eventbus.Event{}
+		}
+	}
+
+	t.Run("publishes the network server and device events", func(t *testing.T) {
+		p := NewPool()
+		s := p.Subscribe(eventbus.Filter{NetworkServer: "test-server"})
+		defer s.Close()
+
+		ns, err := p.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		assert.NoError(t, err)
+		assert.Equal(t, EventNetworkServerAdded, receive(t, s).Type)
+		event := receive(t, s)
+		assert.Equal(t, EventSynced, event.Type)
+		assert.Equal(t, "0 gateways and 0 devices added", event.Message)
+
+		dev, err := ns.AddDevice(devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, devAddr, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+		assert.NoError(t, err)
+		event = receive(t, s)
+		assert.Equal(t, EventDeviceAdded, event.Type)
+		assert.Equal(t, devEUI, *event.DevEUI)
+
+		_, err = dev.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+		event = receive(t, s)
+		assert.Equal(t, eventbus.SourceDevice, event.Source)
+		assert.Equal(t, string(device.EventUplink), event.Type)
+		assert.Equal(t, "test-server", event.NetworkServer)
+		assert.Equal(t, devEUI, *event.DevEUI)
+		if assert.IsType(t, device.Event{}, event.Data) {
+			assert.Equal(t, "01", event.Data.(device.Event).Payload)
+		}
+
+		p.Remove("test-server")
+		assert.Equal(t, EventNetworkServerRemoved, receive(t, s).Type)
+	})
+
+	t.Run("filters by gateway", func(t *testing.T) {
+		p := NewPool()
+		gatewayEUI := lorawan.EUI64{0xaa}
+		s := p.Subscribe(eventbus.Filter{GatewayEUI: &gatewayEUI})
+		defer s.Close()
+
+		ns, _ := p.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+		ns.AddGateway(lorawan.EUI64{0xbb}, "ws://localhost:3001", nil, nil)
+		ns.AddGateway(gatewayEUI, "ws://localhost:3001", nil, nil)
+
+		event := receive(t, s)
+		assert.Equal(t, EventGatewayAdded, event.Type)
+		assert.Equal(t, gatewayEUI, *event.GatewayEUI)
+		assert.Empty(t, s.C)
+	})
+}
+
+func TestPool_BroadcastDownlink(t *testing.T) {
+	t.Run("each device decrypts its own copy of the downlink", func(t *testing.T) {
+		p := NewPool()
+		s := p.Subscribe(eventbus.Filter{})
+		defer s.Close()
+
+		// ABP devices of two network servers sharing their DevAddr and keys
+		devAddr := lorawan.DevAddr{0x26, 0x01, 0x1f, 0x00}
+		key := lorawan.AES128Key{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+		var devices []*device.Device
+		for i, name := range []string{"first-server", "second-server"} {
+			ns, err := p.Add(name, integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+			assert.NoError(t, err)
+			dev, err := ns.AddDevice(lorawan.EUI64{byte(i + 1)}, lorawan.EUI64{}, lorawan.AES128Key{}, 0, devAddr, key, key, 0, 0x10000, nil)
+			assert.NoError(t, err)
+			// Class C devices receive on RX2 at any time
+			assert.NoError(t, dev.SetClass(device.ClassC))
+			devices = append(devices, dev)
+		}
+
+		// FCnt 0x10005 of which the FHDR carries 0x0005
+		fPort := uint8(10)
+		phy := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{MType: lorawan.UnconfirmedDataDown, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.MACPayload{
+				FHDR:       lorawan.FHDR{DevAddr: devAddr, FCnt: 0x10005},
+				FPort:      &fPort,
+				FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte{0xaa, 0xbb}}},
+			},
+		}
+		assert.NoError(t, phy.EncryptFRMPayload(key))
+		assert.NoError(t, phy.SetDownlinkDataMIC(lorawan.LoRaWAN1_0, 0, key))
+		phy.MACPayload.(*lorawan.MACPayload).FHDR.FCnt = 0x0005
+
+		info := devices[0].GetInfo()
+		p.broadcastDownlink <- radio.Downlink{
+			PHYPayload: phy,
+			Region:     info.Region,
+			Frequency:  info.RX2Frequency,
+			DataRate:   info.RX2DataRate,
+			Time:       time.Now(),
+		}
+
+		received := 0
+		timeout := time.After(time.Second)
+		for received < len(devices) {
+			select {
+			case event := <-s.C:
+				if event.Type != string(device.EventDownlink) {
+					continue
+				}
+				received++
+				if assert.IsType(t, device.Event{}, event.Data) {
+					assert.Equal(t, "aabb", event.Data.(device.Event).Payload)
+				}
+			case <-timeout:
+				t.Fatalf("%d downlinks received", received)
+			}
+		}
+		for _, dev := range devices {
+			assert.Equal(t, uint32(0x10006), dev.GetInfo().FCntDn)
+		}
+	})
+}
+
 func TestPool_Concurrency(t *testing.T) {
 	t.Run("concurrent adds are safe", func(t *testing.T) {
 		p := NewPool()
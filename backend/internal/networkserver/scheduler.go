@@ -0,0 +1,319 @@
+package networkserver
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
+	"github.com/robfig/cron/v3"
+)
+
+type ScheduleType string
+
+const (
+	ScheduleTypeInterval ScheduleType = "interval" // fixed interval
+	ScheduleTypeJitter   ScheduleType = "jitter"   // interval +/- random jitter
+	ScheduleTypeCron     ScheduleType = "cron"     // cron-like expression
+)
+
+// ScheduleConfig describes when and what a device sends periodically
+type ScheduleConfig struct {
+	Type     ScheduleType  `json:"type"`
+	Interval time.Duration `json:"interval,omitempty"`
+	Jitter   time.Duration `json:"jitter,omitempty"`
+	Cron     string        `json:"cron,omitempty"`
+
+	FPort     uint8  `json:"fport"`
+	Payload   []byte `json:"payload"`
+	Confirmed bool   `json:"confirmed"`
+}
+
+type ScheduleStatus struct {
+	DevEUI      lorawan.EUI64 `json:"deveui"`
+	Running     bool          `json:"running"`
+	Type        ScheduleType  `json:"type,omitempty"`
+	Interval    string        `json:"interval,omitempty"`
+	Jitter      string        `json:"jitter,omitempty"`
+	Cron        string        `json:"cron,omitempty"`
+	FPort       uint8         `json:"fport"`
+	Payload     string        `json:"payload"`
+	Confirmed   bool          `json:"confirmed"`
+	NextRun     *time.Time    `json:"nextRun,omitempty"`
+	LastRun     *time.Time    `json:"lastRun,omitempty"`
+	UplinkCount uint64        `json:"uplinkCount"`
+	LastError   string        `json:"lastError,omitempty"`
+}
+
+type scheduleEntry struct {
+	config    ScheduleConfig
+	cron      cron.Schedule
+	nextRun   time.Time
+	lastRun   time.Time
+	count     uint64
+	lastError string
+}
+
+// next computes the next run after the given time
+func (e *scheduleEntry) next(after time.Time) time.Time {
+	switch e.config.Type {
+	case ScheduleTypeJitter:
+		// Uniformly distributed in [interval-jitter, interval+jitter]
+		offset := time.Duration(rand.Int63n(int64(2*e.config.Jitter)+1)) - e.config.Jitter
+		return after.Add(e.config.Interval + offset)
+	case ScheduleTypeCron:
+		return e.cron.Next(after)
+	default:
+		return after.Add(e.config.Interval)
+	}
+}
+
+// scheduler sends periodic uplinks for the devices of a network server.
+// A single goroutine serves all schedules and exits when none is left.
+type scheduler struct {
+	mu      sync.Mutex
+	entries map[lorawan.EUI64]*scheduleEntry
+	running bool
+	wakeup  chan struct{}
+	send    func(DevEUI lorawan.EUI64, fPort uint8, payload []byte, confirmed bool) error
+}
+
+func newScheduler(send func(DevEUI lorawan.EUI64, fPort uint8, payload []byte, confirmed bool) error) *scheduler {
+	return &scheduler{
+		entries: make(map[lorawan.EUI64]*scheduleEntry),
+		wakeup:  make(chan struct{}, 1),
+		send:    send,
+	}
+}
+
+// ValidateSchedule checks a schedule config, without the payload size which
+// depends on the data rate of the device
+func ValidateSchedule(config ScheduleConfig) error {
+	_, err := validateSchedule(config)
+	return err
+}
+
+// validateSchedule checks the schedule config and parses the cron expression
+func validateSchedule(config ScheduleConfig) (cron.Schedule, error) {
+	var schedule cron.Schedule
+	switch config.Type {
+	case ScheduleTypeInterval:
+		if config.Interval <= 0 {
+			return nil, errors.New("interval must be positive")
+		}
+	case ScheduleTypeJitter:
+		if config.Interval <= 0 {
+			return nil, errors.New("interval must be positive")
+		}
+		if config.Jitter <= 0 || config.Jitter >= config.Interval {
+			return nil, errors.New("jitter must be positive and lower than interval")
+		}
+	case ScheduleTypeCron:
+		var err error
+		schedule, err = cron.ParseStandard(config.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported schedule type %q", config.Type)
+	}
+
+	// FPort 0 is reserved for MAC commands
+	if config.FPort == 0 || config.FPort > device.MaxFPort {
+		return nil, fmt.Errorf("invalid FPort %d", config.FPort)
+	}
+
+	return schedule, nil
+}
+
+func (s *scheduler) start(DevEUI lorawan.EUI64, config ScheduleConfig) error {
+	cronSchedule, err := validateSchedule(config)
+	if err != nil {
+		return err
+	}
+
+	entry := &scheduleEntry{
+		config: config,
+		cron:   cronSchedule,
+	}
+	entry.nextRun = entry.next(time.Now())
+
+	s.mu.Lock()
+	// Starting an already scheduled device replaces its schedule
+	s.entries[DevEUI] = entry
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	s.mu.Unlock()
+
+	s.notify()
+
+	return nil
+}
+
+func (s *scheduler) stop(DevEUI lorawan.EUI64) error {
+	s.mu.Lock()
+	if _, exists := s.entries[DevEUI]; !exists {
+		s.mu.Unlock()
+		return errors.New("schedule not running")
+	}
+	delete(s.entries, DevEUI)
+	s.mu.Unlock()
+
+	s.notify()
+
+	return nil
+}
+
+func (s *scheduler) stopAll() {
+	s.mu.Lock()
+	s.entries = make(map[lorawan.EUI64]*scheduleEntry)
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+// configs returns the configuration of the running schedules
+func (s *scheduler) configs() map[lorawan.EUI64]ScheduleConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	configs := make(map[lorawan.EUI64]ScheduleConfig, len(s.entries))
+	for DevEUI, entry := range s.entries {
+		configs[DevEUI] = entry.config
+	}
+
+	return configs
+}
+
+func (s *scheduler) status(DevEUI lorawan.EUI64) ScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.entries[DevEUI]
+	if !exists {
+		return ScheduleStatus{DevEUI: DevEUI}
+	}
+
+	status := ScheduleStatus{
+		DevEUI:      DevEUI,
+		Running:     true,
+		Type:        entry.config.Type,
+		Cron:        entry.config.Cron,
+		FPort:       entry.config.FPort,
+		Payload:     hex.EncodeToString(entry.config.Payload),
+		Confirmed:   entry.config.Confirmed,
+		UplinkCount: entry.count,
+		LastError:   entry.lastError,
+	}
+	if entry.config.Interval > 0 {
+		status.Interval = entry.config.Interval.String()
+	}
+	if entry.config.Jitter > 0 {
+		status.Jitter = entry.config.Jitter.String()
+	}
+	nextRun := entry.nextRun
+	status.NextRun = &nextRun
+	if !entry.lastRun.IsZero() {
+		lastRun := entry.lastRun
+		status.LastRun = &lastRun
+	}
+
+	return status
+}
+
+// notify wakes up the scheduler goroutine to recompute the next run
+func (s *scheduler) notify() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		// Find the earliest run, exit when there is nothing left to do
+		s.mu.Lock()
+		if len(s.entries) == 0 {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		var earliest time.Time
+		for _, entry := range s.entries {
+			if earliest.IsZero() || entry.nextRun.Before(earliest) {
+				earliest = entry.nextRun
+			}
+		}
+		s.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(earliest))
+
+		select {
+		case <-s.wakeup:
+			continue
+		case <-timer.C:
+		}
+
+		// Collect due schedules
+		type dueUplink struct {
+			DevEUI lorawan.EUI64
+			entry  *scheduleEntry
+			config ScheduleConfig
+		}
+		var due []dueUplink
+		now := time.Now()
+		s.mu.Lock()
+		for DevEUI, entry := range s.entries {
+			if entry.nextRun.After(now) {
+				continue
+			}
+			due = append(due, dueUplink{DevEUI: DevEUI, entry: entry, config: entry.config})
+			entry.lastRun = now
+			entry.nextRun = entry.next(now)
+		}
+		s.mu.Unlock()
+
+		// Send outside the lock
+		for _, d := range due {
+			// Skip schedules stopped or replaced since they were collected
+			s.mu.Lock()
+			current := s.entries[d.DevEUI] == d.entry
+			s.mu.Unlock()
+			if !current {
+				continue
+			}
+
+			err := s.send(d.DevEUI, d.config.FPort, d.config.Payload, d.config.Confirmed)
+			if err != nil {
+				log.Printf("[%s] scheduled uplink error: %v", d.DevEUI, err)
+			}
+
+			s.mu.Lock()
+			if entry := s.entries[d.DevEUI]; entry == d.entry {
+				if err != nil {
+					entry.lastError = err.Error()
+				} else {
+					entry.count++
+					entry.lastError = ""
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package networkserver
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to create a network server with a joined device
+func newTestNetworkServerWithDevice(devEUI lorawan.EUI64) *NetworkServer {
+	ns := newTestNetworkServer("test-server")
+	joinEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	appKey := lorawan.AES128Key{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	ns.AddDevice(devEUI, joinEUI, appKey, 0, devAddr, appKey, appKey, 0, 0, nil)
+	return ns
+}
+
+func TestValidateSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ScheduleConfig
+		wantErr string
+	}{
+		{"valid interval", ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Minute, FPort: 1}, ""},
+		{"zero interval", ScheduleConfig{Type: ScheduleTypeInterval}, "interval must be positive"},
+		{"valid jitter", ScheduleConfig{Type: ScheduleTypeJitter, Interval: time.Minute, Jitter: 10 * time.Second, FPort: 1}, ""},
+		{"jitter larger than interval", ScheduleConfig{Type: ScheduleTypeJitter, Interval: time.Minute, Jitter: 2 * time.Minute}, "jitter must be positive"},
+		{"missing jitter", ScheduleConfig{Type: ScheduleTypeJitter, Interval: time.Minute}, "jitter must be positive"},
+		{"valid cron", ScheduleConfig{Type: ScheduleTypeCron, Cron: "*/5 * * * *", FPort: 1}, ""},
+		{"valid cron descriptor", ScheduleConfig{Type: ScheduleTypeCron, Cron: "@every 30s", FPort: 1}, ""},
+		{"invalid cron", ScheduleConfig{Type: ScheduleTypeCron, Cron: "not a cron"}, "invalid cron expression"},
+		{"unsupported type", ScheduleConfig{Type: "random"}, "unsupported schedule type"},
+		{"MAC commands FPort", ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Minute}, "invalid FPort 0"},
+		{"FPort above 224", ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Minute, FPort: 225}, "invalid FPort 225"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateSchedule(tt.config)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScheduleEntry_Next(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("interval", func(t *testing.T) {
+		entry := &scheduleEntry{config: ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Minute}}
+		assert.Equal(t, now.Add(time.Minute), entry.next(now))
+	})
+
+	t.Run("jitter stays within bounds", func(t *testing.T) {
+		entry := &scheduleEntry{config: ScheduleConfig{Type: ScheduleTypeJitter, Interval: time.Minute, Jitter: 10 * time.Second}}
+		for i := 0; i < 100; i++ {
+			next := entry.next(now)
+			assert.False(t, next.Before(now.Add(50*time.Second)))
+			assert.False(t, next.After(now.Add(70*time.Second)))
+		}
+	})
+
+	t.Run("cron", func(t *testing.T) {
+		schedule, err := validateSchedule(ScheduleConfig{Type: ScheduleTypeCron, Cron: "*/15 * * * *", FPort: 1})
+		assert.NoError(t, err)
+		entry := &scheduleEntry{config: ScheduleConfig{Type: ScheduleTypeCron}, cron: schedule}
+		assert.Equal(t, now.Add(15*time.Minute), entry.next(now))
+	})
+}
+
+func TestScheduler_StopWhenDue(t *testing.T) {
+	devEUI1 := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	devEUI2 := lorawan.EUI64{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}
+
+	// Both schedules are due at once, the first uplink sent stops the other one
+	var s *scheduler
+	sent := make(chan lorawan.EUI64, 2)
+	s = newScheduler(func(DevEUI lorawan.EUI64, fPort uint8, payload []byte, confirmed bool) error {
+		sent <- DevEUI
+		if DevEUI == devEUI1 {
+			s.stop(devEUI2)
+		} else {
+			s.stop(devEUI1)
+		}
+		return nil
+	})
+
+	now := time.Now()
+	config := ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Hour, FPort: 1}
+	s.mu.Lock()
+	s.entries[devEUI1] = &scheduleEntry{config: config, nextRun: now}
+	s.entries[devEUI2] = &scheduleEntry{config: config, nextRun: now}
+	s.running = true
+	go s.run()
+	s.mu.Unlock()
+	defer s.stopAll()
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("no uplink sent")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, sent)
+}
+
+func TestNetworkServer_Schedule(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+
+	t.Run("sends periodic uplinks", func(t *testing.T) {
+		ns := newTestNetworkServerWithDevice(devEUI)
+		dev, _ := ns.GetDevice(devEUI)
+
+		err := ns.StartSchedule(devEUI, ScheduleConfig{
+			Type:      ScheduleTypeInterval,
+			Interval:  20 * time.Millisecond,
+			FPort:     10,
+			Payload:   []byte{0xaa},
+			Confirmed: false,
+		})
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			return dev.GetInfo().FCntUp >= 3
+		}, time.Second, 10*time.Millisecond)
+
+		status, err := ns.GetSchedule(devEUI)
+		assert.NoError(t, err)
+		assert.True(t, status.Running)
+		assert.Equal(t, ScheduleTypeInterval, status.Type)
+		assert.Equal(t, "20ms", status.Interval)
+		assert.Equal(t, uint8(10), status.FPort)
+		assert.Equal(t, "aa", status.Payload)
+		assert.NotNil(t, status.NextRun)
+		assert.NotNil(t, status.LastRun)
+		assert.GreaterOrEqual(t, status.UplinkCount, uint64(3))
+
+		assert.NoError(t, ns.StopSchedule(devEUI))
+	})
+
+	t.Run("stop halts uplinks", func(t *testing.T) {
+		ns := newTestNetworkServerWithDevice(devEUI)
+		dev, _ := ns.GetDevice(devEUI)
+
+		assert.NoError(t, ns.StartSchedule(devEUI, ScheduleConfig{Type: ScheduleTypeInterval, Interval: 10 * time.Millisecond, FPort: 1}))
+		assert.Eventually(t, func() bool {
+			return dev.GetInfo().FCntUp >= 1
+		}, time.Second, 5*time.Millisecond)
+
+		assert.NoError(t, ns.StopSchedule(devEUI))
+		// Let an in-flight uplink settle
+		time.Sleep(20 * time.Millisecond)
+		fCnt := dev.GetInfo().FCntUp
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, fCnt, dev.GetInfo().FCntUp)
+
+		status, err := ns.GetSchedule(devEUI)
+		assert.NoError(t, err)
+		assert.False(t, status.Running)
+	})
+
+	t.Run("stop without schedule returns error", func(t *testing.T) {
+		ns := newTestNetworkServerWithDevice(devEUI)
+
+		err := ns.StopSchedule(devEUI)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "schedule not running")
+	})
+
+	t.Run("start replaces existing schedule", func(t *testing.T) {
+		ns := newTestNetworkServerWithDevice(devEUI)
+
+		assert.NoError(t, ns.StartSchedule(devEUI, ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Hour, FPort: 1}))
+		assert.NoError(t, ns.StartSchedule(devEUI, ScheduleConfig{Type: ScheduleTypeCron, Cron: "@hourly", FPort: 1}))
+
+		status, err := ns.GetSchedule(devEUI)
+		assert.NoError(t, err)
+		assert.Equal(t, ScheduleTypeCron, status.Type)
+		assert.Equal(t, "@hourly", status.Cron)
+
+		assert.NoError(t, ns.StopSchedule(devEUI))
+	})
+
+	t.Run("invalid config is rejected", func(t *testing.T) {
+		ns := newTestNetworkServerWithDevice(devEUI)
+
+		err := ns.StartSchedule(devEUI, ScheduleConfig{Type: ScheduleTypeInterval})
+		assert.Error(t, err)
+
+		status, _ := ns.GetSchedule(devEUI)
+		assert.False(t, status.Running)
+	})
+
+	t.Run("returns error for non-existing device", func(t *testing.T) {
+		ns := newTestNetworkServer("test-server")
+
+		err := ns.StartSchedule(devEUI, ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Minute})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "device not found")
+
+		_, err = ns.GetSchedule(devEUI)
+		assert.Error(t, err)
+
+		err = ns.StopSchedule(devEUI)
+		assert.Error(t, err)
+	})
+
+	t.Run("removing device stops its schedule", func(t *testing.T) {
+		ns := newTestNetworkServerWithDevice(devEUI)
+
+		assert.NoError(t, ns.StartSchedule(devEUI, ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Hour, FPort: 1}))
+		assert.NoError(t, ns.RemoveDevice(devEUI))
+
+		assert.Equal(t, false, ns.scheduler.status(devEUI).Running)
+	})
+
+	t.Run("rejects invalid FPort", func(t *testing.T) {
+		ns := newTestNetworkServerWithDevice(devEUI)
+
+		err := ns.StartSchedule(devEUI, ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Minute, FPort: 230, Payload: []byte{0x01}})
+		assert.EqualError(t, err, "invalid FPort 230")
+
+		status, _ := ns.GetSchedule(devEUI)
+		assert.False(t, status.Running)
+	})
+
+	t.Run("rejects payload too large for the data rate", func(t *testing.T) {
+		ns := newTestNetworkServerWithDevice(devEUI)
+		dev, _ := ns.GetDevice(devEUI)
+		maxSize, err := dev.MaxPayloadSize()
+		assert.NoError(t, err)
+
+		err = ns.StartSchedule(devEUI, ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Minute, FPort: 1, Payload: make([]byte, maxSize+1)})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "payload too large")
+
+		assert.NoError(t, ns.StartSchedule(devEUI, ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Hour, FPort: 1, Payload: make([]byte, maxSize)}))
+		assert.NoError(t, ns.StopSchedule(devEUI))
+	})
+
+	t.Run("records last error", func(t *testing.T) {
+		ns := newTestNetworkServer("test-server")
+		appKey := lorawan.AES128Key{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+		// The uplink frame counter is exhausted until the device joins again
+		_, err := ns.AddDevice(devEUI, lorawan.EUI64{}, appKey, 0, lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}, appKey, appKey, math.MaxUint32, 0, nil)
+		assert.NoError(t, err)
+
+		assert.NoError(t, ns.StartSchedule(devEUI, ScheduleConfig{Type: ScheduleTypeInterval, Interval: 10 * time.Millisecond, FPort: 1, Payload: []byte{0x01}}))
+		assert.Eventually(t, func() bool {
+			status, _ := ns.GetSchedule(devEUI)
+			return status.LastError != ""
+		}, time.Second, 5*time.Millisecond)
+
+		status, _ := ns.GetSchedule(devEUI)
+		assert.Equal(t, "uplink frame counter exhausted", status.LastError)
+		assert.Equal(t, uint64(0), status.UplinkCount)
+
+		assert.NoError(t, ns.StopSchedule(devEUI))
+	})
+}
@@ -0,0 +1,105 @@
+package networkserver
+
+import (
+	"log"
+	"sort"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/gateway"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/propagation"
+)
+
+// Snapshot is the state of a network server kept across restarts of the
+// simulator, with its gateways, devices and periodic uplinks
+type Snapshot struct {
+	Name        string                           `json:"name"`
+	Config      integration.NetworkServerConfig  `json:"config"`
+	Propagation propagation.Config               `json:"propagation"`
+	Gateways    []gateway.Snapshot               `json:"gateways"`
+	Devices     []device.Snapshot                `json:"devices"`
+	Schedules   map[lorawan.EUI64]ScheduleConfig `json:"schedules,omitempty"`
+}
+
+// Snapshot returns the state of the network server to restore after a
+// restart, gateways and devices are sorted by EUI
+func (ns *NetworkServer) Snapshot() Snapshot {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	s := Snapshot{
+		Name:        ns.name,
+		Config:      ns.config,
+		Propagation: ns.propagation.Config(),
+		Gateways:    make([]gateway.Snapshot, 0, len(ns.gateways)),
+		Devices:     make([]device.Snapshot, 0, len(ns.devices)),
+		Schedules:   ns.scheduler.configs(),
+	}
+	for _, gw := range ns.gateways {
+		s.Gateways = append(s.Gateways, gw.Snapshot())
+	}
+	for _, dev := range ns.devices {
+		s.Devices = append(s.Devices, dev.Snapshot())
+	}
+
+	sort.Slice(s.Gateways, func(i, j int) bool {
+		return s.Gateways[i].EUI.String() < s.Gateways[j].EUI.String()
+	})
+	sort.Slice(s.Devices, func(i, j int) bool {
+		return s.Devices[i].DevEUI.String() < s.Devices[j].DevEUI.String()
+	})
+
+	return s
+}
+
+// Restore adds the gateways and devices of a snapshot, or restores the ones
+// already synced from the LNS, keeping the discovery URI of the LNS. It then
+// reconnects the gateways that were connected and restarts the periodic
+// uplinks. Entities failing to restore are skipped.
+func (ns *NetworkServer) Restore(s Snapshot) {
+	if err := ns.SetPropagation(s.Propagation); err != nil {
+		log.Printf("[%s] unable to restore propagation: %v", ns.name, err)
+	}
+
+	for _, gwSnapshot := range s.Gateways {
+		gw, err := ns.GetGateway(gwSnapshot.EUI)
+		if err != nil {
+			gw, err = ns.AddGateway(gwSnapshot.EUI, gwSnapshot.DiscoveryURI, gwSnapshot.Location, gwSnapshot.Headers)
+		}
+		if err == nil {
+			err = gw.Restore(gwSnapshot)
+		}
+		if err != nil {
+			log.Printf("[%s] unable to restore gateway %s: %v", ns.name, gwSnapshot.EUI, err)
+			continue
+		}
+
+		if gwSnapshot.Connected {
+			go func(gw *gateway.Gateway, eui lorawan.EUI64) {
+				if err := gw.Connect(); err != nil {
+					log.Printf("[%s] unable to reconnect gateway %s: %v", ns.name, eui, err)
+				}
+			}(gw, gwSnapshot.EUI)
+		}
+	}
+
+	for _, devSnapshot := range s.Devices {
+		dev, err := ns.GetDevice(devSnapshot.DevEUI)
+		if err != nil {
+			dev, err = ns.AddDevice(devSnapshot.DevEUI, devSnapshot.JoinEUI, devSnapshot.AppKey, devSnapshot.DevNonce, devSnapshot.DevAddr, devSnapshot.AppSKey, devSnapshot.NwkSKey, devSnapshot.FCntUp, devSnapshot.FCntDn, devSnapshot.Location)
+		}
+		if err == nil {
+			err = dev.Restore(devSnapshot)
+		}
+		if err != nil {
+			log.Printf("[%s] unable to restore device %s: %v", ns.name, devSnapshot.DevEUI, err)
+		}
+	}
+
+	for DevEUI, config := range s.Schedules {
+		if err := ns.StartSchedule(DevEUI, config); err != nil {
+			log.Printf("[%s] unable to restore schedule of device %s: %v", ns.name, DevEUI, err)
+		}
+	}
+}
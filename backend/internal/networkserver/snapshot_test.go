@@ -0,0 +1,156 @@
+package networkserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/gateway"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/propagation"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool_Restore(t *testing.T) {
+	gatewayEUI := lorawan.EUI64{0xaa, 0, 0, 0, 0, 0, 0, 0x01}
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	config := integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric}
+
+	// snapshot round-trips the state of a pool through JSON, as a store does
+	snapshot := func(t *testing.T, p *Pool) []Snapshot {
+		data, err := json.Marshal(p.Snapshot())
+		assert.NoError(t, err)
+		var snapshots []Snapshot
+		assert.NoError(t, json.Unmarshal(data, &snapshots))
+		return snapshots
+	}
+
+	t.Run("restores network servers, gateways and devices", func(t *testing.T) {
+		p := NewPool()
+		ns, err := p.Add("test-server", config)
+		assert.NoError(t, err)
+		assert.NoError(t, ns.SetPropagation(propagation.Config{Model: propagation.FreeSpace}))
+
+		gw, err := ns.AddGateway(gatewayEUI, "udp.example.com:1700", &gateway.Location{Latitude: 45.1, Longitude: 7.6}, nil)
+		assert.NoError(t, err)
+		us915, err := region.Get(region.US915)
+		assert.NoError(t, err)
+		gw.SetRegion(us915)
+		assert.NoError(t, gw.SetProtocol(gateway.ProtocolSemtechUDP))
+		assert.NoError(t, gw.SetTxFailureRate(0.25))
+
+		dev, err := ns.AddDevice(devEUI, lorawan.EUI64{0x10}, lorawan.AES128Key{0x20}, 42, devAddr, lorawan.AES128Key{0x30}, lorawan.AES128Key{0x40}, 7, 3, &device.Location{Latitude: 45.2, Longitude: 7.7})
+		assert.NoError(t, err)
+		assert.NoError(t, dev.SetRegion(us915, 1))
+		assert.NoError(t, dev.SetClass(device.ClassC))
+		assert.NoError(t, dev.SetTxPower(20))
+		dev.SetADR(true)
+		_, err = dev.Uplink(1, []byte{0x01}, false)
+		assert.NoError(t, err)
+
+		assert.NoError(t, ns.StartSchedule(devEUI, ScheduleConfig{Type: ScheduleTypeInterval, Interval: time.Hour, FPort: 2, Payload: []byte{0xff}}))
+		defer ns.StopAllSchedules()
+
+		restored := NewPool()
+		restored.Restore(snapshot(t, p))
+
+		restoredNS, err := restored.Get("test-server")
+		assert.NoError(t, err)
+		defer restoredNS.StopAllSchedules()
+		assert.Equal(t, config, restoredNS.GetInfo().Config)
+		assert.Equal(t, propagation.FreeSpace, restoredNS.GetPropagation().Model)
+
+		restoredGw, err := restoredNS.GetGateway(gatewayEUI)
+		assert.NoError(t, err)
+		gwInfo := restoredGw.GetInfo()
+		assert.Equal(t, "udp.example.com:1700", gwInfo.DiscoveryURI)
+		assert.Equal(t, gateway.ProtocolSemtechUDP, gwInfo.Protocol)
+		assert.Equal(t, region.US915, gwInfo.Region)
+		assert.Equal(t, 0.25, gwInfo.TxFailureRate)
+		assert.Equal(t, &gateway.Location{Latitude: 45.1, Longitude: 7.6}, gwInfo.Location)
+
+		restoredDev, err := restoredNS.GetDevice(devEUI)
+		assert.NoError(t, err)
+		assert.Equal(t, dev.Snapshot(), restoredDev.Snapshot())
+		devInfo := restoredDev.GetInfo()
+		assert.Equal(t, lorawan.DevNonce(42), devInfo.DevNonce)
+		assert.Equal(t, uint32(8), devInfo.FCntUp)
+		assert.Equal(t, device.ClassC, devInfo.Class)
+
+		schedule, err := restoredNS.GetSchedule(devEUI)
+		assert.NoError(t, err)
+		assert.True(t, schedule.Running)
+		assert.Equal(t, "1h0m0s", schedule.Interval)
+		assert.Equal(t, "ff", schedule.Payload)
+	})
+
+	t.Run("restores the session of a LoRaWAN 1.1 device", func(t *testing.T) {
+		p := NewPool()
+		ns, err := p.Add("test-server", config)
+		assert.NoError(t, err)
+		dev, err := ns.AddDevice(devEUI, lorawan.EUI64{}, lorawan.AES128Key{0x20}, 5, devAddr, lorawan.AES128Key{0x30}, lorawan.AES128Key{0x40}, 0, 0, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, dev.SetMACVersion(device.MACVersion1_1, device.LoRaWAN11Keys{
+			NwkKey:      lorawan.AES128Key{0x50},
+			SNwkSIntKey: lorawan.AES128Key{0x60},
+			NwkSEncKey:  lorawan.AES128Key{0x70},
+		}))
+
+		restored := NewPool()
+		restored.Restore(snapshot(t, p))
+
+		restoredNS, err := restored.Get("test-server")
+		assert.NoError(t, err)
+		restoredDev, err := restoredNS.GetDevice(devEUI)
+		assert.NoError(t, err)
+		assert.Equal(t, dev.Snapshot(), restoredDev.Snapshot())
+	})
+
+	t.Run("restores the gateways synced from the LNS", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/1/nwk/status":
+				w.Write([]byte(`{"basicsStationUrl": "wss://lns.example.com", "basicsStationDiscoveryPort": 6001}`))
+			case "/1/nwk/gateways":
+				w.Write([]byte(`{"gateways": [{"EUI": "AA00000000000001", "base": "basics-station"}], "total": 1}`))
+			default:
+				w.Write([]byte(`{"total": 0}`))
+			}
+		}))
+		defer server.Close()
+
+		loriot := integration.NetworkServerConfig{Type: integration.NetworkServerTypeLORIOT, URL: server.URL, AuthHeader: "Bearer key"}
+		p := NewPool()
+		p.Restore([]Snapshot{{
+			Name:     "test-server",
+			Config:   loriot,
+			Gateways: []gateway.Snapshot{{EUI: gatewayEUI, Protocol: gateway.ProtocolBasicsStation, DiscoveryURI: "wss://old.example.com:6001", TxFailureRate: 0.5}},
+		}})
+
+		ns, err := p.Get("test-server")
+		assert.NoError(t, err)
+		gw, err := ns.GetGateway(gatewayEUI)
+		assert.NoError(t, err)
+		info := gw.GetInfo()
+		assert.Equal(t, "wss://lns.example.com:6001", info.DiscoveryURI)
+		assert.Equal(t, 0.5, info.TxFailureRate)
+	})
+
+	t.Run("keeps a network server already in the pool", func(t *testing.T) {
+		p := NewPool()
+		_, err := p.Add("test-server", config)
+		assert.NoError(t, err)
+
+		p.Restore([]Snapshot{{Name: "test-server", Config: config, Devices: []device.Snapshot{{DevEUI: devEUI}}}})
+
+		ns, err := p.Get("test-server")
+		assert.NoError(t, err)
+		assert.Empty(t, ns.ListDevices())
+	})
+}
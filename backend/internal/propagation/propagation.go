@@ -0,0 +1,275 @@
+package propagation
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/brocaar/lorawan/band"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+)
+
+// ModelName identifies a path loss model
+type ModelName string
+
+const (
+	FreeSpace   ModelName = "free-space"
+	OkumuraHata ModelName = "okumura-hata"
+	LogDistance ModelName = "log-distance"
+)
+
+// Environment is the terrain of the Okumura-Hata model
+type Environment string
+
+const (
+	Urban    Environment = "urban"
+	Suburban Environment = "suburban"
+	Rural    Environment = "rural"
+)
+
+// Default model parameters
+const (
+	DefaultGatewayHeight     = 30  // m
+	DefaultDeviceHeight      = 1.5 // m
+	DefaultExponent          = 2.7
+	DefaultReferenceDistance = 1 // m
+)
+
+const (
+	earthRadius = 6371000 // m
+
+	// noiseFigure of the gateway and device receivers in dB
+	noiseFigure = 6
+
+	// maxSNR is the highest SNR reported by the gateway, as the demodulator
+	// saturates close to the transmitter
+	maxSNR = 13.5
+)
+
+// Config selects a path loss model and its parameters, zero values select
+// the defaults
+type Config struct {
+	Model ModelName `json:"model"`
+
+	// Okumura-Hata
+	Environment   Environment `json:"environment,omitempty"`
+	GatewayHeight float64     `json:"gatewayHeight,omitempty"` // m
+	DeviceHeight  float64     `json:"deviceHeight,omitempty"`  // m
+
+	// Log-distance
+	Exponent          float64 `json:"exponent,omitempty"`
+	ReferenceDistance float64 `json:"referenceDistance,omitempty"` // m
+	Shadowing         float64 `json:"shadowing,omitempty"`         // dB, standard deviation
+}
+
+// Model computes the path loss between a device and a gateway
+type Model interface {
+	// PathLoss returns the loss in dB at the given distance (m) and
+	// frequency (Hz)
+	PathLoss(distance float64, frequency uint32) float64
+
+	// Config returns the configuration of the model, defaults included
+	Config() Config
+}
+
+// DefaultConfig is the model of network servers created without one
+var DefaultConfig = Config{Model: FreeSpace}
+
+// New returns the path loss model of the configuration
+func New(config Config) (Model, error) {
+	switch config.Model {
+	case "", FreeSpace:
+		return freeSpace{}, nil
+
+	case OkumuraHata:
+		m := okumuraHata{
+			environment:   config.Environment,
+			gatewayHeight: config.GatewayHeight,
+			deviceHeight:  config.DeviceHeight,
+		}
+		switch m.environment {
+		case "":
+			m.environment = Urban
+		case Urban, Suburban, Rural:
+		default:
+			return nil, fmt.Errorf("unsupported environment %q", config.Environment)
+		}
+		if m.gatewayHeight == 0 {
+			m.gatewayHeight = DefaultGatewayHeight
+		}
+		if m.deviceHeight == 0 {
+			m.deviceHeight = DefaultDeviceHeight
+		}
+		if m.gatewayHeight < 0 || m.deviceHeight < 0 {
+			return nil, errors.New("antenna heights must be positive")
+		}
+		return m, nil
+
+	case LogDistance:
+		m := logDistance{
+			exponent:          config.Exponent,
+			referenceDistance: config.ReferenceDistance,
+			shadowing:         config.Shadowing,
+		}
+		if m.exponent == 0 {
+			m.exponent = DefaultExponent
+		}
+		if m.referenceDistance == 0 {
+			m.referenceDistance = DefaultReferenceDistance
+		}
+		if m.exponent < 0 || m.referenceDistance < 0 || m.shadowing < 0 {
+			return nil, errors.New("log-distance parameters must be positive")
+		}
+		return m, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported propagation model %q", config.Model)
+	}
+}
+
+// freeSpace is the Friis free space path loss
+type freeSpace struct{}
+
+func (freeSpace) PathLoss(distance float64, frequency uint32) float64 {
+	return freeSpacePathLoss(distance, frequency)
+}
+
+func (freeSpace) Config() Config {
+	return Config{Model: FreeSpace}
+}
+
+func freeSpacePathLoss(distance float64, frequency uint32) float64 {
+	// The far field starts roughly one meter away from the antenna
+	distance = math.Max(distance, 1)
+
+	return 20*math.Log10(distance) + 20*math.Log10(float64(frequency)) - 147.55
+}
+
+// okumuraHata is the Hata model of the Okumura measurements, defined for
+// 150-1500 MHz and 1-20 km. Closer than that it never returns less than the
+// free space loss.
+type okumuraHata struct {
+	environment   Environment
+	gatewayHeight float64
+	deviceHeight  float64
+}
+
+func (m okumuraHata) PathLoss(distance float64, frequency uint32) float64 {
+	f := float64(frequency) / 1e6
+	d := math.Max(distance, 1) / 1000
+	hb := math.Max(m.gatewayHeight, 1)
+	hm := m.deviceHeight
+
+	// Small and medium city mobile antenna correction
+	a := (1.1*math.Log10(f)-0.7)*hm - (1.56*math.Log10(f) - 0.8)
+	loss := 69.55 + 26.16*math.Log10(f) - 13.82*math.Log10(hb) - a + (44.9-6.55*math.Log10(hb))*math.Log10(d)
+
+	switch m.environment {
+	case Suburban:
+		loss -= 2*math.Pow(math.Log10(f/28), 2) + 5.4
+	case Rural:
+		loss -= 4.78*math.Pow(math.Log10(f), 2) - 18.33*math.Log10(f) + 40.94
+	}
+
+	return math.Max(loss, freeSpacePathLoss(distance, frequency))
+}
+
+func (m okumuraHata) Config() Config {
+	return Config{
+		Model:         OkumuraHata,
+		Environment:   m.environment,
+		GatewayHeight: m.gatewayHeight,
+		DeviceHeight:  m.deviceHeight,
+	}
+}
+
+// logDistance is the free space loss up to the reference distance, growing
+// with the given exponent beyond it, plus a log-normal shadowing
+type logDistance struct {
+	exponent          float64
+	referenceDistance float64
+	shadowing         float64
+}
+
+func (m logDistance) PathLoss(distance float64, frequency uint32) float64 {
+	loss := freeSpacePathLoss(math.Min(distance, m.referenceDistance), frequency)
+	if distance > m.referenceDistance {
+		loss += 10 * m.exponent * math.Log10(distance/m.referenceDistance)
+	}
+
+	return loss + rand.NormFloat64()*m.shadowing
+}
+
+func (m logDistance) Config() Config {
+	return Config{
+		Model:             LogDistance,
+		Exponent:          m.exponent,
+		ReferenceDistance: m.referenceDistance,
+		Shadowing:         m.shadowing,
+	}
+}
+
+// Distance returns the great-circle distance in meters between two locations
+func Distance(a, b radio.Location) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLon/2), 2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// Sensitivity returns the lowest SNR in dB at which a gateway demodulates
+// the given data rate, and the bandwidth in Hz of its noise
+func Sensitivity(dr region.DataRate) (snr float64, bandwidth float64) {
+	switch dr.Modulation {
+	case string(band.LoRaModulation):
+		// -7.5 dB at SF7, 2.5 dB less for each further spreading factor
+		return -7.5 - 2.5*float64(dr.SpreadFactor-7), float64(dr.Bandwidth) * 1000
+	case string(band.FSKModulation):
+		return 14, 2 * float64(dr.BitRate)
+	default:
+		// LR-FHSS, 488 Hz occupied channel width
+		return 4, 488
+	}
+}
+
+// Receive computes the signal of an uplink transmitted at the given
+// distance (m) from a gateway, ok is false when it is below the gateway
+// sensitivity
+func Receive(model Model, uplink radio.Uplink, distance float64) (signal radio.Signal, ok bool) {
+	return receive(model, uplink.Region, uplink.Frequency, uplink.DataRate, uplink.TxPower, distance)
+}
+
+// ReceiveDownlink computes the signal of a downlink transmitted at the given
+// distance (m) from a device, ok is false when it is below the device
+// sensitivity
+func ReceiveDownlink(model Model, downlink radio.Downlink, distance float64) (signal radio.Signal, ok bool) {
+	return receive(model, downlink.Region, downlink.Frequency, downlink.DataRate, downlink.TxPower, distance)
+}
+
+func receive(model Model, name region.Name, frequency uint32, dataRate int, txPower float64, distance float64) (radio.Signal, bool) {
+	r, err := region.Get(name)
+	if err != nil {
+		return radio.Signal{}, false
+	}
+	dr, err := r.DataRate(dataRate)
+	if err != nil {
+		return radio.Signal{}, false
+	}
+
+	minSNR, bandwidth := Sensitivity(dr)
+	noise := -174 + 10*math.Log10(bandwidth) + noiseFigure
+
+	rssi := txPower - model.PathLoss(distance, frequency)
+	snr := rssi - noise
+
+	return radio.Signal{
+		RSSI: math.Round(rssi),
+		SNR:  math.Round(math.Min(snr, maxSNR)*4) / 4,
+	}, snr >= minSNR
+}
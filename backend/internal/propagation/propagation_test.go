@@ -0,0 +1,179 @@
+package propagation
+
+import (
+	"testing"
+
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/radio"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("empty model selects free space", func(t *testing.T) {
+		m, err := New(Config{})
+		assert.NoError(t, err)
+		assert.Equal(t, Config{Model: FreeSpace}, m.Config())
+	})
+
+	t.Run("applies Okumura-Hata defaults", func(t *testing.T) {
+		m, err := New(Config{Model: OkumuraHata})
+		assert.NoError(t, err)
+		assert.Equal(t, Config{
+			Model:         OkumuraHata,
+			Environment:   Urban,
+			GatewayHeight: DefaultGatewayHeight,
+			DeviceHeight:  DefaultDeviceHeight,
+		}, m.Config())
+	})
+
+	t.Run("applies log-distance defaults", func(t *testing.T) {
+		m, err := New(Config{Model: LogDistance, Shadowing: 4})
+		assert.NoError(t, err)
+		assert.Equal(t, Config{
+			Model:             LogDistance,
+			Exponent:          DefaultExponent,
+			ReferenceDistance: DefaultReferenceDistance,
+			Shadowing:         4,
+		}, m.Config())
+	})
+
+	t.Run("rejects invalid configurations", func(t *testing.T) {
+		configs := []Config{
+			{Model: "two-ray"},
+			{Model: OkumuraHata, Environment: "underwater"},
+			{Model: OkumuraHata, GatewayHeight: -1},
+			{Model: LogDistance, Shadowing: -2},
+		}
+		for _, config := range configs {
+			_, err := New(config)
+			assert.Error(t, err, config)
+		}
+	})
+}
+
+func TestModel_PathLoss(t *testing.T) {
+	const frequency = 868000000
+
+	tests := []struct {
+		name     string
+		config   Config
+		distance float64
+		loss     float64
+	}{
+		{"free space 1 km", Config{Model: FreeSpace}, 1000, 91.22},
+		{"free space below 1 m", Config{Model: FreeSpace}, 0, 31.22},
+		{"Okumura-Hata urban 5 km", Config{Model: OkumuraHata}, 5000, 150.61},
+		{"Okumura-Hata suburban 5 km", Config{Model: OkumuraHata, Environment: Suburban}, 5000, 140.77},
+		{"Okumura-Hata rural 5 km", Config{Model: OkumuraHata, Environment: Rural}, 5000, 122.26},
+		{"Okumura-Hata never below free space", Config{Model: OkumuraHata, Environment: Rural}, 10, 51.22},
+		{"log-distance 1 km", Config{Model: LogDistance}, 1000, 112.22},
+		{"log-distance within reference distance", Config{Model: LogDistance, ReferenceDistance: 100}, 10, 51.22},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(tt.config)
+			assert.NoError(t, err)
+			assert.InDelta(t, tt.loss, m.PathLoss(tt.distance, frequency), 0.01)
+		})
+	}
+
+	t.Run("log-distance shadowing varies the loss", func(t *testing.T) {
+		m, err := New(Config{Model: LogDistance, Shadowing: 6})
+		assert.NoError(t, err)
+
+		losses := make(map[float64]bool)
+		sum := 0.0
+		for i := 0; i < 1000; i++ {
+			loss := m.PathLoss(1000, frequency)
+			losses[loss] = true
+			sum += loss
+		}
+		assert.Greater(t, len(losses), 1)
+		assert.InDelta(t, 112.22, sum/1000, 1)
+	})
+}
+
+func TestDistance(t *testing.T) {
+	turin := radio.Location{Latitude: 45.0703, Longitude: 7.6869}
+	milan := radio.Location{Latitude: 45.4642, Longitude: 9.19}
+
+	assert.Equal(t, 0.0, Distance(turin, turin))
+	assert.InDelta(t, 125518, Distance(turin, milan), 1)
+	assert.InDelta(t, Distance(turin, milan), Distance(milan, turin), 1e-6)
+}
+
+func TestSensitivity(t *testing.T) {
+	eu868, err := region.Get(region.EU868)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		dr        int
+		snr       float64
+		bandwidth float64
+	}{
+		{0, -20, 125000},
+		{5, -7.5, 125000},
+		{6, -7.5, 250000},
+		{7, 14, 100000},
+	}
+
+	for _, tt := range tests {
+		dr, err := eu868.DataRate(tt.dr)
+		assert.NoError(t, err)
+
+		snr, bandwidth := Sensitivity(dr)
+		assert.Equal(t, tt.snr, snr, "DR%d", tt.dr)
+		assert.Equal(t, tt.bandwidth, bandwidth, "DR%d", tt.dr)
+	}
+}
+
+func TestReceive(t *testing.T) {
+	uplink := radio.Uplink{Region: region.EU868, Frequency: 868000000, DataRate: 5, TxPower: 16}
+
+	t.Run("receives close uplink with saturated SNR", func(t *testing.T) {
+		m, _ := New(Config{Model: FreeSpace})
+
+		signal, ok := Receive(m, uplink, 1000)
+		assert.True(t, ok)
+		assert.Equal(t, radio.Signal{RSSI: -75, SNR: 13.5}, signal)
+	})
+
+	t.Run("drops uplink below the data rate sensitivity", func(t *testing.T) {
+		m, _ := New(Config{Model: OkumuraHata})
+
+		signal, ok := Receive(m, uplink, 5000)
+		assert.False(t, ok)
+		assert.Equal(t, radio.Signal{RSSI: -135, SNR: -17.5}, signal)
+
+		// SF12 is demodulated down to -20 dB
+		slow := uplink
+		slow.DataRate = 0
+		signal, ok = Receive(m, slow, 5000)
+		assert.True(t, ok)
+		assert.Equal(t, radio.Signal{RSSI: -135, SNR: -17.5}, signal)
+	})
+
+	t.Run("drops uplink with invalid data rate", func(t *testing.T) {
+		m, _ := New(Config{Model: FreeSpace})
+
+		invalid := uplink
+		invalid.DataRate = 15
+		_, ok := Receive(m, invalid, 1000)
+		assert.False(t, ok)
+	})
+
+	t.Run("receives downlink within device sensitivity", func(t *testing.T) {
+		m, _ := New(Config{Model: OkumuraHata})
+
+		// RX2 at SF12 with the 27 dBm of 869.525 MHz
+		downlink := radio.Downlink{Region: region.EU868, Frequency: 869525000, DataRate: 0, TxPower: 27}
+		signal, ok := ReceiveDownlink(m, downlink, 10000)
+		assert.True(t, ok)
+		assert.Equal(t, -134.0, signal.RSSI)
+
+		downlink.DataRate = 5
+		_, ok = ReceiveDownlink(m, downlink, 10000)
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,72 @@
+package radio
+
+import (
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+)
+
+// Uplink is a frame transmitted over the air by a device
+type Uplink struct {
+	PHYPayload lorawan.PHYPayload
+	Region     region.Name
+	Frequency  uint32 // Hz
+	DataRate   int
+	TxPower    float64   // dBm EIRP
+	Location   *Location // of the device, nil when unknown
+	Time       time.Time // end of the transmission, opening the RX windows
+
+	// Signal is the strength of the frame as received by a gateway, nil when
+	// it cannot be computed (e.g. unknown device or gateway location)
+	Signal *Signal
+}
+
+// Downlink is a frame transmitted over the air by a gateway
+type Downlink struct {
+	PHYPayload lorawan.PHYPayload
+	Beacon     []byte // class B beacon frame, set instead of PHYPayload
+	Region     region.Name
+	Frequency  uint32 // Hz
+	DataRate   int
+	TxPower    float64   // dBm EIRP
+	Location   *Location // of the gateway, nil when unknown
+	Time       time.Time // start of the transmission
+
+	// Signal is the strength of the frame as received by a device, nil when
+	// it cannot be computed
+	Signal *Signal
+}
+
+// Location is a point on the earth surface
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Signal is the strength of a received frame
+type Signal struct {
+	RSSI float64 // dBm
+	SNR  float64 // dB
+}
+
+// DefaultSignal is reported for frames whose signal was not computed
+var DefaultSignal = Signal{RSSI: -50, SNR: 9}
+
+// ReceivedSignal returns the signal of the uplink, or DefaultSignal when it
+// was not computed
+func (u Uplink) ReceivedSignal() Signal {
+	if u.Signal == nil {
+		return DefaultSignal
+	}
+	return *u.Signal
+}
+
+// ReceivedSignal returns the signal of the downlink, or DefaultSignal when
+// it was not computed
+func (d Downlink) ReceivedSignal() Signal {
+	if d.Signal == nil {
+		return DefaultSignal
+	}
+	return *d.Signal
+}
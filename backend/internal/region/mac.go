@@ -0,0 +1,164 @@
+package region
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/airtime"
+	"github.com/brocaar/lorawan/band"
+)
+
+// dynamicChannels is the number of uplink channels of regions without
+// sub-bands, the default channels followed by those added with NewChannelReq
+const dynamicChannels = 16
+
+// frequencyRanges are the frequencies (Hz) devices may use in each region
+var frequencyRanges = map[Name][2]uint32{
+	EU868: {863000000, 870000000},
+	US915: {902000000, 928000000},
+	AU915: {915000000, 928000000},
+	AS923: {915000000, 928000000},
+	IN865: {865000000, 867000000},
+}
+
+// ChannelPlan returns the uplink channels of a device, indexed like the
+// channel masks. Regions without sub-bands have 16 channels, those beyond
+// the default ones are unset (zero frequency) until a NewChannelReq.
+func (r *Region) ChannelPlan() []Channel {
+	channels := r.UplinkChannels()
+	if r.SubBands() == 0 && len(channels) < dynamicChannels {
+		channels = append(channels, make([]Channel, dynamicChannels-len(channels))...)
+	}
+	return channels
+}
+
+// DefaultChannels returns the number of channels a NewChannelReq cannot
+// modify, zero for regions with a fixed channel plan
+func (r *Region) DefaultChannels() int {
+	if r.SubBands() > 0 {
+		return 0
+	}
+	return len(r.UplinkChannels())
+}
+
+// SupportsNewChannel reports whether the channel plan can be changed with
+// NewChannelReq and DlChannelReq
+func (r *Region) SupportsNewChannel() bool {
+	return r.SubBands() == 0
+}
+
+// SupportsTxParamSetup reports whether devices implement TxParamSetupReq
+func (r *Region) SupportsTxParamSetup() bool {
+	return r.band.ImplementsTXParamSetup("")
+}
+
+// ApplyChannelMask returns the channels enabled by the ChMask and ChMaskCntl
+// of a LinkADRReq. Enabling a channel of the plan without frequency fails.
+//
+// Without sub-bands ChMaskCntl 0 applies the mask to channels 0-15 and 6
+// enables all channels. With sub-bands ChMaskCntl 0-3 apply the mask to the
+// 125 kHz channels 16*ChMaskCntl to 16*ChMaskCntl+15, 4 to the 500 kHz
+// channels 64-71, 5 enables or disables the 8 banks of 8 125 kHz channels
+// with their 500 kHz channel and 6 (7) enables (disables) all 125 kHz
+// channels, applying the mask to the 500 kHz channels.
+func (r *Region) ApplyChannelMask(channels []Channel, enabled []bool, chMaskCntl uint8, chMask lorawan.ChMask) ([]bool, error) {
+	out := append([]bool(nil), enabled...)
+	set := func(i int, on bool) error {
+		if i >= len(channels) || (on && channels[i].Frequency == 0) {
+			if !on {
+				return nil
+			}
+			return fmt.Errorf("channel %d is not defined", i)
+		}
+		out[i] = on
+		return nil
+	}
+
+	switch {
+	case r.SubBands() == 0 && chMaskCntl == 0,
+		r.SubBands() > 0 && chMaskCntl <= 3:
+		for i, on := range chMask {
+			if err := set(int(chMaskCntl)*16+i, on); err != nil {
+				return nil, err
+			}
+		}
+	case r.SubBands() == 0 && chMaskCntl == 6:
+		for i := range out {
+			out[i] = channels[i].Frequency != 0
+		}
+	case r.SubBands() > 0 && chMaskCntl == 4:
+		for i := 0; i < 8; i++ {
+			out[64+i] = chMask[i]
+		}
+	case r.SubBands() > 0 && chMaskCntl == 5:
+		for bank := 0; bank < 8; bank++ {
+			for i := bank * 8; i < bank*8+8; i++ {
+				out[i] = chMask[bank]
+			}
+			out[64+bank] = chMask[bank]
+		}
+	case r.SubBands() > 0 && (chMaskCntl == 6 || chMaskCntl == 7):
+		for i := 0; i < 64; i++ {
+			out[i] = chMaskCntl == 6
+		}
+		for i := 0; i < 8; i++ {
+			out[64+i] = chMask[i]
+		}
+	default:
+		return nil, fmt.Errorf("invalid ChMaskCntl %d", chMaskCntl)
+	}
+
+	for _, on := range out {
+		if on {
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("channel mask disables all channels")
+}
+
+// TxPowerOffset returns the offset (dB) from the maximum EIRP of a TXPower
+// index of LinkADRReq
+func (r *Region) TxPowerOffset(index int) (float64, error) {
+	offset, err := r.band.GetTXPowerOffset(index)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TX power index %d", index)
+	}
+	return float64(offset), nil
+}
+
+// IsRX1DROffset reports whether the RX1 data rate offset is defined by the
+// region
+func (r *Region) IsRX1DROffset(offset int) bool {
+	_, err := r.band.GetRX1DataRateIndex(r.DefaultDataRate(), offset)
+	return err == nil
+}
+
+// IsFrequency reports whether devices of the region may use the frequency
+func (r *Region) IsFrequency(frequency uint32) bool {
+	limits := frequencyRanges[r.name]
+	return frequency >= limits[0] && frequency <= limits[1]
+}
+
+// Airtime returns the time on air of a frame of the given size (bytes) at a
+// LoRa or FSK data rate
+func (r *Region) Airtime(dr int, size int) (time.Duration, error) {
+	d, err := r.band.GetDataRate(dr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid data rate")
+	}
+
+	switch d.Modulation {
+	case band.LoRaModulation:
+		// Explicit header, CR 4/5 and 8 preamble symbols, low data rate
+		// optimization above 16 ms symbols
+		lowDataRate := airtime.CalculateLoRaSymbolDuration(d.SpreadFactor, d.Bandwidth) > 16*time.Millisecond
+		return airtime.CalculateLoRaAirtime(size, d.SpreadFactor, d.Bandwidth, 8, airtime.CodingRate45, true, lowDataRate)
+	case band.FSKModulation:
+		// 5 bytes preamble, 3 bytes sync word, length and CRC
+		bits := (5 + 3 + 1 + size + 2) * 8
+		return time.Duration(bits) * time.Second / time.Duration(d.BitRate), nil
+	default:
+		return 0, fmt.Errorf("airtime of %s data rates not supported", d.Modulation)
+	}
+}
@@ -0,0 +1,112 @@
+package region
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegion_ChannelPlan(t *testing.T) {
+	eu868, _ := Get(EU868)
+	channels := eu868.ChannelPlan()
+	assert.Len(t, channels, 16)
+	assert.Equal(t, uint32(868100000), channels[0].Frequency)
+	assert.Equal(t, uint32(0), channels[3].Frequency)
+	assert.Equal(t, 3, eu868.DefaultChannels())
+	assert.True(t, eu868.SupportsNewChannel())
+
+	us915, _ := Get(US915)
+	assert.Len(t, us915.ChannelPlan(), 72)
+	assert.Equal(t, 0, us915.DefaultChannels())
+	assert.False(t, us915.SupportsNewChannel())
+}
+
+func TestRegion_ApplyChannelMask(t *testing.T) {
+	t.Run("applies the mask to the defined channels", func(t *testing.T) {
+		eu868, _ := Get(EU868)
+		channels := eu868.ChannelPlan()
+		enabled, err := eu868.ChannelMask(0)
+		assert.NoError(t, err)
+		enabled = append(enabled, make([]bool, len(channels)-len(enabled))...)
+
+		out, err := eu868.ApplyChannelMask(channels, enabled, 0, lorawan.ChMask{true, false, true})
+		assert.NoError(t, err)
+		assert.Equal(t, []bool{true, false, true}, out[:3])
+		assert.True(t, enabled[1], "input not modified")
+
+		_, err = eu868.ApplyChannelMask(channels, enabled, 0, lorawan.ChMask{3: true})
+		assert.Error(t, err, "channel 3 is not defined")
+
+		_, err = eu868.ApplyChannelMask(channels, enabled, 0, lorawan.ChMask{})
+		assert.Error(t, err, "all channels disabled")
+
+		_, err = eu868.ApplyChannelMask(channels, enabled, 5, lorawan.ChMask{})
+		assert.Error(t, err)
+	})
+
+	t.Run("selects the sub-bands of fixed channel plans", func(t *testing.T) {
+		us915, _ := Get(US915)
+		channels := us915.ChannelPlan()
+		enabled, err := us915.ChannelMask(2)
+		assert.NoError(t, err)
+
+		// ChMaskCntl 7 disables the 125 kHz channels, then 1 enables 16-23
+		out, err := us915.ApplyChannelMask(channels, enabled, 7, lorawan.ChMask{})
+		assert.Error(t, err)
+		out, err = us915.ApplyChannelMask(channels, enabled, 7, lorawan.ChMask{2: true})
+		assert.NoError(t, err)
+		out, err = us915.ApplyChannelMask(channels, out, 1, lorawan.ChMask{0: true, 1: true, 2: true, 3: true, 4: true, 5: true, 6: true, 7: true})
+		assert.NoError(t, err)
+		for i, on := range out {
+			assert.Equal(t, (i >= 16 && i < 24) || i == 66, on, "channel %d", i)
+		}
+
+		// ChMaskCntl 5 enables banks of 8 channels and their 500 kHz channel
+		out, err = us915.ApplyChannelMask(channels, out, 5, lorawan.ChMask{0: true})
+		assert.NoError(t, err)
+		for i, on := range out {
+			assert.Equal(t, i < 8 || i == 64, on, "channel %d", i)
+		}
+	})
+}
+
+func TestRegion_TxPowerOffset(t *testing.T) {
+	eu868, _ := Get(EU868)
+	offset, err := eu868.TxPowerOffset(0)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), offset)
+	offset, err = eu868.TxPowerOffset(3)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(-6), offset)
+	_, err = eu868.TxPowerOffset(14)
+	assert.Error(t, err)
+}
+
+func TestRegion_IsFrequency(t *testing.T) {
+	eu868, _ := Get(EU868)
+	assert.True(t, eu868.IsFrequency(867100000))
+	assert.False(t, eu868.IsFrequency(915000000))
+	assert.True(t, eu868.IsRX1DROffset(5))
+	assert.False(t, eu868.IsRX1DROffset(6))
+}
+
+func TestRegion_Airtime(t *testing.T) {
+	eu868, _ := Get(EU868)
+
+	// 13 bytes (empty uplink) at SF12BW125 and SF7BW125
+	airtime, err := eu868.Airtime(0, 13)
+	assert.NoError(t, err)
+	assert.Equal(t, 1155072*time.Microsecond, airtime)
+	airtime, err = eu868.Airtime(5, 13)
+	assert.NoError(t, err)
+	assert.Equal(t, 46336*time.Microsecond, airtime)
+
+	airtime, err = eu868.Airtime(7, 13)
+	assert.NoError(t, err)
+	assert.Equal(t, 3840*time.Microsecond, airtime)
+
+	_, err = eu868.Airtime(15, 13)
+	assert.Error(t, err)
+}
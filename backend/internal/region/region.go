@@ -0,0 +1,339 @@
+package region
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
+)
+
+type Name string
+
+const (
+	EU868 Name = "EU868"
+	US915 Name = "US915"
+	AU915 Name = "AU915"
+	AS923 Name = "AS923"
+	IN865 Name = "IN865"
+)
+
+// Default is the region of devices and gateways created without one
+const Default = EU868
+
+// DefaultSubBand is the sub-band used by US915 and AU915 devices when none is
+// configured (channels 8-15 and 65, the most common network server setup)
+const DefaultSubBand = 2
+
+var names = []Name{EU868, US915, AU915, AS923, IN865}
+
+type Channel struct {
+	Frequency uint32 `json:"frequency"` // Hz
+	MinDR     int    `json:"minDR"`
+	MaxDR     int    `json:"maxDR"`
+}
+
+type DataRate struct {
+	Modulation   string `json:"modulation"` // LORA, FSK or LR_FHSS
+	SpreadFactor int    `json:"spreadFactor,omitempty"`
+	Bandwidth    int    `json:"bandwidth,omitempty"` // kHz
+	BitRate      int    `json:"bitRate,omitempty"`   // bps, FSK only
+}
+
+// String returns the data rate in the packet forwarder notation (e.g. SF7BW125)
+func (dr DataRate) String() string {
+	switch dr.Modulation {
+	case string(band.LoRaModulation):
+		return fmt.Sprintf("SF%dBW%d", dr.SpreadFactor, dr.Bandwidth)
+	case string(band.FSKModulation):
+		return fmt.Sprintf("FSK%d", dr.BitRate)
+	default:
+		return dr.Modulation
+	}
+}
+
+// ParseDataRate parses a LoRa data rate in the packet forwarder notation
+// (e.g. SF7BW125)
+func ParseDataRate(s string) (DataRate, error) {
+	var sf, bw int
+	if _, err := fmt.Sscanf(s, "SF%dBW%d", &sf, &bw); err != nil {
+		return DataRate{}, fmt.Errorf("invalid data rate %q", s)
+	}
+
+	return DataRate{Modulation: string(band.LoRaModulation), SpreadFactor: sf, Bandwidth: bw}, nil
+}
+
+// Region holds the regional parameters (channel plan, data rates and max
+// payload sizes) of a LoRaWAN region
+type Region struct {
+	name Name
+	band band.Band
+}
+
+// Names returns the supported regions
+func Names() []Name {
+	return append([]Name(nil), names...)
+}
+
+// Get returns the regional parameters for the given region, an empty name
+// selects the default region
+func Get(name Name) (*Region, error) {
+	if name == "" {
+		name = Default
+	}
+
+	for _, n := range names {
+		if n != name {
+			continue
+		}
+
+		b, err := band.GetConfig(band.Name(name), false, lorawan.DwellTimeNoLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Region{name: name, band: b}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported region %q", name)
+}
+
+func (r *Region) Name() Name {
+	return r.name
+}
+
+// SubBands returns the number of 8-channel sub-bands of the region, zero for
+// regions with a small channel plan
+func (r *Region) SubBands() int {
+	switch r.name {
+	case US915, AU915:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// UplinkChannels returns all the uplink channels defined by the region
+func (r *Region) UplinkChannels() []Channel {
+	indices := r.band.GetUplinkChannelIndices()
+	channels := make([]Channel, 0, len(indices))
+	for _, i := range indices {
+		c, err := r.band.GetUplinkChannel(i)
+		if err != nil {
+			continue
+		}
+		channels = append(channels, Channel{Frequency: c.Frequency, MinDR: c.MinDR, MaxDR: c.MaxDR})
+	}
+
+	return channels
+}
+
+// DeviceChannels returns the uplink channels a device uses by default.
+// For regions with sub-bands these are the eight 125 kHz channels and the
+// 500 kHz channel of the sub-band (1-8, 0 selects DefaultSubBand).
+func (r *Region) DeviceChannels(subBand int) ([]Channel, error) {
+	mask, err := r.ChannelMask(subBand)
+	if err != nil {
+		return nil, err
+	}
+
+	var channels []Channel
+	for i, c := range r.UplinkChannels() {
+		if mask[i] {
+			channels = append(channels, c)
+		}
+	}
+
+	return channels, nil
+}
+
+// ChannelMask returns the uplink channels a device enables by default,
+// indexed like UplinkChannels (see DeviceChannels)
+func (r *Region) ChannelMask(subBand int) ([]bool, error) {
+	mask := make([]bool, len(r.UplinkChannels()))
+
+	if r.SubBands() == 0 {
+		if subBand != 0 {
+			return nil, fmt.Errorf("region %s has no sub-bands", r.name)
+		}
+		for i := range mask {
+			mask[i] = true
+		}
+		return mask, nil
+	}
+
+	if subBand == 0 {
+		subBand = DefaultSubBand
+	}
+	if subBand < 1 || subBand > r.SubBands() {
+		return nil, fmt.Errorf("invalid sub-band %d", subBand)
+	}
+
+	// 64 125 kHz channels followed by 8 500 kHz channels
+	for i := (subBand - 1) * 8; i < subBand*8; i++ {
+		mask[i] = true
+	}
+	mask[64+subBand-1] = true
+
+	return mask, nil
+}
+
+// IsUplinkChannel reports whether the frequency and data rate match an
+// uplink channel of the region
+func (r *Region) IsUplinkChannel(frequency uint32, dr int) bool {
+	_, err := r.band.GetUplinkChannelIndexForFrequencyDR(frequency, dr)
+	return err == nil
+}
+
+// UplinkChannelIndex returns the index of the uplink channel of the frequency
+// and data rate, signed by the MIC of LoRaWAN 1.1 uplinks
+func (r *Region) UplinkChannelIndex(frequency uint32, dr int) (int, error) {
+	return r.band.GetUplinkChannelIndexForFrequencyDR(frequency, dr)
+}
+
+func (r *Region) DataRate(dr int) (DataRate, error) {
+	d, err := r.band.GetDataRate(dr)
+	if err != nil {
+		return DataRate{}, errors.New("invalid data rate")
+	}
+
+	return DataRate{
+		Modulation:   string(d.Modulation),
+		SpreadFactor: d.SpreadFactor,
+		Bandwidth:    d.Bandwidth,
+		BitRate:      d.BitRate,
+	}, nil
+}
+
+// DefaultDataRate returns the fastest 125 kHz LoRa uplink data rate
+// (SF7BW125), supported by every default channel
+func (r *Region) DefaultDataRate() int {
+	maxDR := 0
+	for _, c := range r.UplinkChannels() {
+		if c.MaxDR > maxDR {
+			maxDR = c.MaxDR
+		}
+	}
+
+	for dr := maxDR; dr > 0; dr-- {
+		d, err := r.DataRate(dr)
+		if err == nil && d.Modulation == string(band.LoRaModulation) && d.Bandwidth == 125 {
+			return dr
+		}
+	}
+
+	return 0
+}
+
+// MaxPayloadSize returns the maximum FRMPayload plus FOpts size in bytes
+// for the given data rate
+func (r *Region) MaxPayloadSize(dr int) (int, error) {
+	ps, err := r.band.GetMaxPayloadSizeForDataRateIndex("", "", dr)
+	if err != nil {
+		return 0, errors.New("invalid data rate")
+	}
+
+	return ps.N, nil
+}
+
+// MaxEIRP returns the default maximum uplink EIRP of the region in dBm
+func (r *Region) MaxEIRP() float64 {
+	return float64(r.band.GetDefaultMaxUplinkEIRP())
+}
+
+// DownlinkDataRateIndex returns the index of a downlink data rate
+func (r *Region) DownlinkDataRateIndex(dr DataRate) (int, error) {
+	i, err := r.band.GetDataRateIndex(false, band.DataRate{
+		Modulation:   band.Modulation(dr.Modulation),
+		SpreadFactor: dr.SpreadFactor,
+		Bandwidth:    dr.Bandwidth,
+		BitRate:      dr.BitRate,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("data rate %s not supported by region %s", dr, r.name)
+	}
+
+	return i, nil
+}
+
+// DownlinkTxPower returns the default downlink TX power in dBm EIRP for the
+// given frequency
+func (r *Region) DownlinkTxPower(frequency uint32) float64 {
+	return float64(r.band.GetDownlinkTXPower(frequency))
+}
+
+// RX1 returns the frequency and data rate of the RX1 window opened by an
+// uplink on the given frequency and data rate
+func (r *Region) RX1(frequency uint32, dr, drOffset int) (uint32, int, error) {
+	rx1Frequency, err := r.band.GetRX1FrequencyForUplinkFrequency(frequency)
+	if err != nil {
+		return 0, 0, err
+	}
+	rx1DR, err := r.band.GetRX1DataRateIndex(dr, drOffset)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return rx1Frequency, rx1DR, nil
+}
+
+// RX2 returns the default frequency and data rate of the RX2 window
+func (r *Region) RX2() (uint32, int) {
+	defaults := r.band.GetDefaults()
+	return defaults.RX2Frequency, defaults.RX2DataRate
+}
+
+// ReceiveDelay returns the default delay of the RX1 window after a data
+// uplink, the RX2 window opens one second later
+func (r *Region) ReceiveDelay() time.Duration {
+	return r.band.GetDefaults().ReceiveDelay1
+}
+
+// JoinAcceptDelay returns the delay of the RX1 window after a join request,
+// the RX2 window opens one second later
+func (r *Region) JoinAcceptDelay() time.Duration {
+	return r.band.GetDefaults().JoinAcceptDelay1
+}
+
+// BeaconDataRate returns the data rate of the class B beacons, which is also
+// the default data rate of the ping slots
+func (r *Region) BeaconDataRate() int {
+	switch r.name {
+	case US915, AU915:
+		return 8
+	case IN865:
+		return 4
+	default:
+		return 3
+	}
+}
+
+// BeaconFrequency returns the frequency of the beacon of the period starting
+// at the given GPS time. Regions with several beacon channels hop between
+// them at every period.
+func (r *Region) BeaconFrequency(beaconTime time.Duration) uint32 {
+	frequency, _ := r.band.GetPingSlotFrequency(lorawan.DevAddr{}, beaconTime)
+	return frequency
+}
+
+// PingSlotFrequency returns the default frequency of the ping slots of a
+// device in the beacon period starting at the given GPS time
+func (r *Region) PingSlotFrequency(devAddr lorawan.DevAddr, beaconTime time.Duration) uint32 {
+	frequency, _ := r.band.GetPingSlotFrequency(devAddr, beaconTime)
+	return frequency
+}
+
+// BeaconLayout returns the offsets of the Time and GwSpecific fields and the
+// length of the beacon frame, which depend on the spreading factor of the
+// beacon
+func (r *Region) BeaconLayout() [3]int {
+	switch r.name {
+	case US915, AU915:
+		return [3]int{5, 11, 23}
+	case IN865:
+		return [3]int{1, 7, 19}
+	default:
+		return [3]int{2, 8, 17}
+	}
+}
@@ -0,0 +1,244 @@
+package region
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGet(t *testing.T) {
+	t.Run("returns every supported region", func(t *testing.T) {
+		for _, name := range Names() {
+			r, err := Get(name)
+			assert.NoError(t, err)
+			assert.Equal(t, name, r.Name())
+		}
+	})
+
+	t.Run("empty name selects default region", func(t *testing.T) {
+		r, err := Get("")
+		assert.NoError(t, err)
+		assert.Equal(t, EU868, r.Name())
+	})
+
+	t.Run("rejects unsupported region", func(t *testing.T) {
+		_, err := Get("XX123")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "unsupported region")
+	})
+}
+
+func TestRegion_DeviceChannels(t *testing.T) {
+	tests := []struct {
+		name        Name
+		subBand     int
+		count       int
+		first       uint32
+		last        uint32
+		expectError bool
+	}{
+		{EU868, 0, 3, 868100000, 868500000, false},
+		{EU868, 1, 0, 0, 0, true},
+		{IN865, 0, 3, 865062500, 865985000, false},
+		{AS923, 0, 2, 923200000, 923400000, false},
+		{US915, 0, 9, 903900000, 904600000, false}, // sub-band 2 by default
+		{US915, 1, 9, 902300000, 903000000, false},
+		{US915, 8, 9, 913500000, 914200000, false},
+		{US915, 9, 0, 0, 0, true},
+		{AU915, 2, 9, 916800000, 917500000, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.name), func(t *testing.T) {
+			r, err := Get(tt.name)
+			assert.NoError(t, err)
+
+			channels, err := r.DeviceChannels(tt.subBand)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, channels, tt.count)
+			assert.Equal(t, tt.first, channels[0].Frequency)
+			assert.Equal(t, tt.last, channels[len(channels)-1].Frequency)
+		})
+	}
+}
+
+func TestRegion_DataRates(t *testing.T) {
+	tests := []struct {
+		name      Name
+		defaultDR int
+		dr0       string
+		maxSizes  map[int]int
+	}{
+		{EU868, 5, "SF12BW125", map[int]int{0: 51, 3: 115, 5: 242}},
+		{US915, 3, "SF10BW125", map[int]int{0: 11, 3: 242, 4: 242}},
+		{AU915, 5, "SF12BW125", map[int]int{0: 51, 5: 242}},
+		{AS923, 5, "SF12BW125", map[int]int{0: 51, 5: 242}},
+		{IN865, 5, "SF12BW125", map[int]int{0: 51, 5: 242}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.name), func(t *testing.T) {
+			r, err := Get(tt.name)
+			assert.NoError(t, err)
+
+			assert.Equal(t, tt.defaultDR, r.DefaultDataRate())
+
+			dr, err := r.DataRate(0)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.dr0, dr.String())
+
+			for dr, size := range tt.maxSizes {
+				maxSize, err := r.MaxPayloadSize(dr)
+				assert.NoError(t, err)
+				assert.Equal(t, size, maxSize, "DR%d", dr)
+			}
+
+			_, err = r.DataRate(100)
+			assert.Error(t, err)
+			_, err = r.MaxPayloadSize(100)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRegion_IsUplinkChannel(t *testing.T) {
+	eu868, _ := Get(EU868)
+	assert.True(t, eu868.IsUplinkChannel(868300000, 5))
+	assert.False(t, eu868.IsUplinkChannel(868300000, 7))
+	assert.False(t, eu868.IsUplinkChannel(902300000, 0))
+
+	us915, _ := Get(US915)
+	assert.True(t, us915.IsUplinkChannel(902300000, 0))
+	assert.False(t, us915.IsUplinkChannel(902300000, 4))
+	assert.True(t, us915.IsUplinkChannel(903000000, 4))
+	assert.False(t, us915.IsUplinkChannel(868300000, 5))
+}
+
+func TestRegion_UplinkChannelIndex(t *testing.T) {
+	eu868, _ := Get(EU868)
+	ch, err := eu868.UplinkChannelIndex(868300000, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ch)
+	_, err = eu868.UplinkChannelIndex(868300000, 7)
+	assert.Error(t, err)
+
+	us915, _ := Get(US915)
+	ch, err = us915.UplinkChannelIndex(903000000, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, 64, ch)
+}
+
+func TestRegion_MaxEIRP(t *testing.T) {
+	tests := []struct {
+		name Name
+		eirp float64
+	}{
+		{EU868, 16},
+		{US915, 30},
+		{AU915, 30},
+		{AS923, 16},
+		{IN865, 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.name), func(t *testing.T) {
+			r, err := Get(tt.name)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.eirp, r.MaxEIRP())
+		})
+	}
+}
+
+func TestParseDataRate(t *testing.T) {
+	dr, err := ParseDataRate("SF9BW125")
+	assert.NoError(t, err)
+	assert.Equal(t, DataRate{Modulation: "LORA", SpreadFactor: 9, Bandwidth: 125}, dr)
+	assert.Equal(t, "SF9BW125", dr.String())
+
+	_, err = ParseDataRate("FSK50000")
+	assert.Error(t, err)
+}
+
+func TestRegion_DownlinkDataRateIndex(t *testing.T) {
+	eu868, _ := Get(EU868)
+	i, err := eu868.DownlinkDataRateIndex(DataRate{Modulation: "LORA", SpreadFactor: 9, Bandwidth: 125})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, i)
+
+	i, err = eu868.DownlinkDataRateIndex(DataRate{Modulation: "FSK", BitRate: 50000})
+	assert.NoError(t, err)
+	assert.Equal(t, 7, i)
+
+	// US915 downlinks use 500 kHz data rates only
+	us915, _ := Get(US915)
+	i, err = us915.DownlinkDataRateIndex(DataRate{Modulation: "LORA", SpreadFactor: 12, Bandwidth: 500})
+	assert.NoError(t, err)
+	assert.Equal(t, 8, i)
+
+	_, err = us915.DownlinkDataRateIndex(DataRate{Modulation: "LORA", SpreadFactor: 12, Bandwidth: 125})
+	assert.Error(t, err)
+}
+
+func TestRegion_RXWindows(t *testing.T) {
+	tests := []struct {
+		name         Name
+		uplinkFreq   uint32
+		uplinkDR     int
+		drOffset     int
+		rx1Frequency uint32
+		rx1DR        int
+		rx2Frequency uint32
+		rx2DR        int
+		txPower      float64
+	}{
+		{EU868, 868300000, 5, 0, 868300000, 5, 869525000, 0, 14},
+		{EU868, 868300000, 5, 2, 868300000, 3, 869525000, 0, 14},
+		{US915, 902300000, 0, 0, 923300000, 10, 923300000, 8, 20},
+		{AU915, 916800000, 2, 0, 923300000, 10, 923300000, 8, 27},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.name), func(t *testing.T) {
+			r, err := Get(tt.name)
+			assert.NoError(t, err)
+
+			rx1Frequency, rx1DR, err := r.RX1(tt.uplinkFreq, tt.uplinkDR, tt.drOffset)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.rx1Frequency, rx1Frequency)
+			assert.Equal(t, tt.rx1DR, rx1DR)
+
+			rx2Frequency, rx2DR := r.RX2()
+			assert.Equal(t, tt.rx2Frequency, rx2Frequency)
+			assert.Equal(t, tt.rx2DR, rx2DR)
+
+			assert.Equal(t, time.Second, r.ReceiveDelay())
+			assert.Equal(t, 5*time.Second, r.JoinAcceptDelay())
+			assert.Equal(t, tt.txPower, r.DownlinkTxPower(rx1Frequency))
+		})
+	}
+}
+
+func TestRegion_Beacon(t *testing.T) {
+	eu868, err := Get(EU868)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, eu868.BeaconDataRate())
+	assert.Equal(t, uint32(869525000), eu868.BeaconFrequency(128*time.Second))
+	assert.Equal(t, uint32(869525000), eu868.PingSlotFrequency(lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}, 128*time.Second))
+	assert.Equal(t, [3]int{2, 8, 17}, eu868.BeaconLayout())
+
+	// US915 hops between the 8 downlink channels at every beacon period
+	us915, err := Get(US915)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, us915.BeaconDataRate())
+	assert.Equal(t, uint32(923300000), us915.BeaconFrequency(0))
+	assert.Equal(t, uint32(923900000), us915.BeaconFrequency(128*time.Second))
+	assert.Equal(t, uint32(923300000), us915.BeaconFrequency(8*128*time.Second))
+	assert.Equal(t, uint32(924500000), us915.PingSlotFrequency(lorawan.DevAddr{0x00, 0x00, 0x00, 0x01}, 128*time.Second))
+	assert.Equal(t, [3]int{5, 11, 23}, us915.BeaconLayout())
+}
@@ -0,0 +1,324 @@
+package scenario
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/gateway"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/propagation"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+)
+
+// metersPerDegree is the length of a degree of latitude
+const metersPerDegree = 111320
+
+// Result counts the entities added by a scenario
+type Result struct {
+	NetworkServers int `json:"networkServers"`
+	Gateways       int `json:"gateways"`
+	Devices        int `json:"devices"`
+	// Failures of the behaviours, e.g. a gateway unable to connect
+	Errors []string `json:"errors,omitempty"`
+}
+
+// behaviours are run once every entity is added
+type behaviours struct {
+	connect   []*gateway.Gateway
+	join      []deviceRef
+	schedules []schedule
+}
+
+type deviceRef struct {
+	ns     *networkserver.NetworkServer
+	devEUI lorawan.EUI64
+}
+
+type schedule struct {
+	deviceRef
+	config networkserver.ScheduleConfig
+}
+
+// Apply adds the network servers, gateways and devices of the scenario to the
+// pool, then connects the gateways, joins the devices and starts their
+// periodic uplinks. Entities that already exist are kept as they are, so
+// that applying a scenario twice adds nothing.
+func Apply(pool *networkserver.Pool, s *Scenario) (Result, error) {
+	var result Result
+	var todo behaviours
+	rng := rand.New(rand.NewSource(s.Seed))
+
+	for _, nsScenario := range s.NetworkServers {
+		ns, err := pool.Get(nsScenario.Name)
+		if err != nil {
+			ns, err = pool.Add(nsScenario.Name, integration.NetworkServerConfig(nsScenario.Config))
+			if err != nil {
+				return result, fmt.Errorf("network server %s: %w", nsScenario.Name, err)
+			}
+			result.NetworkServers++
+		}
+
+		if nsScenario.Propagation != nil {
+			if err := ns.SetPropagation(propagation.Config(*nsScenario.Propagation)); err != nil {
+				return result, fmt.Errorf("network server %s: %w", nsScenario.Name, err)
+			}
+		}
+
+		for _, gwScenario := range nsScenario.Gateways {
+			gw, err := addGateway(ns, gwScenario)
+			if err != nil {
+				return result, fmt.Errorf("gateway %s: %w", gwScenario.EUI, err)
+			}
+			if gw == nil {
+				continue
+			}
+			result.Gateways++
+			if gwScenario.Connect {
+				todo.connect = append(todo.connect, gw)
+			}
+		}
+
+		for _, fleet := range nsScenario.Devices {
+			count := fleet.Count
+			if count == 0 {
+				count = 1
+			}
+			for i := 0; i < count; i++ {
+				// Keys and locations are drawn for every device, added or
+				// not, so that the other devices keep theirs
+				dev, err := addDevice(ns, fleet, i, rng)
+				if err != nil {
+					return result, fmt.Errorf("device %s: %w", incrementEUI(fleet.DevEUI, i), err)
+				}
+				if dev == nil {
+					continue
+				}
+				result.Devices++
+				ref := deviceRef{ns: ns, devEUI: dev.DevEUI}
+				if fleet.Join {
+					todo.join = append(todo.join, ref)
+				}
+				if fleet.Schedule != nil {
+					todo.schedules = append(todo.schedules, schedule{deviceRef: ref, config: fleet.Schedule.config()})
+				}
+			}
+		}
+	}
+
+	result.Errors = todo.run()
+
+	return result, nil
+}
+
+// addGateway adds and configures a gateway, returning nil when it exists
+func addGateway(ns *networkserver.NetworkServer, s Gateway) (*gateway.Gateway, error) {
+	if _, err := ns.GetGateway(s.EUI); err == nil {
+		log.Printf("[scenario] gateway %s already exists", s.EUI)
+		return nil, nil
+	}
+
+	var headers http.Header
+	if len(s.Headers) > 0 {
+		headers = make(http.Header)
+		for k, v := range s.Headers {
+			headers.Set(k, v)
+		}
+	}
+
+	var location *gateway.Location
+	if s.Location != nil {
+		location = &gateway.Location{Latitude: s.Location.Latitude, Longitude: s.Location.Longitude}
+	}
+
+	gw, err := ns.AddGateway(s.EUI, s.DiscoveryURI, location, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := region.Get(s.Region)
+	if err != nil {
+		return nil, err
+	}
+	gw.SetRegion(r)
+
+	protocol, err := gateway.ParseProtocol(string(s.Protocol))
+	if err != nil {
+		return nil, err
+	}
+	if err := gw.SetProtocol(protocol); err != nil {
+		return nil, err
+	}
+	if s.MQTT != nil {
+		if err := gw.SetMQTTConfig(gateway.MQTTConfig(*s.MQTT)); err != nil {
+			return nil, err
+		}
+	}
+	if err := gw.SetTxFailureRate(s.TxFailureRate); err != nil {
+		return nil, err
+	}
+
+	return gw, nil
+}
+
+// addDevice adds and configures the i-th device of a fleet, returning nil
+// when it exists
+func addDevice(ns *networkserver.NetworkServer, fleet Fleet, i int, rng *rand.Rand) (*device.Device, error) {
+	devEUI := incrementEUI(fleet.DevEUI, i)
+
+	appKey, nwkKey, appSKey, nwkSKey := fleet.AppKey, fleet.NwkKey, fleet.AppSKey, fleet.NwkSKey
+	switch fleet.Keys {
+	case KeysRandom:
+		for _, key := range []*lorawan.AES128Key{&appKey, &nwkKey, &appSKey, &nwkSKey} {
+			rng.Read(key[:])
+		}
+	case KeysDevEUI:
+		for _, key := range []*lorawan.AES128Key{&appKey, &nwkKey, &appSKey, &nwkSKey} {
+			copy(key[:8], devEUI[:])
+			copy(key[8:], devEUI[:])
+		}
+	}
+
+	var location *device.Location
+	if fleet.Location != nil {
+		latitude, longitude := spread(fleet.Location.Latitude, fleet.Location.Longitude, fleet.Radius, rng)
+		location = &device.Location{Latitude: latitude, Longitude: longitude}
+	}
+
+	if _, err := ns.GetDevice(devEUI); err == nil {
+		log.Printf("[scenario] device %s already exists", devEUI)
+		return nil, nil
+	}
+
+	var devAddr lorawan.DevAddr
+	if fleet.DevAddr != nil {
+		binary.BigEndian.PutUint32(devAddr[:], binary.BigEndian.Uint32(fleet.DevAddr[:])+uint32(i))
+	} else {
+		// OTAA devices get their session keys when joining
+		appSKey, nwkSKey = lorawan.AES128Key{}, lorawan.AES128Key{}
+	}
+
+	dev, err := ns.AddDevice(devEUI, fleet.JoinEUI, appKey, 0, devAddr, appSKey, nwkSKey, 0, 0, location)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := region.Get(fleet.Region)
+	if err != nil {
+		return nil, err
+	}
+	if err := dev.SetRegion(r, fleet.SubBand); err != nil {
+		return nil, err
+	}
+
+	macVersion, err := device.ParseMACVersion(string(fleet.MACVersion))
+	if err != nil {
+		return nil, err
+	}
+	if macVersion == device.MACVersion1_1 {
+		// The NwkSKey is the FNwkSIntKey, ABP devices use it for every
+		// network session key
+		keys := device.LoRaWAN11Keys{NwkKey: nwkKey, SNwkSIntKey: nwkSKey, NwkSEncKey: nwkSKey}
+		if err := dev.SetMACVersion(macVersion, keys); err != nil {
+			return nil, err
+		}
+	}
+
+	class, err := device.ParseClass(string(fleet.Class))
+	if err != nil {
+		return nil, err
+	}
+	if err := dev.SetClass(class); err != nil {
+		return nil, err
+	}
+	dev.SetADR(fleet.ADR)
+
+	return dev, nil
+}
+
+// run connects the gateways before the devices join, so that the LNS
+// receives the join requests, and returns the failures
+func (b behaviours) run() []string {
+	var mu sync.Mutex
+	var errs []string
+	fail := func(format string, args ...any) {
+		message := fmt.Sprintf(format, args...)
+		log.Printf("[scenario] %s", message)
+		mu.Lock()
+		errs = append(errs, message)
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for _, gw := range b.connect {
+		wg.Add(1)
+		go func(gw *gateway.Gateway) {
+			defer wg.Done()
+			if err := gw.Connect(); err != nil {
+				fail("gateway %s: %v", gw.GetInfo().EUI, err)
+			}
+		}(gw)
+	}
+	wg.Wait()
+
+	for _, dev := range b.join {
+		if err := dev.ns.SendJoinRequest(dev.devEUI); err != nil {
+			fail("device %s: %v", dev.devEUI, err)
+		}
+	}
+
+	for _, s := range b.schedules {
+		if err := s.ns.StartSchedule(s.devEUI, s.config); err != nil {
+			fail("device %s: %v", s.devEUI, err)
+		}
+	}
+
+	return errs
+}
+
+// config returns the schedule configuration of the network server
+func (s Schedule) config() networkserver.ScheduleConfig {
+	fPort := uint8(1)
+	if s.FPort != nil {
+		fPort = *s.FPort
+	}
+	// Validated with the scenario
+	payload, _ := hex.DecodeString(s.Payload)
+
+	return networkserver.ScheduleConfig{
+		Type:      s.Type,
+		Interval:  s.Interval,
+		Jitter:    s.Jitter,
+		Cron:      s.Cron,
+		FPort:     fPort,
+		Payload:   payload,
+		Confirmed: s.Confirmed,
+	}
+}
+
+// incrementEUI returns the EUI plus n
+func incrementEUI(eui lorawan.EUI64, n int) lorawan.EUI64 {
+	var next lorawan.EUI64
+	binary.BigEndian.PutUint64(next[:], binary.BigEndian.Uint64(eui[:])+uint64(n))
+	return next
+}
+
+// spread returns a random location within the radius (m) of a location
+func spread(latitude, longitude, radius float64, rng *rand.Rand) (float64, float64) {
+	// Uniform over the disk
+	distance := radius * math.Sqrt(rng.Float64())
+	bearing := 2 * math.Pi * rng.Float64()
+
+	latitude += distance * math.Cos(bearing) / metersPerDegree
+	longitude += distance * math.Sin(bearing) / (metersPerDegree * math.Cos(latitude*math.Pi/180))
+
+	return latitude, longitude
+}
@@ -0,0 +1,275 @@
+package scenario
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/gateway"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/propagation"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+	"gopkg.in/yaml.v3"
+)
+
+// maxDevices is the number of devices a scenario may describe, applying it
+// adds them all at once
+const maxDevices = 10000
+
+// Scenario describes network servers with their gateways and device fleets,
+// in YAML or JSON. EUIs and keys are hex strings.
+type Scenario struct {
+	// Seed of the random keys and device locations, the same scenario always
+	// generates the same fleets
+	Seed           int64           `json:"seed" yaml:"seed"`
+	NetworkServers []NetworkServer `json:"networkServers" yaml:"networkServers"`
+}
+
+type NetworkServer struct {
+	Name        string       `json:"name" yaml:"name"`
+	Config      Config       `json:"config" yaml:"config"`
+	Propagation *Propagation `json:"propagation,omitempty" yaml:"propagation"`
+	Gateways    []Gateway    `json:"gateways,omitempty" yaml:"gateways"`
+	Devices     []Fleet      `json:"devices,omitempty" yaml:"devices"`
+}
+
+// Config is the integration.NetworkServerConfig of a network server
+type Config struct {
+	Type       integration.NetworkServerType `json:"type" yaml:"type"`
+	URL        string                        `json:"url,omitempty" yaml:"url"`
+	AuthHeader string                        `json:"authHeader,omitempty" yaml:"authHeader"`
+	APIKey     string                        `json:"apiKey,omitempty" yaml:"apiKey"`
+}
+
+// Propagation is the propagation.Config of a network server
+type Propagation struct {
+	Model             propagation.ModelName   `json:"model" yaml:"model"`
+	Environment       propagation.Environment `json:"environment,omitempty" yaml:"environment"`
+	GatewayHeight     float64                 `json:"gatewayHeight,omitempty" yaml:"gatewayHeight"`
+	DeviceHeight      float64                 `json:"deviceHeight,omitempty" yaml:"deviceHeight"`
+	Exponent          float64                 `json:"exponent,omitempty" yaml:"exponent"`
+	ReferenceDistance float64                 `json:"referenceDistance,omitempty" yaml:"referenceDistance"`
+	Shadowing         float64                 `json:"shadowing,omitempty" yaml:"shadowing"`
+}
+
+type Location struct {
+	Latitude  float64 `json:"latitude" yaml:"latitude"`
+	Longitude float64 `json:"longitude" yaml:"longitude"`
+}
+
+type Gateway struct {
+	EUI           lorawan.EUI64     `json:"eui" yaml:"eui"`
+	DiscoveryURI  string            `json:"discoveryUri" yaml:"discoveryUri"`
+	Protocol      gateway.Protocol  `json:"protocol,omitempty" yaml:"protocol"`
+	Region        region.Name       `json:"region,omitempty" yaml:"region"`
+	Headers       map[string]string `json:"headers,omitempty" yaml:"headers"`
+	Location      *Location         `json:"location,omitempty" yaml:"location"`
+	MQTT          *MQTT             `json:"mqtt,omitempty" yaml:"mqtt"`
+	TxFailureRate float64           `json:"txFailureRate,omitempty" yaml:"txFailureRate"`
+	// Connect connects the gateway to the LNS once added
+	Connect bool `json:"connect,omitempty" yaml:"connect"`
+}
+
+// MQTT is the gateway.MQTTConfig of a ChirpStack MQTT gateway
+type MQTT struct {
+	Encoding    gateway.MQTTEncoding `json:"encoding" yaml:"encoding"`
+	TopicPrefix string               `json:"topicPrefix,omitempty" yaml:"topicPrefix"`
+}
+
+// KeyGeneration is the rule generating the keys of the devices of a fleet
+type KeyGeneration string
+
+const (
+	// KeysFixed gives every device the keys of the fleet
+	KeysFixed KeyGeneration = "fixed"
+	// KeysRandom draws the keys from the seed of the scenario
+	KeysRandom KeyGeneration = "random"
+	// KeysDevEUI repeats the DevEUI of the device twice
+	KeysDevEUI KeyGeneration = "deveui"
+)
+
+// Fleet describes devices sharing their configuration. The DevEUI of each
+// device, and the DevAddr of ABP devices, is the one of the previous device
+// plus one.
+type Fleet struct {
+	Count   int           `json:"count,omitempty" yaml:"count"` // 1 when unset
+	DevEUI  lorawan.EUI64 `json:"deveui" yaml:"deveui"`         // of the first device
+	JoinEUI lorawan.EUI64 `json:"joineui" yaml:"joineui"`
+
+	Keys   KeyGeneration     `json:"keys,omitempty" yaml:"keys"` // fixed when unset
+	AppKey lorawan.AES128Key `json:"appkey" yaml:"appkey"`
+	NwkKey lorawan.AES128Key `json:"nwkkey" yaml:"nwkkey"` // LoRaWAN 1.1
+
+	// ABP devices are activated with a DevAddr and session keys
+	DevAddr *lorawan.DevAddr  `json:"devaddr,omitempty" yaml:"devaddr"`
+	AppSKey lorawan.AES128Key `json:"appskey" yaml:"appskey"`
+	NwkSKey lorawan.AES128Key `json:"nwkskey" yaml:"nwkskey"`
+
+	MACVersion device.MACVersion `json:"macVersion,omitempty" yaml:"macVersion"`
+	Region     region.Name       `json:"region,omitempty" yaml:"region"`
+	SubBand    int               `json:"subBand,omitempty" yaml:"subBand"`
+	Class      device.Class      `json:"class,omitempty" yaml:"class"`
+	ADR        bool              `json:"adr,omitempty" yaml:"adr"`
+
+	// Devices are spread at random within the radius (m) of the location
+	Location *Location `json:"location,omitempty" yaml:"location"`
+	Radius   float64   `json:"radius,omitempty" yaml:"radius"`
+
+	// Join sends a join request once the gateways are connected
+	Join     bool      `json:"join,omitempty" yaml:"join"`
+	Schedule *Schedule `json:"schedule,omitempty" yaml:"schedule"`
+}
+
+// Schedule starts periodic uplinks, after the join request of joining devices
+type Schedule struct {
+	Type      networkserver.ScheduleType `json:"type" yaml:"type"`
+	Interval  time.Duration              `json:"interval,omitempty" yaml:"interval"` // e.g. 5m
+	Jitter    time.Duration              `json:"jitter,omitempty" yaml:"jitter"`
+	Cron      string                     `json:"cron,omitempty" yaml:"cron"`
+	FPort     *uint8                     `json:"fport,omitempty" yaml:"fport"`         // 1 when unset
+	Payload   string                     `json:"payload,omitempty" yaml:"payload"`     // hex
+	Confirmed bool                       `json:"confirmed,omitempty" yaml:"confirmed"` // unconfirmed when unset
+}
+
+// Load reads and validates a scenario file
+func Load(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// Parse decodes and validates a YAML or JSON scenario, unknown fields are
+// rejected
+func Parse(data []byte) (*Scenario, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var s Scenario
+	if err := decoder.Decode(&s); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("empty scenario")
+		}
+		return nil, err
+	}
+
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// validate checks the scenario before any entity is added
+func (s *Scenario) validate() error {
+	names := make(map[string]bool)
+	devices := 0
+	for _, ns := range s.NetworkServers {
+		if ns.Name == "" {
+			return errors.New("network server without name")
+		}
+		if names[ns.Name] {
+			return fmt.Errorf("network server %s defined twice", ns.Name)
+		}
+		names[ns.Name] = true
+
+		if ns.Propagation != nil {
+			if _, err := propagation.New(propagation.Config(*ns.Propagation)); err != nil {
+				return fmt.Errorf("network server %s: %w", ns.Name, err)
+			}
+		}
+
+		for _, gw := range ns.Gateways {
+			if err := gw.validate(); err != nil {
+				return fmt.Errorf("gateway %s: %w", gw.EUI, err)
+			}
+		}
+
+		for _, fleet := range ns.Devices {
+			if err := fleet.validate(); err != nil {
+				return fmt.Errorf("devices %s: %w", fleet.DevEUI, err)
+			}
+			devices += max(fleet.Count, 1)
+		}
+	}
+	if devices > maxDevices {
+		return fmt.Errorf("%d devices, at most %d per scenario", devices, maxDevices)
+	}
+
+	return nil
+}
+
+func (gw Gateway) validate() error {
+	if gw.DiscoveryURI == "" {
+		return errors.New("discoveryUri is required")
+	}
+	if _, err := region.Get(gw.Region); err != nil {
+		return err
+	}
+	if _, err := gateway.ParseProtocol(string(gw.Protocol)); err != nil {
+		return err
+	}
+	if gw.TxFailureRate < 0 || gw.TxFailureRate > 1 {
+		return errors.New("TX failure rate must be between 0 and 1")
+	}
+
+	return nil
+}
+
+func (f Fleet) validate() error {
+	if f.Count < 0 || f.Count > maxDevices {
+		return fmt.Errorf("count must be between 0 and %d", maxDevices)
+	}
+	switch f.Keys {
+	case "", KeysFixed, KeysRandom, KeysDevEUI:
+	default:
+		return fmt.Errorf("unsupported key generation %q", f.Keys)
+	}
+	if _, err := device.ParseMACVersion(string(f.MACVersion)); err != nil {
+		return err
+	}
+	if _, err := device.ParseClass(string(f.Class)); err != nil {
+		return err
+	}
+	r, err := region.Get(f.Region)
+	if err != nil {
+		return err
+	}
+	if _, err := r.DeviceChannels(f.SubBand); err != nil {
+		return err
+	}
+	if f.Radius < 0 {
+		return errors.New("radius must not be negative")
+	}
+	if f.Join && f.DevAddr != nil {
+		return errors.New("ABP devices do not join")
+	}
+	if f.Schedule != nil {
+		if _, err := hex.DecodeString(f.Schedule.Payload); err != nil {
+			return fmt.Errorf("invalid schedule payload: %w", err)
+		}
+		config := f.Schedule.config()
+		if err := networkserver.ValidateSchedule(config); err != nil {
+			return fmt.Errorf("invalid schedule: %w", err)
+		}
+		// Devices start at the default data rate of the region
+		maxSize, err := r.MaxPayloadSize(r.DefaultDataRate())
+		if err != nil {
+			return err
+		}
+		if len(config.Payload) > maxSize {
+			return fmt.Errorf("schedule payload too large for DR%d: %d bytes, max %d", r.DefaultDataRate(), len(config.Payload), maxSize)
+		}
+	}
+
+	return nil
+}
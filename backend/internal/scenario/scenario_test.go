@@ -0,0 +1,245 @@
+package scenario
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/gateway"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/propagation"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/region"
+	"github.com/stretchr/testify/assert"
+)
+
+const testScenario = `
+seed: 42
+networkServers:
+  - name: test-server
+    config:
+      type: generic
+    propagation:
+      model: log-distance
+      exponent: 3
+    gateways:
+      - eui: 0016c001f1500001
+        discoveryUri: udp.example.com:1700
+        protocol: semtech-udp
+        region: US915
+        location: {latitude: 45.07, longitude: 7.68}
+        txFailureRate: 0.1
+    devices:
+      - count: 3
+        deveui: 0102030405060700
+        joineui: 0000000000000000
+        keys: random
+        region: US915
+        subBand: 2
+        class: C
+        adr: true
+        location: {latitude: 45.07, longitude: 7.68}
+        radius: 500
+        schedule:
+          type: interval
+          interval: 5m
+          payload: "0102"
+      - deveui: 1111111111111111
+        joineui: 0000000000000000
+        keys: deveui
+        devaddr: 26011f00
+`
+
+func TestParse(t *testing.T) {
+	t.Run("parses a YAML scenario", func(t *testing.T) {
+		s, err := Parse([]byte(testScenario))
+		assert.NoError(t, err)
+
+		assert.Equal(t, int64(42), s.Seed)
+		assert.Len(t, s.NetworkServers, 1)
+		ns := s.NetworkServers[0]
+		assert.Equal(t, integration.NetworkServerTypeGeneric, ns.Config.Type)
+		assert.Equal(t, 3.0, ns.Propagation.Exponent)
+
+		// Hex strings made of digits are not numbers
+		assert.Equal(t, lorawan.EUI64{0x00, 0x16, 0xc0, 0x01, 0xf1, 0x50, 0x00, 0x01}, ns.Gateways[0].EUI)
+		assert.Equal(t, lorawan.EUI64{0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11}, ns.Devices[1].DevEUI)
+		assert.Equal(t, &lorawan.DevAddr{0x26, 0x01, 0x1f, 0x00}, ns.Devices[1].DevAddr)
+
+		assert.Equal(t, 5*time.Minute, ns.Devices[0].Schedule.Interval)
+	})
+
+	t.Run("parses a JSON scenario", func(t *testing.T) {
+		s, err := Parse([]byte(`{"networkServers": [{"name": "test-server", "config": {"type": "generic"}, "devices": [{"deveui": "0102030405060708", "appkey": "00112233445566778899aabbccddeeff", "join": true}]}]}`))
+		assert.NoError(t, err)
+
+		fleet := s.NetworkServers[0].Devices[0]
+		assert.Equal(t, lorawan.AES128Key{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, fleet.AppKey)
+		assert.True(t, fleet.Join)
+	})
+
+	t.Run("rejects invalid scenarios", func(t *testing.T) {
+		for scenario, message := range map[string]string{
+			"":                                       "empty scenario",
+			"networkServers: [{name: a, foo: 1}]":    "field foo not found",
+			"networkServers: [{name: a}, {name: a}]": "network server a defined twice",
+			"networkServers: [{config: {type: generic}}]":                                                                                                                "network server without name",
+			"networkServers: [{name: a, gateways: [{eui: 0102030405060708}]}]":                                                                                           "discoveryUri is required",
+			"networkServers: [{name: a, gateways: [{eui: 0102, discoveryUri: ws://localhost}]}]":                                                                         "lorawan",
+			"networkServers: [{name: a, devices: [{deveui: 0102030405060708, keys: sequential}]}]":                                                                       "unsupported key generation",
+			"networkServers: [{name: a, devices: [{deveui: 0102030405060708, region: XX915}]}]":                                                                          "region",
+			"networkServers: [{name: a, devices: [{deveui: 0102030405060708, devaddr: 01020304, join: true}]}]":                                                          "ABP devices do not join",
+			"networkServers: [{name: a, devices: [{deveui: 0102030405060708, count: 100000000}]}]":                                                                       "count must be between 0 and 10000",
+			"networkServers: [{name: a, devices: [{count: 6000}, {deveui: 0102030405060708, count: 6000}]}]":                                                             "12000 devices, at most 10000 per scenario",
+			"networkServers: [{name: a, devices: [{deveui: 0102030405060708, schedule: {type: daily}}]}]":                                                                "unsupported schedule type",
+			"networkServers: [{name: a, devices: [{deveui: 0102030405060708, schedule: {type: interval}}]}]":                                                             "interval must be positive",
+			"networkServers: [{name: a, devices: [{deveui: 0102030405060708, schedule: {type: cron, cron: x}}]}]":                                                        "invalid cron expression",
+			"networkServers: [{name: a, devices: [{deveui: 0102030405060708, schedule: {type: interval, interval: 1m, fport: 0}}]}]":                                     "invalid FPort 0",
+			"networkServers: [{name: a, devices: [{deveui: 0102030405060708, schedule: {type: interval, interval: 1m, fport: 230}}]}]":                                   "invalid FPort 230",
+			"networkServers: [{name: a, devices: [{deveui: 0102030405060708, schedule: {type: interval, interval: 1m, payload: '" + strings.Repeat("00", 256) + "'}}]}]": "schedule payload too large",
+		} {
+			_, err := Parse([]byte(scenario))
+			if assert.Error(t, err, scenario) {
+				assert.Contains(t, err.Error(), message, scenario)
+			}
+		}
+	})
+}
+
+func TestApply(t *testing.T) {
+	t.Run("adds the network servers, gateways and device fleets", func(t *testing.T) {
+		s, err := Parse([]byte(testScenario))
+		assert.NoError(t, err)
+
+		pool := networkserver.NewPool()
+		result, err := Apply(pool, s)
+		assert.NoError(t, err)
+		assert.Equal(t, Result{NetworkServers: 1, Gateways: 1, Devices: 4}, result)
+
+		ns, err := pool.Get("test-server")
+		assert.NoError(t, err)
+		defer ns.StopAllSchedules()
+		assert.Equal(t, propagation.LogDistance, ns.GetPropagation().Model)
+
+		gateways := ns.ListGateways()
+		assert.Len(t, gateways, 1)
+		assert.Equal(t, gateway.ProtocolSemtechUDP, gateways[0].Protocol)
+		assert.Equal(t, region.US915, gateways[0].Region)
+		assert.Equal(t, 0.1, gateways[0].TxFailureRate)
+		assert.Equal(t, &gateway.Location{Latitude: 45.07, Longitude: 7.68}, gateways[0].Location)
+
+		devices := ns.ListDevices()
+		assert.Len(t, devices, 4)
+		for i, dev := range devices[:3] {
+			assert.Equal(t, lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, byte(i)}, dev.DevEUI)
+			assert.Equal(t, region.US915, dev.Region)
+			assert.Equal(t, device.ClassC, dev.Class)
+			assert.True(t, dev.ADR)
+			assert.NotEqual(t, lorawan.AES128Key{}, dev.AppKey)
+			assert.Equal(t, lorawan.DevAddr{}, dev.DevAddr)
+			// Within the radius
+			assert.InDelta(t, 45.07, dev.Location.Latitude, 0.005)
+			assert.InDelta(t, 7.68, dev.Location.Longitude, 0.007)
+
+			schedule, err := ns.GetSchedule(dev.DevEUI)
+			assert.NoError(t, err)
+			assert.True(t, schedule.Running)
+			assert.Equal(t, "0102", schedule.Payload)
+		}
+		assert.NotEqual(t, devices[0].AppKey, devices[1].AppKey)
+
+		abp := devices[3]
+		key := lorawan.AES128Key{0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11}
+		assert.Equal(t, key, abp.AppKey)
+		assert.Equal(t, key, abp.AppSKey)
+		assert.Equal(t, key, abp.NwkSKey)
+		assert.Equal(t, lorawan.DevAddr{0x26, 0x01, 0x1f, 0x00}, abp.DevAddr)
+	})
+
+	t.Run("generates the same fleets from the same seed", func(t *testing.T) {
+		apply := func() []device.DeviceInfo {
+			s, err := Parse([]byte(testScenario))
+			assert.NoError(t, err)
+			pool := networkserver.NewPool()
+			_, err = Apply(pool, s)
+			assert.NoError(t, err)
+			ns, err := pool.Get("test-server")
+			assert.NoError(t, err)
+			ns.StopAllSchedules()
+			return ns.ListDevices()
+		}
+
+		first, second := apply(), apply()
+		for i := range first {
+			assert.Equal(t, first[i].AppKey, second[i].AppKey)
+			assert.Equal(t, first[i].Location, second[i].Location)
+		}
+	})
+
+	t.Run("increments the DevAddr of ABP fleets", func(t *testing.T) {
+		s, err := Parse([]byte(`
+networkServers:
+  - name: test-server
+    devices:
+      - count: 2
+        deveui: 01020304050607ff
+        devaddr: 260111ff
+        macVersion: "1.1"
+        nwkskey: 000102030405060708090a0b0c0d0e0f
+`))
+		assert.NoError(t, err)
+
+		pool := networkserver.NewPool()
+		_, err = Apply(pool, s)
+		assert.NoError(t, err)
+
+		ns, err := pool.Get("test-server")
+		assert.NoError(t, err)
+		devices := ns.ListDevices()
+		assert.Equal(t, lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0xff}, devices[0].DevEUI)
+		assert.Equal(t, lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x08, 0x00}, devices[1].DevEUI)
+		assert.Equal(t, lorawan.DevAddr{0x26, 0x01, 0x12, 0x00}, devices[1].DevAddr)
+		assert.Equal(t, device.MACVersion1_1, devices[1].MACVersion)
+		assert.Equal(t, devices[1].NwkSKey, devices[1].LoRaWAN11.SNwkSIntKey)
+	})
+
+	t.Run("keeps the existing entities", func(t *testing.T) {
+		s, err := Parse([]byte(testScenario))
+		assert.NoError(t, err)
+
+		pool := networkserver.NewPool()
+		_, err = Apply(pool, s)
+		assert.NoError(t, err)
+		ns, err := pool.Get("test-server")
+		assert.NoError(t, err)
+		defer ns.StopAllSchedules()
+		dev := ns.ListDevices()[0]
+
+		result, err := Apply(pool, s)
+		assert.NoError(t, err)
+		assert.Equal(t, Result{}, result)
+		assert.Len(t, ns.ListDevices(), 4)
+		assert.Equal(t, dev.AppKey, ns.ListDevices()[0].AppKey)
+	})
+
+	t.Run("reports the behaviours failing", func(t *testing.T) {
+		s, err := Parse([]byte(`
+networkServers:
+  - name: test-server
+    gateways:
+      - eui: 0102030405060708
+        discoveryUri: ws://127.0.0.1:1
+        connect: true
+`))
+		assert.NoError(t, err)
+
+		result, err := Apply(networkserver.NewPool(), s)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.Gateways)
+		if assert.Len(t, result.Errors, 1) {
+			assert.Contains(t, result.Errors[0], "gateway 0102030405060708")
+		}
+	})
+}
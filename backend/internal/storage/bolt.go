@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	bolt "go.etcd.io/bbolt"
+)
+
+// networkServersBucket holds a snapshot per network server, by name
+var networkServersBucket = []byte("networkServers")
+
+// BoltStore saves the snapshots in a bbolt database
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens the database, failing when another process holds it
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Load() ([]networkserver.Snapshot, error) {
+	var snapshots []networkserver.Snapshot
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(networkServersBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		// Keys are iterated in byte order, i.e. by name
+		return bucket.ForEach(func(name, value []byte) error {
+			var snapshot networkserver.Snapshot
+			if err := json.Unmarshal(value, &snapshot); err != nil {
+				return err
+			}
+			snapshots = append(snapshots, snapshot)
+			return nil
+		})
+	})
+
+	return snapshots, err
+}
+
+// Save replaces the content of the bucket in a single transaction
+func (s *BoltStore) Save(snapshots []networkserver.Snapshot) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(networkServersBucket) != nil {
+			if err := tx.DeleteBucket(networkServersBucket); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket(networkServersBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, snapshot := range snapshots {
+			value, err := json.Marshal(snapshot)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(snapshot.Name), value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+)
+
+// FileStore saves the snapshots in a JSON file
+type FileStore struct {
+	path string
+}
+
+// fileContent is the layout of the JSON file
+type fileContent struct {
+	NetworkServers []networkserver.Snapshot `json:"networkServers"`
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (s *FileStore) Load() ([]networkserver.Snapshot, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var content fileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+
+	return content.NetworkServers, nil
+}
+
+// Save writes a temporary file renamed over the previous one, so that a
+// crash never leaves a partially written file
+func (s *FileStore) Save(snapshots []networkserver.Snapshot) error {
+	data, err := json.MarshalIndent(fileContent{NetworkServers: snapshots}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/eventbus"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+)
+
+// Variables so that tests can shorten them
+var (
+	// saveDelay groups the changes of the pool into a single save
+	saveDelay = time.Second
+	// saveInterval also saves the changes raising no event, e.g. the
+	// configuration of a device
+	saveInterval = time.Minute
+)
+
+// Type selects how the state of the simulator is persisted
+type Type string
+
+const (
+	TypeJSON Type = "json" // a JSON file
+	TypeBolt Type = "bolt" // an embedded key-value database
+)
+
+// Store persists the network servers of the pool with their gateways and
+// devices
+type Store interface {
+	// Load returns the snapshots saved last, none when nothing was saved
+	Load() ([]networkserver.Snapshot, error)
+	// Save replaces the saved snapshots
+	Save(snapshots []networkserver.Snapshot) error
+	Close() error
+}
+
+// New opens the store of the given type at path, a default file in the
+// working directory when the path is empty
+func New(storeType Type, path string) (Store, error) {
+	switch storeType {
+	case TypeJSON:
+		if path == "" {
+			path = "lorawan-simulator.json"
+		}
+		return NewFileStore(path), nil
+
+	case TypeBolt:
+		if path == "" {
+			path = "lorawan-simulator.db"
+		}
+		return NewBoltStore(path)
+
+	default:
+		return nil, fmt.Errorf("unsupported storage type %q", storeType)
+	}
+}
+
+// Persist saves the state of the pool to the store when it changes, until
+// the context is done, then saves it a last time
+func Persist(ctx context.Context, pool *networkserver.Pool, store Store) {
+	sub := pool.Subscribe(eventbus.Filter{})
+	defer sub.Close()
+
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+
+	// Pending save, nil when the store is up to date
+	var delay <-chan time.Time
+
+	for {
+		select {
+		case <-sub.C:
+			if delay == nil {
+				delay = time.After(saveDelay)
+			}
+		case <-delay:
+			delay = nil
+			save(pool, store)
+		case <-ticker.C:
+			save(pool, store)
+		case <-ctx.Done():
+			save(pool, store)
+			return
+		}
+	}
+}
+
+func save(pool *networkserver.Pool, store Store) {
+	if err := store.Save(pool.Snapshot()); err != nil {
+		log.Printf("[storage] save error: %v", err)
+	}
+}
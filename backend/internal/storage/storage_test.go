@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/device"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/integration"
+	"github.com/emanuele-dedonatis/lorawan-simulator/internal/networkserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := New(TypeJSON, filepath.Join(dir, "state.json"))
+	assert.NoError(t, err)
+	assert.IsType(t, &FileStore{}, store)
+	assert.NoError(t, store.Close())
+
+	store, err = New(TypeBolt, filepath.Join(dir, "state.db"))
+	assert.NoError(t, err)
+	assert.IsType(t, &BoltStore{}, store)
+	assert.NoError(t, store.Close())
+
+	_, err = New("redis", "")
+	assert.EqualError(t, err, `unsupported storage type "redis"`)
+}
+
+func TestStores(t *testing.T) {
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	snapshots := []networkserver.Snapshot{
+		{
+			Name:    "chirpstack",
+			Config:  integration.NetworkServerConfig{Type: integration.NetworkServerTypeChirpStack, URL: "http://localhost:8080", APIKey: "key"},
+			Devices: []device.Snapshot{{DevEUI: devEUI, DevNonce: 42, FCntUp: 7}},
+		},
+		{
+			Name:   "generic",
+			Config: integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric},
+		},
+	}
+
+	for _, storeType := range []Type{TypeJSON, TypeBolt} {
+		t.Run(string(storeType), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state")
+
+			store, err := New(storeType, path)
+			assert.NoError(t, err)
+
+			// Nothing saved yet
+			loaded, err := store.Load()
+			assert.NoError(t, err)
+			assert.Empty(t, loaded)
+
+			assert.NoError(t, store.Save(snapshots))
+			assert.NoError(t, store.Save(snapshots[1:]))
+			assert.NoError(t, store.Save(snapshots))
+			assert.NoError(t, store.Close())
+
+			// Reopened as after a restart
+			store, err = New(storeType, path)
+			assert.NoError(t, err)
+			defer store.Close()
+
+			loaded, err = store.Load()
+			assert.NoError(t, err)
+			assert.Len(t, loaded, 2)
+			assert.Equal(t, snapshots[0].Config, loaded[0].Config)
+			assert.Equal(t, snapshots[0].Devices, loaded[0].Devices)
+			assert.Equal(t, "generic", loaded[1].Name)
+		})
+	}
+
+	t.Run("json leaves no temporary file", func(t *testing.T) {
+		dir := t.TempDir()
+		store := NewFileStore(filepath.Join(dir, "state.json"))
+		assert.NoError(t, store.Save(snapshots))
+
+		entries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+}
+
+func TestPersist(t *testing.T) {
+	saveDelay = 10 * time.Millisecond
+	defer func() { saveDelay = time.Second }()
+
+	devEUI := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+
+	pool := networkserver.NewPool()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Persist(ctx, pool, store)
+		close(done)
+	}()
+	// Let Persist subscribe to the events of the pool
+	time.Sleep(10 * time.Millisecond)
+
+	ns, err := pool.Add("test-server", integration.NetworkServerConfig{Type: integration.NetworkServerTypeGeneric})
+	assert.NoError(t, err)
+	_, err = ns.AddDevice(devEUI, lorawan.EUI64{}, lorawan.AES128Key{}, 0, lorawan.DevAddr{}, lorawan.AES128Key{}, lorawan.AES128Key{}, 0, 0, nil)
+	assert.NoError(t, err)
+
+	// Saved once the changes settle
+	assert.Eventually(t, func() bool {
+		loaded, err := store.Load()
+		return err == nil && len(loaded) == 1 && len(loaded[0].Devices) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Saved a last time when stopped
+	dev, err := ns.GetDevice(devEUI)
+	assert.NoError(t, err)
+	dev.SetBattery(200)
+	cancel()
+	<-done
+
+	loaded, err := store.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(200), loaded[0].Devices[0].Battery)
+}
@@ -15,9 +15,26 @@ let expandedDevices = new Set();
 document.addEventListener('DOMContentLoaded', () => {
     initMap();
     refreshData();
-    // Removed auto-refresh - user can use the refresh button
+    subscribeEvents();
 });
 
+// Refresh when the simulator reports a change
+function subscribeEvents() {
+    const source = new EventSource(`${API_BASE}/events`);
+    let refreshTimer = null;
+    source.onmessage = () => {
+        // Refresh at most every 500 ms: the events received meanwhile are
+        // covered by the pending refresh, even when they never stop
+        if (refreshTimer) {
+            return;
+        }
+        refreshTimer = setTimeout(() => {
+            refreshTimer = null;
+            refreshData();
+        }, 500);
+    };
+}
+
 // Initialize Leaflet map
 function initMap() {
     // Chieti Scalo coordinates